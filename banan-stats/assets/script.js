@@ -19,7 +19,7 @@ function onGraphMouseMove(e) {
     const date = g.getAttribute('data-d');
     if (value && date) {
       const dateObj = new Date(date);
-      const formattedDate = dateObj.toLocaleDateString('en-US', { month: 'short', day: 'numeric' });
+      const formattedDate = dateObj.toLocaleDateString(document.documentElement.lang || 'en-US', { month: 'short', day: 'numeric' });
       graphHover.style.left = (g.querySelector('rect').getAttribute('x') - graphScroll.scrollLeft + 10) + 'px';
       graphHover.style.display = 'block';
       graphHover.textContent = formattedDate + ': ' + value;
@@ -35,8 +35,24 @@ function onGraphMouseLeave(e) {
   graphHover.style.display = 'none';
 }
 
+// Touch screens have no hover: the first tap on a day shows its value like
+// hovering does, a second tap on the same day opens it.
+let tappedGroup = null;
+let tapShowsValue = false;
+
+function onGraphTouchStart(e) {
+  const g = findGroup(e);
+  tapShowsValue = g !== tappedGroup;
+  tappedGroup = g;
+  onGraphMouseMove(e);
+}
+
 function onGraphClick(e) {
   const g = findGroup(e);
+  if (tapShowsValue) {
+    tapShowsValue = false;
+    return;
+  }
   if (g) {
     const date = g.getAttribute('data-d');
     const url = new URL(window.location.href);
@@ -46,7 +62,25 @@ function onGraphClick(e) {
   }
 }
 
-function onLoad() {
+function loadTables() {
+  document.querySelectorAll('.table_outer[data-src]').forEach((el) => {
+    fetch(el.getAttribute('data-src'))
+      .then((resp) => {
+        if (resp.ok) return resp.text();
+        // 503 explains that the range was too large to count in time.
+        if (resp.status === 503) return resp.text().then((msg) => Promise.reject(msg));
+        return Promise.reject(resp.status);
+      })
+      .then((html) => {
+        el.outerHTML = html;
+      })
+      .catch((msg) => {
+        el.querySelector('.loading').textContent = typeof msg === 'string' ? msg : 'Failed to load';
+      });
+  });
+}
+
+function initPage() {
   const scrollables = document.querySelectorAll('.graph_scroll');
 
   scrollables.forEach((el) => {
@@ -64,13 +98,62 @@ function onLoad() {
     });
   });
 
+  loadTables();
+
   const graphs = document.querySelectorAll('.graph');
 
   graphs.forEach((graph) => {
     graph.addEventListener('mousemove', onGraphMouseMove);
     graph.addEventListener('mouseleave', onGraphMouseLeave);
     graph.addEventListener('click', onGraphClick);
+    graph.addEventListener('touchstart', onGraphTouchStart, { passive: true });
   });
 }
 
+// Minimum time between two live refreshes, in milliseconds.
+const LIVE_REFRESH_INTERVAL = 10000;
+
+// Dashboards whose range includes today subscribe to the sidecar's update
+// events and swap in a fresh copy of the page after new events are written.
+function followLive() {
+  const src = document.body.getAttribute('data-live');
+  if (!src || !window.EventSource) {
+    return;
+  }
+  let last = 0;
+  let timer = null;
+
+  function refresh() {
+    timer = null;
+    last = Date.now();
+    fetch(window.location.href)
+      .then((resp) => (resp.ok ? resp.text() : Promise.reject(resp.status)))
+      .then((html) => {
+        const doc = new DOMParser().parseFromString(html, 'text/html');
+        document.body.innerHTML = doc.body.innerHTML;
+        initPage();
+      })
+      .catch(() => {});
+  }
+
+  new EventSource(src).addEventListener('update', () => {
+    if (!timer) {
+      timer = setTimeout(refresh, Math.max(0, last + LIVE_REFRESH_INTERVAL - Date.now()));
+    }
+  });
+}
+
+function onLoad() {
+  initPage();
+  followLive();
+}
+
+// Favicons that fail to load are removed (no inline onerror handlers, so the
+// page works under a strict script-src policy).
+document.addEventListener('error', (e) => {
+  if (e.target instanceof HTMLImageElement && e.target.classList.contains('favicon')) {
+    e.target.remove();
+  }
+}, true);
+
 window.addEventListener('load', onLoad);
@@ -0,0 +1,14 @@
+use std::path::Path;
+
+// Inter is embedded only when assets/fonts/InterVariable.woff2 is present
+// (vendored, never downloaded at build time); builds without it fall back to
+// system fonts.
+fn main() {
+    println!("cargo::rustc-check-cfg=cfg(has_inter_font)");
+    // Set by cargo-fuzz when building fuzz/, which includes src/analyzer.rs.
+    println!("cargo::rustc-check-cfg=cfg(fuzzing)");
+    println!("cargo::rerun-if-changed=assets/fonts");
+    if Path::new("assets/fonts/InterVariable.woff2").exists() {
+        println!("cargo::rustc-cfg=has_inter_font");
+    }
+}
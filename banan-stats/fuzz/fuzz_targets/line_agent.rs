@@ -0,0 +1,13 @@
+#![no_main]
+
+use libfuzzer_sys::fuzz_target;
+
+#[allow(dead_code)]
+#[path = "../../src/analyzer.rs"]
+mod analyzer;
+
+fuzz_target!(|data: &[u8]| {
+    if let Ok(user_agent) = std::str::from_utf8(data) {
+        analyzer::check_user_agent(user_agent);
+    }
+});
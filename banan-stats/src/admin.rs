@@ -0,0 +1,26 @@
+use crate::state::AppState;
+use axum::{
+    http::{header, HeaderMap, StatusCode},
+    response::{IntoResponse, Response},
+};
+
+// Admin views stay disabled until --admin-token is set; requests must then
+// carry the token as a bearer credential.
+pub fn authorize(state: &AppState, headers: &HeaderMap) -> Result<(), Response> {
+    let Some(token) = state.admin_token.as_deref() else {
+        return Err((StatusCode::FORBIDDEN, "admin views are disabled").into_response());
+    };
+    let provided = headers
+        .get(header::AUTHORIZATION)
+        .and_then(|val| val.to_str().ok())
+        .and_then(|val| val.strip_prefix("Bearer "));
+    if provided == Some(token) {
+        return Ok(());
+    }
+    Err((
+        StatusCode::UNAUTHORIZED,
+        [(header::WWW_AUTHENTICATE, "Bearer")],
+        "Unauthorized",
+    )
+        .into_response())
+}
@@ -0,0 +1,120 @@
+use crate::api;
+use axum::{
+    extract::{Request, State},
+    http::{header, StatusCode},
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::sync::{Semaphore, SemaphorePermit};
+
+// How long a request waits for a query slot before it is turned away.
+const QUEUE_WAIT: Duration = Duration::from_secs(10);
+
+// Seconds a turned-away client is asked to wait before trying again.
+const RETRY_AFTER: u64 = 5;
+
+// Limits the dashboard pages and API requests running queries at once
+// (--max-queries), so a burst of them leaves the database to ingest. Up to
+// --query-queue more wait for a slot; the rest are answered 503 right away.
+pub struct Admission {
+    // None when --max-queries is 0.
+    slots: Option<Semaphore>,
+    max_queued: usize,
+    queued: AtomicUsize,
+}
+
+impl Admission {
+    pub fn new(max_queries: usize, max_queued: usize) -> Self {
+        Admission {
+            slots: (max_queries > 0).then(|| Semaphore::new(max_queries)),
+            max_queued,
+            queued: AtomicUsize::new(0),
+        }
+    }
+
+    // A slot held until the permit is dropped, or why there is none.
+    async fn enter(&self) -> Result<Option<SemaphorePermit<'_>>, &'static str> {
+        let Some(slots) = &self.slots else {
+            return Ok(None);
+        };
+        if let Ok(permit) = slots.try_acquire() {
+            return Ok(Some(permit));
+        }
+        let Some(_queued) = Queued::new(&self.queued, self.max_queued) else {
+            return Err("too many queries are waiting");
+        };
+        match tokio::time::timeout(QUEUE_WAIT, slots.acquire()).await {
+            Ok(Ok(permit)) => Ok(Some(permit)),
+            _ => Err("no query slot freed up in time"),
+        }
+    }
+}
+
+// Runs the request once it has a query slot. Turned-away API requests get
+// the usual error envelope, pages a line of text the table script shows.
+pub async fn limit(State(admission): State<Arc<Admission>>, req: Request, next: Next) -> Response {
+    let _slot = match admission.enter().await {
+        Ok(slot) => slot,
+        Err(reason) => {
+            let message = format!("The sidecar is busy: {}; try again in a few seconds.", reason);
+            let mut resp = if req.uri().path().starts_with("/api/") {
+                api::overloaded(message)
+            } else {
+                (StatusCode::SERVICE_UNAVAILABLE, message).into_response()
+            };
+            resp.headers_mut()
+                .insert(header::RETRY_AFTER, RETRY_AFTER.to_string().parse().expect("header value"));
+            return resp;
+        }
+    };
+    next.run(req).await
+}
+
+// Counts one request in Admission::queued for as long as it lives.
+struct Queued<'a>(&'a AtomicUsize);
+
+impl<'a> Queued<'a> {
+    // None when `max` requests are queued already.
+    fn new(counter: &'a AtomicUsize, max: usize) -> Option<Self> {
+        counter
+            .fetch_update(Ordering::Relaxed, Ordering::Relaxed, |n| (n < max).then_some(n + 1))
+            .ok()
+            .map(|_| Self(counter))
+    }
+}
+
+impl Drop for Queued<'_> {
+    fn drop(&mut self) {
+        self.0.fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn queues_then_turns_away() {
+        let admission = Arc::new(Admission::new(1, 1));
+        let running = admission.enter().await.unwrap();
+        assert!(running.is_some());
+
+        let waiting = {
+            let admission = admission.clone();
+            tokio::spawn(async move { admission.enter().await.map(|slot| slot.is_some()) })
+        };
+        while admission.queued.load(Ordering::Relaxed) == 0 {
+            tokio::task::yield_now().await;
+        }
+        assert_eq!(admission.enter().await.err(), Some("too many queries are waiting"));
+
+        drop(running);
+        assert_eq!(waiting.await.unwrap(), Ok(true));
+        assert_eq!(admission.queued.load(Ordering::Relaxed), 0);
+
+        assert!(Admission::new(0, 0).enter().await.unwrap().is_none());
+    }
+}
@@ -1,10 +1,21 @@
-use once_cell::sync::Lazy;
+use anyhow::Context;
+use once_cell::sync::{Lazy, OnceCell};
 use regex::Regex;
 use sha2::{Digest, Sha256};
 use std::borrow::Cow;
+use std::collections::HashMap;
 use url::Url;
 
-#[derive(Clone, Debug)]
+const DEFAULT_AGENT_TYPES: &str = include_str!("../assets/agent_types.txt");
+
+static AGENT_TYPES: OnceCell<HashMap<String, String>> = OnceCell::new();
+// Only the entries of the --agent-types file, which the middleware does not
+// know when it classifies at the edge.
+static CONFIGURED_AGENT_TYPES: OnceCell<HashMap<String, String>> = OnceCell::new();
+// Host each --host-aliases alias stands for.
+static HOST_ALIASES: OnceCell<HashMap<String, String>> = OnceCell::new();
+
+#[derive(Clone, Debug, Default)]
 pub struct Line {
     pub event_id: String,
     pub date: String,
@@ -19,31 +30,297 @@ pub struct Line {
     pub agent: String,
     pub os: String,
     pub ref_domain: String,
+    // Path of the referring page when it is on the same host.
+    pub ref_path: String,
+    // Terms searched for when the referrer is a search engine that passes
+    // them on.
+    pub search_terms: String,
+    // Social platform the visit came from, by referrer or share parameter.
+    pub social: String,
     pub mult: i64,
     pub set_cookie: String,
     pub uniq: String,
     pub second_visit: bool,
+    pub prefetch: bool,
+    // An HTML fragment fetched by a script (htmx, Turbo Frames), not a page view.
+    pub fragment: bool,
+    // JSON object of custom fields from the middleware, empty when none.
+    pub extra: String,
+    // HTTP status of the response, 0 when the middleware does not capture it.
+    pub status: i64,
+    // Time the upstream took to answer, 0 when the middleware does not capture it.
+    pub duration_ms: f64,
+    // Timestamp the middleware sent when clock-skew correction replaced it,
+    // empty otherwise.
+    pub original_ts: String,
+    // Middleware instance or node that reported the event, empty when unset.
+    pub source: String,
+    // Whether a search crawler's address passed the reverse DNS check; None
+    // when it was not checked.
+    pub verified_bot: Option<bool>,
+    // Autonomous system the address belongs to, 0 when it is not in the
+    // ASN database.
+    pub asn: i64,
+    pub asn_name: String,
+    // Whether that network is a hosting provider rather than an ISP.
+    pub datacenter: bool,
+    // Consent level the middleware tracked the visitor at (full, cookieless
+    // or none), empty when it reads no consent signal.
+    pub consent: String,
+    // http or https and the port the request came in on, from the
+    // middleware; empty and 0 when it did not send them.
+    pub scheme: String,
+    pub port: i64,
+}
+
+// One step of analyze: fills in fields derived from the ones the middleware
+// sent. Stages leave fields that are already set alone, so analyzing a line
+// twice changes nothing.
+#[derive(Clone, Copy)]
+pub struct Stage {
+    pub name: &'static str,
+    // Stages whose fields this one reads; they must run before it.
+    pub after: &'static [&'static str],
+    pub run: fn(&mut Line),
+}
+
+// In the order they run by default.
+const BUILT_IN_STAGES: &[Stage] = &[
+    Stage { name: "host", after: &[], run: host_stage },
+    Stage { name: "agent", after: &[], run: agent_stage },
+    Stage { name: "type", after: &["agent"], run: type_stage },
+    Stage { name: "os", after: &[], run: os_stage },
+    Stage { name: "mult", after: &[], run: mult_stage },
+    Stage { name: "uniq", after: &["agent"], run: uniq_stage },
+    Stage { name: "referrer", after: &["host"], run: referrer_stage },
+    Stage { name: "search_terms", after: &[], run: search_terms_stage },
+    Stage { name: "social", after: &[], run: social_stage },
+];
+
+// Without these rows are not counted.
+const REQUIRED_STAGES: &[&str] = &["agent", "type", "mult", "uniq"];
+
+static STAGES: OnceCell<Vec<Stage>> = OnceCell::new();
+
+// Registers `extra` stages, compiled into the sidecar, after the built-in
+// ones, and with `names` (--analyzer-stages, comma-separated) picks the
+// stages that run and their order. Call it before the first line is
+// analyzed; later calls have no effect.
+pub fn configure_stages(extra: &[Stage], names: Option<&str>) -> Result<(), anyhow::Error> {
+    let _ = STAGES.set(select_stages(extra, names)?);
+    Ok(())
+}
+
+fn select_stages(extra: &[Stage], names: Option<&str>) -> Result<Vec<Stage>, anyhow::Error> {
+    let mut all: Vec<Stage> = BUILT_IN_STAGES.to_vec();
+    for stage in extra {
+        if all.iter().any(|s| s.name == stage.name) {
+            anyhow::bail!("analyzer stage {} registered twice", stage.name);
+        }
+        all.push(*stage);
+    }
+    let Some(names) = names else {
+        return Ok(all);
+    };
+    let mut stages: Vec<Stage> = Vec::new();
+    for name in names.split(',').map(str::trim).filter(|n| !n.is_empty()) {
+        let Some(stage) = all.iter().find(|s| s.name == name) else {
+            let known: Vec<&str> = all.iter().map(|s| s.name).collect();
+            anyhow::bail!("unknown analyzer stage {}, expected one of {}", name, known.join(", "));
+        };
+        if stages.iter().any(|s| s.name == name) {
+            anyhow::bail!("analyzer stage {} listed twice", name);
+        }
+        if let Some(missing) = stage.after.iter().find(|dep| !stages.iter().any(|s| s.name == **dep)) {
+            anyhow::bail!("analyzer stage {} must come after {}", name, missing);
+        }
+        stages.push(*stage);
+    }
+    if let Some(missing) = REQUIRED_STAGES.iter().find(|name| !stages.iter().any(|s| s.name == **name)) {
+        anyhow::bail!("--analyzer-stages must include {}", missing);
+    }
+    Ok(stages)
+}
+
+fn stages() -> &'static [Stage] {
+    STAGES.get_or_init(|| BUILT_IN_STAGES.to_vec())
 }
 
 pub fn analyze(line: &mut Line) {
+    for stage in stages() {
+        (stage.run)(line);
+    }
+}
+
+fn host_stage(line: &mut Line) {
+    if let Some(host) = host_aliases().get(&line.host) {
+        line.host = host.clone();
+    }
+}
+
+fn agent_stage(line: &mut Line) {
     if line.agent.is_empty() {
         line.agent = line_agent(&line.user_agent);
     }
+}
+
+fn type_stage(line: &mut Line) {
     if line.r#type.is_empty() {
         line.r#type = line_type(&line.path, &line.agent, &line.user_agent);
     }
+}
+
+fn os_stage(line: &mut Line) {
     if line.os.is_empty() {
         line.os = line_os(&line.user_agent);
     }
+}
+
+fn mult_stage(line: &mut Line) {
     if line.mult == 0 {
         line.mult = line_multiplier(&line.user_agent);
     }
+}
+
+fn uniq_stage(line: &mut Line) {
     if line.uniq.is_empty() {
         line.uniq = line_uniq(&line.ip, &line.user_agent, &line.agent);
     }
+}
+
+fn referrer_stage(line: &mut Line) {
     if line.ref_domain.is_empty() {
         line.ref_domain = line_ref_domain(&line.referrer);
     }
+    if line.ref_path.is_empty() {
+        line.ref_path = line_ref_path(&line.referrer, &line.host);
+    }
+}
+
+fn search_terms_stage(line: &mut Line) {
+    if line.search_terms.is_empty() {
+        line.search_terms = line_search_terms(&line.referrer);
+    }
+}
+
+fn social_stage(line: &mut Line) {
+    if line.social.is_empty() {
+        line.social = line_social(&line.referrer, &line.query);
+    }
+}
+
+// For --minimal-data: drops the address and User-Agent once everything
+// derived from them is set, so neither is stored.
+pub fn minimize(line: &mut Line) {
+    analyze(line);
+    line.ip.clear();
+    line.user_agent.clear();
+}
+
+// Reads the --agent-types file on top of the built-in list. Call it before
+// the first line is analyzed; later calls have no effect.
+pub fn configure_agent_types(path: Option<&str>) -> Result<(), anyhow::Error> {
+    let mut types = parse_agent_types(DEFAULT_AGENT_TYPES)?;
+    if let Some(path) = path {
+        let text = std::fs::read_to_string(path).with_context(|| format!("read {}", path))?;
+        let configured = parse_agent_types(&text).with_context(|| format!("parse {}", path))?;
+        types.extend(configured.clone());
+        let _ = CONFIGURED_AGENT_TYPES.set(configured);
+    }
+    let _ = AGENT_TYPES.set(types);
+    Ok(())
+}
+
+// The type the --agent-types file gives `agent`, if it lists it.
+pub fn configured_agent_type(agent: &str) -> Option<&'static str> {
+    CONFIGURED_AGENT_TYPES.get()?.get(agent).map(String::as_str)
+}
+
+fn agent_types() -> &'static HashMap<String, String> {
+    AGENT_TYPES.get_or_init(|| parse_agent_types(DEFAULT_AGENT_TYPES).expect("agent types"))
+}
+
+fn parse_agent_types(text: &str) -> Result<HashMap<String, String>, anyhow::Error> {
+    let mut types = HashMap::new();
+    for (idx, line) in text.lines().enumerate() {
+        let line = line.trim();
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+        let Some((agent, kind)) = line.rsplit_once(char::is_whitespace) else {
+            anyhow::bail!("line {}: expected \"<agent> <type>\"", idx + 1);
+        };
+        if !matches!(kind, "browser" | "feed" | "bot") {
+            anyhow::bail!("line {}: unknown type {}", idx + 1, kind);
+        }
+        types.insert(agent.trim_end().to_string(), kind.to_string());
+    }
+    Ok(types)
+}
+
+// Reads the --host-aliases file. Call it before the first line is analyzed;
+// later calls have no effect.
+pub fn configure_host_aliases(path: Option<&str>) -> Result<(), anyhow::Error> {
+    let mut aliases = HashMap::new();
+    if let Some(path) = path {
+        let text = std::fs::read_to_string(path).with_context(|| format!("read {}", path))?;
+        aliases = parse_host_aliases(&text).with_context(|| format!("parse {}", path))?;
+    }
+    let _ = HOST_ALIASES.set(aliases);
+    Ok(())
+}
+
+fn host_aliases() -> &'static HashMap<String, String> {
+    HOST_ALIASES.get_or_init(HashMap::new)
+}
+
+// The host `host` is stored and shown as: the one it is an alias of, else
+// itself.
+pub fn canonical_host(host: &str) -> String {
+    host_aliases().get(host).cloned().unwrap_or_else(|| host.to_string())
+}
+
+// Aliases of `host`, so filters on it also match rows stored before the
+// aliases were configured.
+pub fn aliases_of(host: &str) -> Vec<String> {
+    let mut aliases: Vec<String> = host_aliases()
+        .iter()
+        .filter(|(_, canonical)| *canonical == host)
+        .map(|(alias, _)| alias.clone())
+        .collect();
+    aliases.sort();
+    aliases
+}
+
+// One group per line: the host to report, then its aliases, e.g.
+// "example.com www.example.com m.example.com".
+fn parse_host_aliases(text: &str) -> Result<HashMap<String, String>, anyhow::Error> {
+    let mut aliases = HashMap::new();
+    for (idx, line) in text.lines().enumerate() {
+        let line = line.trim();
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+        let mut hosts = line.split_whitespace().map(str::to_lowercase);
+        let canonical = hosts.next().unwrap_or_default();
+        let mut any = false;
+        for alias in hosts {
+            if alias == canonical {
+                continue;
+            }
+            if aliases.insert(alias.clone(), canonical.clone()).is_some() {
+                anyhow::bail!("line {}: {} is already an alias", idx + 1, alias);
+            }
+            any = true;
+        }
+        if !any {
+            anyhow::bail!("line {}: expected \"<host> <alias>...\"", idx + 1);
+        }
+    }
+    if let Some(alias) = aliases.values().find(|canonical| aliases.contains_key(*canonical)) {
+        anyhow::bail!("{} is both a host and an alias", alias);
+    }
+    Ok(aliases)
 }
 
 fn dequote(s: &str) -> Cow<'_, str> {
@@ -66,7 +343,7 @@ static RE_COMPATIBLE: Lazy<Regex> =
 static RE_BOT_BEFORE: Lazy<Regex> =
     Lazy::new(|| Regex::new(r"(?i)^[\w\.\-_@ ]*[\w\.\-_@] (?:ro)?bot").expect("re"));
 static RE_BOT_CONTAINS: Lazy<Regex> =
-    Lazy::new(|| Regex::new(r"(?i)\b[\w-_]+bot\b").expect("re"));
+    Lazy::new(|| Regex::new(r"(?i)\b[\w\-_]+bot\b").expect("re"));
 static RE_TRIDENT: Lazy<Regex> = Lazy::new(|| Regex::new(r"(?i)Trident/[0-9.]+").expect("re"));
 static RE_MOZILLA_FIRST: Lazy<Regex> = Lazy::new(|| {
     Regex::new(r"(?i)^Mozilla/.* ([A-Za-z0-9_]+)/[A-Z0-9.]+(?: (?:Chrome|Version|Mobile|Safari|Mobile Safari)/[A-Z0-9.]+)+$")
@@ -186,24 +463,27 @@ fn is_excluded_agent(name: &str) -> bool {
 }
 
 fn line_type(path: &str, agent: &str, user_agent: &str) -> String {
+    line_type_reason(path, agent, user_agent).0
+}
+
+// The type together with the rule that decided it, for /api/classify.
+pub fn line_type_reason(path: &str, agent: &str, user_agent: &str) -> (String, String) {
     if !user_agent.is_empty() && RE_RSS.is_match(user_agent) {
-        return "feed".to_string();
+        return ("feed".to_string(), "User-Agent mentions RSS".to_string());
     }
-    match agent {
-        "Chrome" | "Firefox" | "Edg" | "EdgA" | "EdgiOS" | "Safari" | "OPR" | "YaBrowser"
-        | "Vivaldi" | "SamsungBrowser" | "UCBrowser" => return "browser".to_string(),
-        _ => {}
+    if let Some(kind) = agent_types().get(agent) {
+        return (kind.clone(), format!("agent {} is listed as {}", agent, kind));
     }
-    if !user_agent.is_empty() && RE_BOT_UA.is_match(user_agent) {
-        return "bot".to_string();
+    if let Some(m) = RE_BOT_UA.find(user_agent) {
+        return ("bot".to_string(), format!("User-Agent contains \"{}\"", m.as_str()));
     }
     if user_agent.starts_with("Mozilla/") {
-        return "browser".to_string();
+        return ("browser".to_string(), "User-Agent starts with Mozilla/".to_string());
     }
     if path.is_empty() {
-        return "bot".to_string();
+        return ("bot".to_string(), "no path".to_string());
     }
-    "bot".to_string()
+    ("bot".to_string(), "no browser signature".to_string())
 }
 
 fn line_os(user_agent: &str) -> String {
@@ -236,6 +516,19 @@ fn line_multiplier(user_agent: &str) -> i64 {
     1
 }
 
+// Which inputs line_uniq hashes, for /api/classify.
+pub fn uniq_source(user_agent: &str, agent: &str) -> &'static str {
+    if !user_agent.is_empty() && !agent.is_empty() {
+        if extract_feed_id(user_agent).is_some() {
+            return "agent and feed-id";
+        }
+        if user_agent.to_lowercase().contains("subscriber") {
+            return "agent (subscriber count reported)";
+        }
+    }
+    "ip and User-Agent"
+}
+
 fn line_uniq(ip: &str, user_agent: &str, agent: &str) -> String {
     if !user_agent.is_empty() && !agent.is_empty() {
         if let Some(feed_id) = extract_feed_id(user_agent) {
@@ -245,6 +538,10 @@ fn line_uniq(ip: &str, user_agent: &str, agent: &str) -> String {
             return hash_uuid(agent);
         }
     }
+    fallback_uniq(ip, user_agent)
+}
+
+pub fn fallback_uniq(ip: &str, user_agent: &str) -> String {
     hash_uuid(&format!("{}{}", ip, user_agent))
 }
 
@@ -267,7 +564,132 @@ fn line_ref_domain(referrer: &str) -> String {
     String::new()
 }
 
-fn hash_uuid(input: &str) -> String {
+fn line_ref_path(referrer: &str, host: &str) -> String {
+    let host = host.split(':').next().unwrap_or_default().to_lowercase();
+    if referrer.is_empty() || host.is_empty() {
+        return String::new();
+    }
+    let Ok(u) = Url::parse(referrer) else {
+        return String::new();
+    };
+    match u.host_str() {
+        Some(ref_host) if ref_host.trim_start_matches("www.") == host.trim_start_matches("www.") => {
+            u.path().to_string()
+        }
+        _ => String::new(),
+    }
+}
+
+// Search engines that keep the query in the referrer, by domain, with the
+// parameters that may hold it. Google and Bing's signed-in search strip it.
+const SEARCH_ENGINES: &[(&str, &[&str])] = &[
+    ("duckduckgo.com", &["q"]),
+    ("bing.com", &["q"]),
+    ("baidu.com", &["wd", "word"]),
+    ("yandex.ru", &["text"]),
+    ("yandex.com", &["text"]),
+    ("search.yahoo.com", &["p"]),
+    ("ecosia.org", &["q"]),
+    ("search.brave.com", &["q"]),
+    ("startpage.com", &["query", "q"]),
+    ("qwant.com", &["q"]),
+    ("kagi.com", &["q"]),
+    ("sogou.com", &["query"]),
+    ("search.naver.com", &["query"]),
+    ("ask.com", &["q"]),
+    ("so.com", &["q"]),
+];
+
+// Lowercased with whitespace collapsed, so the same search groups together.
+fn line_search_terms(referrer: &str) -> String {
+    if referrer.is_empty() {
+        return String::new();
+    }
+    let Ok(u) = Url::parse(referrer) else {
+        return String::new();
+    };
+    let Some(host) = u.host_str() else {
+        return String::new();
+    };
+    let host = host.trim_start_matches("www.");
+    let Some((_, keys)) = SEARCH_ENGINES
+        .iter()
+        .find(|(domain, _)| host == *domain || host.ends_with(&format!(".{}", domain)))
+    else {
+        return String::new();
+    };
+    for key in *keys {
+        if let Some((_, value)) = u.query_pairs().find(|(k, _)| k == key) {
+            let terms = value.split_whitespace().collect::<Vec<_>>().join(" ").to_lowercase();
+            if !terms.is_empty() {
+                return terms;
+            }
+        }
+    }
+    String::new()
+}
+
+// Social platforms, with the referrer domains of their sites and link
+// shorteners, and the values share links put in SHARE_PARAMS.
+const SOCIAL_PLATFORMS: &[(&str, &[&str], &[&str])] = &[
+    (
+        "Mastodon",
+        &["mastodon.social", "mastodon.online", "mstdn.social", "fosstodon.org", "hachyderm.io", "infosec.exchange", "mas.to"],
+        &["mastodon", "fediverse"],
+    ),
+    ("Bluesky", &["bsky.app"], &["bluesky", "bsky"]),
+    ("Hacker News", &["news.ycombinator.com"], &["hn", "hackernews", "hacker_news", "ycombinator"]),
+    ("Reddit", &["reddit.com"], &["reddit"]),
+    ("Lobsters", &["lobste.rs"], &["lobsters"]),
+    ("X", &["x.com", "twitter.com", "t.co"], &["x", "twitter"]),
+    ("Threads", &["threads.net"], &["threads"]),
+    ("Facebook", &["facebook.com"], &["facebook", "fb"]),
+    ("Instagram", &["instagram.com"], &["instagram", "ig"]),
+    ("LinkedIn", &["linkedin.com", "lnkd.in"], &["linkedin"]),
+    ("YouTube", &["youtube.com", "youtu.be"], &["youtube"]),
+];
+
+// Query parameters share links use to name where they were posted.
+const SHARE_PARAMS: &[&str] = &["ref", "src", "source", "utm_source"];
+
+// Mastodon instances are too many to list; their post and profile URLs
+// give them away.
+static RE_FEDIVERSE_PATH: Lazy<Regex> =
+    Lazy::new(|| Regex::new(r"^/@[\w.]+(?:@[\w.-]+)?(?:/\d+)?/?$").expect("re"));
+
+// The referrer wins over a share parameter, as it names where the click
+// actually happened.
+fn line_social(referrer: &str, query: &str) -> String {
+    if let Some(u) = Url::parse(referrer).ok().filter(|u| u.host_str().is_some()) {
+        let host = u.host_str().unwrap_or_default().trim_start_matches("www.");
+        let platform = SOCIAL_PLATFORMS.iter().find(|(_, domains, _)| {
+            domains
+                .iter()
+                .any(|domain| host == *domain || host.ends_with(&format!(".{}", domain)))
+        });
+        if let Some((name, _, _)) = platform {
+            return name.to_string();
+        }
+        if RE_FEDIVERSE_PATH.is_match(u.path()) {
+            return "Mastodon".to_string();
+        }
+    }
+    for (key, value) in url::form_urlencoded::parse(query.as_bytes()) {
+        if !SHARE_PARAMS.contains(&key.as_ref()) {
+            continue;
+        }
+        let value = value.trim().to_lowercase();
+        let platform = SOCIAL_PLATFORMS
+            .iter()
+            .find(|(_, _, values)| values.contains(&value.as_str()));
+        if let Some((name, _, _)) = platform {
+            return name.to_string();
+        }
+    }
+    String::new()
+}
+
+pub fn hash_uuid(input: &str) -> String {
     let mut hasher = Sha256::new();
     hasher.update(input.as_bytes());
     let sum = hasher.finalize();
@@ -288,6 +710,31 @@ fn uuid_from_bytes(b: &[u8]) -> String {
     String::from_utf8_lossy(&buf).to_string()
 }
 
+// Properties every classification has whatever the input: no panic, a
+// trimmed agent taken from the User-Agent and a known type. Checked by the
+// fuzz target in fuzz/ and on mutated fixtures in the tests below.
+#[cfg(any(test, fuzzing))]
+pub fn check_user_agent(user_agent: &str) {
+    let agent = line_agent(user_agent);
+    assert_eq!(agent, agent.trim(), "agent of {:?} is not trimmed", user_agent);
+    assert!(
+        user_agent.to_ascii_lowercase().contains(&agent.to_ascii_lowercase()),
+        "agent {:?} is not part of {:?}",
+        agent,
+        user_agent
+    );
+    let kind = line_type("/", &agent, user_agent);
+    assert!(
+        matches!(kind.as_str(), "browser" | "feed" | "bot"),
+        "type {:?} of {:?}",
+        kind,
+        user_agent
+    );
+    line_os(user_agent);
+    assert!(line_multiplier(user_agent) >= 0, "multiplier of {:?}", user_agent);
+    assert_eq!(line_uniq("127.0.0.1", user_agent, &agent).len(), 36);
+}
+
 fn regex_match(re: &Regex, s: &str) -> String {
     re.find(s).map(|m| m.as_str().to_string()).unwrap_or_default()
 }
@@ -297,3 +744,175 @@ fn regex_group(re: &Regex, s: &str, idx: usize) -> String {
         .and_then(|caps| caps.get(idx).map(|m| m.as_str().to_string()))
         .unwrap_or_default()
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const USER_AGENTS: &str = include_str!("../fixtures/user_agents.tsv");
+    const USER_AGENT_CORPUS: &str = include_str!("../fixtures/user_agent_corpus.tsv");
+    const USER_AGENT_REGRESSIONS: &str = include_str!("../fixtures/user_agent_regressions.tsv");
+
+    // Checks "type, agent, os, user agent" fixture lines, each paired with
+    // the label that names it in failures.
+    fn check_fixtures<'a>(lines: impl Iterator<Item = (String, &'a str)>) -> usize {
+        let mut checked = 0;
+        for (label, line) in lines {
+            let fields: Vec<&str> = line.splitn(4, '\t').collect();
+            let [kind, agent, os, user_agent] = fields[..] else {
+                panic!("malformed fixture {}: {}", label, line);
+            };
+            let derived = line_agent(user_agent);
+            assert_eq!(derived, agent, "agent of {} ({})", user_agent, label);
+            assert_eq!(line_type("/", &derived, user_agent), kind, "type of {} ({})", user_agent, label);
+            assert_eq!(line_os(user_agent), os, "os of {} ({})", user_agent, label);
+            checked += 1;
+        }
+        checked
+    }
+
+    fn fixture_lines(text: &str) -> impl Iterator<Item = (usize, &str)> {
+        text.lines()
+            .enumerate()
+            .filter(|(_, line)| !line.is_empty() && !line.starts_with('#'))
+            .map(|(idx, line)| (idx + 1, line))
+    }
+
+    #[test]
+    fn classifies_fixture_user_agents() {
+        let lines = fixture_lines(USER_AGENTS).map(|(n, line)| (format!("user_agents.tsv:{}", n), line));
+        check_fixtures(lines);
+    }
+
+    #[test]
+    fn classifies_user_agent_corpus() {
+        let lines = fixture_lines(USER_AGENT_CORPUS)
+            .map(|(n, line)| (format!("user_agent_corpus.tsv:{}", n), line));
+        assert!(check_fixtures(lines) > 1000);
+    }
+
+    #[test]
+    fn classifies_reported_user_agents() {
+        let lines = fixture_lines(USER_AGENT_REGRESSIONS).map(|(n, line)| {
+            let Some((issue, rest)) = line.split_once('\t') else {
+                panic!("malformed fixture user_agent_regressions.tsv:{}: {}", n, line);
+            };
+            (format!("issue {}", issue), rest)
+        });
+        check_fixtures(lines);
+    }
+
+    // A cheap stand-in for the fuzz target that runs with the other tests:
+    // fixture user agents with random edits. Set ANALYZER_FUZZ_ITERATIONS to
+    // run longer.
+    #[test]
+    fn classifies_mutated_user_agents() {
+        const PIECES: &[&str] = &[
+            "\"", "(", ")", ";", "/", " ", "\t", "\0", "+http", "compatible; ", "bot", "Mozilla/",
+            " Safari/1.0", "feed-id:", " subscribers", "é", "\u{202e}", "🙂", "-",
+        ];
+        let iterations = std::env::var("ANALYZER_FUZZ_ITERATIONS")
+            .ok()
+            .and_then(|v| v.parse().ok())
+            .unwrap_or(2000);
+        let seeds: Vec<&str> = fixture_lines(USER_AGENTS)
+            .chain(fixture_lines(USER_AGENT_CORPUS))
+            .filter_map(|(_, line)| line.splitn(4, '\t').nth(3))
+            .collect();
+        let mut state: u64 = 0x9e37_79b9_7f4a_7c15;
+        let mut next = |n: usize| {
+            state ^= state << 13;
+            state ^= state >> 7;
+            state ^= state << 17;
+            (state % n.max(1) as u64) as usize
+        };
+        for _ in 0..iterations {
+            let mut ua: Vec<char> = seeds[next(seeds.len())].chars().collect();
+            for _ in 0..1 + next(4) {
+                let pos = next(ua.len() + 1);
+                match next(4) {
+                    0 => {
+                        let piece = PIECES[next(PIECES.len())];
+                        ua.splice(pos..pos, piece.chars());
+                    }
+                    1 if pos < ua.len() => {
+                        ua.remove(pos);
+                    }
+                    2 => ua.truncate(pos),
+                    _ => {
+                        let tail: Vec<char> = ua[pos..].to_vec();
+                        ua.extend(tail);
+                    }
+                }
+            }
+            check_user_agent(&ua.into_iter().collect::<String>());
+        }
+    }
+
+    #[test]
+    fn extracts_search_terms() {
+        assert_eq!(line_search_terms("https://duckduckgo.com/?q=banan+stats&ia=web"), "banan stats");
+        assert_eq!(line_search_terms("https://www.bing.com/search?q=Traefik%20%20Plugin"), "traefik plugin");
+        assert_eq!(line_search_terms("https://www.baidu.com/s?ie=utf-8&wd=%E7%BB%9F%E8%AE%A1"), "统计");
+        assert_eq!(line_search_terms("https://m.baidu.com/s?word=stats"), "stats");
+        assert_eq!(line_search_terms("https://yandex.ru/search/?text=duckdb"), "duckdb");
+        assert_eq!(line_search_terms("https://www.google.com/"), "");
+        assert_eq!(line_search_terms("https://duckduckgo.com/"), "");
+        assert_eq!(line_search_terms("https://notbing.com/?q=x"), "");
+        assert_eq!(line_search_terms("not a url"), "");
+    }
+
+    #[test]
+    fn attributes_social_platforms() {
+        assert_eq!(line_social("https://news.ycombinator.com/item?id=1", ""), "Hacker News");
+        assert_eq!(line_social("https://old.reddit.com/r/rust/", ""), "Reddit");
+        assert_eq!(line_social("https://t.co/abc", ""), "X");
+        assert_eq!(line_social("https://l.facebook.com/l.php", ""), "Facebook");
+        assert_eq!(line_social("https://social.example/@alice/112233", ""), "Mastodon");
+        assert_eq!(line_social("", "utm_source=Bluesky&utm_medium=social"), "Bluesky");
+        assert_eq!(line_social("", "ref=hn"), "Hacker News");
+        assert_eq!(line_social("https://lobste.rs/s/abc", "ref=hn"), "Lobsters");
+        assert_eq!(line_social("https://example.org/blog", "ref=newsletter"), "");
+        assert_eq!(line_social("", "page=2"), "");
+    }
+
+    #[test]
+    fn parses_host_aliases() {
+        let aliases = parse_host_aliases("# comment\n\nexample.com www.example.com M.example.com\n").unwrap();
+        assert_eq!(aliases.get("www.example.com").map(String::as_str), Some("example.com"));
+        assert_eq!(aliases.get("m.example.com").map(String::as_str), Some("example.com"));
+        assert!(!aliases.contains_key("example.com"));
+        assert!(parse_host_aliases("example.com").is_err());
+        assert!(parse_host_aliases("a.com www.a.com\nb.com www.a.com").is_err());
+        assert!(parse_host_aliases("a.com b.com\nb.com c.com").is_err());
+    }
+
+    #[test]
+    fn selects_analyzer_stages() {
+        fn tag(line: &mut Line) {
+            line.extra = "{\"tagged\":true}".to_string();
+        }
+        let extra = [Stage { name: "tag", after: &["type"], run: tag }];
+        let names = |stages: Vec<Stage>| stages.iter().map(|s| s.name).collect::<Vec<_>>().join(",");
+
+        let all = select_stages(&extra, None).unwrap();
+        assert_eq!(names(all), "host,agent,type,os,mult,uniq,referrer,search_terms,social,tag");
+        let picked = select_stages(&extra, Some("agent, type, tag, mult, uniq")).unwrap();
+        assert_eq!(names(picked), "agent,type,tag,mult,uniq");
+
+        let err = |list: &str| select_stages(&extra, Some(list)).err().map(|e| e.to_string());
+        assert_eq!(err("agent,tag,type,mult,uniq").as_deref(), Some("analyzer stage tag must come after type"));
+        assert_eq!(err("agent,type,mult").as_deref(), Some("--analyzer-stages must include uniq"));
+        assert!(err("agent,type,mult,uniq,geo").unwrap().starts_with("unknown analyzer stage geo"));
+        assert!(select_stages(&[Stage { name: "os", after: &[], run: tag }], None).is_err());
+    }
+
+    #[test]
+    fn parses_agent_types() {
+        let types = parse_agent_types("# comment\n\nTiny Tiny RSS  feed\nMiniflux bot\n").unwrap();
+        assert_eq!(types.get("Tiny Tiny RSS").map(String::as_str), Some("feed"));
+        assert_eq!(types.get("Miniflux").map(String::as_str), Some("bot"));
+        assert!(parse_agent_types("Miniflux reader").is_err());
+        assert!(parse_agent_types("Miniflux").is_err());
+    }
+}
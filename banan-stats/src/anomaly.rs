@@ -0,0 +1,252 @@
+use crate::admin;
+use crate::assets;
+use crate::audit;
+use crate::dashboard::{escape_html, first_value, parse_query};
+use crate::state::AppState;
+use crate::store::Store;
+use axum::{
+    extract::State,
+    http::{HeaderMap, StatusCode},
+    response::{IntoResponse, Redirect, Response},
+    routing::{get, post},
+    Router,
+};
+use chrono::{Duration as ChronoDuration, Utc};
+use std::fmt::Write;
+use std::time::Duration;
+
+// No ASN data is stored yet, so traffic is grouped by network range instead:
+// /24 for IPv4, and the (already /64-masked) address for IPv6.
+pub const RANGE_EXPR: &str =
+    r"CASE WHEN ip LIKE '%:%' THEN ip || '/64' ELSE regexp_replace(ip, '\.[0-9]+$', '.0/24') END";
+
+#[derive(Clone, Debug)]
+pub struct Options {
+    // Minimum browser uniques a range needs in a day before it can be flagged.
+    pub min_uniques: i64,
+    // How many times its trailing 14-day daily average a range must reach.
+    pub factor: f64,
+    pub interval: Duration,
+}
+
+pub struct BotRange {
+    pub range: String,
+    pub flagged_on: String,
+    pub uniques: i64,
+    pub baseline: f64,
+    pub status: String,
+}
+
+pub fn router(state: AppState) -> Router {
+    Router::new()
+        .route("/stats/anomalies", get(anomalies_handler))
+        .route("/stats/anomalies/exclude", post(exclude_handler))
+        .with_state(state)
+}
+
+pub async fn run(store: std::sync::Arc<Store>, options: Options) {
+    let mut ticker = tokio::time::interval(options.interval);
+    loop {
+        ticker.tick().await;
+        if let Err(err) = detect(&store, &options).await {
+            eprintln!("anomaly detector failed: {}", err);
+        }
+        if let Err(err) = reclassify(&store).await {
+            eprintln!("anomaly reclassify failed: {}", err);
+        }
+    }
+}
+
+async fn detect(store: &Store, options: &Options) -> Result<(), anyhow::Error> {
+    let today = Utc::now().date_naive();
+    let since = (today - ChronoDuration::days(14)).format("%Y-%m-%d").to_string();
+    let today = today.format("%Y-%m-%d").to_string();
+    let min_uniques = options.min_uniques;
+    let factor = options.factor;
+    let flagged = store
+        .with_conn(move |conn| {
+            let query = format!(
+                "WITH today AS (
+                     SELECT {range} AS range, COUNT(DISTINCT uniq) AS uniques
+                     FROM stats
+                     WHERE date = CAST(? AS DATE) AND type = 'browser' AND ip IS NOT NULL
+                       AND deleted_at IS NULL
+                     GROUP BY 1
+                 ),
+                 history AS (
+                     SELECT {range} AS range, COUNT(DISTINCT uniq) / 14.0 AS baseline
+                     FROM stats
+                     WHERE date >= CAST(? AS DATE) AND date < CAST(? AS DATE)
+                       AND type = 'browser' AND ip IS NOT NULL AND deleted_at IS NULL
+                     GROUP BY 1
+                 )
+                 INSERT INTO bot_ranges (range, flagged_on, uniques, baseline, status)
+                 SELECT t.range, CAST(? AS DATE), t.uniques, coalesce(h.baseline, 0), 'suspected'
+                 FROM today t LEFT JOIN history h USING (range)
+                 WHERE t.uniques >= ?
+                   AND t.uniques >= ? * greatest(coalesce(h.baseline, 0), 1)
+                 ON CONFLICT DO NOTHING",
+                range = RANGE_EXPR
+            );
+            Ok(conn.execute(
+                &query,
+                duckdb::params![today, since, today, today, min_uniques, factor],
+            )?)
+        })
+        .await?;
+    if flagged > 0 {
+        store.touch();
+    }
+    Ok(())
+}
+
+// Suspected ranges are reclassified for the day they were flagged; excluded
+// ranges for every day, including rows ingested after the exclusion. Returns
+// the rows reclassified.
+async fn reclassify(store: &Store) -> Result<usize, anyhow::Error> {
+    let today = Utc::now().date_naive().format("%Y-%m-%d").to_string();
+    let suspected = store
+        .update_stats(
+            format!(
+                "UPDATE {{stats}} SET type = 'bot', agent = 'Suspected bot'
+                 WHERE type = 'browser' AND ip IS NOT NULL AND date = CAST(? AS DATE)
+                   AND {range} IN (
+                       SELECT range FROM bot_ranges
+                       WHERE status = 'suspected' AND flagged_on = CAST(? AS DATE)
+                   )",
+                range = RANGE_EXPR
+            ),
+            vec![today.clone(), today],
+        )
+        .await?;
+    let excluded = store
+        .update_stats(
+            format!(
+                "UPDATE {{stats}} SET type = 'bot', agent = 'Suspected bot'
+                 WHERE type = 'browser' AND ip IS NOT NULL
+                   AND {range} IN (SELECT range FROM bot_ranges WHERE status = 'excluded')",
+                range = RANGE_EXPR
+            ),
+            Vec::new(),
+        )
+        .await?;
+    Ok(suspected + excluded)
+}
+
+pub async fn flagged_ranges(store: &Store) -> Result<Vec<BotRange>, anyhow::Error> {
+    store
+        .with_conn(|conn| {
+            let mut stmt = conn.prepare(
+                "SELECT range, CAST(flagged_on AS VARCHAR), uniques, baseline, status
+                 FROM bot_ranges
+                 ORDER BY flagged_on DESC, uniques DESC",
+            )?;
+            let mut rows = stmt.query([])?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                out.push(BotRange {
+                    range: row.get(0)?,
+                    flagged_on: row.get(1)?,
+                    uniques: row.get(2)?,
+                    baseline: row.get(3)?,
+                    status: row.get(4)?,
+                });
+            }
+            Ok(out)
+        })
+        .await
+}
+
+async fn anomalies_handler(State(state): State<AppState>, headers: HeaderMap) -> Response {
+    if let Err(resp) = admin::authorize(&state, &headers) {
+        return resp;
+    }
+    let ranges = match flagged_ranges(&state.store).await {
+        Ok(ranges) => ranges,
+        Err(err) => {
+            eprintln!("anomalies query failed: {}", err);
+            Vec::new()
+        }
+    };
+
+    let mut body = String::new();
+    let mut out = |s: &str| {
+        let _ = writeln!(body, "{}", s);
+    };
+    out("<!DOCTYPE html>");
+    out("<html>");
+    out("<head>");
+    out("<meta charset=\"utf-8\">");
+    out("<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">");
+    out(&assets::style_tag(false));
+    out("</head>");
+    out("<body>");
+    out("<div class=filters><a class=filter href='/stats'>&larr; Dashboard</a></div>");
+    out("<h1>Suspected bot ranges</h1>");
+    if ranges.is_empty() {
+        out("<div class=notice>No traffic floods detected.</div>");
+    } else {
+        out("<table class=rows>");
+        out("<tr><th>range</th><th>flagged on</th><th>uniques</th><th>daily average</th><th>status</th><th></th></tr>");
+        for r in &ranges {
+            let action = if r.status == "excluded" {
+                String::new()
+            } else {
+                format!(
+                    "<form method=post action='/stats/anomalies/exclude'><input type=hidden name=range value='{}'><button type=submit>Exclude</button></form>",
+                    escape_html(&r.range)
+                )
+            };
+            out(&format!(
+                "<tr><td>{}</td><td>{}</td><td>{}</td><td>{:.1}</td><td>{}</td><td>{}</td></tr>",
+                escape_html(&r.range),
+                escape_html(&r.flagged_on),
+                r.uniques,
+                r.baseline,
+                escape_html(&r.status),
+                action
+            ));
+        }
+        out("</table>");
+    }
+    out("</body>");
+    out("</html>");
+
+    let mut headers = HeaderMap::new();
+    headers.insert(
+        "Content-Type",
+        "text/html; charset=utf-8".parse().expect("header"),
+    );
+    (headers, body).into_response()
+}
+
+async fn exclude_handler(State(state): State<AppState>, headers: HeaderMap, body: String) -> Response {
+    if let Err(resp) = admin::authorize(&state, &headers) {
+        return resp;
+    }
+    let params = parse_query(body);
+    let Some(range) = first_value(&params, "range").filter(|r| !r.is_empty()) else {
+        return StatusCode::BAD_REQUEST.into_response();
+    };
+    let filter = format!("range={}", range);
+    let result = state
+        .store
+        .with_conn(move |conn| {
+            conn.execute(
+                "UPDATE bot_ranges SET status = 'excluded' WHERE range = ?",
+                [range],
+            )?;
+            Ok(())
+        })
+        .await;
+    if let Err(err) = result {
+        eprintln!("anomaly exclude failed: {}", err);
+        return StatusCode::INTERNAL_SERVER_ERROR.into_response();
+    }
+    state.store.touch();
+    match reclassify(&state.store).await {
+        Ok(rows) => audit::log(&state.store, &audit::actor(&state, &headers), "reclassify", &filter, rows).await,
+        Err(err) => eprintln!("anomaly reclassify failed: {}", err),
+    }
+    Redirect::to("/stats/anomalies").into_response()
+}
@@ -0,0 +1,347 @@
+use crate::analyzer::{self, Line};
+use crate::asn;
+use crate::daily;
+use crate::dashboard::{build_where, distinct_hosts, extract_filters, first_value, parse_query, table_rows};
+use crate::growth;
+use crate::schema::{self, Query};
+use crate::search;
+use crate::state::AppState;
+use axum::{
+    extract::{rejection::JsonRejection, RawQuery, State},
+    http::{header, StatusCode},
+    response::{IntoResponse, Response},
+    routing::{get, post},
+    Json, Router,
+};
+use chrono::{Datelike, NaiveDate, Utc};
+use serde::Serialize;
+use std::collections::HashMap;
+
+const OPENAPI_JSON: &str = include_str!("../assets/openapi.json");
+
+pub fn router(state: AppState) -> Router {
+    Router::new()
+        .route("/api/search", get(search_handler))
+        .route("/api/growth", get(growth_handler))
+        .route("/api/hosts", get(hosts_handler))
+        .route("/api/top", get(top_handler))
+        .route("/api/uniques", get(uniques_handler))
+        .route("/api/daily", get(daily_handler))
+        .route("/api/aggregate", get(aggregate_handler))
+        .route("/api/query", post(query_handler))
+        .route("/api/schema", get(schema_handler))
+        .route("/api/classify", get(classify_handler))
+        .route("/api/openapi.json", get(openapi_handler))
+        .with_state(state)
+}
+
+// A failed /api request, answered with {"error": {"code", "message"}}. The
+// code is for programs to branch on: invalid_request, invalid_body,
+// not_found, query_failed or overloaded. The message is for people.
+struct ApiError {
+    status: StatusCode,
+    code: &'static str,
+    message: String,
+}
+
+impl ApiError {
+    fn invalid(message: impl Into<String>) -> Self {
+        ApiError {
+            status: StatusCode::BAD_REQUEST,
+            code: "invalid_request",
+            message: message.into(),
+        }
+    }
+
+    fn not_found(message: impl Into<String>) -> Self {
+        ApiError {
+            status: StatusCode::NOT_FOUND,
+            code: "not_found",
+            message: message.into(),
+        }
+    }
+
+    // Logs the whole error chain; the response only carries its outer message.
+    fn query_failed(what: &str, err: anyhow::Error) -> Self {
+        eprintln!("{} query failed: {:#}", what, err);
+        ApiError {
+            status: StatusCode::INTERNAL_SERVER_ERROR,
+            code: "query_failed",
+            message: err.to_string(),
+        }
+    }
+}
+
+// The 503 for an /api request the admission limit turned away.
+pub fn overloaded(message: String) -> Response {
+    ApiError {
+        status: StatusCode::SERVICE_UNAVAILABLE,
+        code: "overloaded",
+        message,
+    }
+    .into_response()
+}
+
+impl IntoResponse for ApiError {
+    fn into_response(self) -> Response {
+        (
+            self.status,
+            Json(serde_json::json!({ "error": { "code": self.code, "message": self.message } })),
+        )
+            .into_response()
+    }
+}
+
+async fn search_handler(State(state): State<AppState>, RawQuery(raw): RawQuery) -> Response {
+    let params = parse_query(raw.unwrap_or_default());
+    let q = first_value(&params, "q").unwrap_or_default();
+    if q.trim().is_empty() {
+        return ApiError::invalid("missing q").into_response();
+    }
+    let (from, to) = date_range(&params);
+    let filters = extract_filters(&params);
+    let (where_clause, args) = build_where(&from, &to, &filters);
+
+    match search::search(&state.store, q.trim(), &where_clause, &args).await {
+        Ok(result) => Json(result).into_response(),
+        Err(err) => {
+            eprintln!("search failed: {}", err);
+            ApiError::invalid(err.to_string()).into_response()
+        }
+    }
+}
+
+async fn growth_handler(State(state): State<AppState>, RawQuery(raw): RawQuery) -> Response {
+    let params = parse_query(raw.unwrap_or_default());
+    let (_, to) = date_range(&params);
+    let to_date = NaiveDate::parse_from_str(&to, "%Y-%m-%d").expect("date");
+    let filters = extract_filters(&params);
+
+    match growth::monthly_growth(&state.store, &filters, to_date).await {
+        Ok(months) => Json(months).into_response(),
+        Err(err) => ApiError::query_failed("growth", err).into_response(),
+    }
+}
+
+async fn hosts_handler(State(state): State<AppState>) -> Response {
+    match distinct_hosts(&state.store).await {
+        Ok(hosts) => Json(hosts).into_response(),
+        Err(err) => ApiError::query_failed("hosts", err).into_response(),
+    }
+}
+
+#[derive(Serialize)]
+struct TopRow {
+    // None for the bucket of everything outside the top 10.
+    value: Option<String>,
+    count: i64,
+}
+
+async fn top_handler(State(state): State<AppState>, RawQuery(raw): RawQuery) -> Response {
+    let params = parse_query(raw.unwrap_or_default());
+    let name = first_value(&params, "name").unwrap_or_default();
+    let (from, to) = date_range(&params);
+    let filters = extract_filters(&params);
+    let (where_clause, args) = build_where(&from, &to, &filters);
+
+    match table_rows(&state.store, &name, &where_clause, &args).await {
+        Some(Ok(rows)) => {
+            let rows: Vec<TopRow> = rows
+                .into_iter()
+                .enumerate()
+                .map(|(idx, (value, count))| TopRow {
+                    value: (idx < 10).then_some(value),
+                    count,
+                })
+                .collect();
+            Json(rows).into_response()
+        }
+        Some(Err(err)) => ApiError::query_failed("top", err).into_response(),
+        None => ApiError::not_found("unknown table").into_response(),
+    }
+}
+
+async fn uniques_handler(State(state): State<AppState>, RawQuery(raw): RawQuery) -> Response {
+    let params = parse_query(raw.unwrap_or_default());
+    let unit = first_value(&params, "by").unwrap_or_else(|| "day".to_string());
+    if !matches!(unit.as_str(), "day" | "week" | "month" | "year") {
+        return ApiError::invalid("by must be day, week, month or year").into_response();
+    }
+    let (from, to) = date_range(&params);
+    let filters = extract_filters(&params);
+    let (mut where_clause, args) = build_where(&from, &to, &filters);
+    // Like the dashboard, count browsers unless another type is asked for.
+    if !filters.contains_key("type") && !filters.contains_key("type!") {
+        where_clause.push_str(" AND type = 'browser'");
+    }
+
+    match growth::uniques_by(&state.store, &unit, &where_clause, &args).await {
+        Ok(periods) => Json(periods).into_response(),
+        Err(err) => ApiError::query_failed("uniques", err).into_response(),
+    }
+}
+
+async fn daily_handler(State(state): State<AppState>, RawQuery(raw): RawQuery) -> Response {
+    let params = parse_query(raw.unwrap_or_default());
+    let (from, to) = date_range(&params);
+    let filters = extract_filters(&params);
+    let (mut where_clause, args) = build_where(&from, &to, &filters);
+    if !filters.contains_key("type") && !filters.contains_key("type!") {
+        where_clause.push_str(" AND type = 'browser'");
+    }
+    let from_date = NaiveDate::parse_from_str(&from, "%Y-%m-%d").expect("date");
+    let to_date = NaiveDate::parse_from_str(&to, "%Y-%m-%d").expect("date");
+    let today = Utc::now().date_naive();
+
+    match daily::summary(&state.store, from_date, to_date, today, &where_clause, &args).await {
+        Ok(summary) => Json(summary).into_response(),
+        Err(err) => ApiError::query_failed("daily summary", err).into_response(),
+    }
+}
+
+async fn aggregate_handler(State(state): State<AppState>, RawQuery(raw): RawQuery) -> Response {
+    let params = parse_query(raw.unwrap_or_default());
+    let (from, to) = date_range(&params);
+    let query = Query {
+        from: Some(from),
+        to: Some(to),
+        // Unknown parameters are ignored here, as on the dashboard.
+        filters: extract_filters(&params).into_iter().collect(),
+        group_by: params
+            .get("group_by")
+            .into_iter()
+            .flatten()
+            .flat_map(|v| v.split(','))
+            .map(str::trim)
+            .filter(|c| !c.is_empty())
+            .map(str::to_string)
+            .collect(),
+        metric: first_value(&params, "metric"),
+        limit: first_value(&params, "limit").and_then(|v| v.parse().ok()),
+    };
+    if query.group_by.is_empty() {
+        return ApiError::invalid("missing group_by").into_response();
+    }
+    run_query(&state, query).await
+}
+
+// POST /api/query: an aggregate described by a JSON body, which may leave out
+// group_by to count the whole selection.
+async fn query_handler(State(state): State<AppState>, body: Result<Json<Query>, JsonRejection>) -> Response {
+    match body {
+        Ok(Json(query)) => run_query(&state, query).await,
+        Err(rejection) => ApiError {
+            status: rejection.status(),
+            code: "invalid_body",
+            message: rejection.body_text(),
+        }
+        .into_response(),
+    }
+}
+
+async fn run_query(state: &AppState, query: Query) -> Response {
+    let plan = match query.plan(Utc::now().date_naive()) {
+        Ok(plan) => plan,
+        Err(message) => return ApiError::invalid(message).into_response(),
+    };
+    match growth::aggregate(
+        &state.store,
+        &plan.group_by,
+        plan.uniques,
+        plan.limit,
+        &plan.where_clause,
+        &plan.args,
+    )
+    .await
+    {
+        Ok(rows) => Json(rows).into_response(),
+        Err(err) => ApiError::query_failed("aggregate", err).into_response(),
+    }
+}
+
+// The columns requests can filter and group by, from the same list the
+// handlers check them against.
+async fn schema_handler() -> Json<serde_json::Value> {
+    Json(serde_json::json!({
+        "columns": schema::COLUMNS,
+        "metrics": schema::METRICS,
+    }))
+}
+
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct Classification {
+    agent: String,
+    r#type: String,
+    type_reason: String,
+    os: String,
+    mult: i64,
+    ref_domain: String,
+    uniq: String,
+    uniq_source: &'static str,
+    asn: i64,
+    asn_name: String,
+    datacenter: bool,
+}
+
+// Runs the analyzer on a hand-written request so users can see why a
+// visitor got its agent and type. Nothing is stored.
+async fn classify_handler(RawQuery(raw): RawQuery) -> Response {
+    let params = parse_query(raw.unwrap_or_default());
+    let value = |key: &str| first_value(&params, key).unwrap_or_default();
+    let mut line = Line {
+        path: first_value(&params, "path").unwrap_or_else(|| "/".to_string()),
+        ip: value("ip"),
+        user_agent: value("ua"),
+        referrer: value("referrer"),
+        ..Default::default()
+    };
+    analyzer::analyze(&mut line);
+    if first_value(&params, "format").as_deref() == Some("tsv") {
+        // A line for fixtures/user_agent_regressions.tsv, without the issue.
+        return format!(
+            "{}\t{}\t{}\t{}\n",
+            line.r#type, line.agent, line.os, line.user_agent
+        )
+        .into_response();
+    }
+    let (_, mut type_reason) = analyzer::line_type_reason(&line.path, &line.agent, &line.user_agent);
+    let uniq_source = analyzer::uniq_source(&line.user_agent, &line.agent);
+    if asn::reclassified(&line) {
+        type_reason = format!("browser on datacenter network AS{} {}", line.asn, line.asn_name);
+    }
+    Json(Classification {
+        agent: line.agent,
+        r#type: line.r#type,
+        type_reason,
+        os: line.os,
+        mult: line.mult,
+        ref_domain: line.ref_domain,
+        uniq: line.uniq,
+        uniq_source,
+        asn: line.asn,
+        asn_name: line.asn_name,
+        datacenter: line.datacenter,
+    })
+    .into_response()
+}
+
+async fn openapi_handler() -> Response {
+    ([(header::CONTENT_TYPE, "application/json")], OPENAPI_JSON).into_response()
+}
+
+// API callers may omit the range; default to the current year like the
+// dashboard redirect does.
+fn date_range(params: &HashMap<String, Vec<String>>) -> (String, String) {
+    let now = Utc::now().date_naive();
+    let parse = |key: &str| {
+        first_value(params, key)
+            .and_then(|val| NaiveDate::parse_from_str(&val, "%Y-%m-%d").ok())
+    };
+    let from = parse("from").unwrap_or_else(|| NaiveDate::from_ymd_opt(now.year(), 1, 1).unwrap());
+    let to = parse("to").unwrap_or_else(|| NaiveDate::from_ymd_opt(now.year(), 12, 31).unwrap());
+    (
+        from.format("%Y-%m-%d").to_string(),
+        to.format("%Y-%m-%d").to_string(),
+    )
+}
@@ -0,0 +1,190 @@
+use crate::analyzer::{self, Line};
+use anyhow::Context;
+use once_cell::sync::OnceCell;
+use std::collections::{HashMap, HashSet};
+use std::net::IpAddr;
+
+const DEFAULT_RANGES: &str = include_str!("../assets/asn.tsv");
+const DEFAULT_HOSTING: &str = include_str!("../assets/hosting_asns.txt");
+
+// Appended to the agent of browsers reclassified as bots, so the Scrapers
+// table lists them apart from the crawlers that say what they are.
+const DATACENTER_SUFFIX: &str = " (datacenter)";
+
+static DATABASE: OnceCell<Database> = OnceCell::new();
+
+pub struct Network {
+    pub asn: i64,
+    pub name: String,
+    pub datacenter: bool,
+}
+
+struct Database {
+    // First and last address of each range, IPv4 mapped into IPv6, and the
+    // network it belongs to; sorted by first address.
+    ranges: Vec<(u128, u128, usize)>,
+    networks: Vec<Network>,
+    // Store browsers on datacenter networks as bots.
+    reclassify: bool,
+}
+
+// Loads the ranges from `asn_db` instead of the embedded ones and adds the
+// systems listed in `hosting_asns` to the hosting providers.
+pub fn configure(
+    asn_db: Option<&str>,
+    hosting_asns: Option<&str>,
+    reclassify: bool,
+) -> Result<(), anyhow::Error> {
+    let mut hosting = parse_hosting(DEFAULT_HOSTING)?;
+    if let Some(path) = hosting_asns {
+        let text = std::fs::read_to_string(path).with_context(|| format!("read {}", path))?;
+        hosting.extend(parse_hosting(&text).with_context(|| format!("parse {}", path))?);
+    }
+    let mut db = match asn_db {
+        Some(path) => {
+            let text = std::fs::read_to_string(path).with_context(|| format!("read {}", path))?;
+            parse_ranges(&text, &hosting).with_context(|| format!("parse {}", path))?
+        }
+        None => parse_ranges(DEFAULT_RANGES, &hosting)?,
+    };
+    db.reclassify = reclassify;
+    let _ = DATABASE.set(db);
+    Ok(())
+}
+
+fn database() -> &'static Database {
+    DATABASE.get_or_init(|| {
+        let hosting = parse_hosting(DEFAULT_HOSTING).expect("hosting asns");
+        parse_ranges(DEFAULT_RANGES, &hosting).expect("asn ranges")
+    })
+}
+
+fn parse_hosting(text: &str) -> Result<HashSet<i64>, anyhow::Error> {
+    let mut asns = HashSet::new();
+    for (idx, line) in text.lines().enumerate() {
+        let line = line.trim();
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+        let number = line.split_whitespace().next().unwrap_or_default();
+        let asn = number
+            .trim_start_matches("AS")
+            .parse::<i64>()
+            .with_context(|| format!("line {}: invalid AS number {:?}", idx + 1, number))?;
+        asns.insert(asn);
+    }
+    Ok(asns)
+}
+
+fn parse_ranges(text: &str, hosting: &HashSet<i64>) -> Result<Database, anyhow::Error> {
+    let mut ranges = Vec::new();
+    let mut networks = Vec::new();
+    let mut index: HashMap<i64, usize> = HashMap::new();
+    for (idx, line) in text.lines().enumerate() {
+        if line.trim().is_empty() || line.starts_with('#') {
+            continue;
+        }
+        let fields: Vec<&str> = line.split('\t').collect();
+        if fields.len() < 3 {
+            anyhow::bail!("line {}: expected first, last, AS number, country, name", idx + 1);
+        }
+        let address = |field: &str| {
+            field
+                .trim()
+                .parse::<IpAddr>()
+                .map(address_number)
+                .with_context(|| format!("line {}: invalid address {:?}", idx + 1, field))
+        };
+        let first = address(fields[0])?;
+        let last = address(fields[1])?;
+        let asn = fields[2]
+            .trim()
+            .parse::<i64>()
+            .with_context(|| format!("line {}: invalid AS number {:?}", idx + 1, fields[2]))?;
+        // ip2asn lists unrouted space as AS 0.
+        if asn == 0 {
+            continue;
+        }
+        let network = *index.entry(asn).or_insert_with(|| {
+            networks.push(Network {
+                asn,
+                name: fields.get(4).map(|s| s.trim()).unwrap_or_default().to_string(),
+                datacenter: hosting.contains(&asn),
+            });
+            networks.len() - 1
+        });
+        ranges.push((first, last, network));
+    }
+    ranges.sort_unstable();
+    Ok(Database {
+        ranges,
+        networks,
+        reclassify: false,
+    })
+}
+
+fn address_number(ip: IpAddr) -> u128 {
+    match ip {
+        IpAddr::V4(v4) => u128::from(v4.to_ipv6_mapped()),
+        IpAddr::V6(v6) => u128::from(v6),
+    }
+}
+
+// The network `ip` belongs to. Addresses the middleware truncated still
+// match, as the prefix is part of the same range.
+pub fn lookup(ip: &str) -> Option<&'static Network> {
+    let number = address_number(ip.parse().ok()?);
+    let db = database();
+    let idx = db.ranges.partition_point(|(first, _, _)| *first <= number);
+    let (_, last, network) = db.ranges.get(idx.checked_sub(1)?)?;
+    (number <= *last).then(|| &db.networks[*network])
+}
+
+// The "asn" analyzer stage, after "type": sets the network fields of `line`
+// and, when configured, turns browsers on datacenter networks into bots.
+pub const STAGE: analyzer::Stage = analyzer::Stage {
+    name: "asn",
+    after: &["type"],
+    run: enrich,
+};
+
+fn enrich(line: &mut Line) {
+    if line.asn != 0 {
+        return;
+    }
+    let Some(network) = lookup(&line.ip) else {
+        return;
+    };
+    line.asn = network.asn;
+    line.asn_name = network.name.clone();
+    line.datacenter = network.datacenter;
+    if database().reclassify
+        && line.datacenter
+        && line.r#type == "browser"
+        && !line.agent.ends_with(DATACENTER_SUFFIX)
+    {
+        line.r#type = "bot".to_string();
+        line.agent.push_str(DATACENTER_SUFFIX);
+    }
+}
+
+// Whether enrich turned the line into a bot.
+pub fn reclassified(line: &Line) -> bool {
+    line.agent.ends_with(DATACENTER_SUFFIX)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn looks_up_embedded_ranges() {
+        let google = lookup("66.249.66.1").expect("googlebot range");
+        assert_eq!(google.asn, 15169);
+        assert!(!google.datacenter);
+        let hetzner = lookup("5.9.10.20").expect("hetzner range");
+        assert!(hetzner.datacenter);
+        assert!(lookup("192.168.1.1").is_none());
+        assert!(lookup("not an address").is_none());
+    }
+}
@@ -0,0 +1,98 @@
+use axum::{
+    extract::Path,
+    http::{header, StatusCode},
+    response::{IntoResponse, Response},
+    routing::get,
+    Router,
+};
+use once_cell::sync::Lazy;
+use sha2::{Digest, Sha256};
+
+pub(crate) const STYLE_CSS: &str = include_str!("../assets/style.css");
+pub(crate) const SCRIPT_JS: &str = include_str!("../assets/script.js");
+
+// Content-hashed URLs, so the files can be cached forever and a new build
+// is picked up immediately.
+static STYLE_PATH: Lazy<String> = Lazy::new(|| hashed_path("style", "css", STYLE_CSS.as_bytes()));
+static SCRIPT_PATH: Lazy<String> = Lazy::new(|| hashed_path("script", "js", SCRIPT_JS.as_bytes()));
+
+#[cfg(has_inter_font)]
+const INTER_WOFF2: Option<&[u8]> = Some(include_bytes!("../assets/fonts/InterVariable.woff2"));
+#[cfg(not(has_inter_font))]
+const INTER_WOFF2: Option<&[u8]> = None;
+
+static FONT_PATH: Lazy<Option<String>> =
+    Lazy::new(|| INTER_WOFF2.map(|bytes| hashed_path("InterVariable", "woff2", bytes)));
+
+static FONT_FACE_CSS: Lazy<Option<String>> = Lazy::new(|| {
+    FONT_PATH.as_ref().map(|path| {
+        format!(
+            "@font-face {{ font-family: 'Inter'; font-style: normal; font-weight: 100 900; font-display: swap; src: url('{}') format('woff2'); }}",
+            path
+        )
+    })
+});
+
+pub fn router() -> Router {
+    Router::new().route("/stats/assets/:file", get(asset_handler))
+}
+
+fn hashed_path(name: &str, ext: &str, content: &[u8]) -> String {
+    let hash = hex::encode(Sha256::digest(content));
+    format!("/stats/assets/{}.{}.{}", name, &hash[..12], ext)
+}
+
+// Static exports inline the stylesheet and script so the file stays
+// self-contained; served pages reference the hashed URLs.
+pub fn style_tag(inline: bool) -> String {
+    if inline {
+        format!("<style>{}</style>", STYLE_CSS)
+    } else {
+        format!("<link rel=stylesheet href='{}'>", STYLE_PATH.as_str())
+    }
+}
+
+pub fn script_tag(inline: bool) -> String {
+    if inline {
+        format!("<script>{}</script>", SCRIPT_JS)
+    } else {
+        format!("<script src='{}'></script>", SCRIPT_PATH.as_str())
+    }
+}
+
+// The @font-face rule for the embedded font, or None when the dashboard
+// should use system fonts.
+pub fn font_face_css(system_fonts: bool) -> Option<&'static str> {
+    if system_fonts {
+        None
+    } else {
+        FONT_FACE_CSS.as_deref()
+    }
+}
+
+const IMMUTABLE: &str = "public, max-age=31536000, immutable";
+const REVALIDATE: &str = "public, no-cache";
+
+async fn asset_handler(Path(file): Path<String>) -> Response {
+    let path = format!("/stats/assets/{}", file);
+    let (content_type, cache_control, bytes): (&str, &str, &'static [u8]) = match file.as_str() {
+        _ if path == *STYLE_PATH => ("text/css; charset=utf-8", IMMUTABLE, STYLE_CSS.as_bytes()),
+        _ if path == *SCRIPT_PATH => ("text/javascript; charset=utf-8", IMMUTABLE, SCRIPT_JS.as_bytes()),
+        _ if FONT_PATH.as_ref() == Some(&path) => ("font/woff2", IMMUTABLE, INTER_WOFF2.unwrap_or_default()),
+        "style.css" => ("text/css; charset=utf-8", REVALIDATE, STYLE_CSS.as_bytes()),
+        "script.js" => ("text/javascript; charset=utf-8", REVALIDATE, SCRIPT_JS.as_bytes()),
+        "InterVariable.woff2" => match INTER_WOFF2 {
+            Some(bytes) => ("font/woff2", REVALIDATE, bytes),
+            None => return StatusCode::NOT_FOUND.into_response(),
+        },
+        _ => return StatusCode::NOT_FOUND.into_response(),
+    };
+    (
+        [
+            (header::CONTENT_TYPE, content_type),
+            (header::CACHE_CONTROL, cache_control),
+        ],
+        bytes,
+    )
+        .into_response()
+}
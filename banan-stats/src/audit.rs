@@ -0,0 +1,275 @@
+use crate::admin;
+use crate::assets;
+use crate::dashboard::{build_row_where, encode_params, escape_html, extract_filters, first_value, parse_query};
+use crate::state::AppState;
+use crate::store::Store;
+use axum::{
+    extract::State,
+    http::{HeaderMap, StatusCode},
+    response::{IntoResponse, Redirect, Response},
+    routing::{get, post},
+    Router,
+};
+use chrono::{Duration as ChronoDuration, NaiveDateTime, Utc};
+use std::collections::HashMap;
+use std::fmt::Write;
+use std::sync::Arc;
+use std::time::Duration;
+
+// Deleted rows carry the time of their delete in deleted_at, which a restore
+// matches exactly, hence the microseconds.
+const TIMESTAMP_FORMAT: &str = "%Y-%m-%d %H:%M:%S%.6f";
+
+// Entries listed on /stats/audit.
+const MAX_ENTRIES: usize = 200;
+
+pub struct Entry {
+    pub at: NaiveDateTime,
+    pub actor: String,
+    pub action: String,
+    // Dashboard query string of a delete, the delete a restore undid, or a
+    // description of what a background job removed.
+    pub filter: String,
+    pub rows: i64,
+}
+
+pub fn router(state: AppState) -> Router {
+    Router::new()
+        .route("/stats/audit", get(audit_handler))
+        .route("/stats/audit/delete", post(delete_handler))
+        .route("/stats/audit/restore", post(restore_handler))
+        .with_state(state)
+}
+
+// Who made an admin request: the user a forward-auth proxy in front of the
+// dashboard names in --trusted-user-header, else "admin", as the admin token
+// is shared. Any caller can send such a header, so none is read unless the
+// operator says the proxy sets it.
+pub fn actor(state: &AppState, headers: &HeaderMap) -> String {
+    state
+        .trusted_user_header
+        .as_deref()
+        .and_then(|name| headers.get(name))
+        .and_then(|val| val.to_str().ok())
+        .map(str::trim)
+        .filter(|val| !val.is_empty())
+        .unwrap_or("admin")
+        .to_string()
+}
+
+pub async fn record(
+    store: &Store,
+    at: NaiveDateTime,
+    actor: &str,
+    action: &str,
+    filter: &str,
+    rows: usize,
+) -> Result<(), anyhow::Error> {
+    let (actor, action, filter) = (actor.to_string(), action.to_string(), filter.to_string());
+    store
+        .with_conn(move |conn| {
+            conn.execute(
+                "INSERT INTO audit_log (at, actor, action, filter, rows) VALUES (?, ?, ?, ?, ?)",
+                duckdb::params![at, actor, action, filter, rows as i64],
+            )?;
+            Ok(())
+        })
+        .await
+}
+
+// Records an action, logging instead of failing it when the log cannot be
+// written.
+pub async fn log(store: &Store, actor: &str, action: &str, filter: &str, rows: usize) {
+    if let Err(err) = record(store, Utc::now().naive_utc(), actor, action, filter, rows).await {
+        eprintln!("audit log of {} failed: {}", action, err);
+    }
+}
+
+pub async fn entries(store: &Store) -> Result<Vec<Entry>, anyhow::Error> {
+    store
+        .with_conn(|conn| {
+            let mut stmt = conn.prepare(&format!(
+                "SELECT at, actor, action, filter, rows FROM audit_log ORDER BY at DESC LIMIT {}",
+                MAX_ENTRIES
+            ))?;
+            let mut rows = stmt.query([])?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                out.push(Entry {
+                    at: row.get(0)?,
+                    actor: row.get(1)?,
+                    action: row.get(2)?,
+                    filter: row.get::<_, Option<String>>(3)?.unwrap_or_default(),
+                    rows: row.get(4)?,
+                });
+            }
+            Ok(out)
+        })
+        .await
+}
+
+// Marks the rows matching the dashboard filters as deleted. They drop out of
+// every view at once and are removed for good after the grace period.
+pub async fn soft_delete(
+    store: &Store,
+    actor: &str,
+    params: &HashMap<String, Vec<String>>,
+) -> Result<usize, anyhow::Error> {
+    let (Some(from), Some(to)) = (first_value(params, "from"), first_value(params, "to")) else {
+        anyhow::bail!("a delete needs from and to");
+    };
+    let filters = extract_filters(params);
+    let (where_clause, mut args) = build_row_where(&from, &to, &filters);
+    let at = Utc::now().naive_utc();
+    args.insert(0, at.format(TIMESTAMP_FORMAT).to_string());
+    let rows = store
+        .update_stats(
+            format!("UPDATE {{stats}} SET deleted_at = CAST(? AS TIMESTAMP) WHERE {}", where_clause),
+            args,
+        )
+        .await?;
+    let mut described = filters;
+    described.insert("from".to_string(), vec![from]);
+    described.insert("to".to_string(), vec![to]);
+    record(store, at, actor, "delete", &encode_params(&described), rows).await?;
+    Ok(rows)
+}
+
+// Brings back the rows of the delete made at `deleted_at`, unless they were
+// purged already.
+pub async fn restore(store: &Store, actor: &str, deleted_at: &str) -> Result<usize, anyhow::Error> {
+    let rows = store
+        .update_stats(
+            "UPDATE {stats} SET deleted_at = NULL WHERE deleted_at = CAST(? AS TIMESTAMP)".to_string(),
+            vec![deleted_at.to_string()],
+        )
+        .await?;
+    record(store, Utc::now().naive_utc(), actor, "restore", deleted_at, rows).await?;
+    Ok(rows)
+}
+
+// Removes the rows deleted more than `grace_days` ago, every hour.
+pub async fn run(store: Arc<Store>, grace_days: i64) {
+    let mut ticker = tokio::time::interval(Duration::from_secs(3600));
+    loop {
+        ticker.tick().await;
+        if let Err(err) = purge(&store, grace_days, Utc::now().naive_utc()).await {
+            eprintln!("purge of deleted rows failed: {}", err);
+        }
+    }
+}
+
+// Removes the rows deleted more than `grace_days` before `now` and logs the
+// purge when there were any.
+async fn purge(store: &Store, grace_days: i64, now: NaiveDateTime) -> Result<usize, anyhow::Error> {
+    let cutoff = (now - ChronoDuration::days(grace_days)).format(TIMESTAMP_FORMAT).to_string();
+    let rows = store
+        .update_stats(
+            "DELETE FROM {stats} WHERE deleted_at < CAST(? AS TIMESTAMP)".to_string(),
+            vec![cutoff.clone()],
+        )
+        .await?;
+    if rows > 0 {
+        log(store, "retention", "purge", &format!("deleted before {}", cutoff), rows).await;
+    }
+    Ok(rows)
+}
+
+async fn delete_handler(State(state): State<AppState>, headers: HeaderMap, body: String) -> Response {
+    if let Err(resp) = admin::authorize(&state, &headers) {
+        return resp;
+    }
+    let params = parse_query(body);
+    if let Err(err) = soft_delete(&state.store, &actor(&state, &headers), &params).await {
+        eprintln!("delete failed: {}", err);
+        return (StatusCode::BAD_REQUEST, err.to_string()).into_response();
+    }
+    Redirect::to("/stats/audit").into_response()
+}
+
+async fn restore_handler(State(state): State<AppState>, headers: HeaderMap, body: String) -> Response {
+    if let Err(resp) = admin::authorize(&state, &headers) {
+        return resp;
+    }
+    let params = parse_query(body);
+    let Some(at) = first_value(&params, "at").filter(|at| !at.is_empty()) else {
+        return StatusCode::BAD_REQUEST.into_response();
+    };
+    if let Err(err) = restore(&state.store, &actor(&state, &headers), &at).await {
+        eprintln!("restore failed: {}", err);
+        return StatusCode::INTERNAL_SERVER_ERROR.into_response();
+    }
+    Redirect::to("/stats/audit").into_response()
+}
+
+async fn audit_handler(State(state): State<AppState>, headers: HeaderMap) -> Response {
+    if let Err(resp) = admin::authorize(&state, &headers) {
+        return resp;
+    }
+    let entries = entries(&state.store).await.unwrap_or_else(|err| {
+        eprintln!("audit log query failed: {}", err);
+        Vec::new()
+    });
+    let restored: Vec<&str> = entries
+        .iter()
+        .filter(|e| e.action == "restore")
+        .map(|e| e.filter.as_str())
+        .collect();
+    let purge_before = Utc::now().naive_utc() - ChronoDuration::days(state.delete_grace_days);
+
+    let mut body = String::new();
+    let mut out = |s: &str| {
+        let _ = writeln!(body, "{}", s);
+    };
+    out("<!DOCTYPE html>");
+    out("<html>");
+    out("<head>");
+    out("<meta charset=\"utf-8\">");
+    out("<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">");
+    out(&assets::style_tag(false));
+    out("</head>");
+    out("<body>");
+    out("<div class=filters><a class=filter href='/stats'>&larr; Dashboard</a></div>");
+    out("<h1>Audit log</h1>");
+    out(&format!(
+        "<p>Deleted rows are hidden at once and removed for good after {} days; until then the delete can be undone.</p>",
+        state.delete_grace_days
+    ));
+    if entries.is_empty() {
+        out("<div class=notice>No admin actions recorded yet.</div>");
+    } else {
+        out("<table class=rows>");
+        out("<tr><th>at</th><th>actor</th><th>action</th><th>filter</th><th>rows</th><th></th></tr>");
+        for e in &entries {
+            let at = e.at.format(TIMESTAMP_FORMAT).to_string();
+            let action = if e.action == "delete" && e.at > purge_before && !restored.contains(&at.as_str()) {
+                format!(
+                    "<form method=post action='/stats/audit/restore'><input type=hidden name=at value='{}'><button type=submit>Restore</button></form>",
+                    escape_html(&at)
+                )
+            } else {
+                String::new()
+            };
+            out(&format!(
+                "<tr><td>{}</td><td>{}</td><td>{}</td><td title='{}'>{}</td><td>{}</td><td>{}</td></tr>",
+                e.at.format("%Y-%m-%d %H:%M:%S"),
+                escape_html(&e.actor),
+                escape_html(&e.action),
+                escape_html(&e.filter),
+                escape_html(&e.filter),
+                e.rows,
+                action
+            ));
+        }
+        out("</table>");
+    }
+    out("</body>");
+    out("</html>");
+
+    let mut headers = HeaderMap::new();
+    headers.insert(
+        "Content-Type",
+        "text/html; charset=utf-8".parse().expect("header"),
+    );
+    (headers, body).into_response()
+}
@@ -0,0 +1,389 @@
+use crate::assets;
+use crate::daily;
+use crate::dashboard::{self, build_where, escape_html, extract_filters, first_value, parse_query, Filters};
+use crate::growth;
+use crate::locale;
+use crate::schema;
+use crate::state::AppState;
+use crate::store::Store;
+use anyhow::Context;
+use axum::{
+    extract::{Path, RawQuery, State},
+    http::{HeaderMap, StatusCode},
+    response::{IntoResponse, Response},
+    routing::get,
+    Router,
+};
+use chrono::{NaiveDate, Utc};
+use duckdb::params_from_iter;
+use serde::Deserialize;
+use std::collections::{HashMap, HashSet};
+
+// One entry of the --dashboards file, shown at /stats/boards/<name>.
+#[derive(Clone, Debug, Deserialize)]
+pub struct Board {
+    pub name: String,
+    // Link and page title; the name when missing.
+    #[serde(default)]
+    pub title: Option<String>,
+    // Dashboard filters (`host=example.com`) under every widget.
+    #[serde(default)]
+    pub filters: Option<String>,
+    pub widgets: Vec<Widget>,
+}
+
+// A panel of a board. Its `filters` are added to the board's and the page's;
+// one on the same column replaces theirs.
+#[derive(Clone, Debug, Deserialize)]
+#[serde(tag = "widget", rename_all = "lowercase")]
+pub enum Widget {
+    // Today, the last 7 and 30 days and all time, as on the dashboard.
+    Headline,
+    // One card counting `metric` over the selected range.
+    Metric {
+        label: String,
+        #[serde(default)]
+        filters: Option<String>,
+        #[serde(default = "default_metric")]
+        metric: String,
+    },
+    Timeline {
+        #[serde(default)]
+        title: Option<String>,
+        #[serde(default)]
+        filters: Option<String>,
+    },
+    // The top 10 values of `column`, by page views or, with `uniques`, by
+    // unique visitors.
+    Table {
+        column: String,
+        #[serde(default)]
+        title: Option<String>,
+        #[serde(default)]
+        filters: Option<String>,
+        #[serde(default)]
+        uniques: bool,
+    },
+}
+
+fn default_metric() -> String {
+    "uniques".to_string()
+}
+
+impl Board {
+    pub fn label(&self) -> &str {
+        self.title.as_deref().unwrap_or(&self.name)
+    }
+}
+
+impl Widget {
+    fn filters(&self) -> Option<&str> {
+        match self {
+            Widget::Headline => None,
+            Widget::Metric { filters, .. } | Widget::Timeline { filters, .. } | Widget::Table { filters, .. } => {
+                filters.as_deref()
+            }
+        }
+    }
+
+    // The element consecutive widgets of this kind share, so cards line up in
+    // a row and tables in the grid.
+    fn container(&self) -> Option<&'static str> {
+        match self {
+            Widget::Metric { .. } => Some("cards"),
+            Widget::Table { .. } => Some("tables"),
+            Widget::Headline | Widget::Timeline { .. } => None,
+        }
+    }
+}
+
+// Reads the JSON array of boards from `path`.
+pub fn load(path: &str) -> Result<Vec<Board>, anyhow::Error> {
+    let text = std::fs::read_to_string(path).with_context(|| format!("read {}", path))?;
+    let boards: Vec<Board> = serde_json::from_str(&text).with_context(|| format!("parse {}", path))?;
+    let mut names = HashSet::new();
+    for board in &boards {
+        // The name is a URL path segment.
+        if board.name.is_empty()
+            || !board.name.chars().all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_')
+        {
+            anyhow::bail!("{}: board {:?} needs a name of letters, digits, - and _", path, board.name);
+        }
+        if !names.insert(board.name.as_str()) {
+            anyhow::bail!("{}: duplicate board {:?}", path, board.name);
+        }
+        if board.widgets.is_empty() {
+            anyhow::bail!("{}: board {:?} has no widgets", path, board.name);
+        }
+        for filters in std::iter::once(board.filters.as_deref()).chain(board.widgets.iter().map(Widget::filters)) {
+            if let Some(key) = unknown_filter(filters.unwrap_or_default()) {
+                anyhow::bail!("{}: board {:?} has unknown filter {:?}", path, board.name, key);
+            }
+        }
+        for widget in &board.widgets {
+            match widget {
+                Widget::Metric { metric, .. } if !matches!(metric.as_str(), "uniques" | "hits") => {
+                    anyhow::bail!("{}: board {:?} has unknown metric {:?}", path, board.name, metric);
+                }
+                Widget::Table { column, .. } if !schema::column(column).is_some_and(|c| c.filter) => {
+                    anyhow::bail!("{}: board {:?} has unknown table column {:?}", path, board.name, column);
+                }
+                _ => {}
+            }
+        }
+    }
+    Ok(boards)
+}
+
+fn unknown_filter(filters: &str) -> Option<String> {
+    parse_query(filters.to_string())
+        .into_keys()
+        .find(|key| schema::filter_column(key).is_none())
+}
+
+// `filters` with the ones parsed from `extra` on top.
+fn overlay(filters: &Filters, extra: Option<&str>) -> Filters {
+    let mut out = filters.clone();
+    if let Some(extra) = extra {
+        out.extend(extract_filters(&parse_query(extra.to_string())));
+    }
+    out
+}
+
+pub fn router(state: AppState) -> Router {
+    Router::new()
+        .route("/stats/boards/:name", get(board_handler))
+        .with_state(state)
+}
+
+async fn board_handler(
+    State(state): State<AppState>,
+    Path(name): Path<String>,
+    request_headers: HeaderMap,
+    RawQuery(raw): RawQuery,
+) -> Response {
+    let Some(board) = state.boards.iter().find(|board| board.name == name) else {
+        return StatusCode::NOT_FOUND.into_response();
+    };
+    let params = parse_query(raw.unwrap_or_default());
+    let page = format!("/stats/boards/{}", board.name);
+    let date = |key: &str| {
+        first_value(&params, key).and_then(|s| NaiveDate::parse_from_str(&s, "%Y-%m-%d").ok())
+    };
+    let (Some(from_date), Some(to_date)) = (date("from"), date("to")) else {
+        return dashboard::redirect_to_year(&page, &params).into_response();
+    };
+    let (types, _) = dashboard::timeline_types(&params, &request_headers);
+    // The board's filters, then the ones clicked on the page.
+    let mut filters = overlay(&HashMap::new(), board.filters.as_deref());
+    filters.extend(extract_filters(&params));
+    let (min_date, max_date) = dashboard::min_max_date(&state.store)
+        .await
+        .unwrap_or_else(|_| dashboard::default_year_range());
+
+    let mut body = String::new();
+    dashboard::append(&mut body, "<!DOCTYPE html>");
+    dashboard::append(&mut body, &format!("<html lang={}>", locale::current().tag));
+    dashboard::append(&mut body, "<head>");
+    dashboard::append(&mut body, "<meta charset=\"utf-8\">");
+    dashboard::append(&mut body, "<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">");
+    dashboard::append(&mut body, &format!("<title>{}</title>", escape_html(board.label())));
+    if let Some(font_face) = assets::font_face_css(state.system_fonts) {
+        dashboard::append(&mut body, &format!("<style>{}</style>", font_face));
+    }
+    dashboard::append(&mut body, &assets::style_tag(false));
+    dashboard::append(&mut body, &assets::script_tag(false));
+    dashboard::append(&mut body, "</head>");
+    dashboard::append(&mut body, "<body>");
+
+    dashboard::append(&mut body, "<div class=filters>");
+    dashboard::append(
+        &mut body,
+        &format!(
+            "<a class=filter href='/stats?{}'>&larr; Dashboard</a><span class='filter in'>{}</span>",
+            escape_html(&dashboard::encode_params(&params)),
+            escape_html(board.label())
+        ),
+    );
+    dashboard::append_year_filters(&mut body, &params, from_date, to_date, min_date, max_date);
+    dashboard::append_active_filters(&mut body, &params);
+    dashboard::append(&mut body, "</div>");
+
+    let today = Utc::now().date_naive();
+    let widgets = async {
+        let mut open: Option<&str> = None;
+        for widget in &board.widgets {
+            if open != widget.container() {
+                if open.is_some() {
+                    dashboard::append(&mut body, "</div>");
+                }
+                open = widget.container();
+                if let Some(class) = open {
+                    dashboard::append(&mut body, &format!("<div class={}>", class));
+                }
+            }
+            let filters = overlay(&filters, widget.filters());
+            append_widget(&mut body, &state.store, widget, &filters, &params, &types, from_date, to_date, today).await;
+        }
+        if open.is_some() {
+            dashboard::append(&mut body, "</div>");
+        }
+    };
+    if let Err(limit) = dashboard::within_deadline(&state, widgets).await {
+        return dashboard::range_too_large(&page, &params, from_date, to_date, limit);
+    }
+
+    dashboard::append(&mut body, "</body>");
+    dashboard::append(&mut body, "</html>");
+    ([("Content-Type", "text/html; charset=utf-8")], body).into_response()
+}
+
+// The widget engine: renders one widget with the dashboard's own panels.
+async fn append_widget(
+    out: &mut String,
+    store: &Store,
+    widget: &Widget,
+    filters: &Filters,
+    params: &HashMap<String, Vec<String>>,
+    types: &[&str],
+    from_date: NaiveDate,
+    to_date: NaiveDate,
+    today: NaiveDate,
+) {
+    let from_str = from_date.format("%Y-%m-%d").to_string();
+    let to_str = to_date.format("%Y-%m-%d").to_string();
+    let (mut where_clause, args) = build_where(&from_str, &to_str, filters);
+    match widget {
+        Widget::Headline => {
+            let headline = growth::headline(store, filters, today).await.unwrap_or_else(|err| {
+                dashboard::append_error(out, "Headline", &err);
+                Vec::new()
+            });
+            dashboard::append_headline(out, &headline);
+        }
+        Widget::Metric { label, metric, .. } => {
+            let value = match count(store, metric, filters, where_clause, args).await {
+                Ok(n) => dashboard::format_number(n),
+                Err(err) => {
+                    eprintln!("board metric query failed: {:#}", err);
+                    "<span class=error title='Could not be loaded; the sidecar log has the details'>&ndash;</span>"
+                        .to_string()
+                }
+            };
+            dashboard::append(
+                out,
+                &format!(
+                    "<div class=card><div class=label>{}</div><div class=value>{}</div></div>",
+                    escape_html(label),
+                    value
+                ),
+            );
+        }
+        Widget::Timeline { title, .. } => {
+            if let Some(title) = title {
+                dashboard::append(out, &format!("<h1>{}</h1>", escape_html(title)));
+            }
+            let visits = dashboard::visits_by_type_date(store, &where_clause, &args).await;
+            let totals = dashboard::total_uniq(store, &where_clause, &args).await;
+            let (visits, totals) = match (visits, totals) {
+                (Ok(visits), Ok(totals)) => (visits, totals),
+                (Err(err), _) | (_, Err(err)) => {
+                    dashboard::append_error(out, title.as_deref().unwrap_or("Timeline"), &err);
+                    return;
+                }
+            };
+            let summary = visits
+                .get("browser")
+                .and_then(|counts| daily::summarize(counts, from_date, to_date, today));
+            dashboard::append_timelines(
+                out,
+                &visits,
+                &totals,
+                params,
+                types,
+                from_date,
+                to_date,
+                dashboard::bar_width(from_date, to_date, false),
+                summary.as_ref(),
+                None,
+                &[],
+            );
+        }
+        Widget::Table { column, title, uniques, .. } => {
+            if !has_type_filter(filters) {
+                where_clause.push_str(" AND type = 'browser'");
+            }
+            let title = escape_html(title.as_deref().unwrap_or(column));
+            if *uniques {
+                dashboard::append_table_uniq(out, store, &title, column, &where_clause, &args, params, column).await;
+            } else {
+                dashboard::append_table(
+                    out,
+                    store,
+                    &title,
+                    column,
+                    &where_clause,
+                    &args,
+                    params,
+                    column,
+                    None,
+                    "",
+                    &HashMap::new(),
+                )
+                .await;
+            }
+        }
+    }
+}
+
+fn has_type_filter(filters: &Filters) -> bool {
+    filters.contains_key("type") || filters.contains_key("type!")
+}
+
+// Page views, or unique visitors counting browsers unless a type filter is
+// set, as in the reports.
+async fn count(
+    store: &Store,
+    metric: &str,
+    filters: &Filters,
+    mut where_clause: String,
+    args: Vec<String>,
+) -> Result<i64, anyhow::Error> {
+    let query = if metric == "hits" {
+        format!("SELECT COUNT(*) FROM stats WHERE {}", where_clause)
+    } else {
+        if !has_type_filter(filters) {
+            where_clause.push_str(" AND type = 'browser'");
+        }
+        format!(
+            "SELECT COALESCE(SUM(mult), 0)
+             FROM (SELECT MAX(mult) AS mult FROM stats WHERE {} GROUP BY uniq)",
+            where_clause
+        )
+    };
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let n: i64 = stmt.query_row(params_from_iter(args.iter().map(|s| s.as_str())), |row| row.get(0))?;
+            Ok(n)
+        })
+        .await
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn widget_filters_replace_board_filters_per_column() {
+        let board = overlay(&HashMap::new(), Some("host=example.com&path=/blog/*"));
+        let widget = overlay(&board, Some("path=/pricing&ref_domain=google.com&bogus=1"));
+        assert_eq!(widget["host"], ["example.com"]);
+        assert_eq!(widget["path"], ["/pricing"]);
+        assert_eq!(widget["ref_domain"], ["google.com"]);
+        assert!(!widget.contains_key("bogus"));
+
+        assert_eq!(unknown_filter("path=/a&path!=/b&os=Linux"), None);
+        assert_eq!(unknown_filter("path=/a&colour=red").as_deref(), Some("colour"));
+    }
+}
@@ -0,0 +1,245 @@
+use crate::analyzer::{self, Line};
+use crate::store::Store;
+use chrono::{Duration as ChronoDuration, Utc};
+use std::collections::{HashMap, HashSet, VecDeque};
+use std::ffi::CStr;
+use std::net::{IpAddr, SocketAddr, ToSocketAddrs};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+// Search engines that publish the reverse DNS names of their crawlers: the
+// agent the analyzer derives and the domains those names end in.
+const CRAWLERS: &[(&str, &[&str])] = &[
+    ("Googlebot", &["googlebot.com", "google.com", "googleusercontent.com"]),
+    ("bingbot", &["search.msn.com"]),
+    ("Applebot", &["applebot.apple.com"]),
+    ("YandexBot", &["yandex.ru", "yandex.net", "yandex.com"]),
+    ("Baiduspider", &["baidu.com", "baidu.jp"]),
+];
+
+// Appended to the agent of crawlers that failed verification, so the
+// Scrapers table lists them apart from the genuine ones.
+const IMPOSTOR_SUFFIX: &str = " (impostor)";
+
+// Results are kept this long, then looked up again.
+const CACHE_TTL: Duration = Duration::from_secs(24 * 3600);
+const MAX_CACHED: usize = 50_000;
+// Lookups waiting for the worker; more are dropped and retried the next time
+// the address shows up.
+const QUEUE_SIZE: usize = 1000;
+
+#[derive(Clone, Copy, Debug)]
+pub struct Options {
+    // Most lookups started per second.
+    pub rate: u32,
+}
+
+#[derive(Default)]
+pub struct Verifier {
+    cache: Mutex<HashMap<String, (bool, Instant)>>,
+    // Addresses queued or being looked up, with the crawler they claim.
+    queue: Mutex<Lookups>,
+}
+
+#[derive(Default)]
+struct Lookups {
+    waiting: VecDeque<(String, &'static str)>,
+    pending: HashSet<String>,
+}
+
+impl Verifier {
+    // Sets verified_bot on lines of the listed crawlers whose address was
+    // looked up recently, and queues a lookup for the others; those rows are
+    // updated once it finishes.
+    pub fn check(&self, line: &mut Line) {
+        analyzer::analyze(line);
+        let Some(agent) = claimed_crawler(&line.agent) else {
+            return;
+        };
+        if !is_complete_ip(&line.ip) {
+            return;
+        }
+        let cached = {
+            let cache = self.cache.lock().expect("bot cache lock");
+            cache
+                .get(&line.ip)
+                .filter(|(_, at)| at.elapsed() < CACHE_TTL)
+                .map(|(verified, _)| *verified)
+        };
+        match cached {
+            Some(verified) => mark(line, verified),
+            None => {
+                let mut queue = self.queue.lock().expect("bot queue lock");
+                if queue.waiting.len() < QUEUE_SIZE && queue.pending.insert(line.ip.clone()) {
+                    queue.waiting.push_back((line.ip.clone(), agent));
+                }
+            }
+        }
+    }
+
+    fn remember(&self, ip: &str, verified: bool) {
+        let mut cache = self.cache.lock().expect("bot cache lock");
+        if cache.len() >= MAX_CACHED {
+            cache.retain(|_, (_, at)| at.elapsed() < CACHE_TTL);
+            if cache.len() >= MAX_CACHED {
+                cache.clear();
+            }
+        }
+        cache.insert(ip.to_string(), (verified, Instant::now()));
+    }
+
+    fn next_lookup(&self) -> Option<(String, &'static str)> {
+        self.queue.lock().expect("bot queue lock").waiting.pop_front()
+    }
+
+    fn done(&self, ip: &str) {
+        self.queue.lock().expect("bot queue lock").pending.remove(ip);
+    }
+}
+
+fn mark(line: &mut Line, verified: bool) {
+    line.verified_bot = Some(verified);
+    if !verified {
+        line.agent.push_str(IMPOSTOR_SUFFIX);
+    }
+}
+
+fn claimed_crawler(agent: &str) -> Option<&'static str> {
+    CRAWLERS.iter().find(|(name, _)| *name == agent).map(|(name, _)| *name)
+}
+
+fn crawler_domains(agent: &str) -> &'static [&'static str] {
+    CRAWLERS
+        .iter()
+        .find(|(name, _)| *name == agent)
+        .map(|(_, domains)| *domains)
+        .unwrap_or_default()
+}
+
+// The middleware truncates IPv6 addresses to a prefix (ipv6PrefixLength);
+// those name a network rather than the crawler and cannot be looked up.
+fn is_complete_ip(ip: &str) -> bool {
+    match ip.parse::<IpAddr>() {
+        Ok(IpAddr::V4(_)) => true,
+        Ok(IpAddr::V6(v6)) => v6.segments()[4..].iter().any(|s| *s != 0),
+        Err(_) => false,
+    }
+}
+
+// Looks up queued addresses, at most `rate` per second, and records the
+// result on the rows stored meanwhile.
+pub async fn run(store: Arc<Store>, verifier: Arc<Verifier>, options: Options) {
+    let mut ticker = tokio::time::interval(Duration::from_secs(1) / options.rate.max(1));
+    ticker.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Delay);
+    loop {
+        ticker.tick().await;
+        let Some((ip, agent)) = verifier.next_lookup() else {
+            continue;
+        };
+        let lookup_ip = ip.clone();
+        let result = tokio::task::spawn_blocking(move || verify(&lookup_ip, crawler_domains(agent)))
+            .await
+            .map_err(std::io::Error::other)
+            .and_then(|result| result);
+        let verified = match result {
+            Ok(verified) => verified,
+            Err(err) => {
+                // Resolver trouble says nothing about the crawler; it is
+                // looked up again the next time it shows up.
+                eprintln!("bot verification of {} failed: {}", ip, err);
+                verifier.done(&ip);
+                continue;
+            }
+        };
+        verifier.remember(&ip, verified);
+        verifier.done(&ip);
+        let set = if verified {
+            "verified_bot = true".to_string()
+        } else {
+            format!("verified_bot = false, agent = agent || '{}'", IMPOSTOR_SUFFIX)
+        };
+        // Rows of the last two days are enough: the lookup follows the
+        // request within seconds unless the queue was backed up.
+        let since = (Utc::now() - ChronoDuration::days(1)).format("%Y-%m-%d").to_string();
+        let sql = format!(
+            "UPDATE {{stats}} SET {}
+             WHERE ip = ? AND agent = ? AND verified_bot IS NULL AND date >= CAST(? AS DATE)",
+            set
+        );
+        if let Err(err) = store
+            .update_stats(sql, vec![ip.clone(), agent.to_string(), since])
+            .await
+        {
+            eprintln!("bot verification of {} not stored: {}", ip, err);
+        }
+    }
+}
+
+// Reverse-resolves `ip`, checks the name is under one of `domains` and that
+// it resolves forward to the same address. Err means the reverse lookup
+// failed, not that the check did.
+fn verify(ip: &str, domains: &[&str]) -> Result<bool, std::io::Error> {
+    let addr: IpAddr = ip
+        .parse()
+        .map_err(|_| std::io::Error::other(format!("invalid address {}", ip)))?;
+    let Some(name) = reverse_lookup(addr)? else {
+        return Ok(false);
+    };
+    let name = name.trim_end_matches('.').to_ascii_lowercase();
+    if !domains
+        .iter()
+        .any(|domain| name == *domain || name.ends_with(&format!(".{}", domain)))
+    {
+        return Ok(false);
+    }
+    // A name that does not resolve back is as good as a forged one.
+    Ok((name.as_str(), 0)
+        .to_socket_addrs()
+        .map(|mut addrs| addrs.any(|a| a.ip() == addr))
+        .unwrap_or(false))
+}
+
+// The PTR name of `ip`, None when it has none.
+fn reverse_lookup(ip: IpAddr) -> Result<Option<String>, std::io::Error> {
+    let mut storage: libc::sockaddr_storage = unsafe { std::mem::zeroed() };
+    let len = match SocketAddr::new(ip, 0) {
+        SocketAddr::V4(v4) => {
+            let sin = unsafe { &mut *(&mut storage as *mut _ as *mut libc::sockaddr_in) };
+            sin.sin_family = libc::AF_INET as libc::sa_family_t;
+            sin.sin_addr = libc::in_addr {
+                s_addr: u32::from_ne_bytes(v4.ip().octets()),
+            };
+            std::mem::size_of::<libc::sockaddr_in>()
+        }
+        SocketAddr::V6(v6) => {
+            let sin6 = unsafe { &mut *(&mut storage as *mut _ as *mut libc::sockaddr_in6) };
+            sin6.sin6_family = libc::AF_INET6 as libc::sa_family_t;
+            sin6.sin6_addr = libc::in6_addr {
+                s6_addr: v6.ip().octets(),
+            };
+            std::mem::size_of::<libc::sockaddr_in6>()
+        }
+    };
+    let mut host = [0 as libc::c_char; 1025];
+    let rc = unsafe {
+        libc::getnameinfo(
+            &storage as *const _ as *const libc::sockaddr,
+            len as libc::socklen_t,
+            host.as_mut_ptr(),
+            host.len() as libc::socklen_t,
+            std::ptr::null_mut(),
+            0,
+            libc::NI_NAMEREQD,
+        )
+    };
+    match rc {
+        0 => Ok(Some(
+            unsafe { CStr::from_ptr(host.as_ptr()) }.to_string_lossy().into_owned(),
+        )),
+        libc::EAI_NONAME => Ok(None),
+        _ => {
+            let msg = unsafe { CStr::from_ptr(libc::gai_strerror(rc)) };
+            Err(std::io::Error::other(msg.to_string_lossy().into_owned()))
+        }
+    }
+}
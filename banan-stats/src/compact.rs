@@ -0,0 +1,82 @@
+use crate::audit;
+use crate::store::{Store, STATS_COLUMNS};
+
+// Rows count as duplicates when every column matches; rows with an event_id
+// never do, as its unique index keeps them apart.
+fn duplicate_key() -> String {
+    format!("{}, deleted_at", STATS_COLUMNS)
+}
+
+pub struct Report {
+    // Days with duplicates and the extra copies of their rows, oldest first.
+    pub days: Vec<(String, i64)>,
+    // Rows removed; zero for a dry run.
+    pub removed: usize,
+}
+
+impl Report {
+    pub fn duplicates(&self) -> i64 {
+        self.days.iter().map(|(_, copies)| copies).sum()
+    }
+}
+
+pub async fn find_duplicates(store: &Store) -> Result<Vec<(String, i64)>, anyhow::Error> {
+    let query = format!(
+        "SELECT CAST(date AS VARCHAR), CAST(SUM(copies - 1) AS BIGINT)
+         FROM (
+             SELECT date, COUNT(*) AS copies
+             FROM stats
+             GROUP BY {}
+             HAVING COUNT(*) > 1
+         )
+         GROUP BY date
+         ORDER BY date",
+        duplicate_key()
+    );
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query([])?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                out.push((row.get::<_, Option<String>>(0)?.unwrap_or_default(), row.get(1)?));
+            }
+            Ok(out)
+        })
+        .await
+}
+
+// Keeps the first copy of every duplicated row. Each table is cleaned up by a
+// single DELETE, so a failure leaves it untouched.
+pub async fn remove_duplicates(store: &Store) -> Result<usize, anyhow::Error> {
+    store
+        .update_stats(
+            format!(
+                "DELETE FROM {{stats}} WHERE rowid IN (
+                     SELECT rowid FROM (
+                         SELECT rowid, row_number() OVER (PARTITION BY {} ORDER BY rowid) AS copy
+                         FROM {{stats}}
+                     )
+                     WHERE copy > 1
+                 )",
+                duplicate_key()
+            ),
+            Vec::new(),
+        )
+        .await
+}
+
+// Reports duplicate rows and, unless `dry_run`, removes them and checkpoints
+// the database.
+pub async fn run(store: &Store, dry_run: bool) -> Result<Report, anyhow::Error> {
+    let days = find_duplicates(store).await?;
+    if dry_run {
+        return Ok(Report { days, removed: 0 });
+    }
+    let removed = if days.is_empty() { 0 } else { remove_duplicates(store).await? };
+    if removed > 0 {
+        audit::log(store, "compact", "dedupe", "exact duplicates", removed).await;
+    }
+    store.checkpoint().await?;
+    Ok(Report { days, removed })
+}
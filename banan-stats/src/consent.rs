@@ -0,0 +1,57 @@
+use crate::store::Store;
+use duckdb::params_from_iter;
+
+pub struct ConsentShare {
+    pub level: String,
+    pub page_views: i64,
+    pub visitors: i64,
+}
+
+// Browser page views and daily visitors per consent level the middleware
+// tracked at, most exact first. Empty when no event in the range carried a level.
+// `where_clause` comes from build_where.
+pub async fn shares(
+    store: &Store,
+    where_clause: &str,
+    args: &[String],
+) -> Result<Vec<ConsentShare>, anyhow::Error> {
+    let query = format!(
+        "WITH subq AS (
+             SELECT consent, date, uniq, COUNT(*) AS hits
+             FROM stats
+             WHERE {} AND type = 'browser' AND consent IS NOT NULL
+             GROUP BY consent, date, uniq
+         )
+         SELECT consent, CAST(SUM(hits) AS BIGINT), COUNT(*)
+         FROM subq
+         GROUP BY consent
+         ORDER BY CASE consent WHEN 'full' THEN 0 WHEN 'cookieless' THEN 1 ELSE 2 END",
+        where_clause
+    );
+    let args = args.to_owned();
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                out.push(ConsentShare {
+                    level: row.get(0)?,
+                    page_views: row.get(1)?,
+                    visitors: row.get(2)?,
+                });
+            }
+            Ok(out)
+        })
+        .await
+}
+
+// What the visitor counts of a level are worth.
+pub fn describe(level: &str) -> &'static str {
+    match level {
+        "full" => "exact: cookie set and read",
+        "cookieless" => "estimated: daily hash of IP and User-Agent",
+        "none" => "upper bound: every page view counts as a visitor",
+        _ => "",
+    }
+}
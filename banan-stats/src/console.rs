@@ -0,0 +1,325 @@
+use crate::admin;
+use crate::assets;
+use crate::dashboard::{clone_params, encode_params, escape_html, first_value, parse_query};
+use crate::events::csv_field;
+use crate::state::AppState;
+use crate::store::Store;
+use axum::{
+    extract::{RawQuery, State},
+    http::{HeaderMap, StatusCode},
+    response::{IntoResponse, Response},
+    routing::get,
+    Router,
+};
+use chrono::{NaiveDate, NaiveDateTime};
+use duckdb::types::Value;
+use duckdb::{params_from_iter, Connection};
+use std::fmt::Write;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::Duration;
+
+#[derive(Clone, Copy, Debug)]
+pub struct Options {
+    // Most rows a query returns; the rest are cut off.
+    pub max_rows: usize,
+    // How long the page waits for a query before giving up on it.
+    pub timeout: Duration,
+}
+
+// Set while a console query runs. DuckDB cannot cancel it from here, so a
+// query that timed out keeps this set until it finishes and new ones are
+// turned away meanwhile.
+static RUNNING: AtomicBool = AtomicBool::new(false);
+
+struct RunningGuard;
+
+impl Drop for RunningGuard {
+    fn drop(&mut self) {
+        RUNNING.store(false, Ordering::SeqCst);
+    }
+}
+
+pub fn router(state: AppState) -> Router {
+    Router::new()
+        .route("/stats/console", get(console_handler))
+        .with_state(state)
+}
+
+pub struct QueryResult {
+    pub columns: Vec<String>,
+    pub rows: Vec<Vec<String>>,
+    // More rows were available than max_rows.
+    pub truncated: bool,
+}
+
+// Runs one SELECT on a separate connection. The SQL is wrapped in a
+// subquery, so anything but a single query fails to prepare, and runs in a
+// transaction that is always rolled back, so nothing can be written through
+// the console; the store keeps files outside the database out of reach.
+pub async fn run_query(store: &Store, sql: &str, options: Options) -> Result<QueryResult, anyhow::Error> {
+    let sql = sql.trim().trim_end_matches(';').trim();
+    if sql.is_empty() {
+        anyhow::bail!("empty query");
+    }
+    if RUNNING.swap(true, Ordering::SeqCst) {
+        anyhow::bail!("another console query is still running");
+    }
+    let guard = RunningGuard;
+    let sql = sql.to_string();
+    let max_rows = options.max_rows;
+    let task = store.with_separate_conn(move |conn| {
+        let _guard = guard;
+        select_rows(conn, &sql, &[], max_rows)
+    });
+    match tokio::time::timeout(options.timeout, task).await {
+        Ok(result) => result,
+        Err(_) => anyhow::bail!("query timed out after {}s", options.timeout.as_secs()),
+    }
+}
+
+// Runs `sql` as a subquery in a transaction that is rolled back afterwards
+// and returns up to max_rows rows as text; also used by scheduled reports.
+pub fn select_rows(
+    conn: &Connection,
+    sql: &str,
+    args: &[String],
+    max_rows: usize,
+) -> Result<QueryResult, anyhow::Error> {
+    conn.execute_batch("BEGIN TRANSACTION")?;
+    let result = query_rows(conn, sql, args, max_rows);
+    let rollback = conn.execute_batch("ROLLBACK");
+    let result = result?;
+    rollback?;
+    Ok(result)
+}
+
+fn query_rows(
+    conn: &Connection,
+    sql: &str,
+    args: &[String],
+    max_rows: usize,
+) -> Result<QueryResult, anyhow::Error> {
+    let query = format!("SELECT * FROM (\n{}\n) AS console LIMIT {}", sql, max_rows + 1);
+    let mut stmt = conn.prepare(&query)?;
+    let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+    let columns = rows.as_ref().map(|s| s.column_names()).unwrap_or_default();
+    let mut out = Vec::new();
+    while let Some(row) = rows.next()? {
+        let mut values = Vec::with_capacity(columns.len());
+        for idx in 0..columns.len() {
+            values.push(format_value(row, idx)?);
+        }
+        out.push(values);
+    }
+    let truncated = out.len() > max_rows;
+    out.truncate(max_rows);
+    Ok(QueryResult {
+        columns,
+        rows: out,
+        truncated,
+    })
+}
+
+fn format_value(row: &duckdb::Row<'_>, idx: usize) -> Result<String, anyhow::Error> {
+    let value: Value = row.get(idx)?;
+    Ok(match value {
+        Value::Null => String::new(),
+        Value::Boolean(v) => v.to_string(),
+        Value::TinyInt(v) => v.to_string(),
+        Value::SmallInt(v) => v.to_string(),
+        Value::Int(v) => v.to_string(),
+        Value::BigInt(v) => v.to_string(),
+        Value::HugeInt(v) => v.to_string(),
+        Value::UTinyInt(v) => v.to_string(),
+        Value::USmallInt(v) => v.to_string(),
+        Value::UInt(v) => v.to_string(),
+        Value::UBigInt(v) => v.to_string(),
+        Value::Float(v) => v.to_string(),
+        Value::Double(v) => v.to_string(),
+        Value::Text(v) => v,
+        Value::Date32(_) => row.get::<_, NaiveDate>(idx)?.format("%Y-%m-%d").to_string(),
+        Value::Timestamp(..) => row
+            .get::<_, NaiveDateTime>(idx)?
+            .format("%Y-%m-%d %H:%M:%S")
+            .to_string(),
+        other => format!("{:?}", other),
+    })
+}
+
+async fn console_handler(
+    State(state): State<AppState>,
+    headers: HeaderMap,
+    RawQuery(raw): RawQuery,
+) -> Response {
+    if let Err(resp) = admin::authorize(&state, &headers) {
+        return resp;
+    }
+    let params = parse_query(raw.unwrap_or_default());
+    let sql = first_value(&params, "q").unwrap_or_default();
+    let csv = first_value(&params, "format").as_deref() == Some("csv");
+    let result = if sql.trim().is_empty() {
+        None
+    } else {
+        Some(run_query(&state.store, &sql, state.console).await)
+    };
+
+    if csv {
+        return match result {
+            Some(Ok(result)) => render_csv(&result),
+            Some(Err(err)) => (StatusCode::BAD_REQUEST, err.to_string()).into_response(),
+            None => (StatusCode::BAD_REQUEST, "missing q").into_response(),
+        };
+    }
+
+    let mut body = String::new();
+    let mut out = |s: &str| {
+        let _ = writeln!(body, "{}", s);
+    };
+    out("<!DOCTYPE html>");
+    out("<html>");
+    out("<head>");
+    out("<meta charset=\"utf-8\">");
+    out("<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">");
+    out(&assets::style_tag(false));
+    out("</head>");
+    out("<body>");
+    out("<div class=filters>");
+    out("<a class=filter href='/stats'>&larr; Dashboard</a>");
+    if matches!(result, Some(Ok(_))) {
+        let mut download = clone_params(&params);
+        download.insert("format".to_string(), vec!["csv".to_string()]);
+        out(&format!(
+            "<a class=filter href='?{}'>Download CSV</a>",
+            escape_html(&encode_params(&download))
+        ));
+    }
+    out("</div>");
+    out("<h1>SQL console</h1>");
+    out("<form class=console method=get>");
+    out(&format!(
+        "<textarea name=q rows=8 spellcheck=false placeholder='SELECT path, COUNT(*) FROM stats GROUP BY ALL ORDER BY 2 DESC'>{}</textarea>",
+        escape_html(&sql)
+    ));
+    out("<button type=submit>Run</button>");
+    out("</form>");
+    out(&format!(
+        "<p>One read-only query against the <code>stats</code> view and the other tables, at most {} rows and {} seconds.</p>",
+        state.console.max_rows,
+        state.console.timeout.as_secs()
+    ));
+    match &result {
+        Some(Err(err)) => out(&format!("<div class=notice>{}</div>", escape_html(&err.to_string()))),
+        Some(Ok(result)) => {
+            if result.truncated {
+                out(&format!(
+                    "<div class=notice>Showing the first {} rows.</div>",
+                    state.console.max_rows
+                ));
+            }
+            out("<table class=rows>");
+            let header: String = result
+                .columns
+                .iter()
+                .map(|c| format!("<th>{}</th>", escape_html(c)))
+                .collect();
+            out(&format!("<tr>{}</tr>", header));
+            for row in &result.rows {
+                let cells: String = row
+                    .iter()
+                    .map(|v| format!("<td title='{}'>{}</td>", escape_html(v), escape_html(v)))
+                    .collect();
+                out(&format!("<tr>{}</tr>", cells));
+            }
+            out("</table>");
+        }
+        None => {}
+    }
+    out("</body>");
+    out("</html>");
+
+    let mut headers = HeaderMap::new();
+    headers.insert(
+        "Content-Type",
+        "text/html; charset=utf-8".parse().expect("header"),
+    );
+    (headers, body).into_response()
+}
+
+fn render_csv(result: &QueryResult) -> Response {
+    let mut body = String::new();
+    let header = result.columns.iter().map(|c| csv_field(c)).collect::<Vec<_>>().join(",");
+    let _ = writeln!(body, "{}", header);
+    for row in &result.rows {
+        let line = row.iter().map(|v| csv_field(v)).collect::<Vec<_>>().join(",");
+        let _ = writeln!(body, "{}", line);
+    }
+    let mut headers = HeaderMap::new();
+    headers.insert(
+        "Content-Type",
+        "text/csv; charset=utf-8".parse().expect("header"),
+    );
+    headers.insert(
+        "Content-Disposition",
+        "attachment; filename=\"query.csv\"".parse().expect("header"),
+    );
+    (headers, body).into_response()
+}
+
+#[cfg(test)]
+pub mod tests {
+    use super::*;
+    use crate::analyzer::Line;
+    use crate::store;
+    use chrono::{Datelike, Utc};
+
+    // A store partitioned by year with one browser hit in 2023 and one in
+    // 2024, both kept in the current year's partition as only it and the
+    // next are attached.
+    pub async fn partitioned_store(name: &str) -> Store {
+        let dir = std::env::temp_dir().join(format!("banan-stats-{}-{}", name, std::process::id()));
+        let _ = std::fs::remove_dir_all(&dir);
+        std::fs::create_dir_all(&dir).unwrap();
+        let options = store::Options {
+            partition_by_year: true,
+            ..Default::default()
+        };
+        let store = Store::open(dir.join("stats.duckdb").to_str().unwrap(), options).unwrap();
+        let line = |event_id: &str, date: &str| Line {
+            event_id: event_id.to_string(),
+            date: date.to_string(),
+            time: "12:00:00".to_string(),
+            path: "/".to_string(),
+            ip: "192.0.2.1".to_string(),
+            user_agent: "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0".to_string(),
+            ..Default::default()
+        };
+        store
+            .insert(vec![line("a", "2023-06-01"), line("b", "2024-01-01")])
+            .await
+            .unwrap();
+        store
+    }
+
+    #[tokio::test]
+    async fn queries_every_partition_but_writes_nothing() {
+        let store = partitioned_store("console").await;
+        let options = Options {
+            max_rows: 10,
+            timeout: Duration::from_secs(10),
+        };
+        let count = "SELECT COUNT(*) AS hits FROM stats";
+        assert_eq!(run_query(&store, count, options).await.unwrap().rows, [["2"]]);
+        let table = format!("y{}.stats", Utc::now().year());
+        for sql in [
+            "SELECT * FROM read_csv('/etc/hostname')".to_string(),
+            "COPY (SELECT 1) TO '/tmp/banan-stats-console.csv'".to_string(),
+            format!("DELETE FROM {}", table),
+            format!("SELECT 1; DELETE FROM {}", table),
+            format!("INSERT INTO {} (event_id) VALUES ('c')", table),
+            "CREATE TABLE copied AS SELECT * FROM stats".to_string(),
+        ] {
+            assert!(run_query(&store, &sql, options).await.is_err(), "{} ran", sql);
+        }
+        assert_eq!(run_query(&store, count, options).await.unwrap().rows, [["2"]]);
+    }
+}
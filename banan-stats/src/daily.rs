@@ -0,0 +1,269 @@
+use crate::dashboard::{build_where, Filters};
+use crate::growth;
+use crate::store::Store;
+use chrono::{Duration, NaiveDate};
+use serde::Serialize;
+use std::collections::HashMap;
+
+#[derive(Clone, Serialize)]
+pub struct DayCount {
+    pub date: String,
+    pub uniques: i64,
+}
+
+// How daily unique visitors were spread over a range.
+#[derive(Clone, Serialize)]
+pub struct DailySummary {
+    // Days the figures cover.
+    pub days: i64,
+    // The record day; the earliest one on a tie.
+    pub best: DayCount,
+    pub worst: DayCount,
+    pub p25: i64,
+    pub median: i64,
+    pub p75: i64,
+    pub p90: i64,
+}
+
+// Summarizes `counts`, unique visitors per date, over the complete days of
+// `from`..=`to`: from the first day with visitors, so a site launched
+// mid-range does not get zero worst days, to `to` or yesterday, as today is
+// not over yet. Days without visitors in between count as zero. None when no
+// such day is left.
+pub fn summarize(
+    counts: &HashMap<NaiveDate, i64>,
+    from: NaiveDate,
+    to: NaiveDate,
+    today: NaiveDate,
+) -> Option<DailySummary> {
+    let first = counts.keys().filter(|d| **d >= from).min()?.to_owned();
+    let last = to.min(today - Duration::days(1));
+    if first > last {
+        return None;
+    }
+    let mut days = Vec::new();
+    let mut date = first;
+    while date <= last {
+        days.push((date, *counts.get(&date).unwrap_or(&0)));
+        date += Duration::days(1);
+    }
+    let day = |(date, uniques): (NaiveDate, i64)| DayCount {
+        date: date.format("%Y-%m-%d").to_string(),
+        uniques,
+    };
+    let best = days.iter().copied().reduce(|a, b| if b.1 > a.1 { b } else { a })?;
+    let worst = days.iter().copied().reduce(|a, b| if b.1 < a.1 { b } else { a })?;
+    let mut sorted: Vec<i64> = days.iter().map(|(_, n)| *n).collect();
+    sorted.sort_unstable();
+    Some(DailySummary {
+        days: sorted.len() as i64,
+        best: day(best),
+        worst: day(worst),
+        p25: percentile(&sorted, 25),
+        median: percentile(&sorted, 50),
+        p75: percentile(&sorted, 75),
+        p90: percentile(&sorted, 90),
+    })
+}
+
+// Nearest-rank percentile of a sorted, non-empty slice.
+fn percentile(sorted: &[i64], p: usize) -> i64 {
+    let rank = (p * sorted.len()).div_ceil(100).max(1);
+    sorted[rank - 1]
+}
+
+// Queries daily unique visitors and summarizes them; `where_clause` comes
+// from build_where.
+pub async fn summary(
+    store: &Store,
+    from: NaiveDate,
+    to: NaiveDate,
+    today: NaiveDate,
+    where_clause: &str,
+    args: &[String],
+) -> Result<Option<DailySummary>, anyhow::Error> {
+    let counts = daily_counts(store, where_clause, args).await?;
+    Ok(summarize(&counts, from, to, today))
+}
+
+async fn daily_counts(
+    store: &Store,
+    where_clause: &str,
+    args: &[String],
+) -> Result<HashMap<NaiveDate, i64>, anyhow::Error> {
+    let periods = growth::uniques_by(store, "day", where_clause, args).await?;
+    Ok(periods
+        .into_iter()
+        .filter_map(|p| {
+            let date = NaiveDate::parse_from_str(&p.period, "%Y-%m-%d").ok()?;
+            Some((date, p.uniques))
+        })
+        .collect())
+}
+
+// Days a day is compared against: the ones right before it.
+pub const TRAILING_DAYS: i64 = 28;
+
+// Days of history a day needs before it is judged.
+const MIN_TRAILING_DAYS: usize = 14;
+
+// A day whose unique visitors are far from the median of the days before it.
+pub struct Outlier {
+    pub date: NaiveDate,
+    pub uniques: i64,
+    pub median: f64,
+    // Distance from the median in median absolute deviations.
+    pub mads: f64,
+}
+
+impl Outlier {
+    pub fn is_high(&self) -> bool {
+        self.uniques as f64 > self.median
+    }
+
+    pub fn reason(&self) -> String {
+        format!(
+            "{:.1} MADs {} the {}-day median of {:.0}",
+            self.mads,
+            if self.is_high() { "above" } else { "below" },
+            TRAILING_DAYS,
+            self.median
+        )
+    }
+}
+
+// Complete days of `from`..=`to` more than `threshold` median absolute
+// deviations away from the median of their TRAILING_DAYS days. The trailing
+// days start at the first day with visitors; days without visitors after it
+// count as zero. The deviation is at least 5% of the median and at least one
+// visitor, so a flat or two-valued series, whose MAD is 0, does not flag every
+// small change. Empty when `threshold` is 0.
+pub fn outliers(
+    counts: &HashMap<NaiveDate, i64>,
+    from: NaiveDate,
+    to: NaiveDate,
+    today: NaiveDate,
+    threshold: f64,
+) -> Vec<Outlier> {
+    let mut out = Vec::new();
+    let Some(first) = counts.keys().min().copied().filter(|_| threshold > 0.0) else {
+        return out;
+    };
+    let count = |date: NaiveDate| *counts.get(&date).unwrap_or(&0) as f64;
+    let last = to.min(today - Duration::days(1));
+    let mut date = from.max(first);
+    while date <= last {
+        let trailing: Vec<f64> = (1..=TRAILING_DAYS)
+            .map(|offset| date - Duration::days(offset))
+            .filter(|d| *d >= first)
+            .map(count)
+            .collect();
+        if trailing.len() >= MIN_TRAILING_DAYS {
+            let median = median_of(trailing.clone());
+            let mad = median_of(trailing.iter().map(|v| (v - median).abs()).collect())
+                .max(median * 0.05)
+                .max(1.0);
+            let mads = (count(date) - median).abs() / mad;
+            if mads > threshold {
+                out.push(Outlier {
+                    date,
+                    uniques: count(date) as i64,
+                    median,
+                    mads,
+                });
+            }
+        }
+        date += Duration::days(1);
+    }
+    out
+}
+
+fn median_of(mut values: Vec<f64>) -> f64 {
+    values.sort_by(|a, b| a.total_cmp(b));
+    let mid = values.len() / 2;
+    if values.len() % 2 == 0 {
+        (values[mid - 1] + values[mid]) / 2.0
+    } else {
+        values[mid]
+    }
+}
+
+// Queries the daily browser visitors of `from`..=`to` and the trailing days
+// before it, with the dashboard filters, and finds the outliers.
+pub async fn find_outliers(
+    store: &Store,
+    filters: &Filters,
+    from: NaiveDate,
+    to: NaiveDate,
+    today: NaiveDate,
+    threshold: f64,
+) -> Result<Vec<Outlier>, anyhow::Error> {
+    if threshold <= 0.0 {
+        return Ok(Vec::new());
+    }
+    let (mut where_clause, args) = build_where(
+        &(from - Duration::days(TRAILING_DAYS)).format("%Y-%m-%d").to_string(),
+        &to.format("%Y-%m-%d").to_string(),
+        filters,
+    );
+    where_clause.push_str(" AND type = 'browser'");
+    let counts = daily_counts(store, &where_clause, &args).await?;
+    Ok(outliers(&counts, from, to, today, threshold))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn summarizes_complete_days() {
+        let date = |s: &str| NaiveDate::parse_from_str(s, "%Y-%m-%d").unwrap();
+        let counts: HashMap<NaiveDate, i64> = [
+            ("2024-05-02", 10),
+            ("2024-05-03", 40),
+            ("2024-05-05", 20),
+            ("2024-05-06", 40),
+            ("2024-05-07", 500),
+        ]
+        .into_iter()
+        .map(|(d, n)| (date(d), n))
+        .collect();
+
+        // May 1 precedes the first visitor, May 4 had none, May 7 is today.
+        let summary = summarize(&counts, date("2024-05-01"), date("2024-05-31"), date("2024-05-07")).unwrap();
+        assert_eq!(summary.days, 5);
+        assert_eq!(summary.best.date, "2024-05-03");
+        assert_eq!(summary.best.uniques, 40);
+        assert_eq!(summary.worst.date, "2024-05-04");
+        assert_eq!(summary.worst.uniques, 0);
+        assert_eq!((summary.p25, summary.median, summary.p75, summary.p90), (10, 20, 40, 40));
+
+        assert!(summarize(&counts, date("2024-05-07"), date("2024-05-07"), date("2024-05-07")).is_none());
+        assert!(summarize(&HashMap::new(), date("2024-05-01"), date("2024-05-31"), date("2024-06-01")).is_none());
+    }
+
+    #[test]
+    fn flags_days_far_from_trailing_median() {
+        let date = |s: &str| NaiveDate::parse_from_str(s, "%Y-%m-%d").unwrap();
+        // Alternating 95 and 105 visitors from April 1, a spike on May 10 and
+        // a dip on May 20.
+        let mut counts = HashMap::new();
+        let mut day = date("2024-04-01");
+        let mut n = 0;
+        while day <= date("2024-05-31") {
+            counts.insert(day, if n % 2 == 0 { 95 } else { 105 });
+            day += Duration::days(1);
+            n += 1;
+        }
+        counts.insert(date("2024-05-10"), 400);
+        counts.insert(date("2024-05-20"), 10);
+
+        let found = outliers(&counts, date("2024-04-01"), date("2024-05-31"), date("2024-06-01"), 5.0);
+        let days: Vec<String> = found.iter().map(|o| o.date.to_string()).collect();
+        assert_eq!(days, ["2024-05-10", "2024-05-20"]);
+        assert!(found[0].is_high() && !found[1].is_high());
+        assert_eq!(found[0].reason(), "60.0 MADs above the 28-day median of 100");
+
+        assert!(outliers(&counts, date("2024-04-01"), date("2024-05-31"), date("2024-06-01"), 0.0).is_empty());
+    }
+}
@@ -1,28 +1,75 @@
+use crate::analyzer;
+use crate::anomaly;
+use crate::assets;
+use crate::boards::Board;
+use crate::consent;
+use crate::daily::{self, DailySummary, Outlier};
+use crate::errors;
+use crate::favicon;
+use crate::feeds;
+use crate::forecast::{self, Forecast};
+use crate::latency::{self, Percentiles};
+use crate::locale;
+use crate::movers::{self, Mover};
+use crate::growth;
+use crate::https;
+use crate::quota;
+use crate::reports::{self, Report};
+use crate::schema;
+use crate::search;
+use crate::shortlinks;
 use crate::state::AppState;
 use crate::store::Store;
+use crate::views::{self, SavedView};
 use axum::{
     extract::{RawQuery, State},
-    http::HeaderMap,
+    http::{header, HeaderMap, StatusCode},
     response::{IntoResponse, Redirect, Response},
-    routing::get,
+    routing::{get, post},
     Router,
 };
-use chrono::{Datelike, Duration, NaiveDate, Utc};
+use chrono::{DateTime, Datelike, Duration, NaiveDate, Utc};
 use duckdb::params_from_iter;
+use once_cell::sync::Lazy;
+use regex::Regex;
+use sha2::{Digest, Sha256};
 use std::collections::HashMap;
 use std::fmt::Write;
 
-const STYLE_CSS: &str = include_str!("../assets/style.css");
-const SCRIPT_JS: &str = include_str!("../assets/script.js");
 
 const YEAR_MONTH_FORMAT: &str = "%Y-%m";
 
-const ALLOWED_FILTERS: &[&str] = &["host", "path", "query", "ref_domain", "agent", "type", "os"];
+// Type, legend title and the short label used in the hover.
+const TIMELINE_TYPES: &[(&str, &str, &str)] = &[
+    ("browser", "Unique visitors", "visitors"),
+    ("feed", "RSS Readers", "readers"),
+    ("bot", "Scrapers", "scrapers"),
+];
+const TYPES_COOKIE: &str = "stats_types";
+// Set by the dashboard's "Exclude this browser" toggle; the middleware skips
+// requests that carry it (see its excludeCookies option).
+const EXCLUDE_COOKIE: &str = "stats_exclude";
+// Ten years, the longest lifetime browsers reliably keep.
+const EXCLUDE_COOKIE_MAX_AGE: i64 = 315_360_000;
+
+static RE_FILTER_ICON_LINK: Lazy<Regex> =
+    Lazy::new(|| Regex::new(r"(?s)<a href='\?[^']*'[^>]*>(?:&#x1F50D;|&#x2298;|\+)</a>").expect("re"));
+static RE_FILTER_LINK: Lazy<Regex> =
+    Lazy::new(|| Regex::new(r"(?s)<a href='\?[^']*'[^>]*>(.*?)</a>").expect("re"));
+static RE_FAVICON: Lazy<Regex> = Lazy::new(|| Regex::new(r"<img class=favicon[^>]*>").expect("re"));
+
+// Longest regular expression accepted in a host filter.
+const MAX_HOST_PATTERN: usize = 256;
+
+// Timeline width in report mode, which fits a portrait A4 or Letter page.
+const PRINT_GRAPH_WIDTH: usize = 640;
 
 pub fn router(state: AppState) -> Router {
     Router::new()
         .route("/stats", get(stats_handler))
         .route("/stats/favicon.ico", get(favicon_handler))
+        .route("/stats/api/table", get(table_handler))
+        .route("/stats/exclusion", post(exclusion_handler))
         .with_state(state)
 }
 
@@ -32,9 +79,20 @@ async fn favicon_handler() -> impl IntoResponse {
 
 async fn stats_handler(
     State(state): State<AppState>,
+    request_headers: HeaderMap,
     RawQuery(raw): RawQuery,
 ) -> Response {
-    let params = parse_query(raw.unwrap_or_default());
+    let raw = raw.unwrap_or_default();
+    let params = parse_query(raw.clone());
+    let (types, remember_types) = timeline_types(&params, &request_headers);
+    let excluded = cookie_value(&request_headers, EXCLUDE_COOKIE).is_some_and(|v| !v.is_empty());
+    let validators = cache_validators(
+        &state,
+        &format!("{}#{}#{}", raw, types.join(","), excluded),
+    );
+    if let Some(resp) = not_modified(&request_headers, validators.as_ref()) {
+        return resp;
+    }
     let from_str = first_value(&params, "from");
     let to_str = first_value(&params, "to");
 
@@ -55,82 +113,652 @@ async fn stats_handler(
     let filters = extract_filters(&params);
     let (where_clause, args) = build_where(&from_str, &to_str, &filters);
 
-    let (min_date, max_date) = match min_max_date(&state.store).await {
-        Ok(val) => val,
-        Err(_) => default_year_range(),
-    };
-    let hosts = distinct_hosts(&state.store).await.unwrap_or_default();
+    if let (Some(shards), Some(host)) = (state.shards.as_deref(), single_filter(&filters, "host")) {
+        if !shards.is_local(host) {
+            return proxy_to_shard(shards, shards.owner(host), "/stats", &params).await;
+        }
+    }
 
-    let visits = visits_by_type_date(&state.store, &where_clause, &args)
-        .await
-        .unwrap_or_default();
-    let totals = total_uniq(&state.store, &where_clause, &args)
+    let page = async {
+        let (min_date, max_date) = min_max_date(&state.store).await.unwrap_or_else(|err| {
+            eprintln!("date range query failed: {}", err);
+            default_year_range()
+        });
+        let mut hosts = distinct_hosts(&state.store).await.unwrap_or_else(|err| {
+            eprintln!("hosts query failed: {}", err);
+            Vec::new()
+        });
+        if let Some(shards) = state.shards.as_deref() {
+            hosts.extend(shards.remote_hosts().await);
+            hosts.sort();
+            hosts.dedup();
+        }
+
+        // Shown as errors once the page has started.
+        let visits = visits_by_type_date(&state.store, &where_clause, &args).await;
+        let totals = total_uniq(&state.store, &where_clause, &args).await;
+
+        let static_export = first_value(&params, "format").as_deref() == Some("static");
+        // Report mode: the page as it should come out of the printer.
+        let print = first_value(&params, "print").as_deref() == Some("1");
+        let bar_w = bar_width(from_date, to_date, print);
+        let saved = views::saved_views(&state.store).await.unwrap_or_else(|err| {
+            eprintln!("saved views query failed: {}", err);
+            Vec::new()
+        });
+
+        let mut body = String::new();
+        append(&mut body, "<!DOCTYPE html>");
+        append(&mut body, &format!("<html lang={}>", locale::current().tag));
+        append(&mut body, "<head>");
+        append(&mut body, "<meta charset=\"utf-8\">");
+        append(&mut body, "<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">");
+        if !static_export {
+            append(
+                &mut body,
+                &format!(
+                    "<link rel='icon' href='/stats/favicon.ico' sizes='32x32'>"
+                ),
+            );
+        }
+        if let Some(font_face) = assets::font_face_css(state.system_fonts).filter(|_| !static_export) {
+            append(&mut body, &format!("<style>{}</style>", font_face));
+        }
+        append(&mut body, &assets::style_tag(static_export));
+        append(&mut body, &assets::script_tag(static_export));
+        append(&mut body, "</head>");
+        // Ranges that include today follow new events as they are written.
+        let today = Utc::now().date_naive();
+        if print {
+            append(&mut body, "<body class=print>");
+        } else if !static_export && from_date <= today && today <= to_date {
+            append(&mut body, "<body data-live='/stats/api/live'>");
+        } else {
+            append(&mut body, "<body>");
+        }
+
+        if static_export || print {
+            append_static_header(&mut body, &from_str, &to_str, &filters);
+        } else {
+            append_filter_bar(
+                &mut body,
+                &params,
+                from_date,
+                to_date,
+                min_date,
+                max_date,
+                &hosts,
+                &saved,
+                &state.boards,
+                state.admin_token.is_some(),
+                excluded,
+            );
+        }
+
+        if state.shards.is_some() && single_filter(&filters, "host").is_none() && !static_export && !print {
+            append(
+                &mut body,
+                "<div class=notice>Sharded deployment: figures below cover only the hosts stored on this instance. Select a host to see its complete stats.</div>",
+            );
+        }
+
+        if !static_export && !print {
+            let selected_host = single_filter(&filters, "host");
+            for over in state.quotas.over_quota() {
+                if selected_host.is_some_and(|h| h != over.host) {
+                    continue;
+                }
+                append(
+                    &mut body,
+                    &format!(
+                        "<div class=notice>{} reached its storage quota ({}); {} new event{} dropped since the sidecar started.</div>",
+                        escape_html(&over.host),
+                        describe_quota(&over),
+                        format_number(over.dropped as i64),
+                        if over.dropped == 1 { "" } else { "s" }
+                    ),
+                );
+            }
+        }
+
+        if state.admin_token.is_some() && !static_export && !print {
+            let suspected = anomaly::flagged_ranges(&state.store)
+                .await
+                .unwrap_or_else(|err| {
+                    eprintln!("flagged ranges query failed: {}", err);
+                    Vec::new()
+                })
+                .into_iter()
+                .filter(|r| r.status == "suspected")
+                .count();
+            if suspected > 0 {
+                append(
+                    &mut body,
+                    &format!(
+                        "<div class=notice>{} network range{} flagged as suspected bot traffic and counted as bots. <a href='/stats/anomalies'>Review</a></div>",
+                        suspected,
+                        if suspected == 1 { "" } else { "s" }
+                    ),
+                );
+            }
+        }
+
+        let visits = visits.unwrap_or_else(|err| {
+            append_error(&mut body, "Visits", &err);
+            HashMap::new()
+        });
+        let totals = totals.unwrap_or_else(|err| {
+            append_error(&mut body, "Unique visitor totals", &err);
+            HashMap::new()
+        });
+        let growth = growth::monthly_growth(&state.store, &filters, to_date)
+            .await
+            .unwrap_or_else(|err| {
+                append_error(&mut body, "Growth", &err);
+                Vec::new()
+            });
+        append_growth_summary(&mut body, &growth);
+        let headline = growth::headline(&state.store, &filters, Utc::now().date_naive())
+            .await
+            .unwrap_or_else(|err| {
+                append_error(&mut body, "Headline", &err);
+                Vec::new()
+            });
+        append_headline(&mut body, &headline);
+        if !state.reports.is_empty() {
+            let runs = reports::latest_runs(&state.store).await.unwrap_or_else(|err| {
+                append_error(&mut body, "Scheduled reports", &err);
+                HashMap::new()
+            });
+            append_reports(&mut body, &state.reports, &runs);
+        }
+
+        if let Some(q) = first_value(&params, "q").filter(|q| !q.trim().is_empty()) {
+            append_search_results(&mut body, &state.store, q.trim(), &where_clause, &args).await;
+        }
+
+        if let (Some(host_a), Some(host_b)) = (first_value(&params, "host"), first_value(&params, "host2")) {
+            append_host_comparison(
+                &mut body,
+                &state.store,
+                &from_str,
+                &to_str,
+                &filters,
+                &host_a,
+                &host_b,
+                from_date,
+                to_date,
+                bar_w,
+            )
+            .await;
+        }
+
+        let daily = visits
+            .get("browser")
+            .and_then(|counts| daily::summarize(counts, from_date, to_date, today));
+        let outliers = daily::find_outliers(&state.store, &filters, from_date, to_date, today, state.outlier_mads)
+            .await
+            .unwrap_or_else(|err| {
+                append_error(&mut body, "Outlier days", &err);
+                Vec::new()
+            });
+        let projection = if from_date <= today && today <= to_date {
+            forecast::forecast(&state.store, &filters, today, state.forecast_weeks)
+                .await
+                .unwrap_or_else(|err| {
+                    append_error(&mut body, "Forecast", &err);
+                    None
+                })
+        } else {
+            None
+        };
+        append_timelines(
+            &mut body,
+            &visits,
+            &totals,
+            &params,
+            &types,
+            from_date,
+            to_date,
+            bar_w,
+            daily.as_ref(),
+            projection.as_ref(),
+            &outliers,
+        );
+        append_heatmap(&mut body, &state.store, &where_clause, &args).await;
+        append_feeds(&mut body, &state.store, &where_clause, &args, from_date, to_date, bar_w).await;
+        append_consent(&mut body, &state.store, &where_clause, &args).await;
+        append_https(&mut body, &state.store, &where_clause, &args, &params).await;
+        append_errors(&mut body, &state.store, &from_str, &to_str, &filters, from_date, to_date, bar_w).await;
+        append_growth_table(&mut body, &growth);
+        let cohorts = growth::weekly_cohorts(&state.store, &filters, to_date)
+            .await
+            .unwrap_or_else(|err| {
+                append_error(&mut body, "Cohorts", &err);
+                Vec::new()
+            });
+        append_cohort_table(&mut body, &cohorts);
+        append_movers(&mut body, &state.store, &filters, &params, from_date, to_date).await;
+        let progressive = !static_export && !print && !state.inline_tables;
+        append_tables(&mut body, &state.store, &where_clause, &args, &params, progressive).await;
+        append_slowest_pages(&mut body, &state.store, &params).await;
+
+        append(&mut body, "</body>");
+        append(&mut body, "</html>");
+
+        let mut headers = HeaderMap::new();
+        headers.insert(
+            "Content-Type",
+            "text/html; charset=utf-8".parse().expect("header"),
+        );
+        insert_validators(&mut headers, validators.as_ref());
+        headers.insert(header::VARY, "Cookie".parse().expect("header"));
+        if static_export {
+            let body = RE_FILTER_ICON_LINK.replace_all(&body, "");
+            let body = RE_FILTER_LINK.replace_all(&body, "$1");
+            let body = RE_FAVICON.replace_all(&body, "").into_owned();
+            headers.insert(
+                "Content-Disposition",
+                format!("attachment; filename=\"stats-{}-{}.html\"", from_str, to_str)
+                    .parse()
+                    .expect("header"),
+            );
+            return (headers, body).into_response();
+        }
+        if remember_types {
+            headers.insert(
+                header::SET_COOKIE,
+                format!(
+                    "{}={}; Path=/stats; Max-Age=31536000; SameSite=Lax",
+                    TYPES_COOKIE,
+                    types.join(".")
+                )
+                .parse()
+                .expect("header"),
+            );
+        }
+        (headers, body).into_response()
+    };
+    within_deadline(&state, page)
         .await
-        .unwrap_or_default();
+        .unwrap_or_else(|limit| range_too_large("/stats", &params, from_date, to_date, limit))
+}
 
-    let mut body = String::new();
-    append(&mut body, "<!DOCTYPE html>");
-    append(&mut body, "<html>");
-    append(&mut body, "<head>");
-    append(&mut body, "<meta charset=\"utf-8\">");
+fn append_filter_bar(
+    out: &mut String,
+    params: &HashMap<String, Vec<String>>,
+    from_date: NaiveDate,
+    to_date: NaiveDate,
+    min_date: NaiveDate,
+    max_date: NaiveDate,
+    hosts: &[String],
+    saved: &[SavedView],
+    boards: &[Board],
+    show_admin: bool,
+    excluded: bool,
+) {
+    append_saved_views(out, params, saved);
+    append(out, "<div class=filters>");
+    append_year_filters(out, params, from_date, to_date, min_date, max_date);
+    append_host_filters(out, params, hosts);
+    append_active_filters(out, params);
+    append_search_form(out, params);
     append(
-        &mut body,
+        out,
         &format!(
-            "<link rel='icon' href='/stats/favicon.ico' sizes='32x32'>"
+            "<a class=filter href='/stats/paths?{}'>Path tree</a>",
+            escape_html(&encode_params(params))
         ),
     );
+    let mut print = clone_params(params);
+    print.insert("print".to_string(), vec!["1".to_string()]);
     append(
-        &mut body,
-        "<link rel=\"preconnect\" href=\"https://fonts.gstatic.com\" crossorigin>",
+        out,
+        &format!(
+            "<a class=filter href='?{}'>Print</a>",
+            escape_html(&encode_params(&print))
+        ),
     );
+    for board in boards {
+        append(
+            out,
+            &format!(
+                "<a class=filter href='/stats/boards/{}?{}'>{}</a>",
+                board.name,
+                escape_html(&encode_params(params)),
+                escape_html(board.label())
+            ),
+        );
+    }
+    if show_admin {
+        append(
+            out,
+            &format!(
+                "<a class=filter href='/stats/events?{}'>Events</a>",
+                encode_params(params)
+            ),
+        );
+        append(out, "<a class=filter href='/stats/anomalies'>Anomalies</a>");
+        append(out, "<a class=filter href='/stats/sources'>Sources</a>");
+        append(out, "<a class=filter href='/stats/console'>SQL</a>");
+    }
     append(
-        &mut body,
-        "<link href=\"https://fonts.googleapis.com/css2?family=Inter:opsz,wght@14..32,100..900&display=swap\" rel=\"stylesheet\">",
+        out,
+        &format!(
+            "<form method=post action='/stats/exclusion'><input type=hidden name=query value='{}'><input type=hidden name=exclude value='{}'><button type=submit class='filter{}' title='{}'>{}</button></form>",
+            escape_html(&encode_params(params)),
+            if excluded { "0" } else { "1" },
+            if excluded { " in" } else { "" },
+            if excluded {
+                "Visits from this browser are not recorded"
+            } else {
+                "Stop recording visits from this browser"
+            },
+            if excluded { "Browser excluded" } else { "Exclude this browser" }
+        ),
     );
-    append(&mut body, &format!("<style>{}</style>", STYLE_CSS));
-    append(&mut body, &format!("<script>{}</script>", SCRIPT_JS));
-    append(&mut body, "</head>");
-    append(&mut body, "<body>");
+    append(out, "</div>");
+}
 
-    append(&mut body, "<div class=filters>");
-    append_year_filters(
-        &mut body,
-        &params,
-        from_date,
-        to_date,
-        min_date,
-        max_date,
+// Sets or clears the exclusion cookie for the whole site, then returns to
+// the dashboard view the toggle was pressed on.
+async fn exclusion_handler(body: String) -> Response {
+    let params = parse_query(body);
+    let exclude = first_value(&params, "exclude").as_deref() == Some("1");
+    let query = first_value(&params, "query").unwrap_or_default();
+    let cookie = if exclude {
+        format!(
+            "{}=1; Path=/; Max-Age={}; SameSite=Lax; HttpOnly",
+            EXCLUDE_COOKIE, EXCLUDE_COOKIE_MAX_AGE
+        )
+    } else {
+        format!("{}=; Path=/; Max-Age=0; SameSite=Lax; HttpOnly", EXCLUDE_COOKIE)
+    };
+    let mut headers = HeaderMap::new();
+    headers.insert(header::SET_COOKIE, cookie.parse().expect("header"));
+    let target = if query.is_empty() {
+        "/stats".to_string()
+    } else {
+        format!("/stats?{}", query)
+    };
+    (headers, Redirect::to(&target)).into_response()
+}
+
+fn cookie_value<'a>(headers: &'a HeaderMap, name: &str) -> Option<&'a str> {
+    headers
+        .get_all(header::COOKIE)
+        .iter()
+        .filter_map(|v| v.to_str().ok())
+        .flat_map(|v| v.split(';'))
+        .find_map(|c| c.trim().strip_prefix(name)?.strip_prefix('='))
+}
+
+fn append_saved_views(out: &mut String, params: &HashMap<String, Vec<String>>, saved: &[SavedView]) {
+    let mut current = clone_params(params);
+    current.remove("format");
+    let current = encode_params(&current);
+
+    append(out, "<div class='filters views'>");
+    for view in saved {
+        let active = view.query == current;
+        append(
+            out,
+            &format!(
+                "<a class='filter{}' href='/stats?{}'>{}</a>",
+                if active { " in" } else { "" },
+                escape_html(&view.query),
+                escape_html(&view.name)
+            ),
+        );
+        if active {
+            append(
+                out,
+                &format!(
+                    "<form method=post action='/stats/views/delete'><input type=hidden name=name value='{}'><button type=submit title='Delete view'>&times;</button></form>",
+                    escape_html(&view.name)
+                ),
+            );
+        }
+    }
+    append(
+        out,
+        &format!(
+            "<form method=post action='/stats/views'><input type=hidden name=query value='{}'><input name=name placeholder='Save view as…' required></form>",
+            escape_html(&current)
+        ),
     );
-    append_host_filters(&mut body, &params, &hosts);
-    append_active_filters(&mut body, &params);
-    append(&mut body, "</div>");
+    let mut expiry = String::new();
+    for (days, label) in shortlinks::EXPIRY_CHOICES {
+        let _ = write!(expiry, "<option value={}>{}</option>", days, label);
+    }
+    append(
+        out,
+        &format!(
+            "<form method=post action='/stats/s'><input type=hidden name=query value='{}'><select name=expires title='Link expires'>{}</select><button type=submit class=filter>Short link</button></form>",
+            escape_html(&current),
+            expiry
+        ),
+    );
+    append(out, "</div>");
+}
 
-    append_timelines(
-        &mut body,
-        &visits,
-        &totals,
-        &params,
+// Static exports replace the interactive filter bar with a plain description
+// of what the snapshot covers.
+fn append_static_header(
+    out: &mut String,
+    from_str: &str,
+    to_str: &str,
+    filters: &Filters,
+) {
+    let mut keys: Vec<_> = filters.keys().collect();
+    keys.sort();
+    let mut desc = format!("{} &ndash; {}", from_str, to_str);
+    for key in keys {
+        let _ = write!(desc, " &middot; {}", escape_html(&describe_filter(key, &filters[key])));
+    }
+    append(out, &format!("<div class=filters><span class=filter>{}</span></div>", desc));
+}
+
+async fn proxy_to_shard(
+    shards: &crate::shard::Shards,
+    owner: usize,
+    path: &str,
+    params: &HashMap<String, Vec<String>>,
+) -> Response {
+    let path = format!("{}?{}", path, encode_params(params));
+    let resp = match shards.fetch(owner, &path).await {
+        Ok(resp) => resp,
+        Err(err) => {
+            eprintln!("shard {} dashboard failed: {}", owner, err);
+            return axum::http::StatusCode::BAD_GATEWAY.into_response();
+        }
+    };
+    let status = axum::http::StatusCode::from_u16(resp.status().as_u16())
+        .unwrap_or(axum::http::StatusCode::BAD_GATEWAY);
+    let mut headers = HeaderMap::new();
+    for name in ["content-type", "content-disposition"] {
+        if let Some(val) = resp.headers().get(name).and_then(|v| v.to_str().ok()) {
+            if let Ok(val) = val.parse() {
+                headers.insert(name, val);
+            }
+        }
+    }
+    match resp.bytes().await {
+        Ok(bytes) => (status, headers, bytes.to_vec()).into_response(),
+        Err(_) => axum::http::StatusCode::BAD_GATEWAY.into_response(),
+    }
+}
+
+struct Validators {
+    etag: String,
+    last_modified: DateTime<Utc>,
+}
+
+// Pages only change when the store is written to or the date rolls over
+// (default ranges and "today" figures), so both feed the validators. Sharded
+// instances also show remote data and are never cached.
+fn cache_validators(state: &AppState, raw_query: &str) -> Option<Validators> {
+    if state.shards.is_some() {
+        return None;
+    }
+    let (version, modified) = state.store.version();
+    let today = Utc::now().date_naive();
+    let mut hasher = Sha256::new();
+    hasher.update(version.as_bytes());
+    hasher.update(today.to_string().as_bytes());
+    hasher.update(raw_query.as_bytes());
+    let midnight = today.and_hms_opt(0, 0, 0).unwrap().and_utc();
+    Some(Validators {
+        etag: format!("W/\"{}\"", &hex::encode(hasher.finalize())[..20]),
+        last_modified: modified.max(midnight),
+    })
+}
+
+fn not_modified(headers: &HeaderMap, validators: Option<&Validators>) -> Option<Response> {
+    let validators = validators?;
+    let fresh = if let Some(inm) = headers.get(header::IF_NONE_MATCH).and_then(|v| v.to_str().ok()) {
+        inm.split(',').any(|tag| {
+            let tag = tag.trim();
+            tag == "*" || tag.trim_start_matches("W/") == validators.etag.trim_start_matches("W/")
+        })
+    } else if let Some(ims) = headers
+        .get(header::IF_MODIFIED_SINCE)
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| DateTime::parse_from_rfc2822(v).ok())
+    {
+        validators.last_modified.timestamp() <= ims.timestamp()
+    } else {
+        false
+    };
+    if !fresh {
+        return None;
+    }
+    let mut resp_headers = HeaderMap::new();
+    insert_validators(&mut resp_headers, Some(validators));
+    Some((StatusCode::NOT_MODIFIED, resp_headers).into_response())
+}
+
+fn insert_validators(headers: &mut HeaderMap, validators: Option<&Validators>) {
+    let Some(validators) = validators else {
+        return;
+    };
+    if let Ok(val) = validators.etag.parse() {
+        headers.insert(header::ETAG, val);
+    }
+    if let Ok(val) = validators
+        .last_modified
+        .format("%a, %d %b %Y %H:%M:%S GMT")
+        .to_string()
+        .parse()
+    {
+        headers.insert(header::LAST_MODIFIED, val);
+    }
+    headers.insert(header::CACHE_CONTROL, "private, no-cache".parse().expect("header"));
+}
+
+// Awaits `page` for at most --dashboard-timeout, or returns that limit. A page
+// past it is dropped at the query it waits for, and with_conn skips the ones
+// it had queued, so only the query already running keeps the connection. A
+// client that goes away drops the page the same way.
+pub(crate) async fn within_deadline<T>(
+    state: &AppState,
+    page: impl std::future::Future<Output = T>,
+) -> Result<T, std::time::Duration> {
+    match state.dashboard_timeout {
+        Some(limit) => tokio::time::timeout(limit, page).await.map_err(|_| limit),
+        None => Ok(page.await),
+    }
+}
+
+// The page shown instead of a dashboard that took longer than `limit`, with
+// links to shorter ranges ending at `to_date`.
+pub(crate) fn range_too_large(
+    path: &str,
+    params: &HashMap<String, Vec<String>>,
+    from_date: NaiveDate,
+    to_date: NaiveDate,
+    limit: std::time::Duration,
+) -> Response {
+    eprintln!(
+        "{} for {} to {} took longer than {}s",
+        path,
         from_date,
         to_date,
+        limit.as_secs()
     );
-    append_tables(&mut body, &state.store, &where_clause, &args, &params).await;
-
+    let mut body = String::new();
+    append(&mut body, "<!DOCTYPE html>");
+    append(&mut body, &format!("<html lang={}>", locale::current().tag));
+    append(&mut body, "<head>");
+    append(&mut body, "<meta charset=\"utf-8\">");
+    append(&mut body, "<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">");
+    append(&mut body, "<title>Range too large</title>");
+    append(&mut body, &assets::style_tag(false));
+    append(&mut body, "</head>");
+    append(&mut body, "<body>");
+    append(
+        &mut body,
+        &format!(
+            "<div class=notice>Counting {} to {} took longer than {}s, so the page was given up on. Try a shorter range:",
+            from_date,
+            to_date,
+            limit.as_secs()
+        ),
+    );
+    let month_start = to_date.with_day(1).unwrap_or(to_date);
+    for (label, from) in [
+        ("last 7 days", to_date - Duration::days(6)),
+        ("last 30 days", to_date - Duration::days(29)),
+        ("this month", month_start),
+    ] {
+        if from <= from_date {
+            continue;
+        }
+        let mut qs = clone_params(params);
+        qs.insert("from".to_string(), vec![from.format("%Y-%m-%d").to_string()]);
+        qs.insert("to".to_string(), vec![to_date.format("%Y-%m-%d").to_string()]);
+        append(
+            &mut body,
+            &format!(" <a href='{}?{}'>{}</a>", path, escape_html(&encode_params(&qs)), label),
+        );
+    }
+    append(&mut body, "</div>");
     append(&mut body, "</body>");
     append(&mut body, "</html>");
+    (
+        StatusCode::SERVICE_UNAVAILABLE,
+        [(header::CONTENT_TYPE, "text/html; charset=utf-8")],
+        body,
+    )
+        .into_response()
+}
 
-    let mut headers = HeaderMap::new();
-    headers.insert(
-        "Content-Type",
-        "text/html; charset=utf-8".parse().expect("header"),
+// Logs a failed query and shows a banner where its section would be, so a
+// broken database does not pass for one without visits.
+pub(crate) fn append_error(out: &mut String, section: &str, err: &anyhow::Error) {
+    eprintln!("{} query failed: {:#}", section, err);
+    append(
+        out,
+        &format!(
+            "<div class='notice error'>{} could not be loaded; the sidecar log has the details.</div>",
+            escape_html(section)
+        ),
     );
-    (headers, body).into_response()
 }
 
-fn append(out: &mut String, value: &str) {
+// append_error for a top-10 table, keeping its place in the grid.
+fn append_table_error(out: &mut String, title: &str, err: &anyhow::Error) {
+    append(out, "<div class=table_outer>");
+    append(out, &format!("<h1>{}</h1>", title));
+    append_error(out, title, err);
+    append(out, "</div>");
+}
+
+pub(crate) fn append(out: &mut String, value: &str) {
     let _ = writeln!(out, "{}", value);
 }
 
-fn parse_query(raw: String) -> HashMap<String, Vec<String>> {
+pub(crate) fn parse_query(raw: String) -> HashMap<String, Vec<String>> {
     let mut params: HashMap<String, Vec<String>> = HashMap::new();
     for (k, v) in url::form_urlencoded::parse(raw.as_bytes()) {
         params
@@ -141,11 +769,11 @@ fn parse_query(raw: String) -> HashMap<String, Vec<String>> {
     params
 }
 
-fn first_value(params: &HashMap<String, Vec<String>>, key: &str) -> Option<String> {
+pub(crate) fn first_value(params: &HashMap<String, Vec<String>>, key: &str) -> Option<String> {
     params.get(key).and_then(|vals| vals.get(0)).cloned()
 }
 
-fn redirect_to_year(path: &str, params: &HashMap<String, Vec<String>>) -> Redirect {
+pub(crate) fn redirect_to_year(path: &str, params: &HashMap<String, Vec<String>>) -> Redirect {
     let now = Utc::now().date_naive();
     let from = NaiveDate::from_ymd_opt(now.year(), 1, 1).unwrap();
     let to = NaiveDate::from_ymd_opt(now.year(), 12, 31).unwrap();
@@ -156,31 +784,140 @@ fn redirect_to_year(path: &str, params: &HashMap<String, Vec<String>>) -> Redire
     Redirect::to(&format!("{}?{}", path, query))
 }
 
-fn extract_filters(params: &HashMap<String, Vec<String>>) -> HashMap<String, String> {
+// Filters keyed by column. A key ending in `!` (from `path!=/feed.xml`)
+// excludes its values; otherwise several values match any of them. A `*` in
+// a value matches any text, so `/blog/*` matches by prefix and
+// `*.example.com` every subdomain. Host values starting with `~` are regular
+// expressions.
+pub(crate) type Filters = HashMap<String, Vec<String>>;
+
+pub(crate) fn extract_filters(params: &HashMap<String, Vec<String>>) -> Filters {
     let mut filters = HashMap::new();
     for (key, values) in params {
         if key == "from" || key == "to" {
             continue;
         }
-        if !ALLOWED_FILTERS.contains(&key.as_str()) || values.is_empty() {
+        if schema::filter_column(key).is_none() || values.is_empty() {
             continue;
         }
-        filters.insert(key.clone(), values[0].clone());
+        filters.insert(key.clone(), values.clone());
     }
     filters
 }
 
-fn build_where(from_str: &str, to_str: &str, filters: &HashMap<String, String>) -> (String, Vec<String>) {
-    let mut where_parts = vec!["date >= ?".to_string(), "date <= ?".to_string()];
+// The value of a filter that pins exactly one value, e.g. the host to route
+// to a shard; None when it is negated, a pattern or has several values.
+pub(crate) fn single_filter<'a>(filters: &'a Filters, key: &str) -> Option<&'a str> {
+    match filters.get(key).map(Vec::as_slice) {
+        Some([value]) if !value.contains('*') && !value.starts_with('~') => Some(value.as_str()),
+        _ => None,
+    }
+}
+
+pub(crate) fn build_where(from_str: &str, to_str: &str, filters: &Filters) -> (String, Vec<String>) {
+    // Error responses are only recorded when the middleware captures status
+    // codes and never count as visits.
+    rows_where(
+        from_str,
+        to_str,
+        filters,
+        &["prefetch IS NOT TRUE", "fragment IS NOT TRUE", "COALESCE(status, 0) < 400"],
+    )
+}
+
+// Like build_where, but selects the 4xx and 5xx responses for the Errors panel.
+pub(crate) fn build_error_where(from_str: &str, to_str: &str, filters: &Filters) -> (String, Vec<String>) {
+    rows_where(from_str, to_str, filters, &["status >= 400"])
+}
+
+// Like build_where, but with every row the filters match, for admin deletes.
+pub(crate) fn build_row_where(from_str: &str, to_str: &str, filters: &Filters) -> (String, Vec<String>) {
+    rows_where(from_str, to_str, filters, &[])
+}
+
+// Selects path_latency rows. The histograms only know date, host and path,
+// so filters on other columns do not narrow them.
+pub(crate) fn build_latency_where(from_str: &str, to_str: &str, filters: &Filters) -> (String, Vec<String>) {
+    let filters: Filters = filters
+        .iter()
+        .filter(|(key, _)| matches!(key.trim_end_matches('!'), "host" | "path"))
+        .map(|(key, values)| (key.clone(), values.clone()))
+        .collect();
+    rows_where(from_str, to_str, &filters, &[])
+}
+
+fn rows_where(from_str: &str, to_str: &str, filters: &Filters, conditions: &[&str]) -> (String, Vec<String>) {
+    // Deleted rows wait out their grace period hidden from every view.
+    let mut where_parts = vec![
+        "date >= ?".to_string(),
+        "date <= ?".to_string(),
+        "deleted_at IS NULL".to_string(),
+    ];
+    where_parts.extend(conditions.iter().map(|c| c.to_string()));
     let mut args = vec![from_str.to_string(), to_str.to_string()];
-    for (key, val) in filters {
-        where_parts.push(format!("{} = ?", key));
-        args.push(val.clone());
+    let mut keys: Vec<&String> = filters.keys().collect();
+    keys.sort();
+    for key in keys {
+        // Keys that are no column never reach the SQL.
+        let Some(column) = schema::filter_column(key) else {
+            continue;
+        };
+        let negate = key.ends_with('!');
+        let mut conditions = Vec::new();
+        for val in &filters[key] {
+            match val.strip_prefix('~') {
+                Some(pattern) if column == "host" => {
+                    // Checked here so a typo matches nothing instead of
+                    // failing the whole page.
+                    if pattern.len() <= MAX_HOST_PATTERN && Regex::new(pattern).is_ok() {
+                        conditions.push("regexp_matches(host, ?)".to_string());
+                        args.push(pattern.to_string());
+                    } else {
+                        conditions.push("FALSE".to_string());
+                    }
+                }
+                _ if val.contains('*') => {
+                    conditions.push(format!("{} LIKE ? ESCAPE '\\'", column));
+                    args.push(like_pattern(val));
+                }
+                _ if column == "host" => {
+                    // Rows stored before the alias was configured still
+                    // carry it.
+                    let host = analyzer::canonical_host(val);
+                    for alias in analyzer::aliases_of(&host) {
+                        conditions.push("host = ?".to_string());
+                        args.push(alias);
+                    }
+                    conditions.push("host = ?".to_string());
+                    args.push(host);
+                }
+                _ => {
+                    conditions.push(format!("{} = ?", column));
+                    args.push(val.clone());
+                }
+            }
+        }
+        // NULL columns never match, so they pass a negated filter.
+        if negate {
+            where_parts.push(format!("NOT COALESCE({}, FALSE)", conditions.join(" OR ")));
+        } else {
+            where_parts.push(format!("({})", conditions.join(" OR ")));
+        }
     }
     (where_parts.join(" AND "), args)
 }
 
-async fn min_max_date(store: &Store) -> Result<(NaiveDate, NaiveDate), anyhow::Error> {
+pub(crate) fn escape_like(s: &str) -> String {
+    s.replace('\\', "\\\\").replace('%', "\\%").replace('_', "\\_")
+}
+
+// A filter value with `*` wildcards as a LIKE pattern; everything else
+// matches literally.
+fn like_pattern(val: &str) -> String {
+    val.split('*').map(escape_like).collect::<Vec<_>>().join("%")
+}
+
+pub(crate) async fn min_max_date(store: &Store) -> Result<(NaiveDate, NaiveDate), anyhow::Error> {
     store
         .with_conn(|conn| {
             let mut stmt = conn.prepare("SELECT min(date), max(date) FROM stats")?;
@@ -203,7 +940,7 @@ async fn min_max_date(store: &Store) -> Result<(NaiveDate, NaiveDate), anyhow::E
         .await
 }
 
-fn default_year_range() -> (NaiveDate, NaiveDate) {
+pub(crate) fn default_year_range() -> (NaiveDate, NaiveDate) {
     let now = Utc::now().date_naive();
     (
         NaiveDate::from_ymd_opt(now.year(), 1, 1).unwrap(),
@@ -211,7 +948,7 @@ fn default_year_range() -> (NaiveDate, NaiveDate) {
     )
 }
 
-async fn distinct_hosts(store: &Store) -> Result<Vec<String>, anyhow::Error> {
+pub(crate) async fn distinct_hosts(store: &Store) -> Result<Vec<String>, anyhow::Error> {
     store
         .with_conn(|conn| {
             let mut stmt = conn.prepare(
@@ -222,17 +959,19 @@ async fn distinct_hosts(store: &Store) -> Result<Vec<String>, anyhow::Error> {
             while let Some(row) = rows.next()? {
                 let host: Option<String> = row.get(0)?;
                 if let Some(host) = host {
-                    if !host.is_empty() {
+                    let host = analyzer::canonical_host(&host);
+                    if !host.is_empty() && !hosts.contains(&host) {
                         hosts.push(host);
                     }
                 }
             }
+            hosts.sort();
             Ok(hosts)
         })
         .await
 }
 
-async fn visits_by_type_date(
+pub(crate) async fn visits_by_type_date(
     store: &Store,
     where_clause: &str,
     args: &[String],
@@ -269,7 +1008,7 @@ async fn visits_by_type_date(
         .await
 }
 
-async fn total_uniq(
+pub(crate) async fn total_uniq(
     store: &Store,
     where_clause: &str,
     args: &[String],
@@ -305,7 +1044,7 @@ async fn total_uniq(
         .await
 }
 
-fn append_year_filters(
+pub(crate) fn append_year_filters(
     out: &mut String,
     params: &HashMap<String, Vec<String>>,
     from_date: NaiveDate,
@@ -343,279 +1082,1461 @@ fn append_year_filters(
     }
 }
 
-fn append_host_filters(out: &mut String, params: &HashMap<String, Vec<String>>, hosts: &[String]) {
-    for host in hosts {
-        let mut qs = clone_params(params);
-        qs.insert("host".to_string(), vec![host.to_string()]);
+fn append_host_filters(out: &mut String, params: &HashMap<String, Vec<String>>, hosts: &[String]) {
+    let current = first_value(params, "host");
+    for host in hosts {
+        let mut qs = clone_params(params);
+        qs.insert("host".to_string(), vec![host.to_string()]);
+        append(
+            out,
+            &format!(
+                "<a href='?{}' class='filter'>{}</a>",
+                encode_params(&qs),
+                host
+            ),
+        );
+        if current.as_deref().is_some_and(|c| c != host) {
+            let mut qs = clone_params(params);
+            qs.insert("host2".to_string(), vec![host.to_string()]);
+            append(
+                out,
+                &format!(
+                    "<a href='?{}' class='filter compare' title='Compare with {}'>vs</a>",
+                    encode_params(&qs),
+                    host
+                ),
+            );
+        }
+    }
+}
+
+pub(crate) fn append_active_filters(out: &mut String, params: &HashMap<String, Vec<String>>) {
+    for (key, values) in params {
+        if key == "from" || key == "to" || values.is_empty() {
+            continue;
+        }
+        let column = key.strip_suffix('!').unwrap_or(key);
+        let mut actions = String::new();
+        if schema::filter_column(column).is_some() {
+            let inverted = if column == key { format!("{}!", column) } else { column.to_string() };
+            let mut qs = clone_params(params);
+            qs.remove(key);
+            qs.insert(inverted, values.clone());
+            let _ = write!(actions, "<a href='?{}' title='Invert'>&#x21C4;</a>", encode_params(&qs));
+        }
+        // A single path widens to its parent directory, e.g. /blog/post to /blog/*.
+        if column == "path" && values.len() == 1 {
+            let trimmed = values[0].trim_end_matches('*').trim_end_matches('/');
+            if let Some((parent, _)) = trimmed.rsplit_once('/') {
+                let widened = format!("{}/*", parent);
+                let mut qs = clone_params(params);
+                qs.insert(key.clone(), vec![widened.clone()]);
+                let _ = write!(
+                    actions,
+                    "<a href='?{}' title='Widen to {}'>&#x2191;</a>",
+                    encode_params(&qs),
+                    escape_html(&widened)
+                );
+            }
+        }
+        let mut qs = clone_params(params);
+        qs.remove(key);
+        append(
+            out,
+            &format!(
+                "<div class=filter>{}{}<a href='?{}' title='Remove'>&times;</a></div>",
+                escape_html(&describe_filter(key, values)),
+                actions,
+                encode_params(&qs)
+            ),
+        );
+    }
+}
+
+fn describe_filter(key: &str, values: &[String]) -> String {
+    match key.strip_suffix('!') {
+        Some(column) => format!("{} \u{2260} {}", column, values.join(" | ")),
+        None => format!("{}: {}", key, values.join(" | ")),
+    }
+}
+
+// Table rows link to a filter on their value, to excluding it, and, when the
+// column is already filtered, to adding it as an alternative.
+fn filter_links(params: &HashMap<String, Vec<String>>, column: &str, value: &str) -> String {
+    let mut links = String::new();
+    let mut qs = clone_params(params);
+    qs.insert(column.to_string(), vec![value.to_string()]);
+    let _ = write!(
+        links,
+        "<a href='?{}' title='Filter by {} = {}'>&#x1F50D;</a>",
+        encode_params(&qs),
+        column,
+        escape_html(value)
+    );
+    let current = params.get(column).cloned().unwrap_or_default();
+    if !current.is_empty() && !current.iter().any(|v| v == value) {
+        let mut qs = clone_params(params);
+        qs.entry(column.to_string()).or_default().push(value.to_string());
+        let _ = write!(
+            links,
+            "<a href='?{}' title='Also {} = {}'>+</a>",
+            encode_params(&qs),
+            column,
+            escape_html(value)
+        );
+    }
+    let mut qs = clone_params(params);
+    qs.entry(format!("{}!", column)).or_default().push(value.to_string());
+    let _ = write!(
+        links,
+        "<a href='?{}' title='Exclude {} = {}'>&#x2298;</a>",
+        encode_params(&qs),
+        column,
+        escape_html(value)
+    );
+    links
+}
+
+fn append_search_form(out: &mut String, params: &HashMap<String, Vec<String>>) {
+    append(out, "<form class=search method=get>");
+    for (key, values) in params {
+        if key == "q" {
+            continue;
+        }
+        for value in values {
+            append(
+                out,
+                &format!(
+                    "<input type=hidden name='{}' value='{}'>",
+                    escape_html(key),
+                    escape_html(value)
+                ),
+            );
+        }
+    }
+    append(
+        out,
+        &format!(
+            "<input type=search name=q value='{}' placeholder='Search paths, referrers, agents'>",
+            escape_html(&first_value(params, "q").unwrap_or_default())
+        ),
+    );
+    append(out, "</form>");
+}
+
+async fn append_search_results(
+    out: &mut String,
+    store: &Store,
+    q: &str,
+    where_clause: &str,
+    args: &[String],
+) {
+    let result = match search::search(store, q, where_clause, args).await {
+        Ok(result) => result,
+        Err(err) => {
+            append_error(out, "Search", &err);
+            return;
+        }
+    };
+    let total: i64 = result.days.iter().map(|d| d.hits).sum();
+    append(
+        out,
+        &format!(
+            "<h1>Search &ldquo;{}&rdquo;: {} hits on {} days</h1>",
+            escape_html(q),
+            format_number(total),
+            result.days.len()
+        ),
+    );
+    if result.rows.is_empty() {
+        return;
+    }
+    append(out, "<table class=rows>");
+    append(
+        out,
+        "<tr><th>Date</th><th>Type</th><th>Path</th><th>Referrer</th><th>User agent</th><td>Hits</td></tr>",
+    );
+    for row in &result.rows {
+        let path = if row.query.is_empty() {
+            row.path.clone()
+        } else {
+            format!("{}?{}", row.path, row.query)
+        };
+        append(
+            out,
+            &format!(
+                "<tr><td>{}</td><td>{}</td><td title='{}'>{}</td><td title='{}'>{}</td><td title='{}'>{}</td><td>{}</td></tr>",
+                row.date,
+                escape_html(&row.r#type),
+                escape_html(&path),
+                escape_html(&path),
+                escape_html(&row.referrer),
+                escape_html(&row.referrer),
+                escape_html(&row.user_agent),
+                escape_html(&row.user_agent),
+                format_num(row.hits)
+            ),
+        );
+    }
+    append(out, "</table>");
+}
+
+async fn append_host_comparison(
+    out: &mut String,
+    store: &Store,
+    from_str: &str,
+    to_str: &str,
+    filters: &Filters,
+    host_a: &str,
+    host_b: &str,
+    from_date: NaiveDate,
+    to_date: NaiveDate,
+    bar_w: usize,
+) {
+    let mut series = Vec::new();
+    for host in [host_a, host_b] {
+        let mut host_filters = filters.clone();
+        host_filters.remove("host!");
+        host_filters.insert("host".to_string(), vec![host.to_string()]);
+        let (where_clause, args) = build_where(from_str, to_str, &host_filters);
+        let visits = visits_by_type_date(store, &where_clause, &args).await;
+        let totals = total_uniq(store, &where_clause, &args).await;
+        let (visits, totals) = match (visits, totals) {
+            (Ok(visits), Ok(totals)) => (visits, totals),
+            (Err(err), _) | (_, Err(err)) => {
+                append_error(out, "Host comparison", &err);
+                return;
+            }
+        };
+        series.push((
+            host,
+            visits.get("browser").cloned().unwrap_or_default(),
+            *totals.get("browser").unwrap_or(&0),
+        ));
+    }
+
+    append(out, "<h1>Unique visitors compared</h1>");
+    append(out, "<div class=compare_legend>");
+    for (idx, (host, _, total)) in series.iter().enumerate() {
+        append(
+            out,
+            &format!(
+                "<span class=s{}>{}: {}</span>",
+                idx,
+                escape_html(host),
+                format_number(*total)
+            ),
+        );
+    }
+    append(out, "</div>");
+    let lines: Vec<&HashMap<NaiveDate, i64>> = series.iter().map(|(_, date_counts, _)| date_counts).collect();
+    append_line_chart(out, &lines, from_date, to_date, bar_w);
+}
+
+// One line per series, colored s0, s1, ... like the legend above it.
+fn append_line_chart(
+    out: &mut String,
+    series: &[&HashMap<NaiveDate, i64>],
+    from_date: NaiveDate,
+    to_date: NaiveDate,
+    bar_w: usize,
+) {
+    let mut max_val = 1i64;
+    for date_counts in series {
+        for val in date_counts.values() {
+            max_val = max_val.max(*val);
+        }
+    }
+    max_val = round_max_val(max_val);
+    let bar_height = |v: i64| -> i64 { (v * 100) / max_val.max(1) };
+    let hrz_step = horizontal_step(max_val);
+    let dates = list_dates(from_date, to_date);
+    let graph_w = dates.len() * bar_w;
+
+    append(out, "<div class=graph_outer>");
+    append(out, "<div class=graph_scroll>");
+    append(
+        out,
+        &format!("<svg class='graph compare' width={} height=130>", graph_w),
+    );
+    let mut val = 0;
+    while val <= max_val {
+        let y = 110 - bar_height(val);
+        append(
+            out,
+            &format!("<line class=hrz x1=0 y1={} x2={} y2={} />", y, graph_w, y),
+        );
+        val += hrz_step;
+    }
+    for (idx, date_counts) in series.iter().enumerate() {
+        let points: Vec<String> = dates
+            .iter()
+            .enumerate()
+            .map(|(i, date)| {
+                let v = *date_counts.get(date).unwrap_or(&0);
+                format!("{},{}", i * bar_w + bar_w / 2, 110 - bar_height(v))
+            })
+            .collect();
+        append(
+            out,
+            &format!("<polyline class=s{} points='{}' />", idx, points.join(" ")),
+        );
+    }
+    for (idx, date) in dates.iter().enumerate() {
+        if date.day() == 1 {
+            append(
+                out,
+                &format!(
+                    "<line class=date x1={} y1=112 x2={} y2=120 /><text x={} y=130>{}</text>",
+                    idx * bar_w,
+                    idx * bar_w,
+                    idx * bar_w,
+                    date.format(YEAR_MONTH_FORMAT)
+                ),
+            );
+        }
+    }
+    append(out, "</svg>");
+    append(out, "</div>");
+    append(out, "<svg class=graph_legend height=130>");
+    let mut val = 0;
+    while val <= max_val {
+        append(
+            out,
+            &format!(
+                "<text x=20 y={} text-anchor=end>{}</text>",
+                113 - bar_height(val),
+                format_num(val)
+            ),
+        );
+        val += hrz_step;
+    }
+    append(out, "</svg>");
+    append(out, "</div>");
+}
+
+pub(crate) fn append_timelines(
+    out: &mut String,
+    data: &HashMap<String, HashMap<NaiveDate, i64>>,
+    totals: &HashMap<String, i64>,
+    params: &HashMap<String, Vec<String>>,
+    types: &[&str],
+    from_date: NaiveDate,
+    to_date: NaiveDate,
+    bar_w: usize,
+    daily: Option<&DailySummary>,
+    projection: Option<&Forecast>,
+    outliers: &[Outlier],
+) {
+    let present: Vec<&(&str, &str, &str)> = TIMELINE_TYPES
+        .iter()
+        .filter(|(typ, _, _)| data.get(*typ).map_or(false, |counts| !counts.is_empty()))
+        .collect();
+    if present.is_empty() {
+        return;
+    }
+    let visible: Vec<&(&str, &str, &str)> = present
+        .iter()
+        .copied()
+        .filter(|(typ, _, _)| types.contains(typ))
+        .collect();
+    let empty = HashMap::new();
+    let counts = |typ: &str| data.get(typ).unwrap_or(&empty);
+
+    append(out, "<h1 class=types>");
+    for (typ, title, _) in &present {
+        let label = if *typ == "feed" {
+            format!("{}: ~{} / day", title, format_number(average(counts(*typ))))
+        } else {
+            format!("{}: {}", title, format_number(*totals.get(*typ).unwrap_or(&0)))
+        };
+        let mut toggled: Vec<&str> = TIMELINE_TYPES
+            .iter()
+            .map(|(t, _, _)| *t)
+            .filter(|t| types.contains(t) != (t == typ))
+            .collect();
+        // Hiding the last visible type brings all of them back.
+        if toggled.is_empty() {
+            toggled = TIMELINE_TYPES.iter().map(|(t, _, _)| *t).collect();
+        }
+        let mut qs = clone_params(params);
+        qs.insert("types".to_string(), vec![toggled.join(",")]);
+        append(
+            out,
+            &format!(
+                "<span class='t {}{}'><a href='?{}' title='Show or hide'>{}</a></span>",
+                typ,
+                if types.contains(typ) { "" } else { " off" },
+                escape_html(&encode_params(&qs)),
+                label
+            ),
+        );
+    }
+    append(out, "</h1>");
+
+    // The daily summary, the projection and the outliers count browsers, so
+    // they are drawn only while browsers show.
+    let browsers_shown = visible.iter().any(|(typ, _, _)| *typ == "browser");
+    let record_day = daily.filter(|_| browsers_shown).map(|d| d.best.date.as_str());
+    let projection = projection.filter(|_| browsers_shown);
+
+    let mut max_val = 1i64;
+    let dates = list_dates(from_date, to_date);
+    for date in &dates {
+        let sum: i64 = visible
+            .iter()
+            .map(|(typ, _, _)| *counts(*typ).get(date).unwrap_or(&0))
+            .sum();
+        let projected = projection.and_then(|p| p.projected(*date)).unwrap_or(0);
+        max_val = max_val.max(sum).max(projected);
+    }
+    max_val = round_max_val(max_val);
+
+    let graph_w = dates.len() * bar_w;
+
+    let bar_height = |v: i64| -> i64 { (v * 100) / max_val.max(1) };
+    let hrz_step = horizontal_step(max_val);
+
+    append(out, "<div class=graph_outer>");
+    append(out, "<div class=graph_scroll>");
+    append(
+        out,
+        &format!("<svg class=graph width={} height=130>", graph_w),
+    );
+
+    let mut val = 0;
+    while val <= max_val {
+        let bar_h = bar_height(val);
+        append(
+            out,
+            &format!(
+                "<line class=hrz x1=0 y1={} x2={} y2={} />",
+                110 - bar_h,
+                graph_w,
+                110 - bar_h
+            ),
+        );
+        val += hrz_step;
+    }
+
+    for (idx, date) in dates.iter().enumerate() {
+        let values: Vec<(&str, &str, i64)> = visible
+            .iter()
+            .map(|(typ, _, short)| (*typ, *short, *counts(*typ).get(date).unwrap_or(&0)))
+            .collect();
+        let outlier = outliers.iter().find(|o| o.date == *date).filter(|_| browsers_shown);
+        // An outlier is drawn even without visitors, as a day that lost all
+        // of them is worth a tooltip too.
+        if values.iter().any(|(_, _, v)| *v > 0) || outlier.is_some() {
+            let mut data_v = if values.len() == 1 {
+                format_num(values[0].2)
+            } else {
+                values
+                    .iter()
+                    .map(|(_, short, v)| format!("{} {}", format_num(*v), short))
+                    .collect::<Vec<_>>()
+                    .join(" · ")
+            };
+            let class = match outlier {
+                Some(o) => {
+                    let _ = write!(data_v, " · {}", o.reason());
+                    if o.is_high() { " class=high" } else { " class=low" }
+                }
+                None => "",
+            };
+            let x = idx * bar_w;
+            let mut group = format!(
+                "<g{} data-v='{}' data-d='{}'><rect class=i x={} y=0 width={} height=110 />",
+                class,
+                data_v,
+                date.format("%Y-%m-%d"),
+                x,
+                bar_w
+            );
+            // Stack bottom-up; heights come from running totals so the
+            // segments meet without rounding gaps.
+            let mut below = 0;
+            for (typ, _, v) in &values {
+                if *v == 0 {
+                    continue;
+                }
+                let bottom = 110 - bar_height(below) as usize;
+                below += v;
+                let top = 110 - bar_height(below) as usize;
+                let _ = write!(
+                    group,
+                    "<rect class={} x={} y={} width={} height={} />\
+                     <line class={} x1={} y1={} x2={} y2={} />",
+                    typ,
+                    x,
+                    top.saturating_sub(2),
+                    bar_w,
+                    bottom - top + 2,
+                    typ,
+                    x,
+                    top.saturating_sub(1),
+                    x + bar_w,
+                    top.saturating_sub(1)
+                );
+            }
+            group.push_str("</g>");
+            append(out, &group);
+        }
+        if date.day() == 1 {
+            let month_end = (*date + Duration::days(32))
+                .with_day(1)
+                .unwrap()
+                - Duration::days(1);
+            let mut qs = clone_params(params);
+            qs.insert("from".to_string(), vec![date.format("%Y-%m-%d").to_string()]);
+            qs.insert(
+                "to".to_string(),
+                vec![month_end.format("%Y-%m-%d").to_string()],
+            );
+            append(
+                out,
+                &format!(
+                    "<line class=date x1={} y1=112 x2={} y2=120 />\
+                     <a href='?{}'><text x={} y=130>{}</text></a>",
+                    idx * bar_w,
+                    idx * bar_w,
+                    encode_params(&qs),
+                    idx * bar_w,
+                    date.format(YEAR_MONTH_FORMAT)
+                ),
+            );
+        }
+        if same_day(*date, Utc::now().date_naive()) {
+            append(
+                out,
+                &format!(
+                    "<line class=today x1={} y1=0 x2={} y2=120 />",
+                    idx * bar_w + bar_w / 2,
+                    idx * bar_w + bar_w / 2
+                ),
+            );
+        }
+        if let Some(best) = record_day.filter(|d| *d == date.format("%Y-%m-%d").to_string()) {
+            append(
+                out,
+                &format!(
+                    "<line class=record x1={} y1=0 x2={} y2=110><title>Record day: {}</title></line>",
+                    idx * bar_w + bar_w / 2,
+                    idx * bar_w + bar_w / 2,
+                    best
+                ),
+            );
+        }
+    }
+    if let Some(projection) = projection {
+        let points: Vec<String> = dates
+            .iter()
+            .enumerate()
+            .filter_map(|(idx, date)| {
+                let v = projection.projected(*date)?;
+                Some(format!("{},{}", idx * bar_w + bar_w / 2, 110 - bar_height(v)))
+            })
+            .collect();
+        append(
+            out,
+            &format!("<polyline class=forecast points='{}' />", points.join(" ")),
+        );
+    }
+    append(out, "</svg>");
+    append(out, "</div>");
+
+    append(out, "<svg class=graph_legend height=130>");
+    let mut val = 0;
+    while val <= max_val {
+        let bar_h = bar_height(val);
+        append(
+            out,
+            &format!(
+                "<text x=20 y={} text-anchor=end>{}</text>",
+                113 - bar_h,
+                format_num(val)
+            ),
+        );
+        val += hrz_step;
+    }
+    append(out, "</svg>");
+
+    append(out, "<div class=graph_hover style='display: none'></div>");
+    append(out, "</div>");
+
+    if let Some(daily) = daily {
+        append(
+            out,
+            &format!(
+                "<div class=growth>Daily unique visitors over {} complete days: \
+                 best {} ({}) &middot; worst {} ({}) &middot; median {} &middot; \
+                 25th&ndash;75th percentile {}&ndash;{} &middot; 90th percentile {}</div>",
+                daily.days,
+                format_number(daily.best.uniques),
+                daily.best.date,
+                format_number(daily.worst.uniques),
+                daily.worst.date,
+                format_number(daily.median),
+                format_number(daily.p25),
+                format_number(daily.p75),
+                format_number(daily.p90)
+            ),
+        );
+    }
+    if let Some(projection) = projection {
+        let delta = (projection.last_month_total > 0).then(|| {
+            (projection.month_total - projection.last_month_total) as f64 * 100.0
+                / projection.last_month_total as f64
+        });
+        append(
+            out,
+            &format!(
+                "<div class=growth>Projected this month: {} visits (daily unique visitors summed) \
+                 &middot; last month {} &middot; {}</div>",
+                format_number(projection.month_total),
+                format_number(projection.last_month_total),
+                growth::format_delta(delta)
+            ),
+        );
+    }
+}
+
+// The timeline types to stack: ?types= when present, otherwise the cookie
+// left by the last toggle, otherwise all of them. The flag tells the caller
+// to remember a selection that came from the query.
+pub(crate) fn timeline_types(params: &HashMap<String, Vec<String>>, headers: &HeaderMap) -> (Vec<&'static str>, bool) {
+    let parse = |value: &str| -> Option<Vec<&'static str>> {
+        let wanted: Vec<&str> = value.split([',', '.']).map(str::trim).collect();
+        let types: Vec<&'static str> = TIMELINE_TYPES
+            .iter()
+            .map(|(typ, _, _)| *typ)
+            .filter(|typ| wanted.contains(typ))
+            .collect();
+        (!types.is_empty()).then_some(types)
+    };
+    if let Some(types) = first_value(params, "types").as_deref().and_then(parse) {
+        return (types, true);
+    }
+    match cookie_value(headers, TYPES_COOKIE).and_then(parse) {
+        Some(types) => (types, false),
+        None => (TIMELINE_TYPES.iter().map(|(typ, _, _)| *typ).collect(), false),
+    }
+}
+
+fn describe_quota(over: &quota::OverQuota) -> String {
+    let mut parts = Vec::new();
+    if let Some(rows) = over.limit.rows {
+        parts.push(format!(
+            "{} of {} rows",
+            format_number(over.usage.rows as i64),
+            format_number(rows as i64)
+        ));
+    }
+    if let Some(bytes) = over.limit.bytes {
+        parts.push(format!(
+            "{} of {} bytes",
+            format_number(over.usage.bytes as i64),
+            format_number(bytes as i64)
+        ));
+    }
+    parts.join(", ")
+}
+
+fn append_growth_summary(out: &mut String, growth: &[growth::MonthGrowth]) {
+    let Some(current) = growth.last() else { return };
+    append(
+        out,
+        &format!(
+            "<div class=growth>{}: {} unique visitors &middot; MoM {} &middot; YoY {}</div>",
+            current.month,
+            format_number(current.uniques),
+            growth::format_delta(current.mom),
+            growth::format_delta(current.yoy)
+        ),
+    );
+}
+
+pub(crate) fn append_headline(out: &mut String, headline: &[growth::Headline]) {
+    if headline.iter().all(|card| card.uniques == 0) {
+        return;
+    }
+    append(out, "<div class=cards>");
+    for card in headline {
+        append(
+            out,
+            &format!(
+                "<div class=card><div class=label>{}</div><div class=value>{}</div><div class=delta>{}</div></div>",
+                card.label,
+                format_number(card.uniques),
+                growth::format_delta(card.delta)
+            ),
+        );
+    }
+    append(out, "</div>");
+}
+
+// Cards for the scheduled reports, in the order of the --reports file. A
+// single value is shown like the headline; larger results as a short table.
+fn append_reports(out: &mut String, defs: &[Report], runs: &HashMap<String, reports::Run>) {
+    append(out, "<div class=cards>");
+    for report in defs {
+        let mut card = format!(
+            "<div class=card><div class=label>{}</div>",
+            escape_html(report.label())
+        );
+        match runs.get(&report.name) {
+            None => card.push_str("<div class=delta>not run yet</div>"),
+            Some(run) => {
+                if let Some(err) = &run.error {
+                    let _ = write!(card, "<div class=delta title='{}'>failed</div>", escape_html(err));
+                } else if let [row] = run.rows.as_slice() {
+                    if let [value] = row.as_slice() {
+                        let value = value
+                            .parse::<i64>()
+                            .map(format_number)
+                            .unwrap_or_else(|_| escape_html(value));
+                        let _ = write!(card, "<div class=value>{}</div>", value);
+                    } else {
+                        append_report_table(&mut card, run);
+                    }
+                } else {
+                    append_report_table(&mut card, run);
+                }
+                let _ = write!(
+                    card,
+                    "<div class=delta>updated {} {} UTC</div>",
+                    locale::current().day_month(run.run_at.date()),
+                    run.run_at.format("%H:%M")
+                );
+            }
+        }
+        card.push_str("</div>");
+        append(out, &card);
+    }
+    append(out, "</div>");
+}
+
+fn append_report_table(card: &mut String, run: &reports::Run) {
+    card.push_str("<table class=rows>");
+    card.push_str("<tr>");
+    for col in &run.columns {
+        let _ = write!(card, "<th>{}</th>", escape_html(col));
+    }
+    card.push_str("</tr>");
+    for row in run.rows.iter().take(10) {
+        card.push_str("<tr>");
+        for value in row {
+            let shown = value
+                .parse::<i64>()
+                .map(format_number)
+                .unwrap_or_else(|_| escape_html(value));
+            let _ = write!(card, "<td title='{}'>{}</td>", escape_html(value), shown);
+        }
+        card.push_str("</tr>");
+    }
+    card.push_str("</table>");
+}
+
+fn append_growth_table(out: &mut String, growth: &[growth::MonthGrowth]) {
+    if growth.iter().all(|m| m.uniques == 0) {
+        return;
+    }
+    append(out, "<h1>Last 12 months</h1>");
+    append(out, "<table class=rows>");
+    append(out, "<tr><th>Month</th><th>Unique visitors</th><th>MoM</th><th>YoY</th></tr>");
+    for month in growth.iter().rev() {
+        append(
+            out,
+            &format!(
+                "<tr><td>{}</td><td>{}</td><td>{}</td><td>{}</td></tr>",
+                month.month,
+                format_number(month.uniques),
+                growth::format_delta(month.mom),
+                growth::format_delta(month.yoy)
+            ),
+        );
+    }
+    append(out, "</table>");
+}
+
+fn append_cohort_table(out: &mut String, cohorts: &[growth::Cohort]) {
+    if cohorts.iter().all(|c| c.size == 0) {
+        return;
+    }
+    append(out, "<h1>Weekly retention</h1>");
+    append(out, "<table class='rows cohorts'>");
+    let weeks: String = (1..growth::COHORT_WEEKS)
+        .map(|offset| format!("<th>+{}</th>", offset))
+        .collect();
+    append(out, &format!("<tr><th>First seen</th><th>Visitors</th>{}</tr>", weeks));
+    for cohort in cohorts {
+        let cells: String = (0..growth::COHORT_WEEKS - 1)
+            .map(|idx| match cohort.returned.get(idx) {
+                Some(&returned) if cohort.size > 0 => format!(
+                    "<td title='{}'>{:.0}%</td>",
+                    format_number(returned),
+                    (returned as f64) * 100.0 / (cohort.size as f64)
+                ),
+                _ => "<td></td>".to_string(),
+            })
+            .collect();
+        append(
+            out,
+            &format!(
+                "<tr><td>{}</td><td>{}</td>{}</tr>",
+                cohort.week,
+                format_number(cohort.size),
+                cells
+            ),
+        );
+    }
+    append(out, "</table>");
+}
+
+// Paths and referrers whose page views changed the most against the period
+// of the same length before the selected one.
+async fn append_movers(
+    out: &mut String,
+    store: &Store,
+    filters: &Filters,
+    params: &HashMap<String, Vec<String>>,
+    from_date: NaiveDate,
+    to_date: NaiveDate,
+) {
+    let by_percent = first_value(params, "movers").as_deref() == Some("percent");
+    let mut panels = Vec::new();
+    for (column, label) in [("path", "paths"), ("ref_domain", "referrers")] {
+        match movers::movers(store, column, from_date, to_date, filters, by_percent).await {
+            Ok((rising, falling)) => panels.push((column, label, rising, falling)),
+            Err(err) => append_error(out, "Movers", &err),
+        }
+    }
+    if panels.iter().all(|(_, _, rising, falling)| rising.is_empty() && falling.is_empty()) {
+        return;
+    }
+
+    let (prior_from, prior_to) = movers::prior_period(from_date, to_date);
+    let mut toggle = clone_params(params);
+    let (toggle_label, toggle_value) = if by_percent {
+        ("by page views", "views")
+    } else {
+        ("by percent", "percent")
+    };
+    toggle.insert("movers".to_string(), vec![toggle_value.to_string()]);
+    append(
+        out,
+        &format!(
+            "<h1>Movers <span class=pct>vs {} &ndash; {} &middot; <a href='?{}'>{}</a></span></h1>",
+            prior_from,
+            prior_to,
+            escape_html(&encode_params(&toggle)),
+            toggle_label
+        ),
+    );
+    append(out, "<div class=tables>");
+    for (column, label, rising, falling) in &panels {
+        for (title, rows) in [("Rising", rising), ("Falling", falling)] {
+            if rows.is_empty() {
+                continue;
+            }
+            append_mover_table(out, params, column, &format!("{} {}", title, label), rows);
+        }
+    }
+    append(out, "</div>");
+}
+
+fn append_mover_table(
+    out: &mut String,
+    params: &HashMap<String, Vec<String>>,
+    column: &str,
+    title: &str,
+    rows: &[Mover],
+) {
+    append(out, "<table class=rows>");
+    append(
+        out,
+        &format!(
+            "<tr><th>{}</th><th>Page views</th><th>Before</th><th>Change</th><th></th></tr>",
+            title
+        ),
+    );
+    for row in rows {
+        let mut qs = clone_params(params);
+        // The columns compared are dashboard filters of the same name.
+        qs.insert(column.to_string(), vec![row.value.clone()]);
+        let change = row.change();
+        append(
+            out,
+            &format!(
+                "<tr><td><a href='?{}' title='{}'>{}</a></td><td>{}</td><td>{}</td><td>{}{}</td><td class=pct>{}</td></tr>",
+                escape_html(&encode_params(&qs)),
+                escape_html(&row.value),
+                escape_html(&row.value),
+                format_number(row.current),
+                format_number(row.previous),
+                if change >= 0 { "+" } else { "&minus;" },
+                format_number(change.abs()),
+                growth::format_delta(row.percent())
+            ),
+        );
+    }
+    append(out, "</table>");
+}
+
+async fn weekday_hour_counts(
+    store: &Store,
+    where_clause: &str,
+    args: &[String],
+) -> Result<[[i64; 24]; 7], anyhow::Error> {
+    let query = format!(
+        "SELECT isodow(date) AS dow, hour(time) AS hour, COUNT(*) AS cnt
+         FROM stats
+         WHERE {} AND type = 'browser'
+         GROUP BY dow, hour",
+        where_clause
+    );
+    let args = args.to_owned();
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let params = params_from_iter(args.iter().map(|s| s.as_str()));
+            let mut rows = stmt.query(params)?;
+            let mut result = [[0i64; 24]; 7];
+            while let Some(row) = rows.next()? {
+                let dow: i64 = row.get(0)?;
+                let hour: i64 = row.get(1)?;
+                let cnt: i64 = row.get(2)?;
+                if (1..=7).contains(&dow) && (0..24).contains(&hour) {
+                    result[(dow - 1) as usize][hour as usize] = cnt;
+                }
+            }
+            Ok(result)
+        })
+        .await
+}
+
+async fn append_heatmap(out: &mut String, store: &Store, where_clause: &str, args: &[String]) {
+    let counts = match weekday_hour_counts(store, where_clause, args).await {
+        Ok(counts) => counts,
+        Err(err) => {
+            append_error(out, "Weekday and hour heatmap", &err);
+            return;
+        }
+    };
+    let max_val = counts.iter().flatten().copied().max().unwrap_or(0);
+    if max_val == 0 {
+        return;
+    }
+    const WEEKDAYS: [&str; 7] = ["Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"];
+
+    append(out, "<h1>Page views by weekday and hour (UTC)</h1>");
+    append(out, "<table class=heatmap>");
+    let mut header = String::from("<tr><td></td>");
+    for hour in 0..24 {
+        let _ = write!(header, "<th>{}</th>", hour);
+    }
+    header.push_str("</tr>");
+    append(out, &header);
+    for (dow, hours) in counts.iter().enumerate() {
+        let mut row = format!("<tr><th>{}</th>", WEEKDAYS[dow]);
+        for (hour, cnt) in hours.iter().enumerate() {
+            let alpha = (*cnt as f64) / (max_val as f64);
+            let _ = write!(
+                row,
+                "<td style='background: rgba(1, 119, 161, {:.2})' title='{} {:02}:00: {}'></td>",
+                alpha,
+                WEEKDAYS[dow],
+                hour,
+                format_num(*cnt)
+            );
+        }
+        row.push_str("</tr>");
+        append(out, &row);
+    }
+    append(out, "</table>");
+}
+
+// Subscribers per feed URL, for sites with several feeds (posts, comments,
+// categories); with one, the RSS Readers timeline already shows it.
+async fn append_feeds(
+    out: &mut String,
+    store: &Store,
+    where_clause: &str,
+    args: &[String],
+    from_date: NaiveDate,
+    to_date: NaiveDate,
+    bar_w: usize,
+) {
+    let series = feeds::daily_subscribers(store, where_clause, args)
+        .await
+        .unwrap_or_else(|err| {
+            append_error(out, "Feeds", &err);
+            Vec::new()
+        });
+    if series.len() < 2 {
+        return;
+    }
+    append(out, "<h1>Feeds</h1>");
+    append(out, "<div class=compare_legend>");
+    for (idx, feed) in series.iter().enumerate() {
+        append(
+            out,
+            &format!(
+                "<span class=s{}>{}: ~{} / day</span>",
+                idx,
+                escape_html(&feed.path),
+                format_number(average(&feed.days))
+            ),
+        );
+    }
+    append(out, "</div>");
+    let lines: Vec<&HashMap<NaiveDate, i64>> = series.iter().map(|feed| &feed.days).collect();
+    append_line_chart(out, &lines, from_date, to_date, bar_w);
+
+    let readers = feeds::feed_readers(store, where_clause, args)
+        .await
+        .unwrap_or_else(|err| {
+            append_error(out, "Feed readers", &err);
+            Vec::new()
+        });
+    if readers.is_empty() {
+        return;
+    }
+    append(out, "<table class=rows>");
+    append(out, "<tr><th>Feed</th><th>Reader</th><th>Subscribers / day</th></tr>");
+    for row in &readers {
+        append(
+            out,
+            &format!(
+                "<tr><td title='{}'>{}</td><td>{}</td><td>{}</td></tr>",
+                escape_html(&row.path),
+                escape_html(&row.path),
+                escape_html(&row.agent),
+                format_number(row.subscribers)
+            ),
+        );
+    }
+    append(out, "</table>");
+}
+
+// Shown only when the middleware reads a consent signal, so readers know
+// how many of the visitors above are estimates.
+async fn append_consent(out: &mut String, store: &Store, where_clause: &str, args: &[String]) {
+    let shares = consent::shares(store, where_clause, args)
+        .await
+        .unwrap_or_else(|err| {
+            append_error(out, "Consent", &err);
+            Vec::new()
+        });
+    let total: i64 = shares.iter().map(|share| share.page_views).sum();
+    if total == 0 {
+        return;
+    }
+    append(out, "<h1>Consent</h1>");
+    append(out, "<table class=rows>");
+    append(out, "<tr><th>Level</th><th>Page views</th><th>Share</th><th>Visitors</th></tr>");
+    for share in &shares {
+        append(
+            out,
+            &format!(
+                "<tr><td title='{}'>{}</td><td>{}</td><td>{:.1}%</td><td>{}</td></tr>",
+                escape_html(consent::describe(&share.level)),
+                escape_html(&share.level),
+                format_number(share.page_views),
+                share.page_views as f64 * 100.0 / total as f64,
+                format_number(share.visitors)
+            ),
+        );
+    }
+    append(out, "</table>");
+}
+
+// Shown only when the middleware sends the scheme. Hosts with HTTP page views
+// are listed below the shares while a migration is under way.
+async fn append_https(
+    out: &mut String,
+    store: &Store,
+    where_clause: &str,
+    args: &[String],
+    params: &HashMap<String, Vec<String>>,
+) {
+    let shares = https::shares(store, where_clause, args).await.unwrap_or_else(|err| {
+        append_error(out, "HTTPS", &err);
+        Vec::new()
+    });
+    let total: i64 = shares.iter().map(|share| share.page_views).sum();
+    if total == 0 {
+        return;
+    }
+    append(out, "<h1>HTTPS</h1>");
+    append(out, "<table class=rows>");
+    append(out, "<tr><th></th><th>Scheme</th><th>Page views</th><th>Share</th><th>Visitors</th></tr>");
+    for share in &shares {
         append(
             out,
             &format!(
-                "<a href='?{}' class='filter'>{}</a>",
-                encode_params(&qs),
-                host
+                "<tr><td class=f>{}</td><td>{}</td><td>{}</td><td>{:.1}%</td><td>{}</td></tr>",
+                filter_links(params, "scheme", &share.scheme),
+                escape_html(&share.scheme),
+                format_number(share.page_views),
+                share.page_views as f64 * 100.0 / total as f64,
+                format_number(share.visitors)
             ),
         );
     }
-}
+    append(out, "</table>");
 
-fn append_active_filters(out: &mut String, params: &HashMap<String, Vec<String>>) {
-    for (key, values) in params {
-        if key == "from" || key == "to" || values.is_empty() {
-            continue;
-        }
-        let mut qs = clone_params(params);
-        qs.remove(key);
+    let hosts = https::http_hosts(store, where_clause, args).await.unwrap_or_else(|err| {
+        append_error(out, "Hosts over HTTP", &err);
+        Vec::new()
+    });
+    if hosts.is_empty() {
+        return;
+    }
+    append(out, "<table class=rows>");
+    append(out, "<tr><th></th><th>Host</th><th>HTTP page views</th><th>HTTPS share</th></tr>");
+    for host in &hosts {
         append(
             out,
             &format!(
-                "<div class=filter>{}: {}<a href='?{}'>&times;</a></div>",
-                key,
-                values[0],
-                encode_params(&qs)
+                "<tr><td class=f>{}</td><td>{}</td><td>{}</td><td>{:.1}%</td></tr>",
+                filter_links(params, "host", &host.host),
+                escape_html(&host.host),
+                format_number(host.http_views),
+                (host.page_views - host.http_views) as f64 * 100.0 / host.page_views as f64
             ),
         );
     }
+    append(out, "</table>");
 }
 
-fn append_timelines(
+// Shown only when the middleware captures status codes and some responses
+// in the range were errors.
+async fn append_errors(
     out: &mut String,
-    data: &HashMap<String, HashMap<NaiveDate, i64>>,
-    totals: &HashMap<String, i64>,
-    params: &HashMap<String, Vec<String>>,
+    store: &Store,
+    from_str: &str,
+    to_str: &str,
+    filters: &Filters,
     from_date: NaiveDate,
     to_date: NaiveDate,
+    bar_w: usize,
 ) {
-    let mut max_val = 1i64;
-    for date_counts in data.values() {
-        for val in date_counts.values() {
-            if *val > max_val {
-                max_val = *val;
-            }
-        }
+    let (where_clause, args) = build_error_where(from_str, to_str, filters);
+    let days = errors::daily_errors(store, &where_clause, &args)
+        .await
+        .unwrap_or_else(|err| {
+            append_error(out, "Errors", &err);
+            HashMap::new()
+        });
+    if days.is_empty() {
+        return;
     }
-    max_val = round_max_val(max_val);
+    let paths = errors::top_error_paths(store, &where_clause, &args)
+        .await
+        .unwrap_or_else(|err| {
+            append_error(out, "Error paths", &err);
+            Vec::new()
+        });
+    let client: i64 = days.values().map(|d| d.client).sum();
+    let server: i64 = days.values().map(|d| d.server).sum();
 
-    let dates = list_dates(from_date, to_date);
-    let graph_w = dates.len() * 3;
+    append(
+        out,
+        &format!(
+            "<h1 class=types><span class='t e4'>4xx: {}</span><span class='t e5'>5xx: {}</span></h1>",
+            format_number(client),
+            format_number(server)
+        ),
+    );
 
+    let dates = list_dates(from_date, to_date);
+    let max_val = round_max_val(days.values().map(|d| d.client + d.server).max().unwrap_or(1));
     let bar_height = |v: i64| -> i64 { (v * 100) / max_val.max(1) };
     let hrz_step = horizontal_step(max_val);
+    let graph_w = dates.len() * bar_w;
 
-    let sections = [
-        ("browser", "Unique visitors"),
-        ("feed", "RSS Readers"),
-        ("bot", "Scrapers"),
-    ];
-
-    for (typ, title) in sections {
-        let Some(date_counts) = data.get(typ) else { continue };
-        if date_counts.is_empty() {
-            continue;
-        }
-        if typ == "feed" {
-            append(
-                out,
-                &format!(
-                    "<h1>{}: ~{} / day</h1>",
-                    title,
-                    format_number_with_commas(average(date_counts))
-                ),
+    append(out, "<div class=graph_outer>");
+    append(out, "<div class=graph_scroll>");
+    append(out, &format!("<svg class=graph width={} height=130>", graph_w));
+    let mut val = 0;
+    while val <= max_val {
+        let y = 110 - bar_height(val);
+        append(out, &format!("<line class=hrz x1=0 y1={} x2={} y2={} />", y, graph_w, y));
+        val += hrz_step;
+    }
+    for (idx, date) in dates.iter().enumerate() {
+        if let Some(day) = days.get(date) {
+            let x = idx * bar_w;
+            let mut group = format!(
+                "<g data-v='{} 4xx · {} 5xx' data-d='{}'><rect class=i x={} y=0 width={} height=110 />",
+                format_num(day.client),
+                format_num(day.server),
+                date.format("%Y-%m-%d"),
+                x,
+                bar_w
             );
-        } else {
+            let mut below = 0;
+            for (class, v) in [("e4", day.client), ("e5", day.server)] {
+                if v == 0 {
+                    continue;
+                }
+                let bottom = 110 - bar_height(below) as usize;
+                below += v;
+                let top = 110 - bar_height(below) as usize;
+                let _ = write!(
+                    group,
+                    "<rect class={} x={} y={} width={} height={} />",
+                    class,
+                    x,
+                    top.saturating_sub(1),
+                    bar_w,
+                    bottom - top + 1
+                );
+            }
+            group.push_str("</g>");
+            append(out, &group);
+        }
+        if date.day() == 1 {
             append(
                 out,
                 &format!(
-                    "<h1>{}: {}</h1>",
-                    title,
-                    format_number_with_commas(*totals.get(typ).unwrap_or(&0))
+                    "<line class=date x1={} y1=112 x2={} y2=120 /><text x={} y=130>{}</text>",
+                    idx * bar_w,
+                    idx * bar_w,
+                    idx * bar_w,
+                    date.format(YEAR_MONTH_FORMAT)
                 ),
             );
         }
-        append(out, "<div class=graph_outer>");
-        append(out, "<div class=graph_scroll>");
+    }
+    append(out, "</svg>");
+    append(out, "</div>");
+    append(out, "<svg class=graph_legend height=130>");
+    let mut val = 0;
+    while val <= max_val {
         append(
             out,
-            &format!("<svg class=graph width={} height=130>", graph_w),
+            &format!(
+                "<text x=20 y={} text-anchor=end>{}</text>",
+                113 - bar_height(val),
+                format_num(val)
+            ),
         );
+        val += hrz_step;
+    }
+    append(out, "</svg>");
+    append(out, "<div class=graph_hover style='display: none'></div>");
+    append(out, "</div>");
 
-        let mut val = 0;
-        while val <= max_val {
-            let bar_h = bar_height(val);
-            append(
-                out,
-                &format!(
-                    "<line class=hrz x1=0 y1={} x2={} y2={} />",
-                    110 - bar_h,
-                    graph_w,
-                    110 - bar_h
-                ),
-            );
-            val += hrz_step;
-        }
+    if paths.is_empty() {
+        return;
+    }
+    append(out, "<h1>Top error paths</h1>");
+    append(out, "<table class=rows>");
+    append(out, "<tr><th>Status</th><th>Path</th><th>Hits</th></tr>");
+    for row in &paths {
+        append(
+            out,
+            &format!(
+                "<tr><td>{}</td><td title='{}'>{}</td><td>{}</td></tr>",
+                row.status,
+                escape_html(&row.path),
+                escape_html(&row.path),
+                format_number(row.hits)
+            ),
+        );
+    }
+    append(out, "</table>");
+}
 
-        for (idx, date) in dates.iter().enumerate() {
-            let val = *date_counts.get(date).unwrap_or(&0);
-            if val > 0 {
-                let bar_h = bar_height(val);
-                let data_v = format_num(val);
-                let data_d = date.format("%Y-%m-%d");
-                let x = idx * 3;
-                let y = 110 - bar_h as usize;
-                append(
-                    out,
-                    &format!(
-                        "<g data-v='{}' data-d='{}'><rect class=i x={} y=0 width=3 height=110 />\
-                         <rect x={} y={} width=3 height={} /><line x1={} y1={} x2={} y2={} /></g>",
-                        data_v,
-                        data_d,
-                        x,
-                        x,
-                        y.saturating_sub(2),
-                        bar_h + 2,
-                        x,
-                        y.saturating_sub(1),
-                        x + 3,
-                        y.saturating_sub(1)
-                    ),
-                );
-            }
-            if date.day() == 1 {
-                let month_end = (*date + Duration::days(32))
-                    .with_day(1)
-                    .unwrap()
-                    - Duration::days(1);
-                let mut qs = clone_params(params);
-                qs.insert("from".to_string(), vec![date.format("%Y-%m-%d").to_string()]);
-                qs.insert(
-                    "to".to_string(),
-                    vec![month_end.format("%Y-%m-%d").to_string()],
-                );
-                append(
-                    out,
-                    &format!(
-                        "<line class=date x1={} y1=112 x2={} y2=120 />\
-                         <a href='?{}'><text x={} y=130>{}</text></a>",
-                        idx * 3,
-                        idx * 3,
-                        encode_params(&qs),
-                        idx * 3,
-                        date.format(YEAR_MONTH_FORMAT)
-                    ),
-                );
-            }
-            if same_day(*date, Utc::now().date_naive()) {
-                append(
-                    out,
-                    &format!(
-                        "<line class=today x1={} y1=0 x2={} y2=120 />",
-                        (idx * 3) + 1,
-                        (idx * 3) + 1
-                    ),
-                );
-            }
-        }
-        append(out, "</svg>");
-        append(out, "</div>");
+struct TableSpec {
+    name: &'static str,
+    title: &'static str,
+    column: &'static str,
+    agent_type: &'static str,
+    href_fn: Option<fn(String) -> String>,
+    // Count distinct visitors instead of hits.
+    uniq: bool,
+    // Rows link to a filter on `column`; off when it is an expression.
+    filter: bool,
+    // Adds p50/p95/p99 response times from path_latency; `column` is the path.
+    latency: bool,
+    // Further SQL condition on the rows, empty for none.
+    condition: &'static str,
+    // Counts the rows where `column` is NULL under this label instead of
+    // leaving them out, empty for none.
+    null_label: &'static str,
+}
+
+// Browser visits without a referrer, or with one that is not a URL: typed
+// in, bookmarked, or hidden by the referring site's Referrer-Policy.
+const DIRECT_LABEL: &str = "Direct / unknown";
+
+const TABLES: &[TableSpec] = &[
+    TableSpec { name: "paths", title: "Paths", column: "path", agent_type: "browser", href_fn: Some(path_href), uniq: false, filter: true, latency: true, condition: "", null_label: "" },
+    TableSpec { name: "queries", title: "Queries", column: "query", agent_type: "browser", href_fn: None, uniq: false, filter: true, latency: false, condition: "", null_label: "" },
+    TableSpec { name: "referrers", title: "Referrers", column: "ref_domain", agent_type: "browser", href_fn: Some(ref_domain_href), uniq: false, filter: true, latency: false, condition: "", null_label: DIRECT_LABEL },
+    TableSpec { name: "search_terms", title: "Search terms", column: "search_terms", agent_type: "browser", href_fn: None, uniq: false, filter: true, latency: false, condition: "", null_label: "" },
+    TableSpec { name: "social", title: "Social", column: "social", agent_type: "browser", href_fn: None, uniq: false, filter: true, latency: false, condition: "", null_label: "" },
+    TableSpec { name: "browsers", title: "Browsers", column: "agent", agent_type: "browser", href_fn: None, uniq: true, filter: true, latency: false, condition: "", null_label: "" },
+    TableSpec { name: "readers", title: "RSS Readers", column: "agent", agent_type: "feed", href_fn: None, uniq: true, filter: true, latency: false, condition: "", null_label: "" },
+    TableSpec { name: "scrapers", title: "Scrapers", column: "agent", agent_type: "bot", href_fn: None, uniq: true, filter: true, latency: false, condition: "", null_label: "" },
+    TableSpec { name: "trapped", title: "Trapped bots", column: "agent", agent_type: "bot", href_fn: None, uniq: true, filter: true, latency: false, condition: "agent LIKE '% (trapped)'", null_label: "" },
+    TableSpec { name: "navigation", title: "Navigation", column: "ref_path || ' → ' || path", agent_type: "browser", href_fn: None, uniq: false, filter: false, latency: false, condition: "", null_label: "" },
+];
+
+// Rows behind one of the dashboard tables, for /api/top. When present, the
+// "others" bucket is the 11th row.
+pub(crate) async fn table_rows(
+    store: &Store,
+    name: &str,
+    where_clause: &str,
+    args: &[String],
+) -> Option<Result<Vec<(String, i64)>, anyhow::Error>> {
+    let spec = TABLES.iter().find(|spec| spec.name == name)?;
+    let where_clause = spec_where(spec, where_clause);
+    let rows = if spec.uniq {
+        top10_uniq(store, spec.column, &where_clause, args).await
+    } else {
+        top10(store, &spec_column(spec), &where_clause, args).await
+    };
+    Some(rows.map(|rows| rows.into_iter().map(|row| (row.value, row.count)).collect()))
+}
+
+fn spec_where(spec: &TableSpec, where_clause: &str) -> String {
+    let mut where_clause = format!("{} AND type = '{}'", where_clause, spec.agent_type);
+    if !spec.condition.is_empty() {
+        where_clause.push_str(&format!(" AND {}", spec.condition));
+    }
+    where_clause
+}
+
+fn spec_column(spec: &TableSpec) -> String {
+    if spec.null_label.is_empty() {
+        spec.column.to_string()
+    } else {
+        format!("COALESCE({}, '{}')", spec.column, spec.null_label)
+    }
+}
+
+fn path_href(v: String) -> String {
+    v
+}
+
+fn ref_domain_href(v: String) -> String {
+    format!("https://{}", v)
+}
 
-        append(out, "<svg class=graph_legend height=130>");
-        let mut val = 0;
-        while val <= max_val {
-            let bar_h = bar_height(val);
+// In progressive mode only placeholders are rendered; script.js then loads
+// each table from /stats/api/table so slow aggregates don't block the page.
+async fn append_tables(
+    out: &mut String,
+    store: &Store,
+    where_clause: &str,
+    args: &[String],
+    params: &HashMap<String, Vec<String>>,
+    progressive: bool,
+) {
+    append(out, "<div class=tables>");
+    for spec in TABLES {
+        if progressive {
+            let mut qs = clone_params(params);
+            qs.insert("name".to_string(), vec![spec.name.to_string()]);
             append(
                 out,
                 &format!(
-                    "<text x=20 y={} text-anchor=end>{}</text>",
-                    113 - bar_h,
-                    format_num(val)
+                    "<div class=table_outer data-src='/stats/api/table?{}'><h1>{}</h1><div class=loading>Loading&hellip;</div></div>",
+                    escape_html(&encode_params(&qs)),
+                    spec.title
                 ),
             );
-            val += hrz_step;
+        } else {
+            append_table_spec(out, store, spec, where_clause, args, params).await;
         }
-        append(out, "</svg>");
-
-        append(out, "<div class=graph_hover style='display: none'></div>");
-        append(out, "</div>");
     }
+    append(out, "</div>");
 }
 
-async fn append_tables(
+async fn append_table_spec(
     out: &mut String,
     store: &Store,
+    spec: &TableSpec,
     where_clause: &str,
     args: &[String],
     params: &HashMap<String, Vec<String>>,
 ) {
-    append(out, "<div class=tables>");
-    append_table(
-        out,
-        store,
-        "Paths",
-        "path",
-        &format!("{} AND type = 'browser'", where_clause),
-        args,
-        params,
-        "path",
-        Some(|v: String| v),
-    )
-    .await;
-    append_table(
-        out,
-        store,
-        "Queries",
-        "query",
-        &format!("{} AND type = 'browser'", where_clause),
-        args,
-        params,
-        "query",
-        None,
-    )
-    .await;
-    append_table(
-        out,
-        store,
-        "Referrers",
-        "ref_domain",
-        &format!("{} AND type = 'browser'", where_clause),
-        args,
-        params,
-        "ref_domain",
-        Some(|v| format!("https://{}", v)),
-    )
-    .await;
-    append_table_uniq(
-        out,
-        store,
-        "Browsers",
-        "agent",
-        &format!("{} AND type = 'browser'", where_clause),
-        args,
-        params,
-        "agent",
-    )
-    .await;
-    append_table_uniq(
-        out,
-        store,
-        "RSS Readers",
-        "agent",
-        &format!("{} AND type = 'feed'", where_clause),
-        args,
-        params,
-        "agent",
-    )
-    .await;
-    append_table_uniq(
-        out,
-        store,
-        "Scrapers",
-        "agent",
-        &format!("{} AND type = 'bot'", where_clause),
-        args,
-        params,
-        "agent",
-    )
-    .await;
-    append(out, "</div>");
+    let where_clause = spec_where(spec, where_clause);
+    if spec.uniq {
+        append_table_uniq(out, store, spec.title, spec.column, &where_clause, args, params, spec.column).await;
+    } else {
+        let filter_param = if spec.filter { spec.column } else { "" };
+        let latency = if spec.latency {
+            path_percentiles(store, params).await
+        } else {
+            HashMap::new()
+        };
+        append_table(
+            out,
+            store,
+            spec.title,
+            &spec_column(spec),
+            &where_clause,
+            args,
+            params,
+            filter_param,
+            spec.href_fn,
+            spec.null_label,
+            &latency,
+        )
+        .await;
+    }
+}
+
+async fn table_handler(
+    State(state): State<AppState>,
+    request_headers: HeaderMap,
+    RawQuery(raw): RawQuery,
+) -> Response {
+    let raw = raw.unwrap_or_default();
+    let validators = cache_validators(&state, &raw);
+    if let Some(resp) = not_modified(&request_headers, validators.as_ref()) {
+        return resp;
+    }
+    let mut params = parse_query(raw);
+    let name = first_value(&params, "name").unwrap_or_default();
+    let Some(spec) = TABLES.iter().find(|spec| spec.name == name) else {
+        return axum::http::StatusCode::NOT_FOUND.into_response();
+    };
+    let filters = extract_filters(&params);
+    if let (Some(shards), Some(host)) = (state.shards.as_deref(), single_filter(&filters, "host")) {
+        if !shards.is_local(host) {
+            return proxy_to_shard(shards, shards.owner(host), "/stats/api/table", &params).await;
+        }
+    }
+    params.remove("name");
+    let (default_from, default_to) = default_year_range();
+    let from_str = first_value(&params, "from").unwrap_or_else(|| default_from.format("%Y-%m-%d").to_string());
+    let to_str = first_value(&params, "to").unwrap_or_else(|| default_to.format("%Y-%m-%d").to_string());
+    let (where_clause, args) = build_where(&from_str, &to_str, &filters);
+
+    let mut body = String::new();
+    let table = append_table_spec(&mut body, &state.store, spec, &where_clause, &args, &params);
+    if let Err(limit) = within_deadline(&state, table).await {
+        eprintln!("{} table for {} to {} took longer than {}s", spec.name, from_str, to_str, limit.as_secs());
+        return (
+            StatusCode::SERVICE_UNAVAILABLE,
+            format!("{} took longer than {}s for this range; try a shorter one.", spec.title, limit.as_secs()),
+        )
+            .into_response();
+    }
+    let mut headers = HeaderMap::new();
+    headers.insert(
+        "Content-Type",
+        "text/html; charset=utf-8".parse().expect("header"),
+    );
+    insert_validators(&mut headers, validators.as_ref());
+    (headers, body).into_response()
 }
 
 #[derive(Clone)]
@@ -624,7 +2545,7 @@ struct RowCount {
     count: i64,
 }
 
-async fn append_table(
+pub(crate) async fn append_table(
     out: &mut String,
     store: &Store,
     title: &str,
@@ -634,14 +2555,22 @@ async fn append_table(
     params: &HashMap<String, Vec<String>>,
     filter_param: &str,
     href_fn: Option<fn(String) -> String>,
+    null_label: &str,
+    latency: &HashMap<String, Percentiles>,
 ) {
-    let rows = top10(store, column, where_clause, args).await.unwrap_or_default();
+    let rows = match top10(store, column, where_clause, args).await {
+        Ok(rows) => rows,
+        Err(err) => {
+            append_table_error(out, title, &err);
+            return;
+        }
+    };
     if rows.is_empty() {
         return;
     }
     append(out, "<div class=table_outer>");
     append(out, &format!("<h1>{}</h1>", title));
-    append(out, "<table>");
+    append(out, if latency.is_empty() { "<table>" } else { "<table class=latency>" });
     let mut total = 0i64;
     for row in &rows {
         total += row.count;
@@ -659,20 +2588,13 @@ async fn append_table(
             percent = (percent * 10.0).round() / 10.0;
             percent_str = format!("{:.1}%", percent);
         }
+        // The label of NULL values is not a value the column can be filtered
+        // or linked by.
+        let unset = !null_label.is_empty() && row.value == null_label;
         append(out, "<tr>");
         append(out, "<td class=f>");
-        if !row.value.is_empty() && !filter_param.is_empty() {
-            let mut qs = clone_params(params);
-            qs.insert(filter_param.to_string(), vec![row.value.clone()]);
-            append(
-                out,
-                &format!(
-                    "<a href='?{}' title='Filter by {} = {}'>&#x1F50D;</a>",
-                    encode_params(&qs),
-                    filter_param,
-                    row.value
-                ),
-            );
+        if !row.value.is_empty() && !unset && !filter_param.is_empty() {
+            append(out, &filter_links(params, filter_param, &row.value));
         }
         append(out, "</td>");
         append(out, "<th>");
@@ -681,11 +2603,19 @@ async fn append_table(
             &format!(
                 "<div style='width: {}'{}></div>",
                 percent_str,
-                if row.value.is_empty() { " class=other" } else { "" }
+                if row.value.is_empty() || unset { " class=other" } else { "" }
             ),
         );
+        if filter_param == "ref_domain" && !row.value.is_empty() && !unset {
+            append(out, &favicon::img(&row.value));
+        }
+        if filter_param == "social" {
+            if let Some(domain) = favicon::social_domain(&row.value) {
+                append(out, &favicon::img(domain));
+            }
+        }
         if let Some(ref href_fn) = href_fn {
-            if !row.value.is_empty() {
+            if !row.value.is_empty() && !unset {
                 append(
                     out,
                     &format!(
@@ -697,7 +2627,7 @@ async fn append_table(
                 );
             }
         }
-        if href_fn.is_none() || row.value.is_empty() {
+        if href_fn.is_none() || row.value.is_empty() || unset {
             let label = if row.value.is_empty() {
                 "Others".to_string()
             } else {
@@ -707,13 +2637,68 @@ async fn append_table(
         }
         append(out, &format!("<td>{}</td>", format_num(row.count)));
         append(out, &format!("<td class='pct'>{}</td>", percent_str));
+        if !latency.is_empty() {
+            append(out, &latency_cells(latency.get(&row.value)));
+        }
         append(out, "</tr>");
     }
     append(out, "</table>");
     append(out, "</div>");
 }
 
-async fn append_table_uniq(
+fn latency_cells(p: Option<&Percentiles>) -> String {
+    match p {
+        Some(p) => format!(
+            "<td class=ms title='p50'>{}</td><td class=ms title='p95'>{}</td><td class=ms title='p99'>{}</td>",
+            latency::format_ms(p.p50),
+            latency::format_ms(p.p95),
+            latency::format_ms(p.p99)
+        ),
+        None => "<td class=ms></td><td class=ms></td><td class=ms></td>".to_string(),
+    }
+}
+
+// Percentiles per path for the range and host/path filters in `params`,
+// empty when durations are not captured.
+async fn path_percentiles(store: &Store, params: &HashMap<String, Vec<String>>) -> HashMap<String, Percentiles> {
+    let (default_from, default_to) = default_year_range();
+    let from_str = first_value(params, "from").unwrap_or_else(|| default_from.format("%Y-%m-%d").to_string());
+    let to_str = first_value(params, "to").unwrap_or_else(|| default_to.format("%Y-%m-%d").to_string());
+    let (where_clause, args) = build_latency_where(&from_str, &to_str, &extract_filters(params));
+    latency::path_percentiles(store, &where_clause, &args)
+        .await
+        .unwrap_or_else(|err| {
+            eprintln!("latency query failed: {}", err);
+            HashMap::new()
+        })
+}
+
+async fn append_slowest_pages(out: &mut String, store: &Store, params: &HashMap<String, Vec<String>>) {
+    let slowest = latency::slowest(&path_percentiles(store, params).await);
+    if slowest.is_empty() {
+        return;
+    }
+    append(out, "<h1>Slowest pages</h1>");
+    append(out, "<table class=rows>");
+    append(out, "<tr><th>Path</th><th>Timed hits</th><th>p50</th><th>p95</th><th>p99</th></tr>");
+    for (path, p) in &slowest {
+        append(
+            out,
+            &format!(
+                "<tr><td title='{}'>{}</td><td>{}</td><td>{}</td><td>{}</td><td>{}</td></tr>",
+                escape_html(path),
+                escape_html(path),
+                format_number(p.hits),
+                latency::format_ms(p.p50),
+                latency::format_ms(p.p95),
+                latency::format_ms(p.p99)
+            ),
+        );
+    }
+    append(out, "</table>");
+}
+
+pub(crate) async fn append_table_uniq(
     out: &mut String,
     store: &Store,
     title: &str,
@@ -723,9 +2708,13 @@ async fn append_table_uniq(
     params: &HashMap<String, Vec<String>>,
     filter_param: &str,
 ) {
-    let rows = top10_uniq(store, column, where_clause, args)
-        .await
-        .unwrap_or_default();
+    let rows = match top10_uniq(store, column, where_clause, args).await {
+        Ok(rows) => rows,
+        Err(err) => {
+            append_table_error(out, title, &err);
+            return;
+        }
+    };
     if rows.is_empty() {
         return;
     }
@@ -752,17 +2741,7 @@ async fn append_table_uniq(
         append(out, "<tr>");
         append(out, "<td class=f>");
         if !row.value.is_empty() && !filter_param.is_empty() {
-            let mut qs = clone_params(params);
-            qs.insert(filter_param.to_string(), vec![row.value.clone()]);
-            append(
-                out,
-                &format!(
-                    "<a href='?{}' title='Filter by {} = {}'>&#x1F50D;</a>",
-                    encode_params(&qs),
-                    filter_param,
-                    row.value
-                ),
-            );
+            append(out, &filter_links(params, filter_param, &row.value));
         }
         append(out, "</td>");
         append(out, "<th>");
@@ -774,6 +2753,9 @@ async fn append_table_uniq(
                 if row.value.is_empty() { " class=other" } else { "" }
             ),
         );
+        if let Some(domain) = favicon::agent_domain(&row.value) {
+            append(out, &favicon::img(domain));
+        }
         let label = if row.value.is_empty() {
             "Others".to_string()
         } else {
@@ -795,16 +2777,17 @@ async fn top10(
     where_clause: &str,
     args: &[String],
 ) -> Result<Vec<RowCount>, anyhow::Error> {
+    // `column` may be an expression, so it is evaluated once as `value`.
     let query = format!(
         "WITH base_query AS (
-            SELECT {col}
+            SELECT {col} AS value
             FROM stats
             WHERE {where_clause}
         ),
         top_values AS (
-            SELECT {col} AS value, COUNT(*) AS count
+            SELECT value, COUNT(*) AS count
             FROM base_query
-            WHERE {col} IS NOT NULL
+            WHERE value IS NOT NULL
             GROUP BY value
             ORDER BY count DESC
         ),
@@ -814,7 +2797,7 @@ async fn top10(
         others AS (
             SELECT NULL AS value, COUNT(*) AS count
             FROM base_query
-            WHERE {col} IS NOT NULL AND {col} NOT IN (SELECT value FROM top_n)
+            WHERE value IS NOT NULL AND value NOT IN (SELECT value FROM top_n)
         )
         SELECT * FROM top_n
         UNION ALL
@@ -893,6 +2876,16 @@ fn read_rows(rows: &mut duckdb::Rows<'_>) -> Result<Vec<RowCount>, anyhow::Error
     Ok(out)
 }
 
+// Width of one day in the timelines: 3px on screen, where long ranges scroll
+// sideways, and as wide as fits PRINT_GRAPH_WIDTH in report mode.
+pub(crate) fn bar_width(from_date: NaiveDate, to_date: NaiveDate, print: bool) -> usize {
+    if !print {
+        return 3;
+    }
+    let days = (to_date - from_date).num_days().max(0) as usize + 1;
+    (PRINT_GRAPH_WIDTH / days).clamp(1, 20)
+}
+
 fn list_dates(from_date: NaiveDate, to_date: NaiveDate) -> Vec<NaiveDate> {
     let mut dates = Vec::new();
     let mut d = from_date;
@@ -936,45 +2929,12 @@ fn horizontal_step(max_val: i64) -> i64 {
     }
 }
 
-fn format_num(n: i64) -> String {
-    if n >= 10_000_000 {
-        return trim_trailing_zero(format!("{:.0}M", n as f64 / 1_000_000.0));
-    }
-    if n >= 1_000_000 {
-        return trim_trailing_zero(format!("{:.1}M", n as f64 / 1_000_000.0));
-    }
-    if n >= 10_000 {
-        return trim_trailing_zero(format!("{:.0}K", n as f64 / 1_000.0));
-    }
-    if n >= 1_000 {
-        return trim_trailing_zero(format!("{:.1}K", n as f64 / 1_000.0));
-    }
-    n.to_string()
-}
-
-fn trim_trailing_zero(mut s: String) -> String {
-    if s.ends_with(".0M") {
-        s = s.replace(".0M", "M");
-    }
-    if s.ends_with(".0K") {
-        s = s.replace(".0K", "K");
-    }
-    s
+pub(crate) fn format_num(n: i64) -> String {
+    locale::current().compact(n)
 }
 
-fn format_number_with_commas(n: i64) -> String {
-    let s = n.to_string();
-    if s.len() <= 3 {
-        return s;
-    }
-    let mut result = String::new();
-    for (i, c) in s.chars().enumerate() {
-        if i > 0 && (s.len() - i) % 3 == 0 {
-            result.push(',');
-        }
-        result.push(c);
-    }
-    result
+pub(crate) fn format_number(n: i64) -> String {
+    locale::current().grouped(n)
 }
 
 fn average(values: &HashMap<NaiveDate, i64>) -> i64 {
@@ -989,14 +2949,29 @@ fn same_day(a: NaiveDate, b: NaiveDate) -> bool {
     a == b
 }
 
-fn clone_params(params: &HashMap<String, Vec<String>>) -> HashMap<String, Vec<String>> {
+pub(crate) fn escape_html(s: &str) -> String {
+    let mut out = String::with_capacity(s.len());
+    for c in s.chars() {
+        match c {
+            '&' => out.push_str("&amp;"),
+            '<' => out.push_str("&lt;"),
+            '>' => out.push_str("&gt;"),
+            '"' => out.push_str("&quot;"),
+            '\'' => out.push_str("&#39;"),
+            _ => out.push(c),
+        }
+    }
+    out
+}
+
+pub(crate) fn clone_params(params: &HashMap<String, Vec<String>>) -> HashMap<String, Vec<String>> {
     params
         .iter()
         .map(|(k, v)| (k.clone(), v.clone()))
         .collect()
 }
 
-fn encode_params(params: &HashMap<String, Vec<String>>) -> String {
+pub(crate) fn encode_params(params: &HashMap<String, Vec<String>>) -> String {
     let mut serializer = url::form_urlencoded::Serializer::new(String::new());
     let mut keys: Vec<_> = params.keys().collect();
     keys.sort();
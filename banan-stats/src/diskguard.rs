@@ -0,0 +1,160 @@
+use crate::audit;
+use crate::store::{DiskUsage, Store};
+use chrono::{Duration as ChronoDuration, Utc};
+use serde_json::json;
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::sync::Arc;
+use std::time::Duration;
+
+#[derive(Clone, Debug)]
+pub struct Options {
+    // Bytes of database blocks plus WAL the store may occupy; 0 disables.
+    pub max_db_size: u64,
+    // Bytes that must stay available on the database's filesystem; 0 disables.
+    pub min_free_space: u64,
+    // Days of raw rows an emergency prune keeps; older ones are rolled up
+    // into daily_rollup and deleted. None only pauses ingest and alerts.
+    pub keep_days: Option<i64>,
+    pub webhook_url: Option<String>,
+    pub interval: Duration,
+}
+
+// Shared between the checker and the ingest handlers.
+#[derive(Default)]
+pub struct Guard {
+    exceeded: AtomicBool,
+    used_bytes: AtomicU64,
+}
+
+impl Guard {
+    // True while a limit is exceeded; ingest answers 507 meanwhile.
+    pub fn exceeded(&self) -> bool {
+        self.exceeded.load(Ordering::Relaxed)
+    }
+
+    // Database size at the last check, for /metrics.
+    pub fn used_bytes(&self) -> u64 {
+        self.used_bytes.load(Ordering::Relaxed)
+    }
+}
+
+// Parses a byte count with an optional binary suffix: 512M, 20G, 1.5T.
+pub fn parse_size(value: &str) -> Result<u64, anyhow::Error> {
+    let value = value.trim();
+    let split = value
+        .find(|c: char| !c.is_ascii_digit() && c != '.')
+        .unwrap_or(value.len());
+    let (number, unit) = value.split_at(split);
+    let number: f64 = number
+        .parse()
+        .map_err(|_| anyhow::anyhow!("invalid size {:?}", value))?;
+    let factor: u64 = match unit.trim().to_ascii_uppercase().trim_end_matches("IB").trim_end_matches('B') {
+        "" => 1,
+        "K" => 1 << 10,
+        "M" => 1 << 20,
+        "G" => 1 << 30,
+        "T" => 1 << 40,
+        _ => anyhow::bail!("invalid size unit in {:?}", value),
+    };
+    Ok((number * factor as f64) as u64)
+}
+
+fn over_limit(usage: &DiskUsage, options: &Options) -> Option<String> {
+    if options.max_db_size > 0 && usage.used > options.max_db_size {
+        return Some(format!(
+            "database uses {} bytes, over --max-db-size {}",
+            usage.used, options.max_db_size
+        ));
+    }
+    if options.min_free_space > 0 && usage.free < options.min_free_space {
+        return Some(format!(
+            "{} bytes left for the database, under --min-free-space {}",
+            usage.free, options.min_free_space
+        ));
+    }
+    None
+}
+
+pub async fn run(store: Arc<Store>, guard: Arc<Guard>, options: Options) {
+    let client = reqwest::Client::new();
+    let mut ticker = tokio::time::interval(options.interval);
+    loop {
+        ticker.tick().await;
+        if let Err(err) = check(&store, &guard, &client, &options).await {
+            eprintln!("disk guard failed: {}", err);
+        }
+    }
+}
+
+async fn check(
+    store: &Store,
+    guard: &Guard,
+    client: &reqwest::Client,
+    options: &Options,
+) -> Result<(), anyhow::Error> {
+    let mut usage = store.disk_usage().await?;
+    guard.used_bytes.store(usage.used, Ordering::Relaxed);
+    let Some(reason) = over_limit(&usage, options) else {
+        if guard.exceeded.swap(false, Ordering::Relaxed) {
+            eprintln!("disk guard: back under the limits, ingest resumed");
+            alert(client, options, "banan-stats resumed ingest: disk usage is back under the limits").await;
+        }
+        return Ok(());
+    };
+    if guard.exceeded.swap(true, Ordering::Relaxed) {
+        // Already paused and pruned; wait for an operator or for space to
+        // free up elsewhere.
+        return Ok(());
+    }
+    eprintln!("disk guard: {}, pausing ingest", reason);
+    let Some(keep_days) = options.keep_days else {
+        let text = format!("banan-stats paused ingest: {}. Free up space or raise the limit.", reason);
+        alert(client, options, &text).await;
+        return Ok(());
+    };
+
+    let cutoff = (Utc::now().date_naive() - ChronoDuration::days(keep_days))
+        .format("%Y-%m-%d")
+        .to_string();
+    let pruned = store.rollup_and_prune(cutoff.clone()).await?;
+    audit::log(store, "disk guard", "prune", &format!("date<{}", cutoff), pruned).await;
+    usage = store.disk_usage().await?;
+    guard.used_bytes.store(usage.used, Ordering::Relaxed);
+    let still = over_limit(&usage, options);
+    eprintln!(
+        "disk guard: rolled up and pruned {} rows before {}{}",
+        pruned,
+        cutoff,
+        if still.is_some() { ", still over the limit" } else { "" }
+    );
+    let text = match &still {
+        Some(reason) => format!(
+            "banan-stats paused ingest: {}. Pruned {} rows before {}, which was not enough.",
+            reason, pruned, cutoff
+        ),
+        None => format!(
+            "banan-stats paused ingest: {}. Pruned {} rows before {}; ingest resumes at the next check.",
+            reason, pruned, cutoff
+        ),
+    };
+    alert(client, options, &text).await;
+    Ok(())
+}
+
+async fn alert(client: &reqwest::Client, options: &Options, text: &str) {
+    let Some(url) = options.webhook_url.as_deref() else {
+        return;
+    };
+    let payload = json!({ "text": text });
+    let result = client
+        .post(url)
+        .timeout(Duration::from_secs(10))
+        .json(&payload)
+        .send()
+        .await;
+    match result {
+        Ok(resp) if !resp.status().is_success() => eprintln!("disk alert webhook returned {}", resp.status()),
+        Err(err) => eprintln!("disk alert webhook failed: {}", err),
+        Ok(_) => {}
+    }
+}
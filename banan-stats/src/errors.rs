@@ -0,0 +1,86 @@
+use crate::store::Store;
+use chrono::NaiveDate;
+use duckdb::params_from_iter;
+use std::collections::HashMap;
+
+#[derive(Clone, Copy, Default)]
+pub struct DayErrors {
+    pub client: i64,
+    pub server: i64,
+}
+
+#[derive(Clone)]
+pub struct ErrorPath {
+    pub path: String,
+    pub status: i64,
+    pub hits: i64,
+}
+
+// 4xx and 5xx responses per day. `where_clause` comes from build_error_where.
+pub async fn daily_errors(
+    store: &Store,
+    where_clause: &str,
+    args: &[String],
+) -> Result<HashMap<NaiveDate, DayErrors>, anyhow::Error> {
+    let query = format!(
+        "SELECT date, CAST(status // 100 AS BIGINT) AS class, COUNT(*) AS cnt
+         FROM stats
+         WHERE {}
+         GROUP BY date, class",
+        where_clause
+    );
+    let args = args.to_owned();
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            let mut result: HashMap<NaiveDate, DayErrors> = HashMap::new();
+            while let Some(row) = rows.next()? {
+                let date: NaiveDate = row.get(0)?;
+                let class: i64 = row.get(1)?;
+                let cnt: i64 = row.get(2)?;
+                let day = result.entry(date).or_default();
+                if class == 4 {
+                    day.client += cnt;
+                } else {
+                    day.server += cnt;
+                }
+            }
+            Ok(result)
+        })
+        .await
+}
+
+// The paths answered with an error most often, split by status code.
+pub async fn top_error_paths(
+    store: &Store,
+    where_clause: &str,
+    args: &[String],
+) -> Result<Vec<ErrorPath>, anyhow::Error> {
+    let query = format!(
+        "SELECT path, CAST(status AS BIGINT) AS status, COUNT(*) AS hits
+         FROM stats
+         WHERE {}
+         GROUP BY path, status
+         ORDER BY hits DESC, path
+         LIMIT 10",
+        where_clause
+    );
+    let args = args.to_owned();
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                let path: Option<String> = row.get(0)?;
+                out.push(ErrorPath {
+                    path: path.unwrap_or_default(),
+                    status: row.get(1)?,
+                    hits: row.get(2)?,
+                });
+            }
+            Ok(out)
+        })
+        .await
+}
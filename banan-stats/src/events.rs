@@ -0,0 +1,263 @@
+use crate::admin;
+use crate::assets;
+use crate::dashboard::{
+    build_where, clone_params, encode_params, escape_html, extract_filters, first_value, parse_query,
+};
+use crate::state::AppState;
+use crate::store::Store;
+use axum::{
+    extract::{RawQuery, State},
+    http::HeaderMap,
+    response::{IntoResponse, Response},
+    routing::get,
+    Router,
+};
+use chrono::{Datelike, Utc};
+use duckdb::params_from_iter;
+use std::collections::HashMap;
+use std::fmt::Write;
+
+const PAGE_SIZE: usize = 100;
+
+const EVENT_COLUMNS: &[&str] = &[
+    "date", "time", "host", "path", "query", "ip", "user_agent", "referrer", "type", "agent", "os",
+    "ref_domain", "ref_path", "mult", "set_cookie", "uniq", "event_id", "extra", "status",
+    "original_ts", "source", "verified_bot", "asn", "asn_name", "datacenter", "fragment",
+    "consent", "search_terms", "social", "scheme", "port",
+];
+
+const DEFAULT_COLUMNS: &[&str] = &[
+    "date", "time", "host", "path", "user_agent", "referrer", "type", "agent", "os",
+];
+
+pub fn router(state: AppState) -> Router {
+    Router::new()
+        .route("/stats/events", get(events_handler))
+        .with_state(state)
+}
+
+async fn events_handler(
+    State(state): State<AppState>,
+    headers: HeaderMap,
+    RawQuery(raw): RawQuery,
+) -> Response {
+    if let Err(resp) = admin::authorize(&state, &headers) {
+        return resp;
+    }
+    let params = parse_query(raw.unwrap_or_default());
+    let now = Utc::now().date_naive();
+    let from = first_value(&params, "from").unwrap_or_else(|| format!("{}-01-01", now.year()));
+    let to = first_value(&params, "to").unwrap_or_else(|| format!("{}-12-31", now.year()));
+    let page = first_value(&params, "page")
+        .and_then(|p| p.parse::<usize>().ok())
+        .unwrap_or(0);
+    let columns = selected_columns(&params);
+
+    let filters = extract_filters(&params);
+    let (where_clause, args) = build_where(&from, &to, &filters);
+    let rows = match fetch_page(&state.store, &columns, &where_clause, &args, page).await {
+        Ok(rows) => rows,
+        Err(err) => {
+            eprintln!("events query failed: {}", err);
+            Vec::new()
+        }
+    };
+
+    if first_value(&params, "format").as_deref() == Some("csv") {
+        return render_csv(&columns, &rows, page);
+    }
+    render_html(&params, &columns, &rows, page).into_response()
+}
+
+fn selected_columns(params: &HashMap<String, Vec<String>>) -> Vec<&'static str> {
+    let requested = params.get("col").cloned().unwrap_or_default();
+    let columns: Vec<&'static str> = EVENT_COLUMNS
+        .iter()
+        .copied()
+        .filter(|col| requested.iter().any(|r| r == col))
+        .collect();
+    if columns.is_empty() {
+        DEFAULT_COLUMNS.to_vec()
+    } else {
+        columns
+    }
+}
+
+async fn fetch_page(
+    store: &Store,
+    columns: &[&str],
+    where_clause: &str,
+    args: &[String],
+    page: usize,
+) -> Result<Vec<Vec<String>>, anyhow::Error> {
+    let select = columns
+        .iter()
+        .map(|col| format!("CAST({} AS VARCHAR)", col))
+        .collect::<Vec<_>>()
+        .join(", ");
+    let query = format!(
+        "SELECT {}
+         FROM stats
+         WHERE {}
+         ORDER BY date DESC, time DESC
+         LIMIT {} OFFSET {}",
+        select,
+        where_clause,
+        PAGE_SIZE,
+        page * PAGE_SIZE
+    );
+    let width = columns.len();
+    let args = args.to_owned();
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                let mut values = Vec::with_capacity(width);
+                for idx in 0..width {
+                    let val: Option<String> = row.get(idx)?;
+                    values.push(val.unwrap_or_default());
+                }
+                out.push(values);
+            }
+            Ok(out)
+        })
+        .await
+}
+
+fn render_csv(columns: &[&str], rows: &[Vec<String>], page: usize) -> Response {
+    let mut body = String::new();
+    let _ = writeln!(body, "{}", columns.join(","));
+    for row in rows {
+        let line = row.iter().map(|v| csv_field(v)).collect::<Vec<_>>().join(",");
+        let _ = writeln!(body, "{}", line);
+    }
+    let mut headers = HeaderMap::new();
+    headers.insert(
+        "Content-Type",
+        "text/csv; charset=utf-8".parse().expect("header"),
+    );
+    headers.insert(
+        "Content-Disposition",
+        format!("attachment; filename=\"events-page-{}.csv\"", page + 1)
+            .parse()
+            .expect("header"),
+    );
+    (headers, body).into_response()
+}
+
+pub(crate) fn csv_field(value: &str) -> String {
+    if value.contains(|c: char| matches!(c, ',' | '"' | '\n' | '\r')) {
+        format!("\"{}\"", value.replace('"', "\"\""))
+    } else {
+        value.to_string()
+    }
+}
+
+fn render_html(
+    params: &HashMap<String, Vec<String>>,
+    columns: &[&str],
+    rows: &[Vec<String>],
+    page: usize,
+) -> (HeaderMap, String) {
+    let mut body = String::new();
+    let mut out = |s: &str| {
+        let _ = writeln!(body, "{}", s);
+    };
+    out("<!DOCTYPE html>");
+    out("<html>");
+    out("<head>");
+    out("<meta charset=\"utf-8\">");
+    out("<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">");
+    out(&assets::style_tag(false));
+    out("</head>");
+    out("<body>");
+
+    let mut back = clone_params(params);
+    for key in ["page", "col", "format"] {
+        back.remove(key);
+    }
+    out("<div class=filters>");
+    out(&format!("<a class=filter href='/stats?{}'>&larr; Dashboard</a>", escape_html(&encode_params(&back))));
+    let mut csv = clone_params(params);
+    csv.insert("format".to_string(), vec!["csv".to_string()]);
+    out(&format!("<a class=filter href='?{}'>Download CSV</a>", escape_html(&encode_params(&csv))));
+    out("</div>");
+
+    out("<form class=columns method=get>");
+    for (key, values) in params {
+        if key == "col" || key == "page" {
+            continue;
+        }
+        for value in values {
+            out(&format!(
+                "<input type=hidden name='{}' value='{}'>",
+                escape_html(key),
+                escape_html(value)
+            ));
+        }
+    }
+    for col in EVENT_COLUMNS {
+        out(&format!(
+            "<label><input type=checkbox name=col value='{}'{}>{}</label>",
+            col,
+            if columns.contains(col) { " checked" } else { "" },
+            col
+        ));
+    }
+    out("<button type=submit>Apply</button>");
+    out("</form>");
+
+    out(&format!("<h1>Events: page {}</h1>", page + 1));
+    out("<table class=rows>");
+    let header: String = columns.iter().map(|c| format!("<th>{}</th>", c)).collect();
+    out(&format!("<tr>{}</tr>", header));
+    for row in rows {
+        let cells: String = row
+            .iter()
+            .map(|v| format!("<td title='{}'>{}</td>", escape_html(v), escape_html(v)))
+            .collect();
+        out(&format!("<tr>{}</tr>", cells));
+    }
+    out("</table>");
+
+    out("<div class=filters>");
+    if page > 0 {
+        let mut prev = clone_params(params);
+        prev.insert("page".to_string(), vec![(page - 1).to_string()]);
+        out(&format!("<a class=filter href='?{}'>&larr; Newer</a>", escape_html(&encode_params(&prev))));
+    }
+    if rows.len() == PAGE_SIZE {
+        let mut next = clone_params(params);
+        next.insert("page".to_string(), vec![(page + 1).to_string()]);
+        out(&format!("<a class=filter href='?{}'>Older &rarr;</a>", escape_html(&encode_params(&next))));
+    }
+    out("</div>");
+
+    // Deletes every row the filters match, including prefetches, fragments
+    // and errors this list leaves out; restorable from the audit log.
+    out("<form class=columns method=post action='/stats/audit/delete'>");
+    for (key, values) in &back {
+        for value in values {
+            out(&format!(
+                "<input type=hidden name='{}' value='{}'>",
+                escape_html(key),
+                escape_html(value)
+            ));
+        }
+    }
+    out("<button type=submit>Delete all rows matching these filters</button>");
+    out("<a class=filter href='/stats/audit'>Audit log</a>");
+    out("</form>");
+
+    out("</body>");
+    out("</html>");
+
+    let mut headers = HeaderMap::new();
+    headers.insert(
+        "Content-Type",
+        "text/html; charset=utf-8".parse().expect("header"),
+    );
+    (headers, body)
+}
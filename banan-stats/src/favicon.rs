@@ -0,0 +1,224 @@
+use crate::dashboard::{escape_html, first_value, parse_query};
+use axum::{
+    body::Bytes,
+    extract::RawQuery,
+    http::{header, StatusCode},
+    response::{IntoResponse, Response},
+    routing::get,
+    Router,
+};
+use once_cell::sync::Lazy;
+use regex::Regex;
+use std::collections::HashMap;
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr, SocketAddr};
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+const MAX_ICON_BYTES: usize = 64 * 1024;
+const MAX_CACHE_ENTRIES: usize = 2048;
+const HIT_TTL: Duration = Duration::from_secs(24 * 3600);
+const MISS_TTL: Duration = Duration::from_secs(3600);
+
+// Hostnames only: IP literals, single-label names and ports are rejected
+// before any lookup happens.
+static RE_DOMAIN: Lazy<Regex> = Lazy::new(|| {
+    Regex::new(r"^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z][a-z0-9-]{0,62}$").unwrap()
+});
+
+struct CacheEntry {
+    fetched: Instant,
+    icon: Option<(String, Bytes)>,
+}
+
+static CACHE: Lazy<Mutex<HashMap<String, CacheEntry>>> = Lazy::new(|| Mutex::new(HashMap::new()));
+
+pub fn router() -> Router {
+    Router::new().route("/stats/favicon-proxy", get(favicon_handler))
+}
+
+// Domains whose favicon stands in for a browser, OS or feed reader name.
+pub fn agent_domain(agent: &str) -> Option<&'static str> {
+    let domain = match agent {
+        "Chrome" => "www.google.com",
+        "Firefox" => "www.mozilla.org",
+        "Safari" | "iOS" | "macOS" => "www.apple.com",
+        "Edg" | "EdgA" | "EdgiOS" | "Windows" => "www.microsoft.com",
+        "OPR" => "www.opera.com",
+        "YaBrowser" => "yandex.com",
+        "SamsungBrowser" => "www.samsung.com",
+        "Vivaldi" => "vivaldi.com",
+        "Android" => "www.android.com",
+        "Linux" => "www.kernel.org",
+        "Feedly" => "feedly.com",
+        "Inoreader" => "www.inoreader.com",
+        "NewsBlur" => "newsblur.com",
+        "Feedbin" => "feedbin.com",
+        "The Old Reader" => "theoldreader.com",
+        _ => return None,
+    };
+    Some(domain)
+}
+
+// Domains whose favicon stands in for a social platform.
+pub fn social_domain(platform: &str) -> Option<&'static str> {
+    let domain = match platform {
+        "Mastodon" => "joinmastodon.org",
+        "Bluesky" => "bsky.app",
+        "Hacker News" => "news.ycombinator.com",
+        "Reddit" => "www.reddit.com",
+        "Lobsters" => "lobste.rs",
+        "X" => "x.com",
+        "Threads" => "www.threads.net",
+        "Facebook" => "www.facebook.com",
+        "Instagram" => "www.instagram.com",
+        "LinkedIn" => "www.linkedin.com",
+        "YouTube" => "www.youtube.com",
+        _ => return None,
+    };
+    Some(domain)
+}
+
+pub fn img(domain: &str) -> String {
+    format!(
+        "<img class=favicon src='/stats/favicon-proxy?domain={}' alt='' loading=lazy>",
+        escape_html(&url::form_urlencoded::byte_serialize(domain.as_bytes()).collect::<String>())
+    )
+}
+
+async fn favicon_handler(RawQuery(raw): RawQuery) -> Response {
+    let params = parse_query(raw.unwrap_or_default());
+    let domain = first_value(&params, "domain")
+        .unwrap_or_default()
+        .trim()
+        .trim_end_matches('.')
+        .to_lowercase();
+    if !RE_DOMAIN.is_match(&domain) {
+        return StatusCode::BAD_REQUEST.into_response();
+    }
+
+    let cached = {
+        let cache = CACHE.lock().expect("favicon cache");
+        cache.get(&domain).and_then(|entry| {
+            let ttl = if entry.icon.is_some() { HIT_TTL } else { MISS_TTL };
+            (entry.fetched.elapsed() < ttl).then(|| entry.icon.clone())
+        })
+    };
+    let icon = match cached {
+        Some(icon) => icon,
+        None => {
+            let icon = match fetch(&domain).await {
+                Ok(icon) => icon,
+                Err(err) => {
+                    eprintln!("favicon {} failed: {}", domain, err);
+                    None
+                }
+            };
+            let mut cache = CACHE.lock().expect("favicon cache");
+            if cache.len() >= MAX_CACHE_ENTRIES {
+                cache.retain(|_, e| e.fetched.elapsed() < MISS_TTL);
+                if cache.len() >= MAX_CACHE_ENTRIES {
+                    cache.clear();
+                }
+            }
+            cache.insert(
+                domain,
+                CacheEntry {
+                    fetched: Instant::now(),
+                    icon: icon.clone(),
+                },
+            );
+            icon
+        }
+    };
+
+    match icon {
+        Some((content_type, bytes)) => (
+            [
+                (header::CONTENT_TYPE, content_type),
+                (header::CACHE_CONTROL, "public, max-age=86400".to_string()),
+            ],
+            bytes,
+        )
+            .into_response(),
+        None => (
+            StatusCode::NOT_FOUND,
+            [(header::CACHE_CONTROL, "public, max-age=3600")],
+        )
+            .into_response(),
+    }
+}
+
+// Resolves the domain once, refuses non-public addresses and pins the request
+// to the checked address so a second DNS answer cannot redirect it. Redirects
+// are not followed.
+async fn fetch(domain: &str) -> Result<Option<(String, Bytes)>, anyhow::Error> {
+    let addr = tokio::net::lookup_host((domain, 443))
+        .await?
+        .find(|addr| is_public(addr.ip()))
+        .ok_or_else(|| anyhow::anyhow!("no public address"))?;
+
+    let client = reqwest::Client::builder()
+        .resolve(domain, SocketAddr::new(addr.ip(), 443))
+        .redirect(reqwest::redirect::Policy::none())
+        .timeout(Duration::from_secs(5))
+        .build()?;
+    let mut resp = client
+        .get(format!("https://{}/favicon.ico", domain))
+        .send()
+        .await?;
+    if !resp.status().is_success() {
+        return Ok(None);
+    }
+    let content_type = resp
+        .headers()
+        .get(header::CONTENT_TYPE)
+        .and_then(|v| v.to_str().ok())
+        .unwrap_or("image/x-icon")
+        .to_string();
+    if !content_type.starts_with("image/") {
+        return Ok(None);
+    }
+    let mut body = Vec::new();
+    while let Some(chunk) = resp.chunk().await? {
+        body.extend_from_slice(&chunk);
+        if body.len() > MAX_ICON_BYTES {
+            return Ok(None);
+        }
+    }
+    Ok(Some((content_type, Bytes::from(body))))
+}
+
+fn is_public(ip: IpAddr) -> bool {
+    match ip {
+        IpAddr::V4(v4) => is_public_v4(v4),
+        IpAddr::V6(v6) => match v6.to_ipv4_mapped() {
+            Some(v4) => is_public_v4(v4),
+            None => is_public_v6(v6),
+        },
+    }
+}
+
+fn is_public_v4(ip: Ipv4Addr) -> bool {
+    let [a, b, ..] = ip.octets();
+    !(ip.is_private()
+        || ip.is_loopback()
+        || ip.is_link_local()
+        || ip.is_broadcast()
+        || ip.is_documentation()
+        || ip.is_unspecified()
+        || ip.is_multicast()
+        || a == 0
+        || (a == 100 && (64..128).contains(&b))
+        || (a == 198 && (18..20).contains(&b))
+        || a >= 240)
+}
+
+fn is_public_v6(ip: Ipv6Addr) -> bool {
+    let first = ip.segments()[0];
+    !(ip.is_loopback()
+        || ip.is_unspecified()
+        || ip.is_multicast()
+        || (first & 0xfe00) == 0xfc00
+        || (first & 0xffc0) == 0xfe80
+        || first == 0x2001 && ip.segments()[1] == 0x0db8)
+}
@@ -0,0 +1,116 @@
+use crate::store::Store;
+use chrono::NaiveDate;
+use duckdb::params_from_iter;
+use std::collections::HashMap;
+
+// Feeds charted separately; the rest only appear in the table.
+const MAX_CHARTED: usize = 5;
+
+pub struct FeedSeries {
+    pub path: String,
+    // Estimated subscribers per day.
+    pub days: HashMap<NaiveDate, i64>,
+}
+
+#[derive(Clone)]
+pub struct FeedReader {
+    pub path: String,
+    pub agent: String,
+    // Subscribers per day, averaged over the days the reader fetched the feed.
+    pub subscribers: i64,
+}
+
+// Subscribers of the most followed feeds per day, counted like the RSS
+// Readers timeline: every reader once a day with its highest multiplier.
+// `where_clause` comes from build_where.
+pub async fn daily_subscribers(
+    store: &Store,
+    where_clause: &str,
+    args: &[String],
+) -> Result<Vec<FeedSeries>, anyhow::Error> {
+    let query = format!(
+        "WITH subq AS (
+             SELECT path, date, MAX(mult) AS mult
+             FROM stats
+             WHERE {} AND type = 'feed'
+             GROUP BY path, date, uniq
+         ),
+         daily AS (
+             SELECT path, date, SUM(mult) AS cnt
+             FROM subq
+             GROUP BY path, date
+         ),
+         top AS (
+             SELECT path FROM daily GROUP BY path ORDER BY AVG(cnt) DESC, path LIMIT {}
+         )
+         SELECT path, date, CAST(cnt AS BIGINT)
+         FROM daily JOIN top USING (path)",
+        where_clause, MAX_CHARTED
+    );
+    let args = args.to_owned();
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            let mut result: HashMap<String, HashMap<NaiveDate, i64>> = HashMap::new();
+            while let Some(row) = rows.next()? {
+                let path: Option<String> = row.get(0)?;
+                let date: NaiveDate = row.get(1)?;
+                let cnt: i64 = row.get(2)?;
+                result.entry(path.unwrap_or_default()).or_default().insert(date, cnt);
+            }
+            let mut out: Vec<FeedSeries> = result
+                .into_iter()
+                .map(|(path, days)| FeedSeries { path, days })
+                .collect();
+            let average = |s: &FeedSeries| s.days.values().sum::<i64>() as f64 / s.days.len().max(1) as f64;
+            out.sort_by(|a, b| average(b).total_cmp(&average(a)).then_with(|| a.path.cmp(&b.path)));
+            Ok(out)
+        })
+        .await
+}
+
+// Subscribers per feed and reader, largest first.
+pub async fn feed_readers(
+    store: &Store,
+    where_clause: &str,
+    args: &[String],
+) -> Result<Vec<FeedReader>, anyhow::Error> {
+    let query = format!(
+        "WITH subq AS (
+             SELECT path, agent, date, MAX(mult) AS mult
+             FROM stats
+             WHERE {} AND type = 'feed'
+             GROUP BY path, agent, date, uniq
+         ),
+         daily AS (
+             SELECT path, agent, date, SUM(mult) AS cnt
+             FROM subq
+             GROUP BY path, agent, date
+         )
+         SELECT path, agent, CAST(round(AVG(cnt)) AS BIGINT) AS subscribers
+         FROM daily
+         GROUP BY path, agent
+         ORDER BY subscribers DESC, path, agent
+         LIMIT 20",
+        where_clause
+    );
+    let args = args.to_owned();
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                let path: Option<String> = row.get(0)?;
+                let agent: Option<String> = row.get(1)?;
+                out.push(FeedReader {
+                    path: path.unwrap_or_default(),
+                    agent: agent.unwrap_or_default(),
+                    subscribers: row.get(2)?,
+                });
+            }
+            Ok(out)
+        })
+        .await
+}
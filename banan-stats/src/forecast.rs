@@ -0,0 +1,135 @@
+use crate::dashboard::{build_where, Filters};
+use crate::growth;
+use crate::store::Store;
+use chrono::{Datelike, Duration, Months, NaiveDate};
+use std::collections::HashMap;
+
+pub struct Forecast {
+    // Projected unique visitors for each day from today to the end of the
+    // month; today is not over, so it is projected too.
+    pub days: Vec<(NaiveDate, i64)>,
+    // Daily unique visitors summed over the month: counted before today plus
+    // projected from today.
+    pub month_total: i64,
+    // The same sum over last month.
+    pub last_month_total: i64,
+}
+
+impl Forecast {
+    pub fn projected(&self, date: NaiveDate) -> Option<i64> {
+        self.days.iter().find(|(d, _)| *d == date).map(|(_, n)| *n)
+    }
+}
+
+// Projects the rest of the month of `today` from the `weeks` weeks before it:
+// each day gets the average of the same weekday over them, so weekend dips
+// carry over. `counts` are unique visitors per date and must cover those weeks
+// and last month. None when `weeks` is 0 or the weeks had no visitors.
+pub fn project(counts: &HashMap<NaiveDate, i64>, today: NaiveDate, weeks: usize) -> Option<Forecast> {
+    if weeks == 0 {
+        return None;
+    }
+    let count = |date: NaiveDate| *counts.get(&date).unwrap_or(&0);
+    let sum_range = |from: NaiveDate, to: NaiveDate| {
+        let mut sum = 0;
+        let mut date = from;
+        while date < to {
+            sum += count(date);
+            date += Duration::days(1);
+        }
+        sum
+    };
+
+    let mut by_weekday = [0i64; 7];
+    let mut date = today - Duration::weeks(weeks as i64);
+    while date < today {
+        by_weekday[date.weekday().num_days_from_monday() as usize] += count(date);
+        date += Duration::days(1);
+    }
+    if by_weekday.iter().all(|n| *n == 0) {
+        return None;
+    }
+    let average = |date: NaiveDate| {
+        let sum = by_weekday[date.weekday().num_days_from_monday() as usize];
+        (sum as f64 / weeks as f64).round() as i64
+    };
+
+    let month_start = today.with_day(1)?;
+    let next_month = month_start + Months::new(1);
+    let mut days = Vec::new();
+    let mut date = today;
+    while date < next_month {
+        days.push((date, average(date)));
+        date += Duration::days(1);
+    }
+    let projected: i64 = days.iter().map(|(_, n)| n).sum();
+    Some(Forecast {
+        month_total: sum_range(month_start, today) + projected,
+        last_month_total: sum_range(month_start - Months::new(1), month_start),
+        days,
+    })
+}
+
+// Queries the daily unique visitors `project` needs, with the dashboard
+// filters; browsers unless a type filter is set.
+pub async fn forecast(
+    store: &Store,
+    filters: &Filters,
+    today: NaiveDate,
+    weeks: usize,
+) -> Result<Option<Forecast>, anyhow::Error> {
+    if weeks == 0 {
+        return Ok(None);
+    }
+    let last_month = today.with_day(1).expect("day 1") - Months::new(1);
+    let from = last_month.min(today - Duration::weeks(weeks as i64));
+    let (mut where_clause, args) = build_where(
+        &from.format("%Y-%m-%d").to_string(),
+        &(today - Duration::days(1)).format("%Y-%m-%d").to_string(),
+        filters,
+    );
+    if !filters.contains_key("type") && !filters.contains_key("type!") {
+        where_clause.push_str(" AND type = 'browser'");
+    }
+    let periods = growth::uniques_by(store, "day", &where_clause, &args).await?;
+    let counts: HashMap<NaiveDate, i64> = periods
+        .into_iter()
+        .filter_map(|p| {
+            let date = NaiveDate::parse_from_str(&p.period, "%Y-%m-%d").ok()?;
+            Some((date, p.uniques))
+        })
+        .collect();
+    Ok(project(&counts, today, weeks))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn projects_weekday_pattern() {
+        let date = |s: &str| NaiveDate::parse_from_str(s, "%Y-%m-%d").unwrap();
+        // Two weeks of 10 visitors on weekdays and 2 on weekends, plus last
+        // month.
+        let mut counts = HashMap::new();
+        let mut day = date("2024-04-01");
+        while day < date("2024-05-27") {
+            let weekend = day.weekday().num_days_from_monday() >= 5;
+            counts.insert(day, if weekend { 2 } else { 10 });
+            day += Duration::days(1);
+        }
+
+        // Monday May 27th: the rest of May is Mon-Fri 27-31.
+        let forecast = project(&counts, date("2024-05-27"), 2).unwrap();
+        assert_eq!(forecast.days.len(), 5);
+        assert_eq!(forecast.projected(date("2024-05-31")), Some(10));
+        assert_eq!(forecast.projected(date("2024-06-01")), None);
+        // May 1-26 has 18 weekdays and 8 weekend days.
+        assert_eq!(forecast.month_total, 18 * 10 + 8 * 2 + 5 * 10);
+        // April has 22 weekdays and 8 weekend days.
+        assert_eq!(forecast.last_month_total, 22 * 10 + 8 * 2);
+
+        assert!(project(&counts, date("2024-05-27"), 0).is_none());
+        assert!(project(&HashMap::new(), date("2024-05-27"), 2).is_none());
+    }
+}
@@ -0,0 +1,221 @@
+use crate::dashboard::{build_where, visits_by_type_date, Filters};
+use crate::schema;
+use crate::state::AppState;
+use crate::store::Store;
+use axum::{
+    extract::State,
+    http::StatusCode,
+    response::{IntoResponse, Response},
+    routing::{get, post},
+    Json, Router,
+};
+use chrono::{DateTime, NaiveDate, Utc};
+use duckdb::params_from_iter;
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+use std::collections::HashMap;
+
+// Implements the Grafana JSON / SimpleJSON datasource contract. Point the
+// datasource URL at http://sidecar:7070/api/grafana.
+const METRICS: &[&str] = &[
+    "uniques.browser",
+    "uniques.feed",
+    "uniques.bot",
+    "pageviews.browser",
+    "pageviews.feed",
+    "pageviews.bot",
+];
+
+pub fn router(state: AppState) -> Router {
+    Router::new()
+        .route("/api/grafana", get(health_handler))
+        .route("/api/grafana/", get(health_handler))
+        .route("/api/grafana/search", post(search_handler))
+        .route("/api/grafana/metrics", post(search_handler))
+        .route("/api/grafana/query", post(query_handler))
+        .route("/api/grafana/annotations", post(annotations_handler))
+        .route("/api/grafana/tag-keys", post(tag_keys_handler))
+        .route("/api/grafana/tag-values", post(tag_values_handler))
+        .with_state(state)
+}
+
+#[derive(Deserialize)]
+struct QueryRequest {
+    range: QueryRange,
+    #[serde(default)]
+    targets: Vec<QueryTarget>,
+    #[serde(default, rename = "adhocFilters")]
+    adhoc_filters: Vec<AdhocFilter>,
+}
+
+#[derive(Deserialize)]
+struct QueryRange {
+    from: DateTime<Utc>,
+    to: DateTime<Utc>,
+}
+
+#[derive(Deserialize)]
+struct QueryTarget {
+    #[serde(default)]
+    target: String,
+}
+
+#[derive(Deserialize)]
+struct AdhocFilter {
+    key: String,
+    #[serde(default)]
+    operator: String,
+    value: String,
+}
+
+#[derive(Serialize)]
+struct TimeSeries {
+    target: String,
+    datapoints: Vec<(i64, i64)>,
+}
+
+#[derive(Deserialize)]
+struct TagValuesRequest {
+    key: String,
+}
+
+async fn health_handler() -> impl IntoResponse {
+    StatusCode::OK
+}
+
+async fn search_handler() -> Json<Vec<&'static str>> {
+    Json(METRICS.to_vec())
+}
+
+async fn query_handler(State(state): State<AppState>, Json(req): Json<QueryRequest>) -> Response {
+    let mut filters: Filters = HashMap::new();
+    for filter in &req.adhoc_filters {
+        if !schema::column(&filter.key).is_some_and(|c| c.filter) {
+            continue;
+        }
+        let key = match filter.operator.as_str() {
+            "" | "=" => filter.key.clone(),
+            "!=" => format!("{}!", filter.key),
+            _ => continue,
+        };
+        filters.entry(key).or_default().push(filter.value.clone());
+    }
+    let from = req.range.from.date_naive().format("%Y-%m-%d").to_string();
+    let to = req.range.to.date_naive().format("%Y-%m-%d").to_string();
+    let (where_clause, args) = build_where(&from, &to, &filters);
+
+    let uniques = visits_by_type_date(&state.store, &where_clause, &args).await;
+    let pageviews = pageviews_by_type_date(&state.store, &where_clause, &args).await;
+    let (uniques, pageviews) = match (uniques, pageviews) {
+        (Ok(u), Ok(p)) => (u, p),
+        (Err(err), _) | (_, Err(err)) => {
+            eprintln!("grafana query failed: {}", err);
+            return (StatusCode::INTERNAL_SERVER_ERROR, err.to_string()).into_response();
+        }
+    };
+
+    let mut out = Vec::new();
+    for target in &req.targets {
+        let Some((metric, typ)) = target.target.split_once('.') else { continue };
+        let source = match metric {
+            "uniques" => &uniques,
+            "pageviews" => &pageviews,
+            _ => continue,
+        };
+        let mut datapoints: Vec<(i64, i64)> = source
+            .get(typ)
+            .map(|counts| {
+                counts
+                    .iter()
+                    .map(|(date, cnt)| (*cnt, epoch_millis(*date)))
+                    .collect()
+            })
+            .unwrap_or_default();
+        datapoints.sort_by_key(|(_, ts)| *ts);
+        out.push(TimeSeries {
+            target: target.target.clone(),
+            datapoints,
+        });
+    }
+    Json(out).into_response()
+}
+
+async fn annotations_handler() -> Json<Vec<Value>> {
+    Json(Vec::new())
+}
+
+async fn tag_keys_handler() -> Json<Vec<Value>> {
+    Json(
+        schema::filter_columns()
+            .map(|key| json!({ "type": "string", "text": key }))
+            .collect(),
+    )
+}
+
+async fn tag_values_handler(
+    State(state): State<AppState>,
+    Json(req): Json<TagValuesRequest>,
+) -> Response {
+    let Some(column) = schema::column(&req.key).filter(|c| c.filter).map(|c| c.name) else {
+        return Json(Vec::<Value>::new()).into_response();
+    };
+    let query = format!(
+        "SELECT DISTINCT CAST({col} AS VARCHAR) FROM stats WHERE {col} IS NOT NULL ORDER BY 1 LIMIT 200",
+        col = column
+    );
+    let values = state
+        .store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query([])?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                let val: String = row.get(0)?;
+                out.push(json!({ "text": val }));
+            }
+            Ok(out)
+        })
+        .await;
+    match values {
+        Ok(values) => Json(values).into_response(),
+        Err(err) => (StatusCode::INTERNAL_SERVER_ERROR, err.to_string()).into_response(),
+    }
+}
+
+async fn pageviews_by_type_date(
+    store: &Store,
+    where_clause: &str,
+    args: &[String],
+) -> Result<HashMap<String, HashMap<NaiveDate, i64>>, anyhow::Error> {
+    let query = format!(
+        "SELECT type, date, COUNT(*) AS cnt
+         FROM stats
+         WHERE {}
+         GROUP BY type, date",
+        where_clause
+    );
+    let args = args.to_owned();
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            let mut result: HashMap<String, HashMap<NaiveDate, i64>> = HashMap::new();
+            while let Some(row) = rows.next()? {
+                let typ: Option<String> = row.get(0)?;
+                let date: NaiveDate = row.get(1)?;
+                let cnt: i64 = row.get(2)?;
+                if let Some(typ) = typ {
+                    result.entry(typ).or_default().insert(date, cnt);
+                }
+            }
+            Ok(result)
+        })
+        .await
+}
+
+fn epoch_millis(date: NaiveDate) -> i64 {
+    date.and_hms_opt(0, 0, 0)
+        .unwrap()
+        .and_utc()
+        .timestamp_millis()
+}
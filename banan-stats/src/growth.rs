@@ -0,0 +1,373 @@
+use crate::dashboard::{build_where, Filters};
+use crate::schema;
+use crate::store::Store;
+use chrono::{Datelike, Duration, Months, NaiveDate};
+use duckdb::params_from_iter;
+use serde::Serialize;
+use std::collections::{BTreeMap, HashMap};
+
+#[derive(Clone, Serialize)]
+pub struct MonthGrowth {
+    pub month: String,
+    pub uniques: i64,
+    pub mom: Option<f64>,
+    pub yoy: Option<f64>,
+}
+
+// Unique browser visitors for the 12 months ending with the month of `to_date`,
+// each with month-over-month and year-over-year change in percent.
+pub async fn monthly_growth(
+    store: &Store,
+    filters: &Filters,
+    to_date: NaiveDate,
+) -> Result<Vec<MonthGrowth>, anyhow::Error> {
+    let last_month = to_date.with_day(1).unwrap();
+    let first_month = last_month - Months::new(23);
+    let range_end = last_month + Months::new(1) - chrono::Duration::days(1);
+    let (where_clause, args) = build_where(
+        &first_month.format("%Y-%m-%d").to_string(),
+        &range_end.format("%Y-%m-%d").to_string(),
+        filters,
+    );
+    let query = format!(
+        "WITH subq AS (
+            SELECT CAST(date_trunc('month', date) AS DATE) AS month, MAX(mult) AS mult
+            FROM stats
+            WHERE {} AND type = 'browser'
+            GROUP BY month, uniq
+        )
+        SELECT month, SUM(mult) AS cnt
+        FROM subq
+        GROUP BY month",
+        where_clause
+    );
+    let counts = store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            let mut result: HashMap<NaiveDate, i64> = HashMap::new();
+            while let Some(row) = rows.next()? {
+                let month: NaiveDate = row.get(0)?;
+                let cnt: i64 = row.get(1)?;
+                result.insert(month, cnt);
+            }
+            Ok(result)
+        })
+        .await?;
+
+    let count = |month: NaiveDate| *counts.get(&month).unwrap_or(&0);
+    let mut out = Vec::with_capacity(12);
+    for offset in (0..12).rev() {
+        let month = last_month - Months::new(offset);
+        let uniques = count(month);
+        out.push(MonthGrowth {
+            month: month.format("%Y-%m").to_string(),
+            uniques,
+            mom: delta_percent(uniques, count(month - Months::new(1))),
+            yoy: delta_percent(uniques, count(month - Months::new(12))),
+        });
+    }
+    Ok(out)
+}
+
+#[derive(Clone, Serialize)]
+pub struct PeriodUniques {
+    pub period: String,
+    pub uniques: i64,
+}
+
+// Unique visitors per day, week, month or year, oldest first. Periods
+// without visitors are left out.
+pub async fn uniques_by(
+    store: &Store,
+    unit: &str,
+    where_clause: &str,
+    args: &[String],
+) -> Result<Vec<PeriodUniques>, anyhow::Error> {
+    let format = match unit {
+        "day" | "week" => "%Y-%m-%d",
+        "month" => "%Y-%m",
+        "year" => "%Y",
+        _ => anyhow::bail!("unknown unit {}", unit),
+    };
+    let query = format!(
+        "WITH subq AS (
+            SELECT CAST(date_trunc('{}', date) AS DATE) AS period, MAX(mult) AS mult
+            FROM stats
+            WHERE {}
+            GROUP BY period, uniq
+        )
+        SELECT period, SUM(mult) AS cnt
+        FROM subq
+        GROUP BY period
+        ORDER BY period",
+        unit, where_clause
+    );
+    let args = args.to_owned();
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                let period: NaiveDate = row.get(0)?;
+                let uniques: i64 = row.get(1)?;
+                out.push(PeriodUniques {
+                    period: period.format(format).to_string(),
+                    uniques,
+                });
+            }
+            Ok(out)
+        })
+        .await
+}
+
+#[derive(Clone, Serialize)]
+pub struct AggregateRow {
+    // Group column to value; None for rows without one.
+    #[serde(flatten)]
+    pub groups: BTreeMap<String, Option<String>>,
+    pub count: i64,
+}
+
+// Counts uniques or hits per combination of `group_by` columns, largest
+// first. A visitor counts once per group, with the highest multiplier it
+// had there, like the dashboard tables. Columns must be group_by columns of
+// schema::COLUMNS; without any, the whole selection is one row.
+pub async fn aggregate(
+    store: &Store,
+    group_by: &[String],
+    uniques: bool,
+    limit: usize,
+    where_clause: &str,
+    args: &[String],
+) -> Result<Vec<AggregateRow>, anyhow::Error> {
+    if let Some(col) = group_by.iter().find(|c| !schema::column(c).is_some_and(|c| c.group_by)) {
+        anyhow::bail!("unknown group_by column {}", col);
+    }
+    let cols = group_by.join(", ");
+    let selected = group_by
+        .iter()
+        .map(|c| format!("CAST({c} AS VARCHAR) AS {c}"))
+        .collect::<Vec<_>>()
+        .join(", ");
+    let query = if group_by.is_empty() && uniques {
+        format!(
+            "SELECT COALESCE(SUM(mult), 0) AS cnt
+            FROM (SELECT MAX(mult) AS mult FROM stats WHERE {where_clause} GROUP BY uniq)"
+        )
+    } else if group_by.is_empty() {
+        format!("SELECT COUNT(*) AS cnt FROM stats WHERE {where_clause}")
+    } else if uniques {
+        format!(
+            "WITH subq AS (
+                SELECT {cols}, MAX(mult) AS mult
+                FROM stats
+                WHERE {where_clause}
+                GROUP BY {cols}, uniq
+            )
+            SELECT {selected}, SUM(mult) AS cnt
+            FROM subq
+            GROUP BY {cols}
+            ORDER BY cnt DESC, {cols}
+            LIMIT {limit}"
+        )
+    } else {
+        format!(
+            "SELECT {selected}, COUNT(*) AS cnt
+            FROM stats
+            WHERE {where_clause}
+            GROUP BY {cols}
+            ORDER BY cnt DESC, {cols}
+            LIMIT {limit}"
+        )
+    };
+    let group_by = group_by.to_owned();
+    let args = args.to_owned();
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                let mut groups = BTreeMap::new();
+                for (idx, col) in group_by.iter().enumerate() {
+                    let value: Option<String> = row.get(idx)?;
+                    groups.insert(col.clone(), value);
+                }
+                let count: i64 = row.get(group_by.len())?;
+                out.push(AggregateRow { groups, count });
+            }
+            Ok(out)
+        })
+        .await
+}
+
+#[derive(Clone, Serialize)]
+pub struct Headline {
+    pub label: &'static str,
+    pub uniques: i64,
+    pub delta: Option<f64>,
+}
+
+// Unique visitors today, over the last 7 and 30 days and all time, each
+// against the period before it: yesterday, the 7 or 30 days before, and
+// all time as of 30 days ago. Counted in a single pass over the table.
+pub async fn headline(
+    store: &Store,
+    filters: &Filters,
+    today: NaiveDate,
+) -> Result<Vec<Headline>, anyhow::Error> {
+    let day = |offset: i64| today - Duration::days(offset);
+    // (label, current from, current to, previous from, previous to);
+    // None leaves the start open.
+    let periods: [(&'static str, Option<NaiveDate>, NaiveDate, Option<NaiveDate>, NaiveDate); 4] = [
+        ("Today", Some(today), today, Some(day(1)), day(1)),
+        ("Last 7 days", Some(day(6)), today, Some(day(13)), day(7)),
+        ("Last 30 days", Some(day(29)), today, Some(day(59)), day(30)),
+        ("All time", None, today, None, day(30)),
+    ];
+    let range = |from: Option<NaiveDate>, to: NaiveDate| match from {
+        Some(from) => format!("date BETWEEN DATE '{}' AND DATE '{}'", from, to),
+        None => format!("date <= DATE '{}'", to),
+    };
+    let mut columns = Vec::new();
+    let mut sums = Vec::new();
+    for (idx, (_, from, to, prev_from, prev_to)) in periods.iter().enumerate() {
+        for (side, (from, to)) in [(from, to), (prev_from, prev_to)].into_iter().enumerate() {
+            let name = format!("p{}_{}", idx, side);
+            columns.push(format!("MAX(mult) FILTER (WHERE {}) AS {}", range(*from, *to), name));
+            sums.push(format!("CAST(COALESCE(SUM({}), 0) AS BIGINT)", name));
+        }
+    }
+
+    let (mut where_clause, args) = build_where("0001-01-01", &today.format("%Y-%m-%d").to_string(), filters);
+    if !filters.contains_key("type") && !filters.contains_key("type!") {
+        where_clause.push_str(" AND type = 'browser'");
+    }
+    let query = format!(
+        "WITH subq AS (
+            SELECT {}
+            FROM stats
+            WHERE {}
+            GROUP BY uniq
+        )
+        SELECT {}
+        FROM subq",
+        columns.join(", "),
+        where_clause,
+        sums.join(", ")
+    );
+    let counts = store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            let mut counts = Vec::new();
+            if let Some(row) = rows.next()? {
+                for idx in 0..8 {
+                    counts.push(row.get::<_, i64>(idx)?);
+                }
+            }
+            Ok(counts)
+        })
+        .await?;
+    if counts.len() < 8 {
+        return Ok(Vec::new());
+    }
+
+    Ok(periods
+        .iter()
+        .enumerate()
+        .map(|(idx, (label, ..))| Headline {
+            label: *label,
+            uniques: counts[idx * 2],
+            delta: delta_percent(counts[idx * 2], counts[idx * 2 + 1]),
+        })
+        .collect())
+}
+
+pub const COHORT_WEEKS: usize = 12;
+
+#[derive(Clone, Serialize)]
+pub struct Cohort {
+    // Monday of the week the visitors were first seen.
+    pub week: String,
+    pub size: i64,
+    // Visitors from the cohort seen again 1, 2, ... weeks later, up to the
+    // week of `to_date`.
+    pub returned: Vec<i64>,
+}
+
+// Weekly retention for the COHORT_WEEKS weeks ending with the week of
+// `to_date`. A visitor's cohort is the first week their uniq shows up in
+// all the data, not just the selected range, so returning visitors from
+// earlier weeks do not count as new.
+pub async fn weekly_cohorts(
+    store: &Store,
+    filters: &Filters,
+    to_date: NaiveDate,
+) -> Result<Vec<Cohort>, anyhow::Error> {
+    let last_week = to_date - Duration::days(to_date.weekday().num_days_from_monday() as i64);
+    let first_week = last_week - Duration::weeks(COHORT_WEEKS as i64 - 1);
+    let (where_clause, args) = build_where("0001-01-01", &to_date.format("%Y-%m-%d").to_string(), filters);
+    let query = format!(
+        "WITH visits AS (
+            SELECT uniq, CAST(date_trunc('week', date) AS DATE) AS week, MAX(mult) AS mult
+            FROM stats
+            WHERE {} AND type = 'browser' AND uniq IS NOT NULL
+            GROUP BY uniq, week
+        ), firsts AS (
+            SELECT uniq, MIN(week) AS cohort
+            FROM visits
+            GROUP BY uniq
+        )
+        SELECT f.cohort, date_diff('week', f.cohort, v.week) AS offset, CAST(SUM(v.mult) AS BIGINT)
+        FROM visits v JOIN firsts f USING (uniq)
+        WHERE f.cohort >= DATE '{}'
+        GROUP BY f.cohort, offset",
+        where_clause, first_week
+    );
+    let counts = store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            let mut result: HashMap<(NaiveDate, i64), i64> = HashMap::new();
+            while let Some(row) = rows.next()? {
+                let cohort: NaiveDate = row.get(0)?;
+                let offset: i64 = row.get(1)?;
+                let cnt: i64 = row.get(2)?;
+                result.insert((cohort, offset), cnt);
+            }
+            Ok(result)
+        })
+        .await?;
+
+    let mut out = Vec::with_capacity(COHORT_WEEKS);
+    for idx in 0..COHORT_WEEKS as i64 {
+        let week = first_week + Duration::weeks(idx);
+        let later = COHORT_WEEKS as i64 - 1 - idx;
+        out.push(Cohort {
+            week: week.format("%Y-%m-%d").to_string(),
+            size: *counts.get(&(week, 0)).unwrap_or(&0),
+            returned: (1..=later)
+                .map(|offset| *counts.get(&(week, offset)).unwrap_or(&0))
+                .collect(),
+        });
+    }
+    Ok(out)
+}
+
+fn delta_percent(current: i64, previous: i64) -> Option<f64> {
+    if previous <= 0 {
+        return None;
+    }
+    Some(((current - previous) as f64) * 100.0 / (previous as f64))
+}
+
+pub fn format_delta(delta: Option<f64>) -> String {
+    match delta {
+        Some(d) if d >= 0.0 => format!("+{:.0}%", d),
+        Some(d) => format!("&minus;{:.0}%", -d),
+        None => "&ndash;".to_string(),
+    }
+}
@@ -0,0 +1,92 @@
+use crate::store::Store;
+use duckdb::params_from_iter;
+
+// Hosts listed under the HTTPS share, most HTTP page views first.
+const MAX_HOSTS: usize = 10;
+
+pub struct SchemeShare {
+    pub scheme: String,
+    pub page_views: i64,
+    pub visitors: i64,
+}
+
+// A host some browser page views still reached over plain HTTP.
+pub struct HttpHost {
+    pub host: String,
+    pub http_views: i64,
+    pub page_views: i64,
+}
+
+// Browser page views and daily visitors per scheme, https first. Empty when
+// no event in the range carried one. `where_clause` comes from build_where.
+pub async fn shares(
+    store: &Store,
+    where_clause: &str,
+    args: &[String],
+) -> Result<Vec<SchemeShare>, anyhow::Error> {
+    let query = format!(
+        "WITH subq AS (
+             SELECT scheme, date, uniq, COUNT(*) AS hits
+             FROM stats
+             WHERE {} AND type = 'browser' AND scheme IS NOT NULL
+             GROUP BY scheme, date, uniq
+         )
+         SELECT scheme, CAST(SUM(hits) AS BIGINT), COUNT(*)
+         FROM subq
+         GROUP BY scheme
+         ORDER BY scheme DESC",
+        where_clause
+    );
+    let args = args.to_owned();
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                out.push(SchemeShare {
+                    scheme: row.get(0)?,
+                    page_views: row.get(1)?,
+                    visitors: row.get(2)?,
+                });
+            }
+            Ok(out)
+        })
+        .await
+}
+
+// The hosts still answering browsers over HTTP, for tracking a migration.
+pub async fn http_hosts(
+    store: &Store,
+    where_clause: &str,
+    args: &[String],
+) -> Result<Vec<HttpHost>, anyhow::Error> {
+    let query = format!(
+        "SELECT host,
+                COUNT(*) FILTER (WHERE scheme = 'http'),
+                COUNT(*)
+         FROM stats
+         WHERE {} AND type = 'browser' AND scheme IS NOT NULL AND host IS NOT NULL
+         GROUP BY host
+         HAVING COUNT(*) FILTER (WHERE scheme = 'http') > 0
+         ORDER BY 2 DESC, host
+         LIMIT {}",
+        where_clause, MAX_HOSTS
+    );
+    let args = args.to_owned();
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                out.push(HttpHost {
+                    host: row.get(0)?,
+                    http_views: row.get(1)?,
+                    page_views: row.get(2)?,
+                });
+            }
+            Ok(out)
+        })
+        .await
+}
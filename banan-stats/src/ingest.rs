@@ -1,25 +1,34 @@
-use crate::analyzer::Line;
+use crate::analyzer::{self, Line};
+use crate::shard::{self, Shards};
 use crate::state::AppState;
+use crate::trap;
+use crate::validate;
 use axum::{
-    body::Body,
+    body::{Body, BodyDataStream, Bytes},
     extract::State,
-    http::StatusCode,
+    http::{header, HeaderMap, StatusCode},
     response::{IntoResponse, Response},
     routing::post,
     Router,
 };
 use chrono::{DateTime, Utc};
 use futures_util::StreamExt;
+use hmac::{Hmac, Mac};
 use http_body_util::BodyExt;
-use serde::Deserialize;
+use serde::{Deserialize, Serialize};
+use sha2::Sha256;
+use std::collections::{BTreeMap, HashMap};
+use url::Url;
 
 pub fn router(state: AppState) -> Router {
     Router::new()
         .route("/ingest", post(ingest_handler))
+        .route("/ingest/v2", post(ingest_v2_handler))
+        .route("/ingest/stream", post(ingest_session_handler))
         .with_state(state)
 }
 
-#[derive(Deserialize)]
+#[derive(Deserialize, Serialize)]
 #[serde(rename_all = "camelCase")]
 struct IngestEvent {
     #[serde(default)]
@@ -46,22 +55,390 @@ struct IngestEvent {
     uniq: String,
     #[serde(default)]
     second_visit: bool,
+    #[serde(default)]
+    prefetch: bool,
+    // Set by the middleware's fragmentMode tag on HTML fetched by scripts.
+    #[serde(default)]
+    fragment: bool,
+    // Fields added by the middleware's captureHeaders and enrichers.
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    extra: BTreeMap<String, String>,
+    // Response status, sent when the middleware's captureStatus is on.
+    #[serde(default)]
+    status: u16,
+    // Upstream response time, sent when the middleware's captureDuration is on.
+    #[serde(default)]
+    duration_ms: f64,
+    // Middleware instance or node that reported the event.
+    #[serde(default)]
+    source: String,
+    // Derived at the edge by the middleware's dataMode minimal, which sends
+    // no IP or User-Agent to derive them from.
+    #[serde(default)]
+    agent: String,
+    #[serde(default)]
+    r#type: String,
+    #[serde(default)]
+    os: String,
+    #[serde(default)]
+    mult: i64,
+    // Consent level the middleware downgraded tracking to, sent when its
+    // consentHeader or consentCookie is set.
+    #[serde(default)]
+    consent: String,
+    // Scheme and port of the request, from X-Forwarded-Proto and
+    // X-Forwarded-Port.
+    #[serde(default)]
+    scheme: String,
+    #[serde(default)]
+    port: i64,
 }
 
-async fn ingest_handler(State(state): State<AppState>, body: Body) -> Response {
-    match ingest_stream(state, body).await {
-        Ok(()) => StatusCode::ACCEPTED.into_response(),
+async fn ingest_handler(State(state): State<AppState>, headers: HeaderMap, body: Body) -> Response {
+    if let Some(busy) = pressure(&state) {
+        return too_busy(busy);
+    }
+    let forwarded = headers.contains_key(shard::FORWARDED_HEADER);
+    let remote = match ingest_stream(state.clone(), forwarded, body).await {
+        Ok(remote) => remote,
         Err(err) => {
             eprintln!("ingest failed: {}", err);
-            StatusCode::BAD_REQUEST.into_response()
+            return StatusCode::BAD_REQUEST.into_response();
+        }
+    };
+    forward_remote(&state, remote).await
+}
+
+// Seconds a disk-full client waits between attempts; the guard rechecks
+// once a minute.
+const DISK_FULL_RETRY_AFTER: u64 = 60;
+
+// The status to turn ingest away with and the seconds a client should wait
+// before sending more, None while the store keeps up and has room.
+fn pressure(state: &AppState) -> Option<(StatusCode, u64)> {
+    if state.disk_guard.exceeded() {
+        return Some((StatusCode::INSUFFICIENT_STORAGE, DISK_FULL_RETRY_AFTER));
+    }
+    let pending = state.store.pending_writes();
+    if state.max_pending_writes == 0 || pending < state.max_pending_writes {
+        return None;
+    }
+    Some((
+        StatusCode::TOO_MANY_REQUESTS,
+        ((pending / state.max_pending_writes) as u64).clamp(1, 30),
+    ))
+}
+
+fn too_busy((status, retry_after): (StatusCode, u64)) -> Response {
+    (status, [(header::RETRY_AFTER, retry_after.to_string())]).into_response()
+}
+
+async fn forward_remote(state: &AppState, remote: HashMap<usize, Vec<u8>>) -> Response {
+    if let Some(shards) = state.shards.as_deref() {
+        for (owner, body) in remote {
+            if let Err(err) = shards.forward_ingest(owner, body).await {
+                eprintln!("ingest forward failed: {}", err);
+                return StatusCode::BAD_GATEWAY.into_response();
+            }
+        }
+    }
+    StatusCode::ACCEPTED.into_response()
+}
+
+// A long-lived ingest connection: the middleware keeps writing NDJSON events
+// (and blank keep-alive lines) into one request while the response streams
+// back an ack line per chunk of stored events, `{"ack":"<last event id>",
+// "count":<events>}`. Counts cover every line consumed, including ones that
+// failed to parse, so the client can drop them in order. Under pressure the
+// ack carries `"drain":<seconds>` and the response ends; the client should
+// reconnect after that long.
+async fn ingest_session_handler(State(state): State<AppState>, headers: HeaderMap, body: Body) -> Response {
+    if let Some(busy) = pressure(&state) {
+        return too_busy(busy);
+    }
+    let session = IngestSession {
+        state,
+        forwarded: headers.contains_key(shard::FORWARDED_HEADER),
+        body: body.into_data_stream(),
+        buffer: Vec::new(),
+        finished: false,
+    };
+    let acks = futures_util::stream::unfold(session, |mut session| async move {
+        let ack = session.next_ack().await?;
+        Some((ack, session))
+    });
+    (
+        [(header::CONTENT_TYPE, "application/x-ndjson")],
+        Body::from_stream(acks),
+    )
+        .into_response()
+}
+
+struct IngestSession {
+    state: AppState,
+    forwarded: bool,
+    body: BodyDataStream,
+    buffer: Vec<u8>,
+    finished: bool,
+}
+
+#[derive(Serialize)]
+struct Ack {
+    ack: String,
+    count: usize,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    drain: Option<u64>,
+}
+
+impl IngestSession {
+    // Reads until at least one event line is complete, stores the lines read
+    // so far and returns their ack. None ends the response.
+    async fn next_ack(&mut self) -> Option<Result<Bytes, std::io::Error>> {
+        while !self.finished {
+            let raw_lines: Vec<Vec<u8>> = match self.body.next().await {
+                Some(Ok(chunk)) => {
+                    self.buffer.extend_from_slice(&chunk);
+                    take_lines(&mut self.buffer)
+                }
+                Some(Err(err)) => {
+                    eprintln!("ingest stream failed: {}", err);
+                    return None;
+                }
+                None => {
+                    self.finished = true;
+                    take_lines(&mut self.buffer).into_iter().chain(take_rest(&mut self.buffer)).collect()
+                }
+            };
+            if raw_lines.is_empty() {
+                continue;
+            }
+            return Some(self.commit(raw_lines).await);
+        }
+        None
+    }
+
+    async fn commit(&mut self, raw_lines: Vec<Vec<u8>>) -> Result<Bytes, std::io::Error> {
+        let shards = if self.forwarded { None } else { self.state.shards.as_deref() };
+        let mut lines = Vec::new();
+        let mut remote: HashMap<usize, Vec<u8>> = HashMap::new();
+        let mut last_id = String::new();
+        let count = raw_lines.len();
+        for raw in raw_lines {
+            match serde_json::from_slice::<IngestEvent>(&raw) {
+                Ok(evt) => {
+                    last_id = evt.event_id.clone();
+                    if verify_event(&self.state, &raw, &evt) {
+                        route_event(&self.state, shards, &raw, evt, &mut lines, &mut remote);
+                    }
+                }
+                Err(err) => eprintln!("ingest stream skipped a line: {}", err),
+            }
+        }
+        // Failures end the response without an ack, so the client resends
+        // everything since the previous one.
+        if !lines.is_empty() {
+            store_lines(&self.state, lines).await.map_err(std::io::Error::other)?;
+        }
+        if let Some(shards) = self.state.shards.as_deref() {
+            for (owner, body) in remote {
+                shards.forward_ingest(owner, body).await.map_err(std::io::Error::other)?;
+            }
+        }
+        let drain = pressure(&self.state).map(|(_, retry_after)| retry_after);
+        if drain.is_some() {
+            self.finished = true;
+        }
+        let mut ack = serde_json::to_vec(&Ack { ack: last_id, count, drain }).map_err(std::io::Error::other)?;
+        ack.push(b'\n');
+        Ok(Bytes::from(ack))
+    }
+}
+
+// Removes the complete, non-blank lines from the front of buffer.
+fn take_lines(buffer: &mut Vec<u8>) -> Vec<Vec<u8>> {
+    let mut lines = Vec::new();
+    while let Some(pos) = buffer.iter().position(|b| *b == b'\n') {
+        let line: Vec<u8> = buffer.drain(..=pos).filter(|b| *b != b'\n' && *b != b'\r').collect();
+        if !line.is_empty() {
+            lines.push(line);
+        }
+    }
+    lines
+}
+
+// The unterminated last line, if any, once the body has ended.
+fn take_rest(buffer: &mut Vec<u8>) -> Option<Vec<u8>> {
+    let line: Vec<u8> = buffer.drain(..).filter(|b| *b != b'\r').collect();
+    (!line.is_empty()).then_some(line)
+}
+
+// Simplified schema for edge collectors: one page view, or an array of them.
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct EdgeEvent {
+    #[serde(default)]
+    id: String,
+    #[serde(default)]
+    ts: Option<DateTime<Utc>>,
+    url: String,
+    #[serde(default)]
+    ip: String,
+    #[serde(default)]
+    ua: String,
+    #[serde(default)]
+    referrer: String,
+    #[serde(default)]
+    content_type: String,
+    #[serde(default)]
+    uniq: String,
+}
+
+#[derive(Deserialize)]
+#[serde(untagged)]
+enum EdgeBatch {
+    Many(Vec<EdgeEvent>),
+    One(EdgeEvent),
+}
+
+async fn ingest_v2_handler(State(state): State<AppState>, headers: HeaderMap, body: Bytes) -> Response {
+    let Some(secret) = state.ingest_secret.as_deref() else {
+        return (StatusCode::FORBIDDEN, "ingest secret not configured").into_response();
+    };
+    if let Err(err) = verify_signature(secret, &headers, &body, Utc::now().timestamp()) {
+        eprintln!("ingest v2 rejected: {}", err);
+        return StatusCode::UNAUTHORIZED.into_response();
+    }
+    if let Some(busy) = pressure(&state) {
+        return too_busy(busy);
+    }
+    let batch: EdgeBatch = match serde_json::from_slice(&body) {
+        Ok(batch) => batch,
+        Err(err) => {
+            eprintln!("ingest v2 failed: {}", err);
+            return StatusCode::BAD_REQUEST.into_response();
+        }
+    };
+    let events = match batch {
+        EdgeBatch::Many(events) => events,
+        EdgeBatch::One(event) => vec![event],
+    };
+
+    let shards = state.shards.as_deref();
+    let mut lines = Vec::new();
+    let mut remote: HashMap<usize, Vec<u8>> = HashMap::new();
+    for edge in events {
+        let Some(mut evt) = edge_to_event(edge) else {
+            return StatusCode::BAD_REQUEST.into_response();
+        };
+        // Forwarded to another shard, the line is signed and then needs a
+        // timestamp for the signature window.
+        evt.timestamp.get_or_insert_with(Utc::now);
+        let raw = match serde_json::to_vec(&evt) {
+            Ok(raw) => raw,
+            Err(err) => {
+                eprintln!("ingest v2 failed: {}", err);
+                return StatusCode::BAD_REQUEST.into_response();
+            }
+        };
+        route_event(&state, shards, &raw, evt, &mut lines, &mut remote);
+    }
+    if !lines.is_empty() {
+        if let Err(err) = store_lines(&state, lines).await {
+            eprintln!("ingest v2 failed: {}", err);
+            return StatusCode::INTERNAL_SERVER_ERROR.into_response();
         }
     }
+    forward_remote(&state, remote).await
+}
+
+// Requests carry `X-Banan-Timestamp` (unix seconds) and `X-Banan-Signature:
+// sha256=<hex>`, the HMAC-SHA256 of "<timestamp>.<body>" keyed with the
+// ingest secret. Timestamps more than five minutes off are rejected.
+fn verify_signature(secret: &str, headers: &HeaderMap, body: &[u8], now: i64) -> Result<(), anyhow::Error> {
+    let timestamp = headers
+        .get("x-banan-timestamp")
+        .and_then(|v| v.to_str().ok())
+        .ok_or_else(|| anyhow::anyhow!("missing timestamp"))?;
+    let ts: i64 = timestamp.parse()?;
+    if (now - ts).abs() > 300 {
+        anyhow::bail!("timestamp out of range");
+    }
+    let signature = headers
+        .get("x-banan-signature")
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| v.strip_prefix("sha256="))
+        .ok_or_else(|| anyhow::anyhow!("missing signature"))?;
+    let signature = hex::decode(signature)?;
+
+    let mut mac = Hmac::<Sha256>::new_from_slice(secret.as_bytes())?;
+    mac.update(timestamp.as_bytes());
+    mac.update(b".");
+    mac.update(body);
+    mac.verify_slice(&signature)
+        .map_err(|_| anyhow::anyhow!("signature mismatch"))
+}
+
+fn edge_to_event(edge: EdgeEvent) -> Option<IngestEvent> {
+    let url = Url::parse(&edge.url).ok()?;
+    let host = url.host_str()?.to_lowercase();
+    let content_type = if edge.content_type.is_empty() {
+        "text/html".to_string()
+    } else {
+        edge.content_type
+    };
+    // Edge uniqs are opaque strings (often a cookie value); hash them into
+    // the UUID space used by the middleware.
+    let uniq = if edge.uniq.is_empty() {
+        String::new()
+    } else {
+        analyzer::hash_uuid(&edge.uniq)
+    };
+    let event_id = if edge.id.is_empty() {
+        String::new()
+    } else {
+        analyzer::hash_uuid(&format!("edge:{}", edge.id))
+    };
+    Some(IngestEvent {
+        event_id,
+        timestamp: edge.ts,
+        host,
+        path: url.path().to_string(),
+        query: url.query().unwrap_or_default().to_string(),
+        ip: edge.ip,
+        user_agent: edge.ua,
+        referrer: edge.referrer,
+        content_type,
+        set_cookie: String::new(),
+        uniq,
+        second_visit: false,
+        prefetch: false,
+        fragment: false,
+        extra: BTreeMap::new(),
+        status: 0,
+        duration_ms: 0.0,
+        source: "edge".to_string(),
+        agent: String::new(),
+        r#type: String::new(),
+        os: String::new(),
+        mult: 0,
+        consent: String::new(),
+        scheme: url.scheme().to_string(),
+        port: url.port_or_known_default().map_or(0, i64::from),
+    })
 }
 
-async fn ingest_stream(state: AppState, body: Body) -> Result<(), anyhow::Error> {
+// Stores the events owned by this instance and returns the raw NDJSON of the
+// events that belong to other shards, keyed by owner.
+async fn ingest_stream(
+    state: AppState,
+    forwarded: bool,
+    body: Body,
+) -> Result<HashMap<usize, Vec<u8>>, anyhow::Error> {
     let mut stream = body.into_data_stream();
     let mut buffer: Vec<u8> = Vec::new();
     let mut lines = Vec::new();
+    let mut remote: HashMap<usize, Vec<u8>> = HashMap::new();
+    let shards = if forwarded { None } else { state.shards.as_deref() };
 
     while let Some(chunk) = stream.next().await {
         let bytes = chunk?;
@@ -77,7 +454,9 @@ async fn ingest_stream(state: AppState, body: Body) -> Result<(), anyhow::Error>
                 continue;
             }
             let evt: IngestEvent = serde_json::from_slice(&trimmed)?;
-            lines.push(event_to_line(evt));
+            if verify_event(&state, &trimmed, &evt) {
+                route_event(&state, shards, &trimmed, evt, &mut lines, &mut remote);
+            }
         }
     }
 
@@ -89,16 +468,179 @@ async fn ingest_stream(state: AppState, body: Body) -> Result<(), anyhow::Error>
             .collect::<Vec<u8>>();
         if !trimmed.is_empty() {
             let evt: IngestEvent = serde_json::from_slice(&trimmed)?;
-            lines.push(event_to_line(evt));
+            if verify_event(&state, &trimmed, &evt) {
+                route_event(&state, shards, &trimmed, evt, &mut lines, &mut remote);
+            }
         }
     }
 
     if !lines.is_empty() {
-        state.store.insert(lines).await?;
+        store_lines(&state, lines).await?;
+    }
+    Ok(remote)
+}
+
+// Inserts the events owned by this instance, minus those of hosts at their
+// storage quota. Dropped events are still acked so the middleware does not
+// resend them.
+async fn store_lines(state: &AppState, mut lines: Vec<Line>) -> Result<(), anyhow::Error> {
+    state.quotas.admit(&mut lines);
+    if lines.is_empty() {
+        return Ok(());
+    }
+    for line in &mut lines {
+        analyzer::analyze(line);
+        if let Some(verifier) = &state.bot_verifier {
+            verifier.check(line);
+        }
+    }
+    let caught = match &state.trap {
+        Some(trap) => trap.check(&mut lines),
+        None => Vec::new(),
+    };
+    if state.minimal_data {
+        lines.iter_mut().for_each(analyzer::minimize);
+    }
+    let forwarded = (!state.sinks.is_empty()).then(|| lines.clone());
+    state.store.insert(lines).await?;
+    if let Some(lines) = forwarded {
+        state.sinks.send(lines);
+    }
+    if !caught.is_empty() {
+        if let Err(err) = trap::reclassify(&state.store, caught).await {
+            eprintln!("trap reclassify failed: {}", err);
+        }
     }
     Ok(())
 }
 
+// Checks the signature of one NDJSON line. With --ingest-secret, signed
+// lines must carry a valid signature and be dated within --signature-window;
+// unsigned ones are only accepted without --require-signed-events. Rejected
+// lines are counted and still acked, so they are not resent.
+fn verify_event(state: &AppState, raw: &[u8], evt: &IngestEvent) -> bool {
+    match verify_line(state, raw, evt) {
+        Ok(()) => true,
+        Err(reject) => {
+            state.validator.count(reject);
+            false
+        }
+    }
+}
+
+fn verify_line(state: &AppState, raw: &[u8], evt: &IngestEvent) -> Result<(), validate::Reject> {
+    let Some(secret) = state.ingest_secret.as_deref() else {
+        return Ok(());
+    };
+    let Some((unsigned, signature)) = split_signature(raw) else {
+        return if state.require_signed_events {
+            Err(validate::Reject::Unsigned)
+        } else {
+            Ok(())
+        };
+    };
+    let mut mac = Hmac::<Sha256>::new_from_slice(secret.as_bytes()).map_err(|_| validate::Reject::Signature)?;
+    mac.update(&unsigned);
+    mac.verify_slice(&signature)
+        .map_err(|_| validate::Reject::Signature)?;
+    // Replays inside the window are dropped by the event_id unique index.
+    let ts = evt.timestamp.ok_or(validate::Reject::Replay)?;
+    if state.signature_window > 0 && (Utc::now() - ts).num_seconds().abs() > state.signature_window {
+        return Err(validate::Reject::Replay);
+    }
+    Ok(())
+}
+
+const SIGNATURE_MEMBER: &[u8] = b",\"sig\":\"";
+
+// A signed line ends in `,"sig":"<64 hex>"}`; the signature covers the line
+// with that member removed. Returns the unsigned line and the signature.
+fn split_signature(raw: &[u8]) -> Option<(Vec<u8>, Vec<u8>)> {
+    let tail = SIGNATURE_MEMBER.len() + 64 + 2;
+    if raw.len() <= tail || !raw.ends_with(b"\"}") {
+        return None;
+    }
+    let start = raw.len() - tail;
+    if &raw[start..start + SIGNATURE_MEMBER.len()] != SIGNATURE_MEMBER {
+        return None;
+    }
+    let signature = hex::decode(&raw[start + SIGNATURE_MEMBER.len()..raw.len() - 2]).ok()?;
+    let mut unsigned = raw[..start].to_vec();
+    unsigned.push(b'}');
+    Some((unsigned, signature))
+}
+
+// Appends a signature to an unsigned line, for lines from /ingest/v2 that
+// are forwarded to the shard owning their host.
+fn sign_line(secret: &str, raw: &[u8]) -> Vec<u8> {
+    let Ok(mut mac) = Hmac::<Sha256>::new_from_slice(secret.as_bytes()) else {
+        return raw.to_vec();
+    };
+    mac.update(raw);
+    let mut signed = raw[..raw.len().saturating_sub(1)].to_vec();
+    signed.extend_from_slice(SIGNATURE_MEMBER);
+    signed.extend_from_slice(hex::encode(mac.finalize().into_bytes()).as_bytes());
+    signed.extend_from_slice(b"\"}");
+    signed
+}
+
+// Validates and normalizes the event, then queues it for this instance or
+// for the shard that owns its host. Rejected events are counted and skipped;
+// forwarded ones carry the raw line and are validated again by their owner.
+fn route_event(
+    state: &AppState,
+    shards: Option<&Shards>,
+    raw: &[u8],
+    mut evt: IngestEvent,
+    lines: &mut Vec<Line>,
+    remote: &mut HashMap<usize, Vec<u8>>,
+) {
+    let validator = &state.validator;
+    let Some(host) = validate::normalize_host(&evt.host) else {
+        validator.count(validate::Reject::Host);
+        return;
+    };
+    // Before sharding, so a host and its aliases land on the same shard.
+    evt.host = analyzer::canonical_host(&host);
+    let mut original = None;
+    if let Some(ts) = evt.timestamp {
+        let now = Utc::now();
+        if let Some(corrected) = validator.correct_timestamp(ts, now) {
+            original = Some(ts);
+            evt.timestamp = Some(corrected);
+        }
+        if let Err(reject) = validator.check_timestamp(evt.timestamp.unwrap_or(now), now) {
+            validator.count(reject);
+            return;
+        }
+    }
+    validator.clamp(&mut [
+        &mut evt.path,
+        &mut evt.query,
+        &mut evt.user_agent,
+        &mut evt.referrer,
+        &mut evt.source,
+        &mut evt.agent,
+    ]);
+    if let Some(shards) = shards {
+        let owner = shards.owner(&evt.host);
+        if !shards.is_local(&evt.host) {
+            let buf = remote.entry(owner).or_default();
+            match state.ingest_secret.as_deref() {
+                Some(secret) if split_signature(raw).is_none() => buf.extend_from_slice(&sign_line(secret, raw)),
+                _ => buf.extend_from_slice(raw),
+            }
+            buf.push(b'\n');
+            return;
+        }
+    }
+    let mut line = event_to_line(evt);
+    if let Some(ts) = original {
+        line.original_ts = ts.format("%Y-%m-%d %H:%M:%S%.3f").to_string();
+    }
+    lines.push(line);
+}
+
 fn event_to_line(evt: IngestEvent) -> Line {
     let ts = evt.timestamp.unwrap_or_else(Utc::now);
     Line {
@@ -111,14 +653,74 @@ fn event_to_line(evt: IngestEvent) -> Line {
         ip: evt.ip,
         user_agent: evt.user_agent,
         referrer: evt.referrer,
-        r#type: content_type_to_type(&evt.content_type),
-        agent: String::new(),
-        os: String::new(),
+        r#type: match content_type_to_type(&evt.content_type) {
+            feed if !feed.is_empty() => feed,
+            _ => edge_type(&evt.r#type, &evt.agent, &evt.user_agent),
+        },
+        agent: evt.agent,
+        os: edge_os(&evt.os),
         ref_domain: String::new(),
-        mult: 0,
+        ref_path: String::new(),
+        mult: evt.mult.max(0),
         set_cookie: evt.set_cookie,
         uniq: evt.uniq,
         second_visit: evt.second_visit,
+        prefetch: evt.prefetch,
+        fragment: evt.fragment,
+        extra: if evt.extra.is_empty() {
+            String::new()
+        } else {
+            serde_json::to_string(&evt.extra).unwrap_or_default()
+        },
+        status: evt.status as i64,
+        duration_ms: evt.duration_ms,
+        original_ts: String::new(),
+        source: evt.source,
+        verified_bot: None,
+        asn: 0,
+        asn_name: String::new(),
+        datacenter: false,
+        consent: edge_consent(&evt.consent),
+        search_terms: String::new(),
+        social: String::new(),
+        scheme: edge_scheme(&evt.scheme),
+        port: if (1..=65535).contains(&evt.port) { evt.port } else { 0 },
+    }
+}
+
+// Only the types and systems the stats columns can hold; anything else is
+// derived here. Events classified at the edge (dataMode minimal, without a
+// User-Agent) still get the --agent-types entry for their agent.
+fn edge_type(kind: &str, agent: &str, user_agent: &str) -> String {
+    if user_agent.is_empty() {
+        if let Some(kind) = analyzer::configured_agent_type(agent) {
+            return kind.to_string();
+        }
+    }
+    match kind {
+        "browser" | "feed" | "bot" => kind.to_string(),
+        _ => String::new(),
+    }
+}
+
+fn edge_os(os: &str) -> String {
+    match os {
+        "Android" | "Windows" | "iOS" | "macOS" | "Linux" => os.to_string(),
+        _ => String::new(),
+    }
+}
+
+fn edge_consent(consent: &str) -> String {
+    match consent {
+        "full" | "cookieless" | "none" => consent.to_string(),
+        _ => String::new(),
+    }
+}
+
+fn edge_scheme(scheme: &str) -> String {
+    match scheme.to_ascii_lowercase().as_str() {
+        scheme @ ("http" | "https") => scheme.to_string(),
+        _ => String::new(),
     }
 }
 
@@ -0,0 +1,118 @@
+use crate::store::Store;
+use duckdb::params_from_iter;
+use std::collections::HashMap;
+
+// Upper bounds of the histogram buckets in milliseconds. Durations above the
+// last bound fall into one more, open-ended bucket.
+pub const BUCKETS_MS: &[f64] = &[5.0, 10.0, 25.0, 50.0, 100.0, 250.0, 500.0, 1000.0, 2500.0, 5000.0, 10000.0];
+
+// Paths with fewer timed hits in the range are left out of the slowest-pages
+// report, where one slow request would otherwise top the list.
+const SLOWEST_MIN_HITS: i64 = 10;
+
+pub fn bucket(duration_ms: f64) -> i64 {
+    BUCKETS_MS
+        .iter()
+        .position(|bound| duration_ms <= *bound)
+        .unwrap_or(BUCKETS_MS.len()) as i64
+}
+
+#[derive(Clone, Copy, Default)]
+pub struct Percentiles {
+    pub hits: i64,
+    pub p50: f64,
+    pub p95: f64,
+    pub p99: f64,
+}
+
+impl Percentiles {
+    fn from_counts(counts: &[i64]) -> Self {
+        Self {
+            hits: counts.iter().sum(),
+            p50: percentile(counts, 0.50),
+            p95: percentile(counts, 0.95),
+            p99: percentile(counts, 0.99),
+        }
+    }
+}
+
+// Estimates the q-quantile by interpolating linearly inside the bucket that
+// holds it. The open-ended bucket reports its lower bound.
+fn percentile(counts: &[i64], q: f64) -> f64 {
+    let total: i64 = counts.iter().sum();
+    if total == 0 {
+        return 0.0;
+    }
+    let rank = q * total as f64;
+    let mut below = 0i64;
+    for (idx, &count) in counts.iter().enumerate() {
+        if count == 0 || ((below + count) as f64) < rank {
+            below += count;
+            continue;
+        }
+        let lower = if idx == 0 { 0.0 } else { BUCKETS_MS[idx - 1] };
+        let Some(&upper) = BUCKETS_MS.get(idx) else {
+            return lower;
+        };
+        return lower + (upper - lower) * (rank - below as f64) / count as f64;
+    }
+    BUCKETS_MS[BUCKETS_MS.len() - 1]
+}
+
+pub fn format_ms(ms: f64) -> String {
+    if ms >= 1000.0 {
+        format!("{:.1}s", ms / 1000.0)
+    } else {
+        format!("{:.0}ms", ms)
+    }
+}
+
+// Percentiles per path for the rows matched by `where_clause`, which comes
+// from build_latency_where.
+pub async fn path_percentiles(
+    store: &Store,
+    where_clause: &str,
+    args: &[String],
+) -> Result<HashMap<String, Percentiles>, anyhow::Error> {
+    let query = format!(
+        "SELECT path, CAST(bucket AS BIGINT), SUM(hits)
+         FROM path_latency
+         WHERE {}
+         GROUP BY path, bucket",
+        where_clause
+    );
+    let args = args.to_owned();
+    let histograms = store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            let mut result: HashMap<String, Vec<i64>> = HashMap::new();
+            while let Some(row) = rows.next()? {
+                let path: String = row.get(0)?;
+                let bucket: i64 = row.get(1)?;
+                let hits: i64 = row.get(2)?;
+                let counts = result.entry(path).or_insert_with(|| vec![0; BUCKETS_MS.len() + 1]);
+                if let Some(slot) = usize::try_from(bucket).ok().and_then(|b| counts.get_mut(b)) {
+                    *slot += hits;
+                }
+            }
+            Ok(result)
+        })
+        .await?;
+    Ok(histograms
+        .into_iter()
+        .map(|(path, counts)| (path, Percentiles::from_counts(&counts)))
+        .collect())
+}
+
+// The ten paths with the highest p95 among those with enough timed hits.
+pub fn slowest(percentiles: &HashMap<String, Percentiles>) -> Vec<(String, Percentiles)> {
+    let mut rows: Vec<(String, Percentiles)> = percentiles
+        .iter()
+        .filter(|(_, p)| p.hits >= SLOWEST_MIN_HITS)
+        .map(|(path, p)| (path.clone(), *p))
+        .collect();
+    rows.sort_by(|a, b| b.1.p95.total_cmp(&a.1.p95).then_with(|| a.0.cmp(&b.0)));
+    rows.truncate(10);
+    rows
+}
@@ -0,0 +1,41 @@
+use crate::state::AppState;
+use axum::{
+    extract::State,
+    response::{
+        sse::{Event, KeepAlive, Sse},
+        IntoResponse, Response,
+    },
+    routing::get,
+    Router,
+};
+use std::convert::Infallible;
+use std::time::Duration;
+
+// How often an open stream checks the store for writes. Each write batch bumps
+// the version, so this also bounds how often a dashboard is told to refresh.
+const POLL_INTERVAL: Duration = Duration::from_secs(5);
+
+pub fn router(state: AppState) -> Router {
+    Router::new()
+        .route("/stats/api/live", get(live_handler))
+        .with_state(state)
+}
+
+// Server-sent events for dashboards showing today: an "update" event, carrying
+// the store version, whenever new events have been written. The page fetches
+// itself again on each one.
+async fn live_handler(State(state): State<AppState>) -> Response {
+    let seen = state.store.version().0;
+    let updates = futures_util::stream::unfold((state, seen), |(state, mut seen)| async move {
+        loop {
+            tokio::time::sleep(POLL_INTERVAL).await;
+            let (version, _) = state.store.version();
+            if version != seen {
+                seen = version.clone();
+                let event = Event::default().event("update").data(version);
+                return Some((Ok::<_, Infallible>(event), (state, seen)));
+            }
+        }
+    });
+    Sse::new(updates).keep_alive(KeepAlive::default()).into_response()
+}
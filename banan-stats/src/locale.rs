@@ -0,0 +1,117 @@
+use chrono::NaiveDate;
+use once_cell::sync::OnceCell;
+
+// How the dashboard writes numbers and short dates.
+pub struct Locale {
+    pub tag: &'static str,
+    // Between groups of three digits.
+    group: &'static str,
+    decimal: &'static str,
+    // strftime pattern for a day and month.
+    day_month: &'static str,
+}
+
+// Looked up by full tag first, then by language, so "de-CH" gets its own
+// grouping and "de-AT" falls back to "de".
+const LOCALES: &[Locale] = &[
+    Locale { tag: "en", group: ",", decimal: ".", day_month: "%b %-d" },
+    Locale { tag: "de", group: ".", decimal: ",", day_month: "%-d.%-m." },
+    Locale { tag: "de-ch", group: "\u{2019}", decimal: ".", day_month: "%-d.%-m." },
+    Locale { tag: "es", group: ".", decimal: ",", day_month: "%-d/%-m" },
+    Locale { tag: "fr", group: "\u{202f}", decimal: ",", day_month: "%d/%m" },
+    Locale { tag: "it", group: ".", decimal: ",", day_month: "%-d/%-m" },
+    Locale { tag: "nl", group: ".", decimal: ",", day_month: "%-d-%-m" },
+    Locale { tag: "pl", group: "\u{a0}", decimal: ",", day_month: "%d.%m" },
+    Locale { tag: "pt", group: ".", decimal: ",", day_month: "%d/%m" },
+    Locale { tag: "ru", group: "\u{a0}", decimal: ",", day_month: "%d.%m" },
+    Locale { tag: "sv", group: "\u{a0}", decimal: ",", day_month: "%-d/%-m" },
+];
+
+static LOCALE: OnceCell<&'static Locale> = OnceCell::new();
+
+// Selects the --locale. Call it before the first page is rendered; later
+// calls have no effect.
+pub fn configure(tag: &str) -> Result<(), anyhow::Error> {
+    let Some(locale) = find(tag) else {
+        let known: Vec<&str> = LOCALES.iter().map(|l| l.tag).collect();
+        anyhow::bail!("unknown locale {}, expected one of {}", tag, known.join(", "));
+    };
+    let _ = LOCALE.set(locale);
+    Ok(())
+}
+
+fn find(tag: &str) -> Option<&'static Locale> {
+    let tag = tag.trim().to_ascii_lowercase().replace('_', "-");
+    let language = tag.split('-').next().unwrap_or_default();
+    LOCALES
+        .iter()
+        .find(|l| l.tag == tag)
+        .or_else(|| LOCALES.iter().find(|l| l.tag == language))
+}
+
+pub fn current() -> &'static Locale {
+    LOCALE.get_or_init(|| &LOCALES[0])
+}
+
+impl Locale {
+    // All digits, grouped: 1,234,567 or 1.234.567.
+    pub fn grouped(&self, n: i64) -> String {
+        let digits = n.unsigned_abs().to_string();
+        let mut out = String::new();
+        if n < 0 {
+            out.push('-');
+        }
+        for (i, c) in digits.chars().enumerate() {
+            if i > 0 && (digits.len() - i) % 3 == 0 {
+                out.push_str(self.group);
+            }
+            out.push(c);
+        }
+        out
+    }
+
+    // Rounded to thousands or millions past 1,000: 1.2K, 35K, 1.5M.
+    pub fn compact(&self, n: i64) -> String {
+        let (value, decimals, suffix) = match n {
+            n if n >= 10_000_000 => (n as f64 / 1_000_000.0, 0, "M"),
+            n if n >= 1_000_000 => (n as f64 / 1_000_000.0, 1, "M"),
+            n if n >= 10_000 => (n as f64 / 1_000.0, 0, "K"),
+            n if n >= 1_000 => (n as f64 / 1_000.0, 1, "K"),
+            n => return n.to_string(),
+        };
+        let mut s = format!("{:.*}", decimals, value);
+        if let Some(whole) = s.strip_suffix(".0") {
+            s = whole.to_string();
+        }
+        format!("{}{}", s.replace('.', self.decimal), suffix)
+    }
+
+    pub fn day_month(&self, date: NaiveDate) -> String {
+        date.format(self.day_month).to_string()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn formats_numbers_per_locale() {
+        let en = find("en-US").unwrap();
+        assert_eq!(en.grouped(1234567), "1,234,567");
+        assert_eq!(en.grouped(-1234), "-1,234");
+        assert_eq!(en.grouped(999), "999");
+        assert_eq!(en.compact(1_250), "1.2K");
+        assert_eq!(en.compact(35_000), "35K");
+        assert_eq!(en.compact(1_000_000), "1M");
+
+        let de = find("de_AT").unwrap();
+        assert_eq!(de.grouped(1234567), "1.234.567");
+        assert_eq!(de.compact(1_500_000), "1,5M");
+
+        let fr = find("fr").unwrap();
+        assert_eq!(fr.grouped(12345), "12\u{202f}345");
+        assert_eq!(find("de-CH").unwrap().grouped(1234), "1\u{2019}234");
+        assert!(find("xx").is_none());
+    }
+}
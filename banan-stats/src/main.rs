@@ -1,13 +1,57 @@
+mod admin;
+mod admission;
 mod analyzer;
+mod anomaly;
+mod assets;
+mod api;
+mod asn;
+mod audit;
+mod boards;
+mod botverify;
+mod compact;
+mod consent;
+mod console;
+mod daily;
 mod dashboard;
+mod diskguard;
+mod errors;
+mod events;
+mod favicon;
+mod feeds;
+mod forecast;
+mod grafana;
+mod growth;
+mod https;
 mod ingest;
+mod latency;
+mod live;
+mod locale;
+mod metrics;
+mod movers;
+mod notifier;
+mod pathtree;
+mod quota;
+mod replay;
+mod reports;
+mod schema;
+mod search;
+mod security;
+mod setup;
+mod shard;
+mod shortlinks;
+mod sinks;
+mod sources;
 mod store;
 mod state;
+mod trap;
+mod validate;
+mod views;
 
 use anyhow::Context;
 use clap::Parser;
 use std::net::SocketAddr;
 use std::sync::Arc;
+use tower_http::compression::CompressionLayer;
 
 #[derive(Parser, Debug)]
 #[command(name = "banan-stats")]
@@ -16,26 +60,372 @@ struct Args {
     listen: String,
     #[arg(long, default_value = "clj_simple_stats.duckdb")]
     db_path: String,
+    #[arg(long, default_value_t = 1800)]
+    uniq_merge_window: i64,
+    #[arg(long)]
+    read_only: bool,
+    #[arg(long)]
+    partition_by_year: bool,
+    #[arg(long)]
+    admin_token: Option<String>,
+    #[arg(long)]
+    trusted_user_header: Option<String>,
+    #[arg(long)]
+    referrer_webhook_url: Option<String>,
+    #[arg(long, default_value_t = 10)]
+    referrer_webhook_threshold: i64,
+    #[arg(long)]
+    referrer_webhook_quiet_hours: Option<String>,
+    #[arg(long, value_delimiter = ',')]
+    shards: Vec<String>,
+    #[arg(long, default_value_t = 0)]
+    shard_index: usize,
+    #[arg(long)]
+    ingest_secret: Option<String>,
+    #[arg(long)]
+    inline_tables: bool,
+    #[arg(long, default_value_t = 30)]
+    dashboard_timeout: u64,
+    #[arg(long, default_value_t = 4)]
+    max_queries: usize,
+    #[arg(long, default_value_t = 16)]
+    query_queue: usize,
+    #[arg(long, default_value_t = 4)]
+    forecast_weeks: usize,
+    #[arg(long, default_value_t = 5.0)]
+    outlier_mads: f64,
+    #[arg(long)]
+    system_fonts: bool,
+    #[arg(long, default_value = security::DEFAULT_CSP)]
+    csp: String,
+    #[arg(long, default_value = "'none'")]
+    frame_ancestors: String,
+    #[arg(long, default_value = "no-referrer")]
+    referrer_policy: String,
+    #[arg(long, default_value_t = 50)]
+    anomaly_min_uniques: i64,
+    #[arg(long, default_value_t = 10.0)]
+    anomaly_factor: f64,
+    #[arg(long)]
+    agent_types: Option<String>,
+    #[arg(long)]
+    host_aliases: Option<String>,
+    #[arg(long, default_value = "en")]
+    locale: String,
+    #[arg(long, default_value_t = 8)]
+    max_pending_writes: usize,
+    #[arg(long)]
+    max_db_size: Option<String>,
+    #[arg(long)]
+    min_free_space: Option<String>,
+    #[arg(long)]
+    emergency_keep_days: Option<i64>,
+    #[arg(long)]
+    disk_alert_webhook_url: Option<String>,
+    #[arg(long)]
+    host_row_quota: Vec<String>,
+    #[arg(long)]
+    host_byte_quota: Vec<String>,
+    #[arg(long, default_value_t = 2048)]
+    max_field_length: usize,
+    #[arg(long, default_value_t = 86400)]
+    max_future_skew: i64,
+    #[arg(long, default_value_t = 0)]
+    max_event_age: i64,
+    #[arg(long, default_value_t = 0)]
+    clock_skew_threshold: i64,
+    #[arg(long, default_value = "bound")]
+    clock_skew_correction: String,
+    #[arg(long)]
+    require_signed_events: bool,
+    #[arg(long, default_value_t = 7 * 86400)]
+    signature_window: i64,
+    #[arg(long, default_value_t = 1000)]
+    console_max_rows: usize,
+    #[arg(long, default_value_t = 10)]
+    console_timeout: u64,
+    #[arg(long)]
+    reports: Option<String>,
+    #[arg(long)]
+    dashboards: Option<String>,
+    #[arg(long)]
+    sink: Vec<String>,
+    #[arg(long)]
+    verify_bots: bool,
+    #[arg(long, default_value_t = 5)]
+    verify_bots_rate: u32,
+    #[arg(long)]
+    analyzer_stages: Option<String>,
+    #[arg(long)]
+    asn_db: Option<String>,
+    #[arg(long)]
+    hosting_asns: Option<String>,
+    #[arg(long)]
+    datacenter_browsers_as_bots: bool,
+    #[arg(long)]
+    trap_path: Vec<String>,
+    #[arg(long, default_value_t = 7)]
+    delete_grace_days: i64,
+    #[arg(long)]
+    minimal_data: bool,
+    #[arg(long)]
+    compact: bool,
+    #[arg(long)]
+    dry_run: bool,
+    #[arg(long)]
+    replay_from: Option<String>,
 }
 
 #[tokio::main]
 async fn main() -> Result<(), anyhow::Error> {
     let args = Args::parse();
-    let store = Arc::new(store::Store::open(&args.db_path)?);
+    analyzer::configure_agent_types(args.agent_types.as_deref())?;
+    analyzer::configure_host_aliases(args.host_aliases.as_deref())?;
+    locale::configure(&args.locale)?;
+    asn::configure(
+        args.asn_db.as_deref(),
+        args.hosting_asns.as_deref(),
+        args.datacenter_browsers_as_bots,
+    )?;
+    // Stages compiled in on top of the built-in ones, in the order they run.
+    analyzer::configure_stages(&[asn::STAGE], args.analyzer_stages.as_deref())?;
+    let store = Arc::new(store::Store::open(
+        &args.db_path,
+        store::Options {
+            uniq_merge_window: args.uniq_merge_window,
+            read_only: args.read_only,
+            partition_by_year: args.partition_by_year,
+        },
+    )?);
+    if args.compact {
+        return run_compaction(&store, args.dry_run).await;
+    }
+    if let Some(dir) = args.replay_from.as_deref() {
+        return run_replay(&store, dir).await;
+    }
     let http_addr = normalize_listen_addr(&args.listen)?;
 
-    let app_state = state::AppState { store: store.clone() };
-    let http_app = dashboard::router(app_state.clone()).merge(ingest::router(app_state));
+    if let Some(url) = args
+        .referrer_webhook_url
+        .clone()
+        .filter(|u| !u.is_empty() && !args.read_only)
+    {
+        let quiet_hours = args
+            .referrer_webhook_quiet_hours
+            .as_deref()
+            .map(notifier::parse_quiet_hours)
+            .transpose()?;
+        tokio::spawn(notifier::run(
+            store.clone(),
+            notifier::Options {
+                webhook_url: url,
+                threshold: args.referrer_webhook_threshold,
+                quiet_hours,
+                interval: std::time::Duration::from_secs(300),
+            },
+        ));
+    }
+
+    if !args.read_only {
+        tokio::spawn(anomaly::run(
+            store.clone(),
+            anomaly::Options {
+                min_uniques: args.anomaly_min_uniques,
+                factor: args.anomaly_factor,
+                interval: std::time::Duration::from_secs(300),
+            },
+        ));
+    }
+
+    if !args.read_only {
+        tokio::spawn(audit::run(store.clone(), args.delete_grace_days.max(0)));
+    }
+
+    let disk_guard = Arc::new(diskguard::Guard::default());
+    let max_db_size = args.max_db_size.as_deref().map(diskguard::parse_size).transpose()?;
+    let min_free_space = args.min_free_space.as_deref().map(diskguard::parse_size).transpose()?;
+    if !args.read_only && (max_db_size.is_some() || min_free_space.is_some()) {
+        tokio::spawn(diskguard::run(
+            store.clone(),
+            disk_guard.clone(),
+            diskguard::Options {
+                max_db_size: max_db_size.unwrap_or(0),
+                min_free_space: min_free_space.unwrap_or(0),
+                keep_days: args.emergency_keep_days,
+                webhook_url: args.disk_alert_webhook_url.clone().filter(|u| !u.is_empty()),
+                interval: std::time::Duration::from_secs(60),
+            },
+        ));
+    }
+
+    let quotas = Arc::new(quota::Quotas::new(&args.host_row_quota, &args.host_byte_quota)?);
+    if !args.read_only && !quotas.is_empty() {
+        tokio::spawn(quota::run(store.clone(), quotas.clone(), std::time::Duration::from_secs(60)));
+    }
+
+    let reports = Arc::new(match args.reports.as_deref() {
+        Some(path) => reports::load(path)?,
+        None => Vec::new(),
+    });
+    if !args.read_only && !reports.is_empty() {
+        tokio::spawn(reports::run(store.clone(), reports.clone()));
+    }
+    let boards = Arc::new(match args.dashboards.as_deref() {
+        Some(path) => boards::load(path)?,
+        None => Vec::new(),
+    });
+
+    let bot_verifier = if args.verify_bots && !args.read_only {
+        let verifier = Arc::new(botverify::Verifier::default());
+        tokio::spawn(botverify::run(
+            store.clone(),
+            verifier.clone(),
+            botverify::Options {
+                rate: args.verify_bots_rate,
+            },
+        ));
+        Some(verifier)
+    } else {
+        None
+    };
+
+    let trap = if !args.trap_path.is_empty() && !args.read_only {
+        let trap = Arc::new(trap::Trap::new(&args.trap_path));
+        if let Err(err) = trap.load(&store).await {
+            eprintln!("trapped visitors not loaded: {}", err);
+        }
+        Some(trap)
+    } else {
+        None
+    };
+
+    let shards = if args.shards.len() > 1 {
+        Some(Arc::new(shard::Shards::new(args.shards.clone(), args.shard_index)?))
+    } else {
+        None
+    };
+
+    if args.require_signed_events && args.ingest_secret.as_deref().unwrap_or_default().is_empty() {
+        anyhow::bail!("--require-signed-events needs --ingest-secret");
+    }
+
+    let app_state = state::AppState {
+        store: store.clone(),
+        admin_token: args.admin_token.clone().filter(|t| !t.is_empty()),
+        trusted_user_header: args.trusted_user_header.clone().filter(|h| !h.is_empty()),
+        shards,
+        ingest_secret: args.ingest_secret.clone().filter(|s| !s.is_empty()),
+        require_signed_events: args.require_signed_events,
+        signature_window: args.signature_window,
+        inline_tables: args.inline_tables,
+        dashboard_timeout: Some(std::time::Duration::from_secs(args.dashboard_timeout)).filter(|d| !d.is_zero()),
+        forecast_weeks: args.forecast_weeks,
+        outlier_mads: args.outlier_mads,
+        system_fonts: args.system_fonts,
+        max_pending_writes: args.max_pending_writes,
+        disk_guard,
+        quotas,
+        validator: Arc::new(validate::Validator::new(validate::Options {
+            max_field_len: args.max_field_length,
+            max_future: args.max_future_skew,
+            max_age: args.max_event_age,
+            skew_threshold: args.clock_skew_threshold,
+            skew_correction: validate::parse_skew_correction(&args.clock_skew_correction)?,
+        })),
+        console: console::Options {
+            max_rows: args.console_max_rows.max(1),
+            timeout: std::time::Duration::from_secs(args.console_timeout.max(1)),
+        },
+        reports,
+        sinks: Arc::new(sinks::Sinks::open(&args.sink)?),
+        boards,
+        bot_verifier,
+        trap,
+        delete_grace_days: args.delete_grace_days.max(0),
+        minimal_data: args.minimal_data,
+    };
+    // Pages and API endpoints that run analytical queries share
+    // --max-queries slots; the live stream, assets and ingest do not.
+    let admission = Arc::new(admission::Admission::new(args.max_queries, args.query_queue));
+    let queries = dashboard::router(app_state.clone())
+        .merge(api::router(app_state.clone()))
+        .merge(events::router(app_state.clone()))
+        .merge(pathtree::router(app_state.clone()))
+        .merge(boards::router(app_state.clone()))
+        .merge(anomaly::router(app_state.clone()))
+        .merge(sources::router(app_state.clone()))
+        .merge(console::router(app_state.clone()))
+        .merge(grafana::router(app_state.clone()))
+        .layer(axum::middleware::from_fn_with_state(admission, admission::limit));
+    let mut http_app = queries
+        .merge(live::router(app_state.clone()))
+        .merge(favicon::router())
+        .merge(assets::router());
+    if !args.read_only {
+        http_app = http_app
+            .merge(metrics::router(app_state.clone()))
+            .merge(setup::router(app_state.clone()))
+            .merge(views::router(app_state.clone()))
+            .merge(shortlinks::router(app_state.clone()))
+            .merge(audit::router(app_state.clone()))
+            .merge(ingest::router(app_state));
+    }
+    let security_options = Arc::new(security::Options {
+        csp: args.csp.clone(),
+        frame_ancestors: args.frame_ancestors.clone(),
+        referrer_policy: args.referrer_policy.clone(),
+    });
+    // Brotli or gzip, negotiated from Accept-Encoding; a year of inline SVG
+    // timelines compresses very well.
+    let http_app = http_app
+        .layer(axum::middleware::from_fn_with_state(security_options, security::headers))
+        .layer(CompressionLayer::new());
     let http_listener = tokio::net::TcpListener::bind(http_addr).await?;
     let http_server = axum::serve(http_listener, http_app).with_graceful_shutdown(shutdown_signal());
 
-    println!("banan-stats listening: http={}", http_addr);
+    println!(
+        "banan-stats listening: http={}{}",
+        http_addr,
+        if args.read_only { " (read-only)" } else { "" }
+    );
 
     let http_task = async { http_server.await.map_err(anyhow::Error::from) };
     tokio::try_join!(http_task)?;
     Ok(())
 }
 
+// --compact: reports exact duplicate rows, removes them unless --dry-run, and
+// checkpoints the database, then exits. Stop the server first; DuckDB lets
+// one process at a time open the file for writing.
+async fn run_compaction(store: &store::Store, dry_run: bool) -> Result<(), anyhow::Error> {
+    let report = compact::run(store, dry_run).await?;
+    for (date, copies) in &report.days {
+        println!("{}  {} duplicate rows", date, copies);
+    }
+    if dry_run {
+        println!("dry run: {} duplicate rows found, nothing removed", report.duplicates());
+    } else {
+        println!("removed {} duplicate rows, database checkpointed", report.removed);
+    }
+    Ok(())
+}
+
+// --replay-from: rebuilds an empty database from an archive sink directory,
+// then exits.
+async fn run_replay(store: &store::Store, dir: &str) -> Result<(), anyhow::Error> {
+    let report = replay::run(store, dir).await?;
+    for (file, events) in &report.files {
+        println!("{}  {} events", file, events);
+    }
+    println!(
+        "replayed {} events from {} files, {} lines skipped",
+        report.events(),
+        report.files.len(),
+        report.skipped
+    );
+    Ok(())
+}
+
 fn normalize_listen_addr(listen: &str) -> Result<SocketAddr, anyhow::Error> {
     if listen.starts_with(':') {
         let normalized = format!("0.0.0.0{}", listen);
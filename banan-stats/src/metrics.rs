@@ -0,0 +1,162 @@
+use crate::state::AppState;
+use crate::store::Store;
+use axum::{
+    extract::State,
+    http::{HeaderMap, StatusCode},
+    response::{IntoResponse, Response},
+    routing::get,
+    Router,
+};
+use chrono::Utc;
+use std::fmt::Write;
+
+pub fn router(state: AppState) -> Router {
+    Router::new()
+        .route("/metrics", get(metrics_handler))
+        .with_state(state)
+}
+
+struct HostTypeCount {
+    host: String,
+    r#type: String,
+    uniques: i64,
+    pageviews: i64,
+}
+
+// Gauges are computed on scrape, so every scrape reflects the current day.
+async fn metrics_handler(State(state): State<AppState>) -> Response {
+    let today = Utc::now().date_naive().format("%Y-%m-%d").to_string();
+    let counts = match host_type_counts(&state.store, &today).await {
+        Ok(counts) => counts,
+        Err(err) => {
+            eprintln!("metrics failed: {}", err);
+            return StatusCode::INTERNAL_SERVER_ERROR.into_response();
+        }
+    };
+    let rows = type_rows(&state.store).await.unwrap_or_default();
+
+    let mut body = String::new();
+    let _ = writeln!(body, "# HELP banan_stats_uniques_today Unique visitors today (UTC) by host and type.");
+    let _ = writeln!(body, "# TYPE banan_stats_uniques_today gauge");
+    for c in &counts {
+        let _ = writeln!(
+            body,
+            "banan_stats_uniques_today{{host=\"{}\",type=\"{}\"}} {}",
+            escape_label(&c.host),
+            escape_label(&c.r#type),
+            c.uniques
+        );
+    }
+    let _ = writeln!(body, "# HELP banan_stats_pageviews_today Recorded hits today (UTC) by host and type.");
+    let _ = writeln!(body, "# TYPE banan_stats_pageviews_today gauge");
+    for c in &counts {
+        let _ = writeln!(
+            body,
+            "banan_stats_pageviews_today{{host=\"{}\",type=\"{}\"}} {}",
+            escape_label(&c.host),
+            escape_label(&c.r#type),
+            c.pageviews
+        );
+    }
+    let _ = writeln!(body, "# HELP banan_stats_rows Rows stored by type.");
+    let _ = writeln!(body, "# TYPE banan_stats_rows gauge");
+    for (typ, cnt) in &rows {
+        let _ = writeln!(body, "banan_stats_rows{{type=\"{}\"}} {}", escape_label(typ), cnt);
+    }
+    let _ = writeln!(body, "# HELP banan_stats_db_bytes Database size at the last disk guard check.");
+    let _ = writeln!(body, "# TYPE banan_stats_db_bytes gauge");
+    let _ = writeln!(body, "banan_stats_db_bytes {}", state.disk_guard.used_bytes());
+    let _ = writeln!(body, "# HELP banan_stats_ingest_paused 1 while ingest is paused for lack of disk space.");
+    let _ = writeln!(body, "# TYPE banan_stats_ingest_paused gauge");
+    let _ = writeln!(body, "banan_stats_ingest_paused {}", u8::from(state.disk_guard.exceeded()));
+    let _ = writeln!(body, "# HELP banan_stats_quota_dropped_total Events dropped because their host reached its storage quota.");
+    let _ = writeln!(body, "# TYPE banan_stats_quota_dropped_total counter");
+    for (host, dropped) in state.quotas.dropped() {
+        let _ = writeln!(body, "banan_stats_quota_dropped_total{{host=\"{}\"}} {}", escape_label(&host), dropped);
+    }
+    let _ = writeln!(body, "# HELP banan_stats_ingest_rejected_total Events rejected by ingest validation.");
+    let _ = writeln!(body, "# TYPE banan_stats_ingest_rejected_total counter");
+    for (reason, rejected) in state.validator.rejected() {
+        let _ = writeln!(body, "banan_stats_ingest_rejected_total{{reason=\"{}\"}} {}", reason.as_str(), rejected);
+    }
+    let _ = writeln!(body, "# HELP banan_stats_ingest_truncated_total Events stored with an over-long field cut short.");
+    let _ = writeln!(body, "# TYPE banan_stats_ingest_truncated_total counter");
+    let _ = writeln!(body, "banan_stats_ingest_truncated_total {}", state.validator.truncated());
+    let _ = writeln!(body, "# HELP banan_stats_ingest_skew_corrected_total Events whose timestamp was corrected for clock skew.");
+    let _ = writeln!(body, "# TYPE banan_stats_ingest_skew_corrected_total counter");
+    let _ = writeln!(body, "banan_stats_ingest_skew_corrected_total {}", state.validator.corrected());
+    let sinks = state.sinks.counts();
+    let _ = writeln!(body, "# HELP banan_stats_sink_failed_total Stored events a --sink failed to write.");
+    let _ = writeln!(body, "# TYPE banan_stats_sink_failed_total counter");
+    for (sink, failed, _) in &sinks {
+        let _ = writeln!(body, "banan_stats_sink_failed_total{{sink=\"{}\"}} {}", escape_label(sink), failed);
+    }
+    let _ = writeln!(body, "# HELP banan_stats_sink_dropped_total Stored events a --sink fell too far behind to receive.");
+    let _ = writeln!(body, "# TYPE banan_stats_sink_dropped_total counter");
+    for (sink, _, dropped) in &sinks {
+        let _ = writeln!(body, "banan_stats_sink_dropped_total{{sink=\"{}\"}} {}", escape_label(sink), dropped);
+    }
+
+    let mut headers = HeaderMap::new();
+    headers.insert(
+        "Content-Type",
+        "text/plain; version=0.0.4; charset=utf-8".parse().expect("header"),
+    );
+    (headers, body).into_response()
+}
+
+async fn host_type_counts(store: &Store, date: &str) -> Result<Vec<HostTypeCount>, anyhow::Error> {
+    let date = date.to_string();
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(
+                "WITH subq AS (
+                    SELECT host, type, MAX(mult) AS mult, COUNT(*) AS hits
+                    FROM stats
+                    WHERE date = ? AND prefetch IS NOT TRUE AND fragment IS NOT TRUE AND COALESCE(status, 0) < 400
+                      AND deleted_at IS NULL
+                    GROUP BY host, type, uniq
+                )
+                SELECT host, type, SUM(mult) AS uniques, SUM(hits) AS pageviews
+                FROM subq
+                GROUP BY host, type
+                ORDER BY host, type",
+            )?;
+            let mut rows = stmt.query([date])?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                let host: Option<String> = row.get(0)?;
+                let typ: Option<String> = row.get(1)?;
+                out.push(HostTypeCount {
+                    host: host.unwrap_or_default(),
+                    r#type: typ.unwrap_or_default(),
+                    uniques: row.get(2)?,
+                    pageviews: row.get(3)?,
+                });
+            }
+            Ok(out)
+        })
+        .await
+}
+
+async fn type_rows(store: &Store) -> Result<Vec<(String, i64)>, anyhow::Error> {
+    store
+        .with_conn(|conn| {
+            let mut stmt = conn.prepare("SELECT type, COUNT(*) FROM stats GROUP BY type ORDER BY type")?;
+            let mut rows = stmt.query([])?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                let typ: Option<String> = row.get(0)?;
+                out.push((typ.unwrap_or_default(), row.get(1)?));
+            }
+            Ok(out)
+        })
+        .await
+}
+
+fn escape_label(value: &str) -> String {
+    value
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
@@ -0,0 +1,112 @@
+use crate::dashboard::{build_where, Filters};
+use crate::store::Store;
+use chrono::{Duration, NaiveDate};
+use duckdb::params_from_iter;
+
+// Entries listed per direction.
+const MOVERS_LIMIT: usize = 5;
+
+// Page views the prior period needs before a relative change counts; going
+// from 1 to 3 is +200% but says little.
+const MIN_PERCENT_BASE: i64 = 10;
+
+pub struct Mover {
+    pub value: String,
+    pub current: i64,
+    pub previous: i64,
+}
+
+impl Mover {
+    pub fn change(&self) -> i64 {
+        self.current - self.previous
+    }
+
+    pub fn percent(&self) -> Option<f64> {
+        if self.previous <= 0 {
+            return None;
+        }
+        Some((self.change() as f64) * 100.0 / (self.previous as f64))
+    }
+}
+
+// The period of the same length right before `from`..=`to`.
+pub fn prior_period(from: NaiveDate, to: NaiveDate) -> (NaiveDate, NaiveDate) {
+    let days = (to - from).num_days() + 1;
+    (from - Duration::days(days), from - Duration::days(1))
+}
+
+// Values of `column` whose browser page views grew (rising) and shrank
+// (falling) the most from the prior period to `from`..=`to`: by page views,
+// or by percent when `by_percent` is set.
+pub async fn movers(
+    store: &Store,
+    column: &str,
+    from: NaiveDate,
+    to: NaiveDate,
+    filters: &Filters,
+    by_percent: bool,
+) -> Result<(Vec<Mover>, Vec<Mover>), anyhow::Error> {
+    let (prior_from, _) = prior_period(from, to);
+    let (where_clause, args) = build_where(
+        &prior_from.format("%Y-%m-%d").to_string(),
+        &to.format("%Y-%m-%d").to_string(),
+        filters,
+    );
+    let (score, eligible) = if by_percent {
+        (
+            "(current - previous) / previous".to_string(),
+            format!("previous >= {}", MIN_PERCENT_BASE),
+        )
+    } else {
+        ("current - previous".to_string(), "TRUE".to_string())
+    };
+    let query = format!(
+        "WITH counts AS (
+             SELECT {column} AS value,
+                    COUNT(*) FILTER (WHERE date >= DATE '{from}') AS current,
+                    COUNT(*) FILTER (WHERE date < DATE '{from}') AS previous
+             FROM stats
+             WHERE {where_clause} AND type = 'browser' AND {column} IS NOT NULL
+             GROUP BY value
+         ), scored AS (
+             SELECT value, current, previous, {score} AS score
+             FROM counts
+             WHERE {eligible}
+         )
+         SELECT * FROM (
+             (SELECT 'rising' AS direction, value, current, previous, score FROM scored
+              WHERE score > 0 ORDER BY score DESC, value LIMIT {limit})
+             UNION ALL
+             (SELECT 'falling', value, current, previous, score FROM scored
+              WHERE score < 0 ORDER BY score, value LIMIT {limit})
+         )
+         ORDER BY abs(score) DESC, value",
+        column = column,
+        from = from,
+        where_clause = where_clause,
+        score = score,
+        eligible = eligible,
+        limit = MOVERS_LIMIT
+    );
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            let (mut rising, mut falling) = (Vec::new(), Vec::new());
+            while let Some(row) = rows.next()? {
+                let direction: String = row.get(0)?;
+                let mover = Mover {
+                    value: row.get(1)?,
+                    current: row.get(2)?,
+                    previous: row.get(3)?,
+                };
+                if direction == "rising" {
+                    rising.push(mover);
+                } else {
+                    falling.push(mover);
+                }
+            }
+            Ok((rising, falling))
+        })
+        .await
+}
@@ -0,0 +1,117 @@
+use crate::store::Store;
+use chrono::{Timelike, Utc};
+use serde_json::json;
+use std::time::Duration;
+
+#[derive(Clone, Debug)]
+pub struct Options {
+    pub webhook_url: String,
+    pub threshold: i64,
+    // Inclusive start and exclusive end hour (UTC) during which no webhook is
+    // sent; a window may wrap around midnight (e.g. 22..7).
+    pub quiet_hours: Option<(u32, u32)>,
+    pub interval: Duration,
+}
+
+pub fn parse_quiet_hours(value: &str) -> Result<(u32, u32), anyhow::Error> {
+    let (start, end) = value
+        .split_once('-')
+        .ok_or_else(|| anyhow::anyhow!("invalid quiet hours {:?}, expected START-END", value))?;
+    let start: u32 = start.trim().parse()?;
+    let end: u32 = end.trim().parse()?;
+    if start > 23 || end > 24 {
+        anyhow::bail!("invalid quiet hours {:?}", value);
+    }
+    Ok((start, end))
+}
+
+fn in_quiet_hours(quiet: Option<(u32, u32)>, hour: u32) -> bool {
+    match quiet {
+        Some((start, end)) if start <= end => hour >= start && hour < end,
+        Some((start, end)) => hour >= start || hour < end,
+        None => false,
+    }
+}
+
+pub async fn run(store: std::sync::Arc<Store>, options: Options) {
+    let client = reqwest::Client::new();
+    let mut ticker = tokio::time::interval(options.interval);
+    loop {
+        ticker.tick().await;
+        if in_quiet_hours(options.quiet_hours, Utc::now().hour()) {
+            continue;
+        }
+        if let Err(err) = notify_new_referrers(&store, &client, &options).await {
+            eprintln!("referrer notifier failed: {}", err);
+        }
+    }
+}
+
+async fn notify_new_referrers(
+    store: &Store,
+    client: &reqwest::Client,
+    options: &Options,
+) -> Result<(), anyhow::Error> {
+    let today = Utc::now().date_naive().format("%Y-%m-%d").to_string();
+    let threshold = options.threshold;
+    let query_date = today.clone();
+    let candidates = store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(
+                "SELECT ref_domain, COUNT(DISTINCT uniq) AS visits
+                 FROM stats
+                 WHERE date = CAST(? AS DATE)
+                   AND deleted_at IS NULL
+                   AND type = 'browser'
+                   AND ref_domain IS NOT NULL
+                   AND host IS DISTINCT FROM ref_domain
+                   AND ref_domain NOT IN (SELECT ref_domain FROM notified_referrers)
+                   AND ref_domain NOT IN (
+                       SELECT DISTINCT ref_domain FROM stats
+                       WHERE date < CAST(? AS DATE) AND ref_domain IS NOT NULL
+                   )
+                 GROUP BY ref_domain
+                 HAVING COUNT(DISTINCT uniq) >= ?
+                 ORDER BY visits DESC",
+            )?;
+            let mut rows = stmt.query(duckdb::params![query_date, query_date, threshold])?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                let domain: String = row.get(0)?;
+                let visits: i64 = row.get(1)?;
+                out.push((domain, visits));
+            }
+            Ok(out)
+        })
+        .await?;
+
+    for (domain, visits) in candidates {
+        let payload = json!({
+            "text": format!("You got linked from {} ({} visitors today)", domain, visits),
+            "refDomain": domain,
+            "visits": visits,
+            "date": today,
+        });
+        let resp = client
+            .post(&options.webhook_url)
+            .timeout(Duration::from_secs(10))
+            .json(&payload)
+            .send()
+            .await?;
+        if !resp.status().is_success() {
+            anyhow::bail!("webhook returned {}", resp.status());
+        }
+        store
+            .with_conn(move |conn| {
+                conn.execute(
+                    "INSERT INTO notified_referrers (ref_domain, notified_at)
+                     VALUES (?, current_timestamp)
+                     ON CONFLICT DO NOTHING",
+                    [domain],
+                )?;
+                Ok(())
+            })
+            .await?;
+    }
+    Ok(())
+}
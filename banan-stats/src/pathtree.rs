@@ -0,0 +1,215 @@
+use crate::assets;
+use crate::dashboard::{
+    build_where, clone_params, encode_params, escape_html, escape_like, extract_filters, first_value,
+    format_num, parse_query,
+};
+use crate::state::AppState;
+use crate::store::Store;
+use axum::{
+    extract::{RawQuery, State},
+    http::HeaderMap,
+    response::{IntoResponse, Response},
+    routing::get,
+    Router,
+};
+use chrono::{Datelike, Utc};
+use duckdb::params_from_iter;
+use std::collections::HashMap;
+use std::fmt::Write;
+
+// Children listed per level; the rest are left out rather than lumped together,
+// as "others" cannot be expanded.
+const MAX_CHILDREN: usize = 200;
+
+pub fn router(state: AppState) -> Router {
+    Router::new()
+        .route("/stats/paths", get(paths_handler))
+        .with_state(state)
+}
+
+pub struct Child {
+    // Path segment after the prefix, ending with "/" for a directory. Empty
+    // for the page at the prefix itself.
+    pub segment: String,
+    pub path: String,
+    pub hits: i64,
+    // Distinct pages under a directory, 1 for a page.
+    pub pages: i64,
+    // Browser page views under the prefix, for the share column.
+    pub total: i64,
+}
+
+impl Child {
+    pub fn is_dir(&self) -> bool {
+        self.segment.ends_with('/')
+    }
+}
+
+// The prefix a tree level lists, always starting and ending with "/".
+fn normalize_prefix(prefix: &str) -> String {
+    let trimmed = prefix.trim().trim_matches('/');
+    if trimmed.is_empty() {
+        "/".to_string()
+    } else {
+        format!("/{}/", trimmed)
+    }
+}
+
+// Browser page views under `prefix`, grouped by the next path segment.
+// `where_clause` comes from build_where.
+pub async fn children(
+    store: &Store,
+    prefix: &str,
+    where_clause: &str,
+    args: &[String],
+) -> Result<Vec<Child>, anyhow::Error> {
+    let query = format!(
+        "WITH base AS (
+             SELECT substr(path, {start}) AS rest
+             FROM stats
+             WHERE {where_clause} AND type = 'browser' AND path LIKE ? ESCAPE '\\'
+         )
+         SELECT CASE WHEN strpos(rest, '/') > 0 THEN substr(rest, 1, strpos(rest, '/')) ELSE rest END AS child,
+                COUNT(*) AS hits,
+                COUNT(DISTINCT rest) AS pages,
+                CAST(SUM(COUNT(*)) OVER () AS BIGINT) AS total
+         FROM base
+         GROUP BY child
+         ORDER BY hits DESC, child
+         LIMIT {limit}",
+        start = prefix.chars().count() + 1,
+        where_clause = where_clause,
+        limit = MAX_CHILDREN
+    );
+    let mut args = args.to_owned();
+    args.push(format!("{}%", escape_like(prefix)));
+    let prefix = prefix.to_string();
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(&query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                let segment: String = row.get::<_, Option<String>>(0)?.unwrap_or_default();
+                out.push(Child {
+                    path: format!("{}{}", prefix, segment),
+                    segment,
+                    hits: row.get(1)?,
+                    pages: row.get(2)?,
+                    total: row.get(3)?,
+                });
+            }
+            Ok(out)
+        })
+        .await
+}
+
+async fn paths_handler(State(state): State<AppState>, RawQuery(raw): RawQuery) -> Response {
+    let params = parse_query(raw.unwrap_or_default());
+    let now = Utc::now().date_naive();
+    let from = first_value(&params, "from").unwrap_or_else(|| format!("{}-01-01", now.year()));
+    let to = first_value(&params, "to").unwrap_or_else(|| format!("{}-12-31", now.year()));
+    let prefix = normalize_prefix(&first_value(&params, "prefix").unwrap_or_default());
+
+    let filters = extract_filters(&params);
+    let (where_clause, args) = build_where(&from, &to, &filters);
+    let rows = children(&state.store, &prefix, &where_clause, &args)
+        .await
+        .unwrap_or_else(|err| {
+            eprintln!("path tree query failed: {}", err);
+            Vec::new()
+        });
+
+    let mut body = String::new();
+    let mut out = |s: &str| {
+        let _ = writeln!(body, "{}", s);
+    };
+    out("<!DOCTYPE html>");
+    out("<html>");
+    out("<head>");
+    out("<meta charset=\"utf-8\">");
+    out("<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">");
+    out(&assets::style_tag(false));
+    out("</head>");
+    out("<body>");
+
+    let mut back = clone_params(&params);
+    back.remove("prefix");
+    out("<div class=filters>");
+    out(&format!(
+        "<a class=filter href='/stats?{}'>&larr; Dashboard</a>",
+        escape_html(&encode_params(&back))
+    ));
+    out("</div>");
+
+    // Breadcrumbs, one per level above and including this one.
+    let mut crumbs = String::from("<h1>");
+    let mut level = String::from("/");
+    let _ = write!(crumbs, "<a href='?{}'>/</a>", escape_html(&level_query(&params, &level)));
+    for segment in prefix.split('/').filter(|s| !s.is_empty()) {
+        level.push_str(segment);
+        level.push('/');
+        let _ = write!(
+            crumbs,
+            "<a href='?{}'>{}/</a>",
+            escape_html(&level_query(&params, &level)),
+            escape_html(segment)
+        );
+    }
+    crumbs.push_str("</h1>");
+    out(&crumbs);
+
+    if rows.is_empty() {
+        out("<div class=notice>No page views under this path in the selected period.</div>");
+    } else {
+        out("<table class=rows>");
+        out("<tr><th>Path</th><th>Page views</th><th>Share</th><th>Pages</th><th></th></tr>");
+        for child in &rows {
+            let label = if child.segment.is_empty() { &child.path } else { &child.segment };
+            let name = if child.is_dir() {
+                format!(
+                    "<a href='?{}' title='{}'>{}</a>",
+                    escape_html(&level_query(&params, &child.path)),
+                    escape_html(&child.path),
+                    escape_html(label)
+                )
+            } else {
+                format!("<span title='{}'>{}</span>", escape_html(&child.path), escape_html(label))
+            };
+            let mut filtered = back.clone();
+            let filter = if child.is_dir() {
+                format!("{}*", child.path)
+            } else {
+                child.path.clone()
+            };
+            filtered.insert("path".to_string(), vec![filter]);
+            out(&format!(
+                "<tr><td>{}</td><td>{}</td><td>{:.1}%</td><td>{}</td><td><a href='/stats?{}'>filter</a></td></tr>",
+                name,
+                format_num(child.hits),
+                child.hits as f64 * 100.0 / child.total.max(1) as f64,
+                format_num(child.pages),
+                escape_html(&encode_params(&filtered))
+            ));
+        }
+        out("</table>");
+        if rows.len() == MAX_CHILDREN {
+            out(&format!("<p>Only the {} busiest entries are listed.</p>", MAX_CHILDREN));
+        }
+    }
+    out("</body>");
+    out("</html>");
+
+    let mut headers = HeaderMap::new();
+    headers.insert(
+        "Content-Type",
+        "text/html; charset=utf-8".parse().expect("header"),
+    );
+    (headers, body).into_response()
+}
+
+fn level_query(params: &HashMap<String, Vec<String>>, prefix: &str) -> String {
+    let mut params = clone_params(params);
+    params.insert("prefix".to_string(), vec![prefix.to_string()]);
+    encode_params(&params)
+}
@@ -0,0 +1,200 @@
+use crate::analyzer::Line;
+use crate::diskguard;
+use crate::store::Store;
+use std::collections::{BTreeMap, HashMap};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+// Key under which --host-row-quota / --host-byte-quota set the limit of
+// every host without one of its own.
+const DEFAULT_HOST: &str = "*";
+
+// Bytes a row counts against a byte quota: the length of its free-form text
+// columns. Mirrors line_bytes so refreshes and ingest agree.
+const ROW_BYTES_SQL: &str = "strlen(COALESCE(event_id, '')) + strlen(COALESCE(path, ''))
+    + strlen(COALESCE(query, '')) + strlen(COALESCE(ip, '')) + strlen(COALESCE(user_agent, ''))
+    + strlen(COALESCE(referrer, '')) + strlen(COALESCE(set_cookie, '')) + strlen(COALESCE(uniq, ''))
+    + strlen(COALESCE(extra, ''))";
+
+fn line_bytes(line: &Line) -> u64 {
+    [
+        &line.event_id,
+        &line.path,
+        &line.query,
+        &line.ip,
+        &line.user_agent,
+        &line.referrer,
+        &line.set_cookie,
+        &line.uniq,
+        &line.extra,
+    ]
+    .iter()
+    .map(|s| s.len() as u64)
+    .sum()
+}
+
+#[derive(Clone, Copy, Debug, Default)]
+pub struct Limit {
+    pub rows: Option<u64>,
+    pub bytes: Option<u64>,
+}
+
+#[derive(Clone, Copy, Debug, Default)]
+pub struct Usage {
+    pub rows: u64,
+    pub bytes: u64,
+}
+
+impl Limit {
+    fn reached(&self, usage: &Usage) -> bool {
+        self.rows.is_some_and(|max| usage.rows >= max) || self.bytes.is_some_and(|max| usage.bytes >= max)
+    }
+}
+
+// A host that has reached its quota, for the dashboard banner.
+pub struct OverQuota {
+    pub host: String,
+    pub usage: Usage,
+    pub limit: Limit,
+    pub dropped: u64,
+}
+
+#[derive(Default)]
+pub struct Quotas {
+    limits: HashMap<String, Limit>,
+    // Rows and bytes stored per host: recounted from the database by refresh
+    // and advanced by admit in between.
+    usage: Mutex<HashMap<String, Usage>>,
+    // Events turned away per host since startup.
+    dropped: Mutex<BTreeMap<String, u64>>,
+}
+
+impl Quotas {
+    // Builds the quotas from HOST=LIMIT entries; rows are plain counts and
+    // bytes accept the same suffixes as --max-db-size. HOST `*` applies to
+    // every host not listed.
+    pub fn new(row_quotas: &[String], byte_quotas: &[String]) -> Result<Self, anyhow::Error> {
+        let mut limits: HashMap<String, Limit> = HashMap::new();
+        for entry in row_quotas {
+            let (host, value) = split_entry(entry)?;
+            let rows: u64 = value
+                .parse()
+                .map_err(|_| anyhow::anyhow!("invalid row quota {:?}", entry))?;
+            limits.entry(host).or_default().rows = Some(rows);
+        }
+        for entry in byte_quotas {
+            let (host, value) = split_entry(entry)?;
+            limits.entry(host).or_default().bytes = Some(diskguard::parse_size(value)?);
+        }
+        Ok(Self {
+            limits,
+            ..Default::default()
+        })
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.limits.is_empty()
+    }
+
+    fn limit(&self, host: &str) -> Option<&Limit> {
+        self.limits.get(host).or_else(|| self.limits.get(DEFAULT_HOST))
+    }
+
+    // Drops lines of hosts at their quota and counts the rest against theirs.
+    pub fn admit(&self, lines: &mut Vec<Line>) {
+        if self.limits.is_empty() {
+            return;
+        }
+        let mut usage = self.usage.lock().expect("quota usage lock");
+        let mut dropped = self.dropped.lock().expect("quota dropped lock");
+        lines.retain(|line| {
+            let Some(limit) = self.limit(&line.host) else {
+                return true;
+            };
+            let used = usage.entry(line.host.clone()).or_default();
+            if limit.reached(used) {
+                *dropped.entry(line.host.clone()).or_default() += 1;
+                return false;
+            }
+            used.rows += 1;
+            used.bytes += line_bytes(line);
+            true
+        });
+    }
+
+    pub fn over_quota(&self) -> Vec<OverQuota> {
+        let usage = self.usage.lock().expect("quota usage lock");
+        let dropped = self.dropped.lock().expect("quota dropped lock");
+        let mut out: Vec<OverQuota> = usage
+            .iter()
+            .filter_map(|(host, used)| {
+                let limit = self.limit(host)?;
+                limit.reached(used).then(|| OverQuota {
+                    host: host.clone(),
+                    usage: *used,
+                    limit: *limit,
+                    dropped: dropped.get(host).copied().unwrap_or(0),
+                })
+            })
+            .collect();
+        out.sort_by(|a, b| a.host.cmp(&b.host));
+        out
+    }
+
+    // Events dropped per host since startup, for /metrics.
+    pub fn dropped(&self) -> BTreeMap<String, u64> {
+        self.dropped.lock().expect("quota dropped lock").clone()
+    }
+
+    async fn refresh(&self, store: &Store) -> Result<(), anyhow::Error> {
+        let query = format!(
+            "SELECT host, COUNT(*), CAST(COALESCE(SUM({}), 0) AS BIGINT) FROM stats GROUP BY host",
+            ROW_BYTES_SQL
+        );
+        let counted = store
+            .with_conn(move |conn| {
+                let mut stmt = conn.prepare(&query)?;
+                let mut rows = stmt.query([])?;
+                let mut out = HashMap::new();
+                while let Some(row) = rows.next()? {
+                    let host: Option<String> = row.get(0)?;
+                    let count: i64 = row.get(1)?;
+                    let bytes: i64 = row.get(2)?;
+                    out.insert(
+                        host.unwrap_or_default(),
+                        Usage {
+                            rows: count.max(0) as u64,
+                            bytes: bytes.max(0) as u64,
+                        },
+                    );
+                }
+                Ok(out)
+            })
+            .await?;
+        *self.usage.lock().expect("quota usage lock") = counted;
+        Ok(())
+    }
+}
+
+fn split_entry(entry: &str) -> Result<(String, &str), anyhow::Error> {
+    let (host, value) = entry
+        .split_once('=')
+        .ok_or_else(|| anyhow::anyhow!("invalid quota {:?}, expected HOST=LIMIT", entry))?;
+    let host = host.trim().to_lowercase();
+    if host.is_empty() {
+        anyhow::bail!("invalid quota {:?}, expected HOST=LIMIT", entry);
+    }
+    Ok((host, value.trim()))
+}
+
+// Recounts usage from the database, which also picks up rows deleted by
+// admins or an emergency prune.
+pub async fn run(store: Arc<Store>, quotas: Arc<Quotas>, interval: Duration) {
+    let mut ticker = tokio::time::interval(interval);
+    loop {
+        ticker.tick().await;
+        if let Err(err) = quotas.refresh(&store).await {
+            eprintln!("quota refresh failed: {}", err);
+        }
+    }
+}
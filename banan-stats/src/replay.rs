@@ -0,0 +1,112 @@
+use crate::analyzer::{self, Line};
+use crate::sinks::{self, ARCHIVE_PREFIX, ARCHIVE_SUFFIX};
+use crate::store::Store;
+use anyhow::Context;
+use flate2::read::MultiGzDecoder;
+use std::io::{BufRead, BufReader};
+use std::path::{Path, PathBuf};
+
+// Events inserted per transaction.
+const BATCH_LINES: usize = 10_000;
+
+pub struct Report {
+    // Archive files read, oldest first, with the events stored from each.
+    pub files: Vec<(String, usize)>,
+    // Lines that were not a JSON event, skipped.
+    pub skipped: usize,
+}
+
+impl Report {
+    pub fn events(&self) -> usize {
+        self.files.iter().map(|(_, events)| events).sum()
+    }
+}
+
+// Rebuilds the database from the archive sink's files in `dir`, oldest day
+// first, running each event through the current analyzer. The database must
+// be empty, so nothing is stored twice.
+pub async fn run(store: &Store, dir: &str) -> Result<Report, anyhow::Error> {
+    let rows = store
+        .with_conn(|conn| Ok(conn.query_row("SELECT COUNT(*) FROM stats", [], |row| row.get::<_, i64>(0))?))
+        .await?;
+    if rows > 0 {
+        anyhow::bail!("replay needs an empty database, this one has {} rows", rows);
+    }
+    let mut report = Report {
+        files: Vec::new(),
+        skipped: 0,
+    };
+    for path in archive_files(Path::new(dir))? {
+        let name = path.file_name().unwrap_or_default().to_string_lossy().into_owned();
+        let (lines, skipped) = tokio::task::spawn_blocking(move || read_archive(&path)).await??;
+        report.skipped += skipped;
+        let count = lines.len();
+        let mut lines = lines.into_iter().peekable();
+        while lines.peek().is_some() {
+            store.insert(lines.by_ref().take(BATCH_LINES).collect()).await?;
+        }
+        report.files.push((name, count));
+    }
+    Ok(report)
+}
+
+fn archive_files(dir: &Path) -> Result<Vec<PathBuf>, anyhow::Error> {
+    let mut files = Vec::new();
+    for entry in std::fs::read_dir(dir).with_context(|| format!("read {}", dir.display()))? {
+        let path = entry?.path();
+        let name = path.file_name().unwrap_or_default().to_string_lossy();
+        if name.starts_with(ARCHIVE_PREFIX) && name.ends_with(ARCHIVE_SUFFIX) {
+            files.push(path);
+        }
+    }
+    // Dated names sort by day; "undated" comes last.
+    files.sort();
+    Ok(files)
+}
+
+// The events of one archive file and the number of lines skipped.
+fn read_archive(path: &Path) -> Result<(Vec<Line>, usize), anyhow::Error> {
+    let file = std::fs::File::open(path).with_context(|| format!("open {}", path.display()))?;
+    let mut lines = Vec::new();
+    let mut skipped = 0;
+    for (idx, text) in BufReader::new(MultiGzDecoder::new(file)).lines().enumerate() {
+        let text = text.with_context(|| format!("read {}", path.display()))?;
+        if text.trim().is_empty() {
+            continue;
+        }
+        match serde_json::from_str::<serde_json::Value>(&text) {
+            Ok(event) if event.is_object() => lines.push(reanalyze(sinks::event_line(&event))),
+            _ => {
+                eprintln!("{}:{}: not a JSON event, skipped", path.display(), idx + 1);
+                skipped += 1;
+            }
+        }
+    }
+    Ok((lines, skipped))
+}
+
+// Clears the fields the analyzer derives from an input the event still has,
+// so the current analyzer sets them again. Events stored without an address
+// or User-Agent (--minimal-data) keep what was derived at the time, and so do
+// visitor IDs, which may come from the middleware's cookie.
+fn reanalyze(mut line: Line) -> Line {
+    if !line.user_agent.is_empty() {
+        line.agent.clear();
+        line.r#type.clear();
+        line.os.clear();
+        line.mult = 0;
+    }
+    if !line.referrer.is_empty() {
+        line.ref_domain.clear();
+        line.ref_path.clear();
+        line.search_terms.clear();
+        line.social.clear();
+    }
+    if !line.ip.is_empty() {
+        line.asn = 0;
+        line.asn_name.clear();
+        line.datacenter = false;
+    }
+    analyzer::analyze(&mut line);
+    line
+}
@@ -0,0 +1,229 @@
+use crate::console;
+use crate::dashboard::{build_where, extract_filters, parse_query};
+use crate::store::Store;
+use anyhow::Context;
+use chrono::{Duration as ChronoDuration, NaiveDate, NaiveDateTime, Utc};
+use serde::Deserialize;
+use std::collections::{HashMap, HashSet};
+use std::sync::Arc;
+use std::time::Duration;
+
+// Rows kept from each run; cards show the first few.
+const MAX_ROWS: usize = 100;
+
+// Runs older than this are deleted when a report runs again.
+const KEEP_DAYS: i64 = 90;
+
+// One entry of the --reports file.
+#[derive(Clone, Debug, Deserialize)]
+pub struct Report {
+    pub name: String,
+    // Card label; the name when missing.
+    #[serde(default)]
+    pub title: Option<String>,
+    // A SELECT over the database, as in the SQL console...
+    #[serde(default)]
+    pub sql: Option<String>,
+    // ...or dashboard filters (`path=/pricing&ref_domain=google.com`) whose
+    // `metric` is counted over the last `days` days.
+    #[serde(default)]
+    pub filters: Option<String>,
+    #[serde(default = "default_metric")]
+    pub metric: String,
+    #[serde(default = "default_days")]
+    pub days: i64,
+    // Seconds between runs.
+    #[serde(default = "default_every")]
+    pub every: u64,
+}
+
+fn default_metric() -> String {
+    "uniques".to_string()
+}
+
+fn default_days() -> i64 {
+    30
+}
+
+fn default_every() -> u64 {
+    3600
+}
+
+impl Report {
+    pub fn label(&self) -> &str {
+        self.title.as_deref().unwrap_or(&self.name)
+    }
+
+    // The SQL to run and its arguments, for a run on `today`.
+    fn query(&self, today: NaiveDate) -> (String, Vec<String>) {
+        if let Some(sql) = &self.sql {
+            return (sql.clone(), Vec::new());
+        }
+        let params = parse_query(self.filters.clone().unwrap_or_default());
+        let filters = extract_filters(&params);
+        let from = (today - ChronoDuration::days(self.days - 1)).format("%Y-%m-%d").to_string();
+        let to = today.format("%Y-%m-%d").to_string();
+        let (mut where_clause, args) = build_where(&from, &to, &filters);
+        if self.metric == "hits" {
+            return (format!("SELECT COUNT(*) AS hits FROM stats WHERE {}", where_clause), args);
+        }
+        // Like the dashboard, count browsers unless another type is asked for.
+        if !filters.contains_key("type") && !filters.contains_key("type!") {
+            where_clause.push_str(" AND type = 'browser'");
+        }
+        (
+            format!(
+                "SELECT COALESCE(SUM(mult), 0) AS uniques
+                 FROM (SELECT MAX(mult) AS mult FROM stats WHERE {} GROUP BY uniq)",
+                where_clause
+            ),
+            args,
+        )
+    }
+}
+
+// Reads the JSON array of reports from `path`.
+pub fn load(path: &str) -> Result<Vec<Report>, anyhow::Error> {
+    let text = std::fs::read_to_string(path).with_context(|| format!("read {}", path))?;
+    let reports: Vec<Report> = serde_json::from_str(&text).with_context(|| format!("parse {}", path))?;
+    let mut names = HashSet::new();
+    for report in &reports {
+        if report.name.trim().is_empty() {
+            anyhow::bail!("{}: report without a name", path);
+        }
+        if !names.insert(report.name.as_str()) {
+            anyhow::bail!("{}: duplicate report {:?}", path, report.name);
+        }
+        if report.sql.is_some() == report.filters.is_some() {
+            anyhow::bail!("{}: report {:?} needs either sql or filters", path, report.name);
+        }
+        if !matches!(report.metric.as_str(), "uniques" | "hits") {
+            anyhow::bail!("{}: report {:?} has unknown metric {:?}", path, report.name, report.metric);
+        }
+        if report.days < 1 || report.every == 0 {
+            anyhow::bail!("{}: report {:?} needs days and every above 0", path, report.name);
+        }
+    }
+    Ok(reports)
+}
+
+// The latest run of a report.
+pub struct Run {
+    pub run_at: NaiveDateTime,
+    pub columns: Vec<String>,
+    pub rows: Vec<Vec<String>>,
+    pub error: Option<String>,
+}
+
+pub async fn latest_runs(store: &Store) -> Result<HashMap<String, Run>, anyhow::Error> {
+    store
+        .with_conn(|conn| {
+            let mut stmt = conn.prepare(
+                "SELECT name, run_at, result_columns, result_rows, error
+                 FROM report_runs
+                 QUALIFY row_number() OVER (PARTITION BY name ORDER BY run_at DESC) = 1",
+            )?;
+            let mut rows = stmt.query([])?;
+            let mut out = HashMap::new();
+            while let Some(row) = rows.next()? {
+                let name: String = row.get(0)?;
+                let columns: Option<String> = row.get(2)?;
+                let values: Option<String> = row.get(3)?;
+                out.insert(
+                    name,
+                    Run {
+                        run_at: row.get(1)?,
+                        columns: serde_json::from_str(columns.as_deref().unwrap_or("[]"))?,
+                        rows: serde_json::from_str(values.as_deref().unwrap_or("[]"))?,
+                        error: row.get(4)?,
+                    },
+                );
+            }
+            Ok(out)
+        })
+        .await
+}
+
+// Runs `report` and stores the result as its run at `now`.
+async fn run_once(store: &Store, report: &Report, now: NaiveDateTime) -> Result<(), anyhow::Error> {
+    let (sql, args) = report.query(now.date());
+    let result = store
+        .with_separate_conn(move |conn| console::select_rows(conn, &sql, &args, MAX_ROWS))
+        .await;
+    let (columns, rows, error) = match result {
+        Ok(result) => (
+            serde_json::to_string(&result.columns)?,
+            serde_json::to_string(&result.rows)?,
+            None,
+        ),
+        Err(err) => {
+            eprintln!("report {} failed: {}", report.name, err);
+            ("[]".to_string(), "[]".to_string(), Some(err.to_string()))
+        }
+    };
+    let name = report.name.clone();
+    let cutoff = now - ChronoDuration::days(KEEP_DAYS);
+    store
+        .with_conn(move |conn| {
+            conn.execute(
+                "INSERT INTO report_runs (name, run_at, result_columns, result_rows, error)
+                 VALUES (?, ?, ?, ?, ?)",
+                duckdb::params![name, now, columns, rows, error],
+            )?;
+            conn.execute(
+                "DELETE FROM report_runs WHERE name = ? AND run_at < ?",
+                duckdb::params![name, cutoff],
+            )?;
+            Ok(())
+        })
+        .await?;
+    store.touch();
+    Ok(())
+}
+
+// Runs every report on its own schedule, the first time right away.
+pub async fn run(store: Arc<Store>, reports: Arc<Vec<Report>>) {
+    for report in reports.iter().cloned() {
+        let store = store.clone();
+        tokio::spawn(async move {
+            let mut ticker = tokio::time::interval(Duration::from_secs(report.every));
+            loop {
+                ticker.tick().await;
+                if let Err(err) = run_once(&store, &report, Utc::now().naive_utc()).await {
+                    eprintln!("report {} could not be stored: {}", report.name, err);
+                }
+            }
+        });
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn filter_reports_count_the_days_up_to_the_run() {
+        let report: Report = serde_json::from_str(r#"{"name": "week", "filters": "path=/pricing", "days": 7}"#).unwrap();
+        let (sql, args) = report.query(NaiveDate::from_ymd_opt(2024, 3, 2).unwrap());
+        assert_eq!(args[..3], ["2024-02-25", "2024-03-02", "/pricing"]);
+        assert!(sql.contains("AND type = 'browser'"));
+
+        let hits: Report = serde_json::from_str(r#"{"name": "today", "filters": "type=bot", "metric": "hits", "days": 1}"#).unwrap();
+        let (sql, args) = hits.query(NaiveDate::from_ymd_opt(2024, 3, 2).unwrap());
+        assert_eq!(args[..2], ["2024-03-02", "2024-03-02"]);
+        assert!(sql.starts_with("SELECT COUNT(*) AS hits"));
+    }
+
+    #[tokio::test]
+    async fn reports_span_every_partition() {
+        let store = crate::console::tests::partitioned_store("reports").await;
+        let sql: Report = serde_json::from_str(r#"{"name": "all", "sql": "SELECT COUNT(*) AS hits FROM stats"}"#).unwrap();
+        let year: Report = serde_json::from_str(r#"{"name": "year", "filters": "type=browser", "metric": "hits", "days": 365}"#).unwrap();
+        let now = NaiveDate::from_ymd_opt(2024, 1, 1).unwrap().and_hms_opt(12, 0, 0).unwrap();
+        run_once(&store, &sql, now).await.unwrap();
+        run_once(&store, &year, now).await.unwrap();
+        let runs = latest_runs(&store).await.unwrap();
+        assert_eq!(runs["all"].rows, [["2"]]);
+        assert_eq!(runs["year"].rows, [["2"]]);
+    }
+}
@@ -0,0 +1,181 @@
+use crate::dashboard::{build_where, Filters};
+use chrono::{Datelike, NaiveDate};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+
+// A column of the stats table as the dashboard and the API expose it. This
+// list is what filters, group_by and /api/schema are checked against, and the
+// only column names that reach SQL from a request.
+#[derive(Serialize)]
+pub struct Column {
+    pub name: &'static str,
+    // string, integer, date or boolean.
+    #[serde(rename = "type")]
+    pub kind: &'static str,
+    // Usable as a filter: `path=/blog/*`, or `path!=/feed.xml` to exclude.
+    pub filter: bool,
+    pub group_by: bool,
+    pub description: &'static str,
+}
+
+pub const COLUMNS: &[Column] = &[
+    Column { name: "date", kind: "date", filter: false, group_by: true, description: "Day of the visit (UTC); select it with from and to" },
+    Column { name: "host", kind: "string", filter: true, group_by: true, description: "Site host with aliases resolved; a ~ value is a regular expression" },
+    Column { name: "path", kind: "string", filter: true, group_by: true, description: "Requested path" },
+    Column { name: "query", kind: "string", filter: true, group_by: true, description: "Query string without the leading ?" },
+    Column { name: "ref_domain", kind: "string", filter: true, group_by: true, description: "Referring domain" },
+    Column { name: "search_terms", kind: "string", filter: true, group_by: false, description: "Terms searched for, when a search engine passes them on" },
+    Column { name: "social", kind: "string", filter: true, group_by: false, description: "Social platform the visit came from" },
+    Column { name: "agent", kind: "string", filter: true, group_by: true, description: "Browser, feed reader or bot name" },
+    Column { name: "type", kind: "string", filter: true, group_by: true, description: "browser, feed or bot" },
+    Column { name: "os", kind: "string", filter: true, group_by: true, description: "Operating system" },
+    Column { name: "scheme", kind: "string", filter: true, group_by: true, description: "http or https, from X-Forwarded-Proto" },
+    Column { name: "port", kind: "integer", filter: false, group_by: true, description: "Port the request came in on, from X-Forwarded-Port" },
+    Column { name: "asn_name", kind: "string", filter: false, group_by: true, description: "Network the address belongs to" },
+    Column { name: "datacenter", kind: "boolean", filter: false, group_by: true, description: "Whether that network is a hosting provider" },
+];
+
+pub const METRICS: &[&str] = &["uniques", "hits"];
+
+// Most rows a query returns, whatever its limit asks for.
+pub const MAX_ROWS: usize = 10_000;
+
+pub fn column(name: &str) -> Option<&'static Column> {
+    COLUMNS.iter().find(|c| c.name == name)
+}
+
+// The column a filter key (`path` or `path!`) applies to, if it can be
+// filtered on.
+pub fn filter_column(key: &str) -> Option<&'static str> {
+    let name = key.strip_suffix('!').unwrap_or(key);
+    column(name).filter(|c| c.filter).map(|c| c.name)
+}
+
+pub fn filter_columns() -> impl Iterator<Item = &'static str> {
+    COLUMNS.iter().filter(|c| c.filter).map(|c| c.name)
+}
+
+pub fn group_by_columns() -> impl Iterator<Item = &'static str> {
+    COLUMNS.iter().filter(|c| c.group_by).map(|c| c.name)
+}
+
+// A POST /api/query body: /api/aggregate as JSON, checked strictly.
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Query {
+    // YYYY-MM-DD; the current year when missing.
+    #[serde(default)]
+    pub from: Option<String>,
+    #[serde(default)]
+    pub to: Option<String>,
+    // Filter key to the values it matches, as the dashboard's parameters.
+    #[serde(default)]
+    pub filters: BTreeMap<String, Vec<String>>,
+    // No columns count the whole selection in one row.
+    #[serde(default)]
+    pub group_by: Vec<String>,
+    #[serde(default)]
+    pub metric: Option<String>,
+    #[serde(default)]
+    pub limit: Option<usize>,
+}
+
+// A checked query: the arguments of growth::aggregate.
+pub struct Plan {
+    pub group_by: Vec<String>,
+    pub uniques: bool,
+    pub limit: usize,
+    pub where_clause: String,
+    pub args: Vec<String>,
+}
+
+impl Query {
+    // Checks every name against COLUMNS; the error says what is wrong.
+    pub fn plan(&self, today: NaiveDate) -> Result<Plan, String> {
+        let date = |value: &Option<String>, key: &str, default: NaiveDate| match value {
+            None => Ok(default),
+            Some(value) => NaiveDate::parse_from_str(value, "%Y-%m-%d")
+                .map_err(|_| format!("{} must be a YYYY-MM-DD date", key)),
+        };
+        let from = date(&self.from, "from", NaiveDate::from_ymd_opt(today.year(), 1, 1).expect("date"))?;
+        let to = date(&self.to, "to", NaiveDate::from_ymd_opt(today.year(), 12, 31).expect("date"))?;
+
+        let mut filters = Filters::new();
+        for (key, values) in &self.filters {
+            if filter_column(key).is_none() {
+                let known: Vec<&str> = filter_columns().collect();
+                return Err(format!("unknown filter {}, expected one of {}", key, known.join(", ")));
+            }
+            if !values.is_empty() {
+                filters.insert(key.clone(), values.clone());
+            }
+        }
+
+        let mut group_by: Vec<String> = Vec::new();
+        for col in &self.group_by {
+            if !column(col).is_some_and(|c| c.group_by) {
+                let known: Vec<&str> = group_by_columns().collect();
+                return Err(format!("group_by must be among {}", known.join(", ")));
+            }
+            if !group_by.contains(col) {
+                group_by.push(col.clone());
+            }
+        }
+
+        let uniques = match self.metric.as_deref() {
+            None | Some("uniques") => true,
+            Some("hits") => false,
+            Some(_) => return Err("metric must be uniques or hits".to_string()),
+        };
+        let (mut where_clause, args) = build_where(
+            &from.format("%Y-%m-%d").to_string(),
+            &to.format("%Y-%m-%d").to_string(),
+            &filters,
+        );
+        // Like the dashboard, count browsers unless types are filtered or split.
+        if uniques
+            && !filters.contains_key("type")
+            && !filters.contains_key("type!")
+            && !group_by.iter().any(|c| c == "type")
+        {
+            where_clause.push_str(" AND type = 'browser'");
+        }
+        Ok(Plan {
+            group_by,
+            uniques,
+            limit: self.limit.unwrap_or(100).clamp(1, MAX_ROWS),
+            where_clause,
+            args,
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn checks_queries_against_columns() {
+        let today = NaiveDate::from_ymd_opt(2024, 5, 7).unwrap();
+        let query: Query = serde_json::from_str(
+            r#"{"from": "2024-05-01", "filters": {"path!": ["/feed.xml"]}, "group_by": ["ref_domain", "ref_domain"], "limit": 50000}"#,
+        )
+        .unwrap();
+        let plan = query.plan(today).unwrap();
+        assert_eq!(plan.group_by, ["ref_domain"]);
+        assert!(plan.uniques);
+        assert_eq!(plan.limit, MAX_ROWS);
+        assert_eq!(plan.args[..3], ["2024-05-01", "2024-12-31", "/feed.xml"]);
+        assert!(plan.where_clause.ends_with("AND type = 'browser'"));
+
+        let err = |json: &str| serde_json::from_str::<Query>(json).unwrap().plan(today).err().unwrap();
+        assert!(err(r#"{"filters": {"path; DROP TABLE stats": ["x"]}}"#).starts_with("unknown filter"));
+        assert!(err(r#"{"group_by": ["search_terms"]}"#).starts_with("group_by must be among date, host"));
+        assert_eq!(err(r#"{"metric": "sessions"}"#), "metric must be uniques or hits");
+        assert_eq!(err(r#"{"to": "May 7"}"#), "to must be a YYYY-MM-DD date");
+        assert!(serde_json::from_str::<Query>(r#"{"sql": "SELECT 1"}"#).is_err());
+
+        assert_eq!(filter_column("os!"), Some("os"));
+        assert_eq!(filter_column("asn_name"), None);
+    }
+}
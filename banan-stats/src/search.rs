@@ -0,0 +1,129 @@
+use crate::store::Store;
+use chrono::NaiveDate;
+use duckdb::params_from_iter;
+use serde::Serialize;
+
+const SEARCH_LIMIT: usize = 200;
+
+#[derive(Clone, Default, Serialize)]
+pub struct SearchResult {
+    pub days: Vec<SearchDay>,
+    pub rows: Vec<SearchRow>,
+}
+
+#[derive(Clone, Serialize)]
+pub struct SearchDay {
+    pub date: String,
+    pub hits: i64,
+    pub uniques: i64,
+}
+
+#[derive(Clone, Serialize)]
+#[serde(rename_all = "camelCase")]
+pub struct SearchRow {
+    pub date: String,
+    pub path: String,
+    pub query: String,
+    pub referrer: String,
+    pub user_agent: String,
+    #[serde(rename = "type")]
+    pub r#type: String,
+    pub hits: i64,
+}
+
+// A query wrapped in slashes (`/googlebot|bingbot/`) is matched as a regular
+// expression, anything else as a case-insensitive substring.
+fn search_clause(q: &str) -> (String, Vec<String>) {
+    let columns = ["path", "query", "referrer", "user_agent"];
+    if q.len() > 2 && q.starts_with('/') && q.ends_with('/') {
+        let pattern = &q[1..q.len() - 1];
+        let parts: Vec<String> = columns
+            .iter()
+            .map(|col| format!("regexp_matches({}, ?)", col))
+            .collect();
+        return (
+            format!("({})", parts.join(" OR ")),
+            vec![pattern.to_string(); columns.len()],
+        );
+    }
+    let like = format!("%{}%", escape_like(q));
+    let parts: Vec<String> = columns
+        .iter()
+        .map(|col| format!("{} ILIKE ? ESCAPE '\\'", col))
+        .collect();
+    (format!("({})", parts.join(" OR ")), vec![like; columns.len()])
+}
+
+fn escape_like(s: &str) -> String {
+    s.replace('\\', "\\\\")
+        .replace('%', "\\%")
+        .replace('_', "\\_")
+}
+
+pub async fn search(
+    store: &Store,
+    q: &str,
+    where_clause: &str,
+    args: &[String],
+) -> Result<SearchResult, anyhow::Error> {
+    let (clause, clause_args) = search_clause(q);
+    let where_clause = format!("{} AND {}", where_clause, clause);
+    let mut args = args.to_owned();
+    args.extend(clause_args);
+
+    let days_query = format!(
+        "SELECT date, COUNT(*) AS hits, COUNT(DISTINCT uniq) AS uniques
+         FROM stats
+         WHERE {}
+         GROUP BY date
+         ORDER BY date DESC",
+        where_clause
+    );
+    let rows_query = format!(
+        "SELECT date, path, query, referrer, user_agent, type, COUNT(*) AS hits
+         FROM stats
+         WHERE {}
+         GROUP BY date, path, query, referrer, user_agent, type
+         ORDER BY date DESC, hits DESC
+         LIMIT {}",
+        where_clause, SEARCH_LIMIT
+    );
+
+    store
+        .with_conn(move |conn| {
+            let mut result = SearchResult::default();
+
+            let mut stmt = conn.prepare(&days_query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            while let Some(row) = rows.next()? {
+                let date: NaiveDate = row.get(0)?;
+                result.days.push(SearchDay {
+                    date: date.format("%Y-%m-%d").to_string(),
+                    hits: row.get(1)?,
+                    uniques: row.get(2)?,
+                });
+            }
+
+            let mut stmt = conn.prepare(&rows_query)?;
+            let mut rows = stmt.query(params_from_iter(args.iter().map(|s| s.as_str())))?;
+            while let Some(row) = rows.next()? {
+                let date: NaiveDate = row.get(0)?;
+                let path: Option<String> = row.get(1)?;
+                let query: Option<String> = row.get(2)?;
+                let referrer: Option<String> = row.get(3)?;
+                let user_agent: Option<String> = row.get(4)?;
+                let typ: Option<String> = row.get(5)?;
+                result.rows.push(SearchRow {
+                    date: date.format("%Y-%m-%d").to_string(),
+                    path: path.unwrap_or_default(),
+                    query: query.unwrap_or_default(),
+                    referrer: referrer.unwrap_or_default(),
+                    user_agent: user_agent.unwrap_or_default(),
+                    r#type: typ.unwrap_or_default(),
+                    hits: row.get(6)?,
+                });
+            }
+            Ok(result)
+        })
+        .await
+}
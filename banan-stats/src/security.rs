@@ -0,0 +1,58 @@
+use axum::{
+    extract::{Request, State},
+    http::{header, HeaderValue},
+    middleware::Next,
+    response::Response,
+};
+use std::sync::Arc;
+
+// Inline style attributes draw the bars and graphs, hence 'unsafe-inline'
+// for styles only; scripts must come from the sidecar itself.
+pub const DEFAULT_CSP: &str = "default-src 'self'; script-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; font-src 'self'; connect-src 'self'; base-uri 'none'; form-action 'self'; object-src 'none'";
+
+#[derive(Clone, Debug)]
+pub struct Options {
+    // Empty disables the Content-Security-Policy header.
+    pub csp: String,
+    pub frame_ancestors: String,
+    pub referrer_policy: String,
+}
+
+// Adds security headers to dashboard responses (everything under /stats).
+pub async fn headers(State(options): State<Arc<Options>>, req: Request, next: Next) -> Response {
+    let dashboard = req.uri().path() == "/stats" || req.uri().path().starts_with("/stats/");
+    let mut resp = next.run(req).await;
+    if !dashboard {
+        return resp;
+    }
+    let headers = resp.headers_mut();
+
+    let csp = options.csp.trim().trim_end_matches(';');
+    if !csp.is_empty() {
+        let csp = if options.frame_ancestors.is_empty() {
+            csp.to_string()
+        } else {
+            format!("{}; frame-ancestors {}", csp, options.frame_ancestors)
+        };
+        if let Ok(val) = HeaderValue::from_str(&csp) {
+            headers.insert(header::CONTENT_SECURITY_POLICY, val);
+        }
+    }
+    // X-Frame-Options for browsers without frame-ancestors support.
+    match options.frame_ancestors.as_str() {
+        "'none'" => {
+            headers.insert(header::X_FRAME_OPTIONS, HeaderValue::from_static("DENY"));
+        }
+        "'self'" => {
+            headers.insert(header::X_FRAME_OPTIONS, HeaderValue::from_static("SAMEORIGIN"));
+        }
+        _ => {}
+    }
+    headers.insert(header::X_CONTENT_TYPE_OPTIONS, HeaderValue::from_static("nosniff"));
+    if !options.referrer_policy.is_empty() {
+        if let Ok(val) = HeaderValue::from_str(&options.referrer_policy) {
+            headers.insert(header::REFERRER_POLICY, val);
+        }
+    }
+    resp
+}
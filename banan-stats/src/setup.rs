@@ -0,0 +1,113 @@
+use crate::dashboard::{first_value, parse_query};
+use crate::state::AppState;
+use axum::{
+    extract::RawQuery,
+    http::{header, HeaderMap},
+    response::{IntoResponse, Response},
+    routing::get,
+    Router,
+};
+
+pub fn router(state: AppState) -> Router {
+    Router::new()
+        .route("/setup/worker.js", get(worker_handler))
+        .with_state(state)
+}
+
+// Serves a Cloudflare Worker that passes requests through to the origin and
+// reports HTML/feed responses to /ingest/v2. The secret is not embedded: the
+// worker reads it from its BANAN_INGEST_SECRET binding.
+async fn worker_handler(headers: HeaderMap, RawQuery(raw_query): RawQuery) -> Response {
+    let params = parse_query(raw_query.unwrap_or_default());
+    let endpoint = first_value(&params, "endpoint").unwrap_or_else(|| default_endpoint(&headers));
+    let cookie = first_value(&params, "cookie").unwrap_or_else(|| "stats_id".to_string());
+
+    let script = WORKER_TEMPLATE
+        .replace("__ENDPOINT__", &js_string(&endpoint))
+        .replace("__COOKIE__", &js_string(&cookie));
+    (
+        [(header::CONTENT_TYPE, "application/javascript; charset=utf-8")],
+        script,
+    )
+        .into_response()
+}
+
+fn default_endpoint(headers: &HeaderMap) -> String {
+    let host = headers
+        .get(header::HOST)
+        .and_then(|v| v.to_str().ok())
+        .unwrap_or("localhost:7070");
+    let scheme = headers
+        .get("x-forwarded-proto")
+        .and_then(|v| v.to_str().ok())
+        .unwrap_or("http");
+    format!("{}://{}/ingest/v2", scheme, host)
+}
+
+fn js_string(s: &str) -> String {
+    serde_json::to_string(s).unwrap_or_else(|_| "\"\"".to_string())
+}
+
+const WORKER_TEMPLATE: &str = r#"// banan-stats edge collector. Generated by /setup/worker.js.
+// Bind the ingest secret as BANAN_INGEST_SECRET (wrangler secret put BANAN_INGEST_SECRET).
+const ENDPOINT = __ENDPOINT__;
+const COOKIE = __COOKIE__;
+
+export default {
+  async fetch(request, env, ctx) {
+    const response = await fetch(request);
+    const type = (response.headers.get("content-type") || "").toLowerCase();
+    const tracked =
+      request.method === "GET" &&
+      response.status === 200 &&
+      (type.startsWith("text/html") ||
+        type.startsWith("application/rss+xml") ||
+        type.startsWith("application/atom+xml"));
+    if (tracked && env.BANAN_INGEST_SECRET) {
+      ctx.waitUntil(report(request, type, env.BANAN_INGEST_SECRET));
+    }
+    return response;
+  },
+};
+
+async function report(request, contentType, secret) {
+  const event = {
+    id: request.headers.get("cf-ray") || crypto.randomUUID(),
+    ts: new Date().toISOString(),
+    url: request.url,
+    ip: request.headers.get("cf-connecting-ip") || "",
+    ua: request.headers.get("user-agent") || "",
+    referrer: request.headers.get("referer") || "",
+    contentType,
+    uniq: readCookie(request.headers.get("cookie") || "", COOKIE),
+  };
+  const body = JSON.stringify(event);
+  const timestamp = Math.floor(Date.now() / 1000).toString();
+  const key = await crypto.subtle.importKey(
+    "raw",
+    new TextEncoder().encode(secret),
+    { name: "HMAC", hash: "SHA-256" },
+    false,
+    ["sign"],
+  );
+  const mac = await crypto.subtle.sign("HMAC", key, new TextEncoder().encode(timestamp + "." + body));
+  const signature = [...new Uint8Array(mac)].map((b) => b.toString(16).padStart(2, "0")).join("");
+  await fetch(ENDPOINT, {
+    method: "POST",
+    headers: {
+      "content-type": "application/json",
+      "x-banan-timestamp": timestamp,
+      "x-banan-signature": "sha256=" + signature,
+    },
+    body,
+  });
+}
+
+function readCookie(header, name) {
+  for (const part of header.split(";")) {
+    const [k, ...v] = part.trim().split("=");
+    if (k === name) return v.join("=").replace(/^\?/, "");
+  }
+  return "";
+}
+"#;
@@ -0,0 +1,94 @@
+use sha2::{Digest, Sha256};
+use std::time::Duration;
+
+pub const FORWARDED_HEADER: &str = "X-Banan-Shard-Forwarded";
+
+// Hosts are assigned to sidecar instances by hashing the host name, so every
+// instance agrees on the owner without coordination. Each instance stores only
+// the hosts it owns and forwards the rest.
+#[derive(Clone, Debug)]
+pub struct Shards {
+    peers: Vec<String>,
+    self_index: usize,
+    client: reqwest::Client,
+}
+
+impl Shards {
+    pub fn new(peers: Vec<String>, self_index: usize) -> Result<Self, anyhow::Error> {
+        if self_index >= peers.len() {
+            anyhow::bail!(
+                "shard index {} out of range for {} shards",
+                self_index,
+                peers.len()
+            );
+        }
+        let peers = peers
+            .into_iter()
+            .map(|p| p.trim().trim_end_matches('/').to_string())
+            .collect();
+        Ok(Self {
+            peers,
+            self_index,
+            client: reqwest::Client::builder()
+                .timeout(Duration::from_secs(10))
+                .build()?,
+        })
+    }
+
+    pub fn owner(&self, host: &str) -> usize {
+        let sum = Sha256::digest(host.to_lowercase().as_bytes());
+        let mut bytes = [0u8; 8];
+        bytes.copy_from_slice(&sum[..8]);
+        (u64::from_be_bytes(bytes) % self.peers.len() as u64) as usize
+    }
+
+    pub fn is_local(&self, host: &str) -> bool {
+        self.owner(host) == self.self_index
+    }
+
+    pub fn peers(&self) -> impl Iterator<Item = (usize, &str)> {
+        self.peers
+            .iter()
+            .enumerate()
+            .filter(move |(idx, _)| *idx != self.self_index)
+            .map(|(idx, url)| (idx, url.as_str()))
+    }
+
+    pub async fn forward_ingest(&self, shard: usize, body: Vec<u8>) -> Result<(), anyhow::Error> {
+        let resp = self
+            .client
+            .post(format!("{}/ingest", self.peers[shard]))
+            .header("Content-Type", "application/x-ndjson")
+            .header(FORWARDED_HEADER, "1")
+            .body(body)
+            .send()
+            .await?;
+        if resp.status() != reqwest::StatusCode::ACCEPTED {
+            anyhow::bail!("shard {} returned {}", shard, resp.status());
+        }
+        Ok(())
+    }
+
+    pub async fn fetch(&self, shard: usize, path_and_query: &str) -> Result<reqwest::Response, anyhow::Error> {
+        Ok(self
+            .client
+            .get(format!("{}{}", self.peers[shard], path_and_query))
+            .header(FORWARDED_HEADER, "1")
+            .send()
+            .await?)
+    }
+
+    pub async fn remote_hosts(&self) -> Vec<String> {
+        let mut hosts = Vec::new();
+        for (idx, _) in self.peers() {
+            match self.fetch(idx, "/api/hosts").await {
+                Ok(resp) => match resp.json::<Vec<String>>().await {
+                    Ok(mut peer_hosts) => hosts.append(&mut peer_hosts),
+                    Err(err) => eprintln!("shard {} hosts decode failed: {}", idx, err),
+                },
+                Err(err) => eprintln!("shard {} hosts failed: {}", idx, err),
+            }
+        }
+        hosts
+    }
+}
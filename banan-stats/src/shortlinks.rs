@@ -0,0 +1,142 @@
+use crate::assets;
+use crate::dashboard::{encode_params, escape_html, first_value, parse_query};
+use crate::state::AppState;
+use crate::store::Store;
+use axum::{
+    extract::{Path, State},
+    http::{HeaderMap, StatusCode},
+    response::{IntoResponse, Redirect, Response},
+    routing::{get, post},
+    Router,
+};
+use chrono::{Duration as ChronoDuration, NaiveDateTime, Utc};
+use sha2::{Digest, Sha256};
+use std::fmt::Write;
+
+// Lifetimes offered on the dashboard, in days; 0 never expires.
+pub const EXPIRY_CHOICES: &[(i64, &str)] = &[
+    (0, "never"),
+    (1, "1 day"),
+    (7, "7 days"),
+    (30, "30 days"),
+    (365, "1 year"),
+];
+
+// Hex digits of a link ID.
+const ID_LEN: usize = 10;
+
+pub fn router(state: AppState) -> Router {
+    Router::new()
+        .route("/stats/s", post(create_handler))
+        .route("/stats/s/:id", get(resolve_handler))
+        .with_state(state)
+}
+
+// The same dashboard state and lifetime always get the same ID, so sharing a
+// view twice does not pile up links; creating it again renews its expiry.
+fn link_id(query: &str, days: i64) -> String {
+    let sum = Sha256::digest(format!("{}#{}", query, days).as_bytes());
+    hex::encode(sum)[..ID_LEN].to_string()
+}
+
+pub async fn create(store: &Store, query: &str, days: i64) -> Result<String, anyhow::Error> {
+    let id = link_id(query, days);
+    let now = Utc::now().naive_utc();
+    let expires_at: Option<NaiveDateTime> = (days > 0).then(|| now + ChronoDuration::days(days));
+    let (link, query) = (id.clone(), query.to_string());
+    store
+        .with_conn(move |conn| {
+            conn.execute("DELETE FROM short_links WHERE expires_at < ?", duckdb::params![now])?;
+            conn.execute(
+                "INSERT INTO short_links (id, query, created_at, expires_at)
+                 VALUES (?, ?, ?, ?)
+                 ON CONFLICT (id) DO UPDATE SET expires_at = excluded.expires_at",
+                duckdb::params![link, query, now, expires_at],
+            )?;
+            Ok(())
+        })
+        .await?;
+    Ok(id)
+}
+
+// The dashboard query string behind `id`; None when it is unknown or expired.
+pub async fn resolve(store: &Store, id: &str) -> Result<Option<String>, anyhow::Error> {
+    let id = id.to_string();
+    let now = Utc::now().naive_utc();
+    store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(
+                "SELECT query FROM short_links
+                 WHERE id = ? AND (expires_at IS NULL OR expires_at > ?)",
+            )?;
+            let mut rows = stmt.query(duckdb::params![id, now])?;
+            match rows.next()? {
+                Some(row) => Ok(Some(row.get::<_, Option<String>>(0)?.unwrap_or_default())),
+                None => Ok(None),
+            }
+        })
+        .await
+}
+
+async fn create_handler(State(state): State<AppState>, body: String) -> Response {
+    let params = parse_query(body);
+    // Re-encoded, so the link only ever redirects to a well-formed dashboard
+    // URL.
+    let query = encode_params(&parse_query(first_value(&params, "query").unwrap_or_default()));
+    let days = first_value(&params, "expires")
+        .and_then(|d| d.parse::<i64>().ok())
+        .unwrap_or(0)
+        .max(0);
+    let id = match create(&state.store, &query, days).await {
+        Ok(id) => id,
+        Err(err) => {
+            eprintln!("short link failed: {}", err);
+            return StatusCode::INTERNAL_SERVER_ERROR.into_response();
+        }
+    };
+
+    let link = format!("/stats/s/{}", id);
+    let mut body = String::new();
+    let mut out = |s: &str| {
+        let _ = writeln!(body, "{}", s);
+    };
+    out("<!DOCTYPE html>");
+    out("<html>");
+    out("<head>");
+    out("<meta charset=\"utf-8\">");
+    out("<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">");
+    out(&assets::style_tag(false));
+    out("</head>");
+    out("<body>");
+    out(&format!(
+        "<div class=filters><a class=filter href='/stats?{}'>&larr; Dashboard</a></div>",
+        escape_html(&query)
+    ));
+    out("<h1>Short link</h1>");
+    out(&format!("<p><a href='{0}'>{0}</a></p>", escape_html(&link)));
+    out(&if days > 0 {
+        format!("<p>Expires in {} days.</p>", days)
+    } else {
+        "<p>Never expires.</p>".to_string()
+    });
+    out("</body>");
+    out("</html>");
+
+    let mut headers = HeaderMap::new();
+    headers.insert(
+        "Content-Type",
+        "text/html; charset=utf-8".parse().expect("header"),
+    );
+    (headers, body).into_response()
+}
+
+async fn resolve_handler(State(state): State<AppState>, Path(id): Path<String>) -> Response {
+    match resolve(&state.store, &id).await {
+        Ok(Some(query)) => Redirect::to(&format!("/stats?{}", query)).into_response(),
+        Ok(None) => (StatusCode::NOT_FOUND, "This link is unknown or has expired.").into_response(),
+        Err(err) => {
+            eprintln!("short link lookup failed: {}", err);
+            StatusCode::INTERNAL_SERVER_ERROR.into_response()
+        }
+    }
+}
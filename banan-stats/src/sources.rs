@@ -0,0 +1,154 @@
+use crate::admin;
+use crate::assets;
+use crate::dashboard::escape_html;
+use crate::locale;
+use crate::state::AppState;
+use crate::store::Store;
+use axum::{
+    extract::State,
+    http::HeaderMap,
+    response::{IntoResponse, Response},
+    routing::get,
+    Router,
+};
+use chrono::{Duration as ChronoDuration, NaiveDate, NaiveDateTime, Utc};
+use std::collections::BTreeMap;
+use std::fmt::Write;
+
+// Days of per-source counts shown, today included.
+const DAYS: i64 = 7;
+
+// A source that has sent nothing for this long is highlighted as silent.
+const SILENT_AFTER_MINUTES: i64 = 60;
+
+pub fn router(state: AppState) -> Router {
+    Router::new()
+        .route("/stats/sources", get(sources_handler))
+        .with_state(state)
+}
+
+pub struct SourceCounts {
+    pub source: String,
+    // Events per day, oldest first, ending today.
+    pub days: Vec<i64>,
+    pub last_seen: Option<NaiveDateTime>,
+}
+
+// Events per middleware source over the last DAYS days (UTC).
+pub async fn source_counts(store: &Store) -> Result<Vec<SourceCounts>, anyhow::Error> {
+    let today = Utc::now().date_naive();
+    let first = today - ChronoDuration::days(DAYS - 1);
+    let since = first.format("%Y-%m-%d").to_string();
+    let rows = store
+        .with_conn(move |conn| {
+            let mut stmt = conn.prepare(
+                "SELECT COALESCE(source, ''), date, COUNT(*), MAX(date + time)
+                 FROM stats
+                 WHERE date >= CAST(? AS DATE)
+                 GROUP BY ALL",
+            )?;
+            let mut rows = stmt.query([since])?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                let source: String = row.get(0)?;
+                let date: NaiveDate = row.get(1)?;
+                let count: i64 = row.get(2)?;
+                let last: Option<NaiveDateTime> = row.get(3)?;
+                out.push((source, date, count, last));
+            }
+            Ok(out)
+        })
+        .await?;
+
+    let mut by_source: BTreeMap<String, SourceCounts> = BTreeMap::new();
+    for (source, date, count, last) in rows {
+        let entry = by_source.entry(source.clone()).or_insert_with(|| SourceCounts {
+            source,
+            days: vec![0; DAYS as usize],
+            last_seen: None,
+        });
+        if let Some(slot) = usize::try_from((date - first).num_days())
+            .ok()
+            .and_then(|idx| entry.days.get_mut(idx))
+        {
+            *slot += count;
+        }
+        entry.last_seen = entry.last_seen.max(last);
+    }
+    Ok(by_source.into_values().collect())
+}
+
+async fn sources_handler(State(state): State<AppState>, headers: HeaderMap) -> Response {
+    if let Err(resp) = admin::authorize(&state, &headers) {
+        return resp;
+    }
+    let sources = match source_counts(&state.store).await {
+        Ok(sources) => sources,
+        Err(err) => {
+            eprintln!("sources query failed: {}", err);
+            Vec::new()
+        }
+    };
+    let today = Utc::now().date_naive();
+    let now = Utc::now().naive_utc();
+
+    let mut body = String::new();
+    let mut out = |s: &str| {
+        let _ = writeln!(body, "{}", s);
+    };
+    out("<!DOCTYPE html>");
+    out("<html>");
+    out("<head>");
+    out("<meta charset=\"utf-8\">");
+    out("<meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">");
+    out(&assets::style_tag(false));
+    out("</head>");
+    out("<body>");
+    out("<div class=filters><a class=filter href='/stats'>&larr; Dashboard</a></div>");
+    out("<h1>Sources</h1>");
+    if sources.is_empty() {
+        out(&format!("<div class=notice>No events in the last {} days.</div>", DAYS));
+    } else {
+        out("<table class=rows>");
+        let mut header = String::from("<tr><th>source</th>");
+        for offset in (0..DAYS).rev() {
+            let _ = write!(header, "<th>{}</th>", locale::current().day_month(today - ChronoDuration::days(offset)));
+        }
+        header.push_str("<th>last event (UTC)</th></tr>");
+        out(&header);
+        for s in &sources {
+            let silent = s
+                .last_seen
+                .is_none_or(|last| now - last > ChronoDuration::minutes(SILENT_AFTER_MINUTES));
+            let name = if s.source.is_empty() {
+                "<i>unlabelled</i>".to_string()
+            } else {
+                escape_html(&s.source)
+            };
+            let mut row = format!("<tr{}><td>{}</td>", if silent { " class=silent" } else { "" }, name);
+            for count in &s.days {
+                let _ = write!(row, "<td>{}</td>", count);
+            }
+            let last = s
+                .last_seen
+                .map(|t| t.format("%Y-%m-%d %H:%M").to_string())
+                .unwrap_or_default();
+            let _ = write!(row, "<td>{}</td></tr>", last);
+            out(&row);
+        }
+        out("</table>");
+        out(&format!(
+            "<p>Highlighted sources have sent nothing in the last {} minutes.</p>",
+            SILENT_AFTER_MINUTES
+        ));
+    }
+    out("</body>");
+    out("</html>");
+
+    let mut headers = HeaderMap::new();
+    headers.insert(
+        "Content-Type",
+        "text/html; charset=utf-8".parse().expect("header"),
+    );
+    (headers, body).into_response()
+}
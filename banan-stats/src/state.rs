@@ -1,7 +1,62 @@
+use crate::boards::Board;
+use crate::botverify::Verifier;
+use crate::console;
+use crate::diskguard::Guard;
+use crate::quota::Quotas;
+use crate::reports::Report;
+use crate::shard::Shards;
+use crate::sinks::Sinks;
 use crate::store::Store;
+use crate::trap::Trap;
+use crate::validate::Validator;
 use std::sync::Arc;
 
 #[derive(Clone)]
 pub struct AppState {
     pub store: Arc<Store>,
+    pub admin_token: Option<String>,
+    // Header a forward-auth proxy names the user in, recorded as the actor of
+    // admin actions; None records "admin".
+    pub trusted_user_header: Option<String>,
+    pub shards: Option<Arc<Shards>>,
+    pub ingest_secret: Option<String>,
+    // Rejects /ingest lines without a valid signature; needs ingest_secret.
+    pub require_signed_events: bool,
+    // Seconds either side of now a signed line may be dated; 0 disables.
+    pub signature_window: i64,
+    pub inline_tables: bool,
+    // Longest a dashboard page or table may take; None when unlimited.
+    pub dashboard_timeout: Option<std::time::Duration>,
+    // Weeks the current month's projection averages over; 0 disables it.
+    pub forecast_weeks: usize,
+    // Timeline days this many MADs from their trailing median are highlighted;
+    // 0 disables it.
+    pub outlier_mads: f64,
+    pub system_fonts: bool,
+    // Ingest answers 429 while this many inserts are running or queued; 0
+    // never sheds load.
+    pub max_pending_writes: usize,
+    // Set while the database is over --max-db-size or under --min-free-space;
+    // ingest answers 507 meanwhile.
+    pub disk_guard: Arc<Guard>,
+    // Per-host row and byte limits; events of a host at its quota are dropped.
+    pub quotas: Arc<Quotas>,
+    // Normalizes ingested events and counts the ones it rejects.
+    pub validator: Arc<Validator>,
+    // Limits of the admin SQL console.
+    pub console: console::Options,
+    // Scheduled queries from --reports, shown as dashboard cards.
+    pub reports: Arc<Vec<Report>>,
+    // Outputs stored events are also handed to, from --sink.
+    pub sinks: Arc<Sinks>,
+    // Named dashboards from --dashboards, at /stats/boards/<name>.
+    pub boards: Arc<Vec<Board>>,
+    // Reverse DNS checks of search crawlers, with --verify-bots.
+    pub bot_verifier: Option<Arc<Verifier>>,
+    // Hidden paths whose visitors are bots for the day, with --trap-path.
+    pub trap: Option<Arc<Trap>>,
+    // Days deleted rows stay restorable before they are removed for good.
+    pub delete_grace_days: i64,
+    // Stores neither IPs nor User-Agents, with --minimal-data.
+    pub minimal_data: bool,
 }
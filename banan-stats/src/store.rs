@@ -1,115 +1,832 @@
 use crate::analyzer::{self, Line};
+use crate::latency;
 use anyhow::Context;
-use duckdb::{params, Connection};
-use std::sync::{Arc, Mutex};
+use chrono::{DateTime, Datelike, NaiveDateTime, Utc};
+use duckdb::{params, params_from_iter, AccessMode, Config, Connection};
+use std::collections::{BTreeMap, BTreeSet};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::{Arc, Condvar, Mutex, MutexGuard};
 
 pub struct Store {
     conn: Arc<Mutex<Connection>>,
+    options: Options,
+    db_path: String,
+    partitions: Arc<Mutex<Partitions>>,
+    // Write counter and time of the last write, used as HTTP cache validators.
+    modified: Arc<Mutex<(u64, DateTime<Utc>)>>,
+    started: DateTime<Utc>,
+    // Inserts running or waiting for the connection; ingest sheds load when
+    // too many pile up.
+    pending_writes: Arc<AtomicUsize>,
+    // Inserts waiting for the connection, which queries let go first.
+    waiting_writes: Arc<WaitingWrites>,
 }
 
+#[derive(Clone, Debug, Default)]
+pub struct Options {
+    // Seconds before a second visit during which cookieless hits from the same
+    // IP+UA are folded into the cookie uniq. Zero disables the merge.
+    pub uniq_merge_window: i64,
+    // Opens the database with access_mode=READ_ONLY and skips schema setup, for
+    // dashboards served from a replicated copy.
+    pub read_only: bool,
+    // Stores each year's rows in its own DuckDB file next to the main one
+    // (`<name>-<year>.duckdb`); `stats` becomes a view over all of them.
+    pub partition_by_year: bool,
+}
+
+// Space taken by the database and left for it to grow into, in bytes.
+#[derive(Clone, Copy, Debug, Default)]
+pub struct DiskUsage {
+    // Used blocks of every attached file plus their WAL files.
+    pub used: u64,
+    // Free space on the filesystem plus blocks DuckDB can reuse.
+    pub free: u64,
+}
+
+#[derive(Default)]
+struct Partitions {
+    years: BTreeSet<i32>,
+    legacy: bool,
+}
+
+pub const STATS_COLUMNS: &str = "event_id, date, time, host, path, query, ip, user_agent, referrer, type, agent, os, ref_domain, mult, set_cookie, uniq, prefetch, ref_path, extra, status, original_ts, source, verified_bot, asn, asn_name, datacenter, fragment, consent, search_terms, social, scheme, port";
+
 impl Store {
-    pub fn open(path: &str) -> Result<Self, anyhow::Error> {
-        let conn = Connection::open(path).with_context(|| format!("open db {}", path))?;
-        for stmt in [
-            "CREATE TYPE agent_type_t AS ENUM ('feed', 'bot', 'browser')",
-            "CREATE TYPE agent_os_t AS ENUM ('Android', 'Windows', 'iOS', 'macOS', 'Linux')",
-        ] {
-            if let Err(err) = conn.execute(stmt, []) {
-                if !is_existing_type_error(&err) {
-                    return Err(err.into());
+    pub fn open(path: &str, options: Options) -> Result<Self, anyhow::Error> {
+        let conn = if options.read_only {
+            let config = Config::default().access_mode(AccessMode::ReadOnly)?;
+            Connection::open_with_flags(path, config)
+                .with_context(|| format!("open db {} read-only", path))?
+        } else {
+            Connection::open(path).with_context(|| format!("open db {}", path))?
+        };
+
+        if !options.read_only {
+            for stmt in [
+                "CREATE TYPE agent_type_t AS ENUM ('feed', 'bot', 'browser')",
+                "CREATE TYPE agent_os_t AS ENUM ('Android', 'Windows', 'iOS', 'macOS', 'Linux')",
+            ] {
+                if let Err(err) = conn.execute(stmt, []) {
+                    if !is_existing_type_error(&err) {
+                        return Err(err.into());
+                    }
                 }
             }
+            // A table left over from before partitioning still backs the view
+            // and needs the same migrations.
+            if !options.partition_by_year || has_main_stats_table(&conn)? {
+                ensure_stats_table(&conn, "stats", "agent_type_t", "agent_os_t")?;
+            }
+            conn.execute_batch(
+                "CREATE TABLE IF NOT EXISTS notified_referrers (
+                     ref_domain  VARCHAR PRIMARY KEY,
+                     notified_at TIMESTAMP
+                 );
+                 CREATE TABLE IF NOT EXISTS saved_views (
+                     name       VARCHAR PRIMARY KEY,
+                     query      VARCHAR,
+                     created_at TIMESTAMP
+                 );
+                 CREATE TABLE IF NOT EXISTS bot_ranges (
+                     range      VARCHAR PRIMARY KEY,
+                     flagged_on DATE,
+                     uniques    BIGINT,
+                     baseline   DOUBLE,
+                     status     VARCHAR
+                 );
+                 CREATE TABLE IF NOT EXISTS path_latency (
+                     date   DATE,
+                     host   VARCHAR,
+                     path   VARCHAR,
+                     bucket SMALLINT,
+                     hits   BIGINT,
+                     PRIMARY KEY (date, host, path, bucket)
+                 );
+                 CREATE TABLE IF NOT EXISTS daily_rollup (
+                     date    DATE,
+                     host    VARCHAR,
+                     type    VARCHAR,
+                     path    VARCHAR,
+                     hits    BIGINT,
+                     uniques BIGINT,
+                     PRIMARY KEY (date, host, type, path)
+                 );
+                 CREATE TABLE IF NOT EXISTS report_runs (
+                     name           VARCHAR,
+                     run_at         TIMESTAMP,
+                     result_columns VARCHAR,
+                     result_rows    VARCHAR,
+                     error          VARCHAR
+                 );
+                 CREATE TABLE IF NOT EXISTS audit_log (
+                     at     TIMESTAMP,
+                     actor  VARCHAR,
+                     action VARCHAR,
+                     filter VARCHAR,
+                     rows   BIGINT
+                 );
+                 CREATE TABLE IF NOT EXISTS short_links (
+                     id         VARCHAR PRIMARY KEY,
+                     query      VARCHAR,
+                     created_at TIMESTAMP,
+                     expires_at TIMESTAMP
+                 );",
+            )?;
         }
 
-        conn.execute_batch(
-            "CREATE TABLE IF NOT EXISTS stats (
-                 event_id   UUID,
-                 date       DATE,
-                 time       TIME,
-                 host       VARCHAR,
-                 path       VARCHAR,
-                 query      VARCHAR,
-                 ip         VARCHAR,
-                 user_agent VARCHAR,
-                 referrer   VARCHAR,
-                 type       agent_type_t,
-                 agent      VARCHAR,
-                 os         agent_os_t,
-                 ref_domain VARCHAR,
-                 mult       INTEGER,
-                 set_cookie UUID,
-                 uniq       UUID
-             );
-             ALTER TABLE stats ADD COLUMN IF NOT EXISTS event_id UUID;
-             ALTER TABLE stats ADD COLUMN IF NOT EXISTS host VARCHAR;
-             CREATE INDEX IF NOT EXISTS idx_stats_host_date ON stats(host, date);
-             CREATE UNIQUE INDEX IF NOT EXISTS idx_stats_event_id ON stats(event_id);",
-        )?;
+        let mut partitions = Partitions::default();
+        if options.partition_by_year {
+            partitions.legacy = has_main_stats_table(&conn)?;
+            partitions.years = discover_partitions(path)?;
+            if !options.read_only {
+                // Next year's too, as nothing can be attached once file access
+                // is locked below.
+                let year = Utc::now().year();
+                partitions.years.extend([year, year + 1]);
+            }
+            if partitions.years.is_empty() && !partitions.legacy {
+                anyhow::bail!("no yearly partitions found next to {}", path);
+            }
+            for year in &partitions.years {
+                attach_partition(&conn, path, *year, options.read_only)?;
+            }
+            refresh_view(&conn, &partitions)?;
+        }
+
+        // Nothing after this reads or writes files other than the attached
+        // ones, so the console and reports cannot either (read_text, read_csv,
+        // COPY ... TO). DuckDB only allows this per database, not per
+        // connection, and once off it stays off.
+        conn.execute_batch("SET enable_external_access = false")
+            .context("disable external access")?;
 
         Ok(Self {
             conn: Arc::new(Mutex::new(conn)),
+            options,
+            db_path: path.to_string(),
+            partitions: Arc::new(Mutex::new(partitions)),
+            modified: Arc::new(Mutex::new((0, Utc::now()))),
+            started: Utc::now(),
+            pending_writes: Arc::new(AtomicUsize::new(0)),
+            waiting_writes: Arc::new(WaitingWrites::default()),
+        })
+    }
+
+    // Identifies the current contents for conditional requests. Read-only
+    // stores follow the database files' mtime instead of the write counter,
+    // since replication replaces them underneath the process.
+    pub fn version(&self) -> (String, DateTime<Utc>) {
+        if self.options.read_only {
+            let mut paths = vec![PathBuf::from(&self.db_path)];
+            let partitions = self.partitions.lock().expect("partitions lock");
+            paths.extend(partitions.years.iter().map(|y| partition_path(&self.db_path, *y)));
+            let modified = paths
+                .iter()
+                .filter_map(|p| std::fs::metadata(p).and_then(|m| m.modified()).ok())
+                .map(DateTime::<Utc>::from)
+                .max()
+                .unwrap_or(self.started);
+            return (format!("ro-{}", modified.timestamp_millis()), modified);
+        }
+        let modified = self.modified.lock().expect("modified lock");
+        (format!("{}-{}", self.started.timestamp_millis(), modified.0), modified.1)
+    }
+
+    // Marks the contents as changed; called after every write.
+    pub fn touch(&self) {
+        let mut modified = self.modified.lock().expect("modified lock");
+        modified.0 += 1;
+        modified.1 = Utc::now();
+    }
+
+    pub fn pending_writes(&self) -> usize {
+        self.pending_writes.load(Ordering::Relaxed)
+    }
+
+    // Deleted rows leave their blocks in the file for reuse, so the file size
+    // alone would never go down after a prune; used blocks do.
+    pub async fn disk_usage(&self) -> Result<DiskUsage, anyhow::Error> {
+        let mut files = vec![PathBuf::from(&self.db_path)];
+        {
+            let partitions = self.partitions.lock().expect("partitions lock");
+            files.extend(partitions.years.iter().map(|y| partition_path(&self.db_path, *y)));
+        }
+        let (used_blocks, free_blocks) = self
+            .with_conn(|conn| {
+                let sizes = conn.query_row(
+                    "SELECT CAST(COALESCE(SUM(block_size * used_blocks), 0) AS BIGINT),
+                            CAST(COALESCE(SUM(block_size * free_blocks), 0) AS BIGINT)
+                     FROM pragma_database_size()",
+                    [],
+                    |row| Ok((row.get::<_, i64>(0)?, row.get::<_, i64>(1)?)),
+                )?;
+                Ok(sizes)
+            })
+            .await?;
+        let wal: u64 = files
+            .iter()
+            .filter_map(|p| std::fs::metadata(wal_path(p)).ok())
+            .map(|m| m.len())
+            .sum();
+        let available = free_space(Path::new(&self.db_path))?;
+        Ok(DiskUsage {
+            used: used_blocks.max(0) as u64 + wal,
+            free: available + free_blocks.max(0) as u64,
+        })
+    }
+
+    // Folds rows dated before `cutoff` into daily_rollup (hits and uniques per
+    // day, host, type and path, uniques weighted by mult as on the
+    // dashboard), deletes them and their latency histograms,
+    // then checkpoints so the freed blocks can be reused. Returns the number
+    // of rows deleted.
+    pub async fn rollup_and_prune(&self, cutoff: String) -> Result<usize, anyhow::Error> {
+        let rollup_cutoff = cutoff.clone();
+        self.with_conn(move |conn| {
+            conn.execute(
+                "INSERT INTO daily_rollup (date, host, type, path, hits, uniques)
+                 SELECT date, host, type, path, SUM(hits), SUM(mult)
+                 FROM (
+                     SELECT date, COALESCE(host, '') AS host, COALESCE(CAST(type AS VARCHAR), '') AS type,
+                            COALESCE(path, '') AS path, uniq, COUNT(*) AS hits, MAX(mult) AS mult
+                     FROM stats
+                     WHERE date < CAST(? AS DATE) AND deleted_at IS NULL
+                     GROUP BY ALL
+                 )
+                 GROUP BY date, host, type, path
+                 ON CONFLICT (date, host, type, path) DO UPDATE SET
+                     hits = hits + EXCLUDED.hits,
+                     uniques = GREATEST(uniques, EXCLUDED.uniques)",
+                [rollup_cutoff],
+            )?;
+            Ok(())
+        })
+        .await?;
+        let deleted = self
+            .update_stats("DELETE FROM {stats} WHERE date < CAST(? AS DATE)".to_string(), vec![cutoff.clone()])
+            .await?;
+        self.with_conn(move |conn| {
+            conn.execute("DELETE FROM path_latency WHERE date < CAST(? AS DATE)", [cutoff])?;
+            conn.execute_batch("CHECKPOINT")?;
+            Ok(())
+        })
+        .await?;
+        Ok(deleted)
+    }
+
+    // Refreshes the optimizer statistics and checkpoints the main database
+    // and every yearly partition, folding the WAL into the files and making
+    // the blocks of deleted rows reusable.
+    pub async fn checkpoint(&self) -> Result<(), anyhow::Error> {
+        if self.options.read_only {
+            anyhow::bail!("store is read-only");
+        }
+        let years: Vec<i32> = {
+            let partitions = self.partitions.lock().expect("partitions lock");
+            partitions.years.iter().copied().collect()
+        };
+        self.with_conn(move |conn| {
+            conn.execute_batch("VACUUM ANALYZE; CHECKPOINT")?;
+            for year in years {
+                conn.execute_batch(&format!("CHECKPOINT y{}", year))?;
+            }
+            Ok(())
         })
+        .await
     }
 
     pub async fn insert(&self, lines: Vec<Line>) -> Result<(), anyhow::Error> {
+        if self.options.read_only {
+            anyhow::bail!("store is read-only");
+        }
+        let _pending = PendingWrite::new(&self.pending_writes);
         let conn = self.conn.clone();
+        let options = self.options.clone();
+        let partitions = self.partitions.clone();
+        let waiting_writes = self.waiting_writes.clone();
         tokio::task::spawn_blocking(move || -> Result<(), anyhow::Error> {
-            let mut conn = conn.lock().expect("db lock");
-            let tx = conn.transaction()?;
-
-            let mut stmt = tx.prepare(
-                "INSERT INTO stats
-                 (event_id, date, time, host, path, query, ip, user_agent, referrer, type, agent, os, ref_domain, mult, set_cookie, uniq)
-                 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-                 ON CONFLICT(event_id) DO NOTHING",
-            )?;
-            let mut upd_stmt = tx.prepare("UPDATE stats SET uniq = ? WHERE set_cookie = ?")?;
-
-            for mut line in lines {
-                analyzer::analyze(&mut line);
-                stmt.execute(params![
-                    null_str(&line.event_id),
-                    null_str(&line.date),
-                    null_str(&line.time),
-                    null_str(&line.host),
-                    null_str(&line.path),
-                    null_str(&line.query),
-                    null_str(&line.ip),
-                    null_str(&line.user_agent),
-                    null_str(&line.referrer),
-                    null_str(&line.r#type),
-                    null_str(&line.agent),
-                    null_str(&line.os),
-                    null_str(&line.ref_domain),
-                    line.mult,
-                    null_str(&line.set_cookie),
-                    null_str(&line.uniq),
-                ])?;
-
-                if line.second_visit && !line.uniq.is_empty() {
-                    upd_stmt.execute(params![line.uniq, line.uniq])?;
-                }
+            let mut conn = waiting_writes.lock_first(&conn);
+            if !options.partition_by_year {
+                let (samples, _) = insert_lines(&mut conn, "stats", lines, &options)?;
+                return record_latency(&mut conn, samples);
             }
 
-            tx.commit()?;
-            Ok(())
+            // DuckDB only lets a transaction write to one attached database,
+            // so each year's rows are committed separately.
+            let partitions = partitions.lock().expect("partitions lock");
+            let mut by_year: BTreeMap<i32, Vec<Line>> = BTreeMap::new();
+            for line in lines {
+                by_year.entry(partition_year(&partitions, line_year(&line))).or_default().push(line);
+            }
+            let mut samples = Vec::new();
+            let mut merges = Vec::new();
+            for (year, lines) in by_year {
+                let (inserted, merged) = insert_lines(&mut conn, &partition_table(year), lines, &options)?;
+                samples.extend(inserted);
+                merges.extend(merged.into_iter().map(|merge| (year, merge)));
+            }
+            // A merge window from just after New Year reaches into the
+            // partitions before, each its own transaction.
+            for (year, merge) in merges {
+                let Some(start) = merge.earlier_year(options.uniq_merge_window, year) else {
+                    continue;
+                };
+                for earlier in partitions.years.range(partition_year(&partitions, start)..year) {
+                    let mut stmt = conn.prepare(&merge_sql(&partition_table(*earlier)))?;
+                    merge.run(&mut stmt, options.uniq_merge_window)?;
+                }
+            }
+            record_latency(&mut conn, samples)
         })
         .await??;
+        self.touch();
         Ok(())
     }
 
+    // Runs `func` on the shared connection once no insert is waiting for it.
+    // If the caller stops waiting, as a dashboard page past its deadline does,
+    // before the connection is free, `func` is skipped; DuckDB cannot stop a
+    // query that already started.
     pub async fn with_conn<T, F>(&self, func: F) -> Result<T, anyhow::Error>
     where
         T: Send + 'static,
         F: FnOnce(&Connection) -> Result<T, anyhow::Error> + Send + 'static,
     {
         let conn = self.conn.clone();
+        let waiting_writes = self.waiting_writes.clone();
+        let (tx, rx) = tokio::sync::oneshot::channel();
         tokio::task::spawn_blocking(move || {
-            let conn = conn.lock().expect("db lock");
-            func(&conn)
+            let conn = waiting_writes.lock_after(&conn);
+            if !tx.is_closed() {
+                let _ = tx.send(func(&conn));
+            }
+        });
+        rx.await.context("database task failed")?
+    }
+
+    // Runs `func` on a connection of its own to the same database, so a slow
+    // query only holds the shared connection while it is cloned. The yearly
+    // `stats` view is a temp view, so the clone gets its own copy.
+    pub async fn with_separate_conn<T, F>(&self, func: F) -> Result<T, anyhow::Error>
+    where
+        T: Send + 'static,
+        F: FnOnce(&Connection) -> Result<T, anyhow::Error> + Send + 'static,
+    {
+        let conn = self.conn.clone();
+        let partitions = self.partitions.clone();
+        let partition_by_year = self.options.partition_by_year;
+        let waiting_writes = self.waiting_writes.clone();
+        tokio::task::spawn_blocking(move || {
+            let separate = {
+                let conn = waiting_writes.lock_after(&conn);
+                let separate = conn.try_clone()?;
+                if partition_by_year {
+                    refresh_view(&separate, &partitions.lock().expect("partitions lock"))?;
+                }
+                separate
+            };
+            func(&separate)
         })
         .await?
     }
+
+    // Runs a data-changing statement against every table backing `stats`.
+    // `{stats}` in the SQL is replaced by each table name, since the yearly
+    // view cannot be updated directly. Returns the number of affected rows.
+    pub async fn update_stats(&self, sql: String, args: Vec<String>) -> Result<usize, anyhow::Error> {
+        if self.options.read_only {
+            anyhow::bail!("store is read-only");
+        }
+        let conn = self.conn.clone();
+        let partitions = self.partitions.clone();
+        let partition_by_year = self.options.partition_by_year;
+        let changed = tokio::task::spawn_blocking(move || -> Result<usize, anyhow::Error> {
+            let conn = conn.lock().expect("db lock");
+            let tables = if partition_by_year {
+                let partitions = partitions.lock().expect("partitions lock");
+                let mut tables: Vec<String> = partitions.years.iter().map(|y| partition_table(*y)).collect();
+                if partitions.legacy {
+                    tables.push("main.stats".to_string());
+                }
+                tables
+            } else {
+                vec!["stats".to_string()]
+            };
+            let mut changed = 0;
+            for table in tables {
+                let query = sql.replace("{stats}", &table);
+                changed += conn.execute(&query, params_from_iter(args.iter().map(|s| s.as_str())))?;
+            }
+            Ok(changed)
+        })
+        .await??;
+        if changed > 0 {
+            self.touch();
+        }
+        Ok(changed)
+    }
+}
+
+fn wal_path(path: &Path) -> PathBuf {
+    let mut wal = path.as_os_str().to_owned();
+    wal.push(".wal");
+    PathBuf::from(wal)
+}
+
+// Bytes available to unprivileged writers on the filesystem holding `path`.
+fn free_space(path: &Path) -> Result<u64, anyhow::Error> {
+    use std::os::unix::ffi::OsStrExt;
+    let dir = path
+        .parent()
+        .filter(|p| !p.as_os_str().is_empty())
+        .unwrap_or(Path::new("."));
+    let c_path = std::ffi::CString::new(dir.as_os_str().as_bytes())?;
+    let mut stat: libc::statvfs = unsafe { std::mem::zeroed() };
+    if unsafe { libc::statvfs(c_path.as_ptr(), &mut stat) } != 0 {
+        return Err(std::io::Error::last_os_error()).with_context(|| format!("statvfs {}", dir.display()));
+    }
+    Ok(stat.f_bavail as u64 * stat.f_frsize as u64)
+}
+
+// Counts one insert in Store::pending_writes for as long as it lives.
+struct PendingWrite<'a>(&'a AtomicUsize);
+
+impl<'a> PendingWrite<'a> {
+    fn new(counter: &'a AtomicUsize) -> Self {
+        counter.fetch_add(1, Ordering::Relaxed);
+        Self(counter)
+    }
+}
+
+impl Drop for PendingWrite<'_> {
+    fn drop(&mut self) {
+        self.0.fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+// Gives inserts the shared connection before queries: a query does not ask
+// for the lock while an insert is waiting for it, so a burst of dashboard
+// queries cannot hold ingest back for longer than the one already running.
+#[derive(Default)]
+struct WaitingWrites {
+    count: Mutex<usize>,
+    done: Condvar,
+}
+
+impl WaitingWrites {
+    // Locks the connection for an insert, ahead of queries not yet waiting
+    // on the lock.
+    fn lock_first<'a>(&self, conn: &'a Mutex<Connection>) -> MutexGuard<'a, Connection> {
+        *self.count.lock().expect("waiting writes lock") += 1;
+        let guard = conn.lock().expect("db lock");
+        let mut count = self.count.lock().expect("waiting writes lock");
+        *count -= 1;
+        if *count == 0 {
+            self.done.notify_all();
+        }
+        guard
+    }
+
+    // Locks the connection for a query once no insert is waiting.
+    fn lock_after<'a>(&self, conn: &'a Mutex<Connection>) -> MutexGuard<'a, Connection> {
+        let count = self.count.lock().expect("waiting writes lock");
+        drop(self.done.wait_while(count, |count| *count > 0).expect("waiting writes lock"));
+        conn.lock().expect("db lock")
+    }
+}
+
+// A timed page view for path_latency: date, host, path and bucket.
+type LatencySample = (String, String, String, i64);
+
+// Returns the timed page views among the newly inserted lines, of which
+// retried events that were already stored are not counted again, and the
+// uniq merges run on `table`.
+fn insert_lines(
+    conn: &mut Connection,
+    table: &str,
+    lines: Vec<Line>,
+    options: &Options,
+) -> Result<(Vec<LatencySample>, Vec<Merge>), anyhow::Error> {
+    let tx = conn.transaction()?;
+    let mut samples = Vec::new();
+
+    let mut stmt = tx.prepare(&format!(
+        "INSERT INTO {}
+         ({})
+         VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+         ON CONFLICT(event_id) DO NOTHING",
+        table, STATS_COLUMNS
+    ))?;
+    let mut upd_stmt = tx.prepare(&format!("UPDATE {} SET uniq = ? WHERE set_cookie = ?", table))?;
+    let mut merge_stmt = tx.prepare(&merge_sql(table))?;
+    let mut merges = Vec::new();
+
+    for mut line in lines {
+        analyzer::analyze(&mut line);
+        let inserted = stmt.execute(params![
+            null_str(&line.event_id),
+            null_str(&line.date),
+            null_str(&line.time),
+            null_str(&line.host),
+            null_str(&line.path),
+            null_str(&line.query),
+            null_str(&line.ip),
+            null_str(&line.user_agent),
+            null_str(&line.referrer),
+            null_str(&line.r#type),
+            null_str(&line.agent),
+            null_str(&line.os),
+            null_str(&line.ref_domain),
+            line.mult,
+            null_str(&line.set_cookie),
+            null_str(&line.uniq),
+            line.prefetch,
+            null_str(&line.ref_path),
+            null_str(&line.extra),
+            (line.status > 0).then_some(line.status),
+            null_str(&line.original_ts),
+            null_str(&line.source),
+            line.verified_bot,
+            (line.asn > 0).then_some(line.asn),
+            null_str(&line.asn_name),
+            (line.asn > 0).then_some(line.datacenter),
+            line.fragment,
+            null_str(&line.consent),
+            null_str(&line.search_terms),
+            null_str(&line.social),
+            null_str(&line.scheme),
+            (line.port > 0).then_some(line.port),
+        ])?;
+        if inserted > 0 && line.duration_ms > 0.0 && !line.prefetch && line.status < 400 {
+            samples.push((
+                line.date.clone(),
+                line.host.clone(),
+                line.path.clone(),
+                latency::bucket(line.duration_ms),
+            ));
+        }
+
+        if line.second_visit && !line.uniq.is_empty() {
+            upd_stmt.execute(params![line.uniq, line.uniq])?;
+            if options.uniq_merge_window > 0 && !line.ip.is_empty() {
+                let merge = Merge {
+                    uniq: line.uniq.clone(),
+                    fallback: analyzer::fallback_uniq(&line.ip, &line.user_agent),
+                    at: format!("{} {}", line.date, line.time),
+                    host: line.host.clone(),
+                };
+                merge.run(&mut merge_stmt, options.uniq_merge_window)?;
+                merges.push(merge);
+            }
+        }
+    }
+
+    drop(stmt);
+    drop(upd_stmt);
+    drop(merge_stmt);
+    tx.commit()?;
+    Ok((samples, merges))
+}
+
+// Folds a visitor's cookieless hits (`fallback` uniq) on the same host from
+// the --uniq-merge-window seconds before their second visit at `at` into
+// their cookie uniq.
+struct Merge {
+    uniq: String,
+    fallback: String,
+    at: String,
+    host: String,
+}
+
+fn merge_sql(table: &str) -> String {
+    format!(
+        "UPDATE {} SET uniq = ?
+         WHERE uniq = ?
+           AND host IS NOT DISTINCT FROM ?
+           AND (date + time) BETWEEN CAST(? AS TIMESTAMP) - to_seconds(?) AND CAST(? AS TIMESTAMP)",
+        table
+    )
+}
+
+impl Merge {
+    fn run(&self, stmt: &mut duckdb::Statement<'_>, window: i64) -> Result<usize, anyhow::Error> {
+        Ok(stmt.execute(params![self.uniq, self.fallback, null_str(&self.host), self.at, window, self.at])?)
+    }
+
+    // The year the window starts in, when it reaches back before `year`.
+    fn earlier_year(&self, window: i64, year: i32) -> Option<i32> {
+        let at = NaiveDateTime::parse_from_str(&self.at, "%Y-%m-%d %H:%M:%S").ok()?;
+        let start = (at - chrono::Duration::seconds(window)).year();
+        (start < year).then_some(start)
+    }
+}
+
+// The histograms live in the main database, outside the yearly partitions,
+// so they are written in a transaction of their own.
+fn record_latency(conn: &mut Connection, samples: Vec<LatencySample>) -> Result<(), anyhow::Error> {
+    if samples.is_empty() {
+        return Ok(());
+    }
+    let mut counts: BTreeMap<LatencySample, i64> = BTreeMap::new();
+    for sample in samples {
+        *counts.entry(sample).or_default() += 1;
+    }
+    let tx = conn.transaction()?;
+    let mut stmt = tx.prepare(
+        "INSERT INTO path_latency (date, host, path, bucket, hits)
+         VALUES (CAST(? AS DATE), ?, ?, ?, ?)
+         ON CONFLICT (date, host, path, bucket) DO UPDATE SET hits = hits + EXCLUDED.hits",
+    )?;
+    for ((date, host, path, bucket), hits) in counts {
+        stmt.execute(params![date, host, path, bucket, hits])?;
+    }
+    drop(stmt);
+    tx.commit()?;
+    Ok(())
+}
+
+// Partition files cannot reference the enum types of the main database, so
+// their `type` and `os` columns are plain VARCHAR.
+fn ensure_stats_table(
+    conn: &Connection,
+    table: &str,
+    type_type: &str,
+    os_type: &str,
+) -> Result<(), anyhow::Error> {
+    conn.execute_batch(&format!(
+        "CREATE TABLE IF NOT EXISTS {table} (
+             event_id   UUID,
+             date       DATE,
+             time       TIME,
+             host       VARCHAR,
+             path       VARCHAR,
+             query      VARCHAR,
+             ip         VARCHAR,
+             user_agent VARCHAR,
+             referrer   VARCHAR,
+             type       {type_type},
+             agent      VARCHAR,
+             os         {os_type},
+             ref_domain VARCHAR,
+             mult       INTEGER,
+             set_cookie UUID,
+             uniq       UUID,
+             prefetch   BOOLEAN,
+             ref_path   VARCHAR,
+             extra      VARCHAR,
+             status     SMALLINT,
+             original_ts TIMESTAMP,
+             source     VARCHAR,
+             verified_bot BOOLEAN,
+             asn        INTEGER,
+             asn_name   VARCHAR,
+             datacenter BOOLEAN,
+             fragment   BOOLEAN,
+             consent    VARCHAR,
+             search_terms VARCHAR,
+             social     VARCHAR,
+             scheme     VARCHAR,
+             port       INTEGER,
+             deleted_at TIMESTAMP
+         );
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS event_id UUID;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS host VARCHAR;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS prefetch BOOLEAN;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS ref_path VARCHAR;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS extra VARCHAR;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS status SMALLINT;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS original_ts TIMESTAMP;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS source VARCHAR;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS verified_bot BOOLEAN;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS asn INTEGER;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS asn_name VARCHAR;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS datacenter BOOLEAN;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS fragment BOOLEAN;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS consent VARCHAR;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS search_terms VARCHAR;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS social VARCHAR;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS scheme VARCHAR;
+         ALTER TABLE {table} ADD COLUMN IF NOT EXISTS port INTEGER;
+         CREATE INDEX IF NOT EXISTS idx_stats_host_date ON {table}(host, date);
+         CREATE UNIQUE INDEX IF NOT EXISTS idx_stats_event_id ON {table}(event_id);",
+    ))?;
+    Ok(())
+}
+
+fn partition_table(year: i32) -> String {
+    format!("y{}.stats", year)
+}
+
+fn partition_path(db_path: &str, year: i32) -> PathBuf {
+    let path = Path::new(db_path);
+    let stem = path.file_stem().and_then(|s| s.to_str()).unwrap_or("stats");
+    let file = match path.extension().and_then(|s| s.to_str()) {
+        Some(ext) => format!("{}-{}.{}", stem, year, ext),
+        None => format!("{}-{}", stem, year),
+    };
+    path.with_file_name(file)
+}
+
+fn discover_partitions(db_path: &str) -> Result<BTreeSet<i32>, anyhow::Error> {
+    let path = Path::new(db_path);
+    let dir = match path.parent() {
+        Some(dir) if !dir.as_os_str().is_empty() => dir.to_path_buf(),
+        _ => PathBuf::from("."),
+    };
+    let stem = path.file_stem().and_then(|s| s.to_str()).unwrap_or("stats");
+    let suffix = path
+        .extension()
+        .and_then(|s| s.to_str())
+        .map(|ext| format!(".{}", ext))
+        .unwrap_or_default();
+    let prefix = format!("{}-", stem);
+
+    let mut years = BTreeSet::new();
+    for entry in std::fs::read_dir(&dir).with_context(|| format!("list {}", dir.display()))? {
+        let name = entry?.file_name();
+        let Some(name) = name.to_str() else { continue };
+        let year = name
+            .strip_prefix(prefix.as_str())
+            .and_then(|rest| rest.strip_suffix(suffix.as_str()))
+            .filter(|year| year.len() == 4 && year.bytes().all(|b| b.is_ascii_digit()))
+            .and_then(|year| year.parse().ok());
+        if let Some(year) = year {
+            years.insert(year);
+        }
+    }
+    Ok(years)
+}
+
+fn attach_partition(
+    conn: &Connection,
+    db_path: &str,
+    year: i32,
+    read_only: bool,
+) -> Result<(), anyhow::Error> {
+    let path = partition_path(db_path, year);
+    conn.execute_batch(&format!(
+        "ATTACH IF NOT EXISTS '{}' AS y{}{}",
+        path.display().to_string().replace('\'', "''"),
+        year,
+        if read_only { " (READ_ONLY)" } else { "" }
+    ))
+    .with_context(|| format!("attach partition {}", path.display()))?;
+    if !read_only {
+        ensure_stats_table(conn, &partition_table(year), "VARCHAR", "VARCHAR")?;
+    }
+    Ok(())
+}
+
+fn has_main_stats_table(conn: &Connection) -> Result<bool, anyhow::Error> {
+    let count: i64 = conn.query_row(
+        "SELECT COUNT(*) FROM duckdb_tables()
+         WHERE database_name = current_database() AND schema_name = 'main' AND table_name = 'stats'",
+        [],
+        |row| row.get(0),
+    )?;
+    Ok(count > 0)
+}
+
+// The temp view shadows any legacy `main.stats` table, so every query that
+// reads `stats` transparently spans all attached years.
+fn refresh_view(conn: &Connection, partitions: &Partitions) -> Result<(), anyhow::Error> {
+    let mut selects: Vec<String> = partitions
+        .years
+        .iter()
+        .map(|year| format!("SELECT {}, deleted_at FROM {}", STATS_COLUMNS, partition_table(*year)))
+        .collect();
+    if partitions.legacy {
+        selects.push(format!("SELECT {}, deleted_at FROM main.stats", STATS_COLUMNS));
+    }
+    conn.execute_batch(&format!(
+        "CREATE OR REPLACE TEMP VIEW stats AS {}",
+        selects.join(" UNION ALL ")
+    ))?;
+    Ok(())
+}
+
+// The attached partition that stores rows dated in `year`: its own, else,
+// as no file can be attached after Store::open, the closest year before it,
+// else the earliest one. The view spans them all, so queries see the rows
+// either way.
+fn partition_year(partitions: &Partitions, year: i32) -> i32 {
+    partitions
+        .years
+        .range(..=year)
+        .next_back()
+        .or_else(|| partitions.years.iter().next())
+        .copied()
+        .unwrap_or(year)
+}
+
+fn line_year(line: &Line) -> i32 {
+    line.date
+        .get(..4)
+        .and_then(|y| y.parse().ok())
+        .unwrap_or_else(|| Utc::now().year())
 }
 
 fn null_str(s: &str) -> Option<&str> {
@@ -124,3 +841,102 @@ fn is_existing_type_error(err: &duckdb::Error) -> bool {
     let msg = err.to_string();
     msg.contains("already exists") || msg.contains("Type with name")
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn open_temp(name: &str, options: Options) -> Store {
+        let dir = std::env::temp_dir().join(format!("banan-stats-{}-{}", name, std::process::id()));
+        let _ = std::fs::remove_dir_all(&dir);
+        std::fs::create_dir_all(&dir).unwrap();
+        Store::open(dir.join("stats.duckdb").to_str().unwrap(), options).unwrap()
+    }
+
+    const COOKIE: &str = "c0c0c0c0-0000-4000-8000-000000000000";
+
+    // Browser hit `n` from one IP and User-Agent; cookieless unless `uniq` is
+    // set, which makes it the second visit that set the cookie.
+    fn hit(n: u32, host: &str, at: &str, uniq: &str) -> Line {
+        let (date, time) = at.split_once(' ').unwrap();
+        Line {
+            event_id: format!("00000000-0000-4000-8000-{:012}", n),
+            date: date.to_string(),
+            time: time.to_string(),
+            host: host.to_string(),
+            path: "/".to_string(),
+            ip: "192.0.2.1".to_string(),
+            user_agent: "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0".to_string(),
+            uniq: uniq.to_string(),
+            set_cookie: uniq.to_string(),
+            second_visit: !uniq.is_empty(),
+            ..Default::default()
+        }
+    }
+
+    // Times of the rows that carry the cookie uniq.
+    async fn merged_times(store: &Store) -> Vec<String> {
+        store
+            .with_conn(|conn| {
+                let mut stmt = conn.prepare(
+                    "SELECT CAST(date + time AS VARCHAR) FROM stats WHERE uniq = CAST(? AS UUID) ORDER BY 1",
+                )?;
+                let times = stmt.query_map([COOKIE], |row| row.get(0))?.collect::<Result<Vec<String>, _>>()?;
+                Ok(times)
+            })
+            .await
+            .unwrap()
+    }
+
+    #[tokio::test]
+    async fn merges_only_the_window_before_the_second_visit_on_its_host() {
+        let store = open_temp(
+            "merge",
+            Options {
+                uniq_merge_window: 1800,
+                ..Default::default()
+            },
+        );
+        store
+            .insert(vec![
+                hit(1, "a.example", "2024-05-07 11:00:00", ""),
+                hit(2, "a.example", "2024-05-07 12:00:00", ""),
+                hit(3, "b.example", "2024-05-07 12:05:00", ""),
+                hit(4, "a.example", "2024-05-07 12:40:00", ""),
+            ])
+            .await
+            .unwrap();
+        store.insert(vec![hit(5, "a.example", "2024-05-07 12:20:00", COOKIE)]).await.unwrap();
+        assert_eq!(merged_times(&store).await, ["2024-05-07 12:00:00", "2024-05-07 12:20:00"]);
+    }
+
+    #[tokio::test]
+    async fn merges_across_new_year_partitions() {
+        let store = open_temp(
+            "merge-partitions",
+            Options {
+                uniq_merge_window: 1800,
+                partition_by_year: true,
+                ..Default::default()
+            },
+        );
+        let year = Utc::now().year();
+        let before = format!("{}-12-31 23:50:00", year);
+        let after = format!("{}-01-01 00:10:00", year + 1);
+        store.insert(vec![hit(1, "a.example", &before, "")]).await.unwrap();
+        store.insert(vec![hit(2, "a.example", &after, COOKIE)]).await.unwrap();
+        assert_eq!(merged_times(&store).await, [before, after]);
+    }
+
+    #[test]
+    fn rows_go_to_the_closest_partition() {
+        let partitions = Partitions {
+            years: BTreeSet::from([2023, 2025]),
+            legacy: false,
+        };
+        assert_eq!(partition_year(&partitions, 2023), 2023);
+        assert_eq!(partition_year(&partitions, 2024), 2023);
+        assert_eq!(partition_year(&partitions, 2027), 2025);
+        assert_eq!(partition_year(&partitions, 2019), 2023);
+    }
+}
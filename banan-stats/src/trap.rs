@@ -0,0 +1,110 @@
+use crate::analyzer::{self, Line};
+use crate::store::Store;
+use chrono::{Duration as ChronoDuration, Utc};
+use std::collections::HashSet;
+use std::sync::Mutex;
+
+// Appended to the agent of visitors that requested a trap path, so the
+// Trapped bots table lists them and reclassified rows are not touched twice.
+pub const TRAPPED_SUFFIX: &str = " (trapped)";
+
+pub struct Trap {
+    paths: Vec<String>,
+    // Visitors (uniq) caught and the day they were, since yesterday.
+    caught: Mutex<HashSet<(String, String)>>,
+}
+
+impl Trap {
+    pub fn new(paths: &[String]) -> Self {
+        Trap {
+            paths: paths.to_vec(),
+            caught: Mutex::new(HashSet::new()),
+        }
+    }
+
+    // Picks up the visitors caught before a restart.
+    pub async fn load(&self, store: &Store) -> Result<(), anyhow::Error> {
+        let since = yesterday();
+        let caught = store
+            .with_conn(move |conn| {
+                let mut stmt = conn.prepare(&format!(
+                    "SELECT DISTINCT CAST(uniq AS VARCHAR), CAST(date AS VARCHAR)
+                     FROM stats
+                     WHERE date >= CAST(? AS DATE) AND uniq IS NOT NULL AND agent LIKE '%{}'",
+                    TRAPPED_SUFFIX
+                ))?;
+                let mut rows = stmt.query([since])?;
+                let mut out = Vec::new();
+                while let Some(row) = rows.next()? {
+                    out.push((row.get::<_, String>(0)?, row.get::<_, String>(1)?));
+                }
+                Ok(out)
+            })
+            .await?;
+        self.caught.lock().expect("trap lock").extend(caught);
+        Ok(())
+    }
+
+    // Turns the lines of visitors caught that day into bots, including the
+    // ones caught by these lines. Returns the visitors caught just now; their
+    // earlier rows still need reclassify.
+    pub fn check(&self, lines: &mut [Line]) -> Vec<(String, String)> {
+        let mut hits = Vec::new();
+        for line in lines.iter_mut() {
+            analyzer::analyze(line);
+            if !line.uniq.is_empty() && self.paths.iter().any(|path| *path == line.path) {
+                hits.push((line.uniq.clone(), line.date.clone()));
+            }
+        }
+        let mut caught = self.caught.lock().expect("trap lock");
+        let mut new = Vec::new();
+        if !hits.is_empty() {
+            let since = yesterday();
+            caught.retain(|(_, date)| *date >= since);
+            for hit in hits {
+                if caught.insert(hit.clone()) {
+                    new.push(hit);
+                }
+            }
+        }
+        if caught.is_empty() {
+            return new;
+        }
+        for line in lines.iter_mut() {
+            if caught.contains(&(line.uniq.clone(), line.date.clone())) {
+                mark(line);
+            }
+        }
+        new
+    }
+}
+
+fn mark(line: &mut Line) {
+    if !line.agent.ends_with(TRAPPED_SUFFIX) {
+        line.r#type = "bot".to_string();
+        line.agent.push_str(TRAPPED_SUFFIX);
+    }
+}
+
+fn yesterday() -> String {
+    (Utc::now() - ChronoDuration::days(1)).format("%Y-%m-%d").to_string()
+}
+
+// Reclassifies what the visitors requested earlier on the day they were
+// caught.
+pub async fn reclassify(store: &Store, caught: Vec<(String, String)>) -> Result<(), anyhow::Error> {
+    for (uniq, date) in caught {
+        store
+            .update_stats(
+                format!(
+                    "UPDATE {{stats}} SET type = 'bot', agent = coalesce(agent, '') || '{suffix}'
+                     WHERE uniq = ? AND date = CAST(? AS DATE)
+                       AND coalesce(agent, '') NOT LIKE '%{suffix}'",
+                    suffix = TRAPPED_SUFFIX
+                ),
+                vec![uniq, date],
+            )
+            .await?;
+    }
+    Ok(())
+}
@@ -0,0 +1,236 @@
+use chrono::{DateTime, Duration, Utc};
+use std::collections::BTreeMap;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Mutex;
+
+#[derive(Clone, Debug)]
+pub struct Options {
+    // Longest path, query, user agent and referrer stored, in bytes; longer
+    // values are cut at a character boundary. 0 keeps them whole.
+    pub max_field_len: usize,
+    // Seconds an event may be dated ahead of the sidecar's clock; 0 disables.
+    pub max_future: i64,
+    // Seconds an event may be dated behind the sidecar's clock; 0, the
+    // default, disables. Middleware buffers hold events through outages of
+    // any length, so keep this generous.
+    pub max_age: i64,
+    // Seconds of clock skew, either way, above which an event's timestamp is
+    // corrected before the checks above; 0 disables.
+    pub skew_threshold: i64,
+    pub skew_correction: SkewCorrection,
+}
+
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum SkewCorrection {
+    // Moves the timestamp to the threshold's edge, keeping the order of
+    // events from the same node.
+    #[default]
+    Bound,
+    // Uses the time the sidecar received the event.
+    Replace,
+}
+
+pub fn parse_skew_correction(value: &str) -> Result<SkewCorrection, anyhow::Error> {
+    match value.trim() {
+        "bound" => Ok(SkewCorrection::Bound),
+        "replace" => Ok(SkewCorrection::Replace),
+        other => anyhow::bail!("invalid clock skew correction {:?}, expected bound or replace", other),
+    }
+}
+
+// Why an event was rejected; also the `reason` label in /metrics.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, PartialOrd, Ord)]
+pub enum Reject {
+    Host,
+    Future,
+    Past,
+    // Unsigned line while signatures are required.
+    Unsigned,
+    // Signature that does not match the shared secret.
+    Signature,
+    // Signed line dated outside the signature window.
+    Replay,
+}
+
+impl Reject {
+    pub fn as_str(self) -> &'static str {
+        match self {
+            Reject::Host => "host",
+            Reject::Future => "future_timestamp",
+            Reject::Past => "past_timestamp",
+            Reject::Unsigned => "unsigned",
+            Reject::Signature => "signature",
+            Reject::Replay => "replay",
+        }
+    }
+}
+
+pub struct Validator {
+    options: Options,
+    rejected: Mutex<BTreeMap<Reject, u64>>,
+    truncated: AtomicU64,
+    corrected: AtomicU64,
+}
+
+impl Validator {
+    pub fn new(options: Options) -> Self {
+        Self {
+            options,
+            rejected: Mutex::new(BTreeMap::new()),
+            truncated: AtomicU64::new(0),
+            corrected: AtomicU64::new(0),
+        }
+    }
+
+    // Returns the corrected timestamp when `ts` is further than the skew
+    // threshold from `now`, None when it can be kept.
+    pub fn correct_timestamp(&self, ts: DateTime<Utc>, now: DateTime<Utc>) -> Option<DateTime<Utc>> {
+        let threshold = self.options.skew_threshold;
+        if threshold <= 0 || (ts - now).num_seconds().abs() <= threshold {
+            return None;
+        }
+        self.corrected.fetch_add(1, Ordering::Relaxed);
+        let bound = Duration::seconds(threshold);
+        Some(match self.options.skew_correction {
+            SkewCorrection::Replace => now,
+            SkewCorrection::Bound => ts.clamp(now - bound, now + bound),
+        })
+    }
+
+    pub fn check_timestamp(&self, ts: DateTime<Utc>, now: DateTime<Utc>) -> Result<(), Reject> {
+        let ahead = (ts - now).num_seconds();
+        if self.options.max_future > 0 && ahead > self.options.max_future {
+            return Err(Reject::Future);
+        }
+        if self.options.max_age > 0 && -ahead > self.options.max_age {
+            return Err(Reject::Past);
+        }
+        Ok(())
+    }
+
+    // Cuts each field to max_field_len bytes; counts the event once if any
+    // field was cut.
+    pub fn clamp(&self, fields: &mut [&mut String]) {
+        let max = self.options.max_field_len;
+        if max == 0 {
+            return;
+        }
+        let mut cut = false;
+        for field in fields.iter_mut() {
+            if field.len() > max {
+                let mut end = max;
+                while !field.is_char_boundary(end) {
+                    end -= 1;
+                }
+                field.truncate(end);
+                cut = true;
+            }
+        }
+        if cut {
+            self.truncated.fetch_add(1, Ordering::Relaxed);
+        }
+    }
+
+    pub fn count(&self, reject: Reject) {
+        *self.rejected.lock().expect("rejected lock").entry(reject).or_default() += 1;
+    }
+
+    pub fn rejected(&self) -> BTreeMap<Reject, u64> {
+        self.rejected.lock().expect("rejected lock").clone()
+    }
+
+    pub fn truncated(&self) -> u64 {
+        self.truncated.load(Ordering::Relaxed)
+    }
+
+    pub fn corrected(&self) -> u64 {
+        self.corrected.load(Ordering::Relaxed)
+    }
+}
+
+// Lowercases the host and converts internationalized names to punycode,
+// keeping a port if there is one. Returns None for hosts that are not valid
+// domain names or IP addresses. An empty host stays empty.
+pub fn normalize_host(raw: &str) -> Option<String> {
+    let raw = raw.trim();
+    if raw.is_empty() {
+        return Some(String::new());
+    }
+    let (name, port) = split_port(raw);
+    let name = name.strip_suffix('.').unwrap_or(name);
+    let host = url::Host::parse(name).ok()?;
+    let mut out = host.to_string();
+    if let Some(port) = port {
+        out.push(':');
+        out.push_str(port);
+    }
+    Some(out)
+}
+
+fn split_port(raw: &str) -> (&str, Option<&str>) {
+    let is_port = |p: &str| !p.is_empty() && p.bytes().all(|b| b.is_ascii_digit());
+    if raw.starts_with('[') {
+        return match raw.rsplit_once("]:") {
+            Some((name, port)) if is_port(port) => (&raw[..name.len() + 1], Some(port)),
+            _ => (raw, None),
+        };
+    }
+    match raw.rsplit_once(':') {
+        Some((name, port)) if !name.contains(':') && is_port(port) => (name, Some(port)),
+        _ => (raw, None),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn normalizes_hosts() {
+        assert_eq!(normalize_host("Example.COM").as_deref(), Some("example.com"));
+        assert_eq!(normalize_host("example.com.:8080").as_deref(), Some("example.com:8080"));
+        assert_eq!(normalize_host("bücher.example").as_deref(), Some("xn--bcher-kva.example"));
+        assert_eq!(normalize_host("[::1]:7070").as_deref(), Some("[::1]:7070"));
+        assert_eq!(normalize_host("").as_deref(), Some(""));
+        assert_eq!(normalize_host("bad host"), None);
+    }
+
+    #[test]
+    fn clamps_at_char_boundaries() {
+        let validator = Validator::new(Options {
+            max_field_len: 3,
+            max_future: 0,
+            max_age: 0,
+            skew_threshold: 0,
+            skew_correction: SkewCorrection::Bound,
+        });
+        let mut ua = "aéb".to_string();
+        let mut path = "/".to_string();
+        validator.clamp(&mut [&mut ua, &mut path]);
+        assert_eq!(ua, "aé");
+        assert_eq!(path, "/");
+        assert_eq!(validator.truncated(), 1);
+    }
+
+    #[test]
+    fn corrects_skewed_timestamps() {
+        let now = Utc::now();
+        let mut options = Options {
+            max_field_len: 0,
+            max_future: 0,
+            max_age: 0,
+            skew_threshold: 60,
+            skew_correction: SkewCorrection::Bound,
+        };
+        let validator = Validator::new(options.clone());
+        assert_eq!(validator.correct_timestamp(now - Duration::seconds(30), now), None);
+        assert_eq!(
+            validator.correct_timestamp(now + Duration::hours(2), now),
+            Some(now + Duration::seconds(60))
+        );
+        options.skew_correction = SkewCorrection::Replace;
+        let validator = Validator::new(options);
+        assert_eq!(validator.correct_timestamp(now - Duration::hours(2), now), Some(now));
+        assert_eq!(validator.corrected(), 1);
+    }
+}
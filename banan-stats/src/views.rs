@@ -0,0 +1,91 @@
+use crate::audit;
+use crate::dashboard::{first_value, parse_query};
+use crate::state::AppState;
+use crate::store::Store;
+use axum::{
+    extract::State,
+    http::{HeaderMap, StatusCode},
+    response::{IntoResponse, Redirect, Response},
+    routing::post,
+    Router,
+};
+
+pub struct SavedView {
+    pub name: String,
+    // Encoded dashboard query string (range and filters) the view restores.
+    pub query: String,
+}
+
+pub fn router(state: AppState) -> Router {
+    Router::new()
+        .route("/stats/views", post(save_handler))
+        .route("/stats/views/delete", post(delete_handler))
+        .with_state(state)
+}
+
+pub async fn saved_views(store: &Store) -> Result<Vec<SavedView>, anyhow::Error> {
+    store
+        .with_conn(|conn| {
+            let mut stmt = conn.prepare("SELECT name, query FROM saved_views ORDER BY name")?;
+            let mut rows = stmt.query([])?;
+            let mut out = Vec::new();
+            while let Some(row) = rows.next()? {
+                out.push(SavedView {
+                    name: row.get(0)?,
+                    query: row.get(1)?,
+                });
+            }
+            Ok(out)
+        })
+        .await
+}
+
+async fn save_handler(State(state): State<AppState>, body: String) -> Response {
+    let params = parse_query(body);
+    let name = first_value(&params, "name").unwrap_or_default().trim().to_string();
+    let query = first_value(&params, "query").unwrap_or_default();
+    if name.is_empty() {
+        return StatusCode::BAD_REQUEST.into_response();
+    }
+    let redirect = format!("/stats?{}", query);
+    let result = state
+        .store
+        .with_conn(move |conn| {
+            conn.execute(
+                "INSERT INTO saved_views (name, query, created_at)
+                 VALUES (?, ?, current_timestamp)
+                 ON CONFLICT (name) DO UPDATE SET query = excluded.query",
+                [name, query],
+            )?;
+            Ok(())
+        })
+        .await;
+    if let Err(err) = result {
+        eprintln!("save view failed: {}", err);
+        return StatusCode::INTERNAL_SERVER_ERROR.into_response();
+    }
+    state.store.touch();
+    Redirect::to(&redirect).into_response()
+}
+
+async fn delete_handler(State(state): State<AppState>, headers: HeaderMap, body: String) -> Response {
+    let params = parse_query(body);
+    let Some(name) = first_value(&params, "name") else {
+        return StatusCode::BAD_REQUEST.into_response();
+    };
+    let filter = format!("name={}", name);
+    let result = state
+        .store
+        .with_conn(move |conn| Ok(conn.execute("DELETE FROM saved_views WHERE name = ?", [name])?))
+        .await;
+    let rows = match result {
+        Ok(rows) => rows,
+        Err(err) => {
+            eprintln!("delete view failed: {}", err);
+            return StatusCode::INTERNAL_SERVER_ERROR.into_response();
+        }
+    };
+    state.store.touch();
+    audit::log(&state.store, &audit::actor(&state, &headers), "delete view", &filter, rows).await;
+    Redirect::to("/stats").into_response()
+}
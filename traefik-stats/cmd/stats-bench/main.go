@@ -0,0 +1,463 @@
+// Command stats-bench generates load against banan-stats and reports how it
+// keeps up: ingest throughput and latency against the sidecar, buffer
+// growth in the middleware, and dashboard API latency while both run.
+//
+//	stats-bench -target sidecar -rate 2000 -batch 200 -duration 1m
+//	stats-bench -target middleware -rate 500 -sidecar-url http://127.0.0.1:7070
+//	stats-bench -target sidecar -replay buffer.ndjson -rate 1000
+//
+// Synthetic traffic spreads page views over a few hosts, paths and visitors
+// with a long tail; -replay sends recorded /ingest lines in a loop instead,
+// dated at the time they are sent.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/khaled/banan-stats/traefik-stats/statsapi"
+	"github.com/khaled/banan-stats/traefik-stats/traefikstats"
+)
+
+type options struct {
+	target        string
+	sidecarURL    string
+	token         string
+	rate          float64
+	batch         int
+	duration      time.Duration
+	concurrency   int
+	hosts         string
+	visitors      int
+	seed          int64
+	replay        string
+	queryInterval time.Duration
+	ingestMode    string
+	bufferPath    string
+	json          bool
+}
+
+func main() {
+	var opts options
+	fs := flag.NewFlagSet("stats-bench", flag.ExitOnError)
+	fs.StringVar(&opts.target, "target", "sidecar", "what to load: sidecar (POST /ingest) or middleware (the Traefik plugin, in process)")
+	fs.StringVar(&opts.sidecarURL, "sidecar-url", envOr("BANAN_STATS_URL", "http://localhost:7070"), "banan-stats sidecar base URL")
+	fs.StringVar(&opts.token, "token", os.Getenv("BANAN_STATS_TOKEN"), "sidecar admin token")
+	fs.Float64Var(&opts.rate, "rate", 1000, "events (sidecar) or requests (middleware) per second")
+	fs.IntVar(&opts.batch, "batch", 100, "events per /ingest request (sidecar target)")
+	fs.DurationVar(&opts.duration, "duration", 30*time.Second, "how long to send")
+	fs.IntVar(&opts.concurrency, "concurrency", 4, "requests in flight at once")
+	fs.StringVar(&opts.hosts, "hosts", "bench.example.com,blog.bench.example.com", "comma-separated hosts of synthetic events")
+	fs.IntVar(&opts.visitors, "visitors", 5000, "distinct synthetic visitors")
+	fs.Int64Var(&opts.seed, "seed", 1, "random seed of synthetic traffic")
+	fs.StringVar(&opts.replay, "replay", "", "NDJSON file of /ingest events to replay instead of synthetic traffic")
+	fs.DurationVar(&opts.queryInterval, "query-interval", time.Second, "time between dashboard API probes; 0 disables them")
+	fs.StringVar(&opts.ingestMode, "ingest-mode", "batch", "ingestMode of the middleware: batch or stream")
+	fs.StringVar(&opts.bufferPath, "buffer-path", "", "middleware buffer file (default: a temporary file)")
+	fs.BoolVar(&opts.json, "json", false, "print the report as JSON")
+	_ = fs.Parse(os.Args[1:])
+
+	rep, err := run(opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "stats-bench: %v\n", err)
+		os.Exit(1)
+	}
+	if opts.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(rep)
+		return
+	}
+	rep.print()
+}
+
+func run(opts options) (*report, error) {
+	if opts.rate <= 0 || opts.batch <= 0 || opts.concurrency <= 0 || opts.duration <= 0 {
+		return nil, errors.New("-rate, -batch, -concurrency and -duration must be above 0")
+	}
+	var t *traffic
+	if opts.replay != "" {
+		var err error
+		if t, err = loadRecordedTraffic(opts.replay); err != nil {
+			return nil, err
+		}
+	} else {
+		var hosts []string
+		for _, h := range strings.Split(opts.hosts, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hosts = append(hosts, h)
+			}
+		}
+		if len(hosts) == 0 {
+			return nil, errors.New("-hosts is empty")
+		}
+		t = newSyntheticTraffic(opts.seed, hosts, opts.visitors)
+	}
+
+	client := statsapi.New(opts.sidecarURL)
+	client.Token = opts.token
+	ctx, cancel := context.WithTimeout(context.Background(), opts.duration)
+	defer cancel()
+
+	var probes *latencies
+	var wg sync.WaitGroup
+	if opts.queryInterval > 0 {
+		probes = &latencies{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probeQueries(ctx, client, opts.queryInterval, probes)
+		}()
+	}
+
+	var rep *report
+	var err error
+	switch opts.target {
+	case "sidecar":
+		rep, err = loadSidecar(ctx, opts, client, t)
+	case "middleware":
+		rep, err = loadMiddleware(ctx, opts, t)
+	default:
+		err = fmt.Errorf("-target must be sidecar or middleware, got %q", opts.target)
+	}
+	cancel()
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	if probes != nil {
+		rep.Query = probes.summary()
+	}
+	return rep, nil
+}
+
+// loadSidecar posts batches to /ingest at the requested rate.
+func loadSidecar(ctx context.Context, opts options, client *statsapi.Client, t *traffic) (*report, error) {
+	rep := &report{Target: "sidecar"}
+	lat := &latencies{}
+	var sent, failed, busy atomic.Int64
+	interval := time.Duration(float64(opts.batch) / opts.rate * float64(time.Second))
+	batches := make(chan []statsapi.Event, opts.concurrency)
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				start := time.Now()
+				// Requests already sent are allowed to finish after the end.
+				err := client.Ingest(context.Background(), batch)
+				lat.add(time.Since(start))
+				var apiErr *statsapi.APIError
+				switch {
+				case err == nil:
+					sent.Add(int64(len(batch)))
+				case errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode == http.StatusInsufficientStorage):
+					busy.Add(int64(len(batch)))
+				default:
+					failed.Add(int64(len(batch)))
+					rep.noteError(err)
+				}
+			}
+		}()
+	}
+
+	start := time.Now()
+	rep.Skipped = pace(ctx, interval, func(now time.Time) bool {
+		batch := make([]statsapi.Event, opts.batch)
+		for i := range batch {
+			batch[i] = t.event(now)
+		}
+		select {
+		case batches <- batch:
+			return true
+		default:
+			return false
+		}
+	}) * int64(opts.batch)
+	close(batches)
+	wg.Wait()
+
+	rep.Elapsed = time.Since(start).Round(time.Millisecond).String()
+	rep.Sent = sent.Load()
+	rep.Busy = busy.Load()
+	rep.Failed = failed.Load()
+	rep.Throughput = float64(rep.Sent) / time.Since(start).Seconds()
+	rep.Ingest = lat.summary()
+	return rep, nil
+}
+
+// loadMiddleware serves requests through an in-process middleware that
+// flushes to the sidecar, sampling its buffer every second.
+func loadMiddleware(ctx context.Context, opts options, t *traffic) (*report, error) {
+	bufferPath := opts.bufferPath
+	if bufferPath == "" {
+		dir, err := os.MkdirTemp("", "stats-bench")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		bufferPath = filepath.Join(dir, "buffer.ndjson")
+	}
+	cfg := traefikstats.CreateConfig()
+	cfg.SidecarURL = opts.sidecarURL
+	cfg.BufferPath = bufferPath
+	cfg.IngestMode = opts.ingestMode
+	cfg.BatchSize = opts.batch
+	cfg.Source = "stats-bench"
+	// Every synthetic request is a separate page view.
+	cfg.PrefetchMode = "count"
+	site := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".xml") {
+			w.Header().Set("Content-Type", "application/rss+xml")
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+	mwCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	handler, err := traefikstats.New(mwCtx, site, cfg, "stats-bench")
+	if err != nil {
+		return nil, err
+	}
+
+	rep := &report{Target: "middleware"}
+	lat := &latencies{}
+	var served atomic.Int64
+	requests := make(chan *http.Request, opts.concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range requests {
+				start := time.Now()
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+				lat.add(time.Since(start))
+				served.Add(1)
+			}
+		}()
+	}
+
+	// The middleware's own status endpoint, as health probes see it.
+	status := func() (pipelineStatus, error) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost"+strings.TrimSuffix(cfg.DashboardPath, "/")+"/status", nil))
+		var st pipelineStatus
+		err := json.Unmarshal(rec.Body.Bytes(), &st)
+		return st, err
+	}
+	sampleDone := make(chan struct{})
+	go func() {
+		defer close(sampleDone)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if st, err := status(); err == nil {
+					rep.QueueDepth = append(rep.QueueDepth, st.QueueDepth)
+				}
+			}
+		}
+	}()
+
+	start := time.Now()
+	rep.Skipped = pace(ctx, time.Duration(float64(time.Second)/opts.rate), func(now time.Time) bool {
+		select {
+		case requests <- t.request(now):
+			return true
+		default:
+			return false
+		}
+	})
+	close(requests)
+	wg.Wait()
+	<-sampleDone
+
+	rep.Elapsed = time.Since(start).Round(time.Millisecond).String()
+	rep.Sent = served.Load()
+	rep.Throughput = float64(rep.Sent) / time.Since(start).Seconds()
+	rep.Ingest = lat.summary()
+	if st, err := status(); err == nil {
+		rep.FinalQueue = st.QueueDepth
+		rep.LastError = st.LastError
+	}
+	if closer, ok := handler.(interface{ Close() error }); ok {
+		_ = closer.Close()
+	}
+	return rep, nil
+}
+
+// pipelineStatus holds the fields of the middleware's status JSON the
+// report uses.
+type pipelineStatus struct {
+	QueueDepth int    `json:"queueDepth"`
+	LastError  string `json:"lastError"`
+}
+
+// pace calls send every interval until ctx is done, catching up after
+// slow rounds, and returns how many sends were refused because every worker
+// was still busy.
+func pace(ctx context.Context, interval time.Duration, send func(time.Time) bool) int64 {
+	if interval <= 0 {
+		interval = time.Microsecond
+	}
+	var skipped int64
+	next := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return skipped
+		default:
+		}
+		now := time.Now()
+		if now.Before(next) {
+			time.Sleep(next.Sub(now))
+			continue
+		}
+		if !send(now) {
+			skipped++
+		}
+		next = next.Add(interval)
+	}
+}
+
+// probeQueries times the dashboard's API queries while load runs.
+func probeQueries(ctx context.Context, client *statsapi.Client, interval time.Duration, lat *latencies) {
+	today := time.Now().UTC().Format("2006-01-02")
+	f := statsapi.Filters{From: today, To: today}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		start := time.Now()
+		var err error
+		if i%2 == 0 {
+			_, err = client.Uniques(ctx, "day", f)
+		} else {
+			_, err = client.Top(ctx, "paths", f)
+		}
+		if err == nil {
+			lat.add(time.Since(start))
+		}
+	}
+}
+
+// latencies collects durations for percentiles.
+type latencies struct {
+	mu  sync.Mutex
+	all []time.Duration
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	l.all = append(l.all, d)
+	l.mu.Unlock()
+}
+
+type latencySummary struct {
+	Count int    `json:"count"`
+	P50   string `json:"p50"`
+	P95   string `json:"p95"`
+	P99   string `json:"p99"`
+	Max   string `json:"max"`
+}
+
+func (l *latencies) summary() *latencySummary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.all) == 0 {
+		return nil
+	}
+	sorted := append([]time.Duration(nil), l.all...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) string {
+		return sorted[int(p*float64(len(sorted)-1))].Round(time.Microsecond).String()
+	}
+	return &latencySummary{Count: len(sorted), P50: at(0.50), P95: at(0.95), P99: at(0.99), Max: at(1)}
+}
+
+type report struct {
+	Target     string  `json:"target"`
+	Elapsed    string  `json:"elapsed"`
+	Sent       int64   `json:"sent"`
+	Throughput float64 `json:"throughput"`
+	// Busy counts events the sidecar turned away with 429 or 507.
+	Busy   int64 `json:"busy,omitempty"`
+	Failed int64 `json:"failed,omitempty"`
+	// Skipped counts events not sent because every worker was still
+	// waiting for an earlier request: the target is slower than -rate.
+	Skipped    int64           `json:"skipped"`
+	Ingest     *latencySummary `json:"ingest,omitempty"`
+	Query      *latencySummary `json:"query,omitempty"`
+	QueueDepth []int           `json:"queueDepth,omitempty"`
+	FinalQueue int             `json:"finalQueue,omitempty"`
+	LastError  string          `json:"lastError,omitempty"`
+
+	errMu sync.Mutex
+}
+
+func (r *report) noteError(err error) {
+	r.errMu.Lock()
+	r.LastError = err.Error()
+	r.errMu.Unlock()
+}
+
+func (r *report) print() {
+	unit := "events"
+	if r.Target == "middleware" {
+		unit = "requests"
+	}
+	fmt.Printf("target      %s\n", r.Target)
+	fmt.Printf("elapsed     %s\n", r.Elapsed)
+	fmt.Printf("sent        %d %s (%.0f/s)\n", r.Sent, unit, r.Throughput)
+	if r.Busy > 0 || r.Failed > 0 {
+		fmt.Printf("rejected    %d busy, %d failed\n", r.Busy, r.Failed)
+	}
+	fmt.Printf("skipped     %d %s (target slower than -rate)\n", r.Skipped, unit)
+	printLatency := func(label string, s *latencySummary) {
+		if s != nil {
+			fmt.Printf("%-11s p50 %s  p95 %s  p99 %s  max %s  (%d samples)\n", label, s.P50, s.P95, s.P99, s.Max, s.Count)
+		}
+	}
+	if r.Target == "middleware" {
+		printLatency("request", r.Ingest)
+	} else {
+		printLatency("ingest", r.Ingest)
+	}
+	printLatency("query", r.Query)
+	if len(r.QueueDepth) > 0 {
+		fmt.Printf("queue       %v, %d left at the end\n", r.QueueDepth, r.FinalQueue)
+	}
+	if r.LastError != "" {
+		fmt.Printf("last error  %s\n", r.LastError)
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSyntheticTrafficIsDeterministic(t *testing.T) {
+	a := newSyntheticTraffic(7, []string{"a.example", "b.example"}, 100)
+	b := newSyntheticTraffic(7, []string{"a.example", "b.example"}, 100)
+	now := time.Now()
+	for i := 0; i < 50; i++ {
+		x, y := a.event(now), b.event(now)
+		if x != y {
+			t.Fatalf("event %d differs: %+v vs %+v", i, x, y)
+		}
+		if x.Host == "" || x.Path == "" || x.Uniq == "" {
+			t.Fatalf("incomplete event %+v", x)
+		}
+	}
+}
+
+func TestLoadSidecarSendsBatches(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ingest" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	rep, err := run(options{
+		target:      "sidecar",
+		sidecarURL:  srv.URL,
+		rate:        500,
+		batch:       10,
+		duration:    200 * time.Millisecond,
+		concurrency: 1,
+		hosts:       "bench.example",
+		visitors:    10,
+		seed:        1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Sent == 0 || rep.Sent%10 != 0 || rep.Failed != 0 {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+}
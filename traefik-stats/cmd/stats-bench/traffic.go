@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/khaled/banan-stats/traefik-stats/statsapi"
+)
+
+var (
+	benchPaths = []string{
+		"/", "/blog/", "/blog/hello-world", "/blog/duckdb-in-production", "/blog/feed-readers",
+		"/about", "/projects", "/projects/banan-stats", "/pricing", "/docs/", "/docs/install",
+		"/docs/configuration", "/feed.xml", "/atom.xml", "/tags/go", "/tags/rust",
+	}
+	benchAgents = []string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_5) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Safari/605.1.15",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:127.0) Gecko/20100101 Firefox/127.0",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1",
+		"Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Mobile Safari/537.36",
+		"Feedly/1.0 (+http://www.feedly.com/fetcher.html; 12 subscribers)",
+		"NetNewsWire (RSS Reader; https://netnewswire.com/)",
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+		"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)",
+		"python-requests/2.32.3",
+	}
+	benchReferrers = []string{
+		"", "", "", "https://www.google.com/", "https://duckduckgo.com/", "https://news.ycombinator.com/",
+		"https://lobste.rs/", "https://github.com/khaled/banan-stats", "https://t.co/abc123",
+	}
+)
+
+// traffic produces the events a benchmark sends: synthetic page views, or
+// recorded ones replayed in a loop with fresh timestamps.
+type traffic struct {
+	rng      *rand.Rand
+	hosts    []string
+	visitors int
+	recorded []statsapi.Event
+	next     int
+}
+
+func newSyntheticTraffic(seed int64, hosts []string, visitors int) *traffic {
+	if visitors <= 0 {
+		visitors = 1
+	}
+	return &traffic{rng: rand.New(rand.NewSource(seed)), hosts: hosts, visitors: visitors}
+}
+
+// loadRecordedTraffic reads NDJSON in the /ingest format, such as lines
+// saved from a middleware buffer or a sidecar log.
+func loadRecordedTraffic(path string) (*traffic, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := &traffic{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" {
+			continue
+		}
+		var ev statsapi.Event
+		if err := json.Unmarshal([]byte(text), &ev); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		t.recorded = append(t.recorded, ev)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(t.recorded) == 0 {
+		return nil, fmt.Errorf("%s: no events", path)
+	}
+	return t, nil
+}
+
+// event returns the next event, dated now.
+func (t *traffic) event(now time.Time) statsapi.Event {
+	if len(t.recorded) > 0 {
+		ev := t.recorded[t.next%len(t.recorded)]
+		t.next++
+		ev.Timestamp = now
+		ev.EventID = ""
+		return ev
+	}
+	// A few paths and visitors get most of the traffic, as on real sites.
+	visitor := t.skewed(t.visitors)
+	ev := statsapi.Event{
+		Timestamp:   now,
+		Host:        t.hosts[t.rng.Intn(len(t.hosts))],
+		Path:        benchPaths[t.skewed(len(benchPaths))],
+		IP:          fmt.Sprintf("10.%d.%d.%d", visitor>>16&0xff, visitor>>8&0xff, visitor&0xff),
+		UserAgent:   benchAgents[visitor%len(benchAgents)],
+		Referrer:    benchReferrers[t.rng.Intn(len(benchReferrers))],
+		ContentType: "text/html; charset=utf-8",
+		Uniq:        fmt.Sprintf("bench-%08x", visitor),
+	}
+	if strings.HasSuffix(ev.Path, ".xml") {
+		ev.ContentType = "application/rss+xml"
+	}
+	return ev
+}
+
+// request turns the next event into a request for the middleware.
+func (t *traffic) request(now time.Time) *http.Request {
+	ev := t.event(now)
+	host := ev.Host
+	if host == "" {
+		host = "localhost"
+	}
+	target := "http://" + host + ev.Path
+	if ev.Query != "" {
+		target += "?" + ev.Query
+	}
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		// Recorded paths are not always valid URLs.
+		req, _ = http.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+	}
+	req.RemoteAddr = ev.IP + ":40000"
+	req.Header.Set("User-Agent", ev.UserAgent)
+	if ev.Referrer != "" {
+		req.Header.Set("Referer", ev.Referrer)
+	}
+	return req
+}
+
+// skewed picks an index below n, low indexes far more often than high ones.
+func (t *traffic) skewed(n int) int {
+	f := t.rng.Float64()
+	return int(f * f * f * float64(n))
+}
@@ -0,0 +1,349 @@
+// Command stats-cdn-ingest reads CDN request logs (Cloudflare Logpush or
+// Fastly JSON) and streams the page views served from the CDN cache to the
+// banan-stats sidecar, since those requests never reach Traefik.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	formatCloudflare = "cloudflare"
+	formatFastly     = "fastly"
+)
+
+// event mirrors the NDJSON schema accepted by the sidecar's /ingest.
+type event struct {
+	EventID     string    `json:"eventId"`
+	Timestamp   time.Time `json:"timestamp"`
+	Host        string    `json:"host"`
+	Path        string    `json:"path"`
+	Query       string    `json:"query"`
+	IP          string    `json:"ip"`
+	UserAgent   string    `json:"userAgent"`
+	Referrer    string    `json:"referrer"`
+	ContentType string    `json:"contentType"`
+	SetCookie   string    `json:"setCookie"`
+	Uniq        string    `json:"uniq"`
+	SecondVisit bool      `json:"secondVisit"`
+}
+
+// record is the CDN-neutral subset of a log line.
+type record struct {
+	ID          string
+	Timestamp   time.Time
+	Method      string
+	Host        string
+	URI         string
+	IP          string
+	UserAgent   string
+	Referrer    string
+	ContentType string
+	Status      int
+	CacheStatus string
+}
+
+func main() {
+	sidecarURL := flag.String("sidecar-url", "http://localhost:7070", "banan-stats sidecar base URL")
+	format := flag.String("format", formatCloudflare, "log format: cloudflare or fastly")
+	batchSize := flag.Int("batch-size", 500, "events per /ingest request")
+	all := flag.Bool("all", false, "also ingest cache misses (normally already counted by Traefik)")
+	flag.Parse()
+
+	parse, err := parserFor(*format)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	inputs := flag.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+
+	endpoint := strings.TrimRight(*sidecarURL, "/") + "/ingest"
+	client := &http.Client{Timeout: 30 * time.Second}
+	var batch []event
+	sent, skipped := 0, 0
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := post(context.Background(), client, endpoint, batch); err != nil {
+			log.Fatalf("ingest failed: %v", err)
+		}
+		sent += len(batch)
+		batch = batch[:0]
+	}
+
+	for _, input := range inputs {
+		err := eachLine(input, func(line []byte) error {
+			rec, err := parse(line)
+			if err != nil {
+				return err
+			}
+			evt, ok := toEvent(rec, *all)
+			if !ok {
+				skipped++
+				return nil
+			}
+			batch = append(batch, evt)
+			if len(batch) >= *batchSize {
+				flush()
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("%s: %v", input, err)
+		}
+	}
+	flush()
+	log.Printf("ingested %d events, skipped %d log lines", sent, skipped)
+}
+
+func parserFor(format string) (func([]byte) (record, error), error) {
+	switch strings.ToLower(format) {
+	case formatCloudflare:
+		return parseCloudflare, nil
+	case formatFastly:
+		return parseFastly, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func eachLine(input string, fn func([]byte) error) error {
+	var r io.Reader = os.Stdin
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseCloudflare handles Logpush http_requests datasets with the default
+// field names; EdgeStartTimestamp may be RFC 3339 or Unix seconds/nanoseconds.
+func parseCloudflare(line []byte) (record, error) {
+	var raw struct {
+		RayID                   string          `json:"RayID"`
+		EdgeStartTimestamp      json.RawMessage `json:"EdgeStartTimestamp"`
+		ClientRequestMethod     string          `json:"ClientRequestMethod"`
+		ClientRequestHost       string          `json:"ClientRequestHost"`
+		ClientRequestURI        string          `json:"ClientRequestURI"`
+		ClientIP                string          `json:"ClientIP"`
+		ClientRequestUserAgent  string          `json:"ClientRequestUserAgent"`
+		ClientRequestReferer    string          `json:"ClientRequestReferer"`
+		EdgeResponseContentType string          `json:"EdgeResponseContentType"`
+		EdgeResponseStatus      int             `json:"EdgeResponseStatus"`
+		CacheCacheStatus        string          `json:"CacheCacheStatus"`
+	}
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return record{}, err
+	}
+	ts, err := parseTimestamp(raw.EdgeStartTimestamp)
+	if err != nil {
+		return record{}, fmt.Errorf("EdgeStartTimestamp: %w", err)
+	}
+	return record{
+		ID:          raw.RayID,
+		Timestamp:   ts,
+		Method:      raw.ClientRequestMethod,
+		Host:        raw.ClientRequestHost,
+		URI:         raw.ClientRequestURI,
+		IP:          raw.ClientIP,
+		UserAgent:   raw.ClientRequestUserAgent,
+		Referrer:    raw.ClientRequestReferer,
+		ContentType: raw.EdgeResponseContentType,
+		Status:      raw.EdgeResponseStatus,
+		CacheStatus: raw.CacheCacheStatus,
+	}, nil
+}
+
+// parseFastly expects a JSON logging endpoint configured with the field names
+// documented in docs/usage.md.
+func parseFastly(line []byte) (record, error) {
+	var raw struct {
+		RequestID   string          `json:"request_id"`
+		Timestamp   json.RawMessage `json:"timestamp"`
+		Method      string          `json:"method"`
+		Host        string          `json:"host"`
+		URL         string          `json:"url"`
+		ClientIP    string          `json:"client_ip"`
+		UserAgent   string          `json:"request_user_agent"`
+		Referer     string          `json:"request_referer"`
+		ContentType string          `json:"content_type"`
+		Status      json.Number     `json:"status"`
+		CacheStatus string          `json:"cache_status"`
+	}
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return record{}, err
+	}
+	ts, err := parseTimestamp(raw.Timestamp)
+	if err != nil {
+		return record{}, fmt.Errorf("timestamp: %w", err)
+	}
+	status, _ := strconv.Atoi(raw.Status.String())
+	return record{
+		ID:          raw.RequestID,
+		Timestamp:   ts,
+		Method:      raw.Method,
+		Host:        raw.Host,
+		URI:         raw.URL,
+		IP:          raw.ClientIP,
+		UserAgent:   raw.UserAgent,
+		Referrer:    raw.Referer,
+		ContentType: raw.ContentType,
+		Status:      status,
+		CacheStatus: raw.CacheStatus,
+	}, nil
+}
+
+func parseTimestamp(raw json.RawMessage) (time.Time, error) {
+	if len(raw) == 0 {
+		return time.Time{}, errors.New("missing")
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		if ts, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return ts.UTC(), nil
+		}
+		raw = json.RawMessage(s)
+	}
+	n, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unsupported timestamp %s", raw)
+	}
+	switch {
+	case n > 1e17:
+		return time.Unix(0, n).UTC(), nil
+	case n > 1e14:
+		return time.UnixMicro(n).UTC(), nil
+	case n > 1e11:
+		return time.UnixMilli(n).UTC(), nil
+	default:
+		return time.Unix(n, 0).UTC(), nil
+	}
+}
+
+// toEvent maps a log record to a sidecar event, keeping only successful GETs
+// of HTML and feeds. Unless all is set, only cache hits are kept: misses were
+// forwarded to the origin and are already counted by the middleware.
+func toEvent(rec record, all bool) (event, bool) {
+	if rec.Method != "" && !strings.EqualFold(rec.Method, http.MethodGet) {
+		return event{}, false
+	}
+	if rec.Status != http.StatusOK {
+		return event{}, false
+	}
+	ct := strings.ToLower(rec.ContentType)
+	if !strings.HasPrefix(ct, "text/html") &&
+		!strings.HasPrefix(ct, "application/atom+xml") &&
+		!strings.HasPrefix(ct, "application/rss+xml") {
+		return event{}, false
+	}
+	if !all && !isCacheHit(rec.CacheStatus) {
+		return event{}, false
+	}
+
+	path, query := rec.URI, ""
+	if u, err := url.ParseRequestURI(rec.URI); err == nil {
+		path, query = u.Path, u.RawQuery
+	}
+	host := strings.ToLower(rec.Host)
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+
+	return event{
+		EventID:     eventID(rec),
+		Timestamp:   rec.Timestamp,
+		Host:        host,
+		Path:        path,
+		Query:       query,
+		IP:          rec.IP,
+		UserAgent:   rec.UserAgent,
+		Referrer:    rec.Referrer,
+		ContentType: rec.ContentType,
+	}, true
+}
+
+func isCacheHit(status string) bool {
+	switch strings.ToLower(status) {
+	case "hit", "stale", "updating", "revalidated":
+		return true
+	}
+	return false
+}
+
+// eventID derives a stable UUID from the CDN request ID so that re-ingesting
+// the same log file does not double count.
+func eventID(rec record) string {
+	key := rec.ID
+	if key == "" {
+		key = rec.Timestamp.Format(time.RFC3339Nano) + rec.IP + rec.Host + rec.URI + rec.UserAgent
+	}
+	sum := sha256.Sum256([]byte("cdn:" + key))
+	b := sum[:16]
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+func post(ctx context.Context, client *http.Client, endpoint string, events []event) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	enc.SetEscapeHTML(false)
+	for _, evt := range events {
+		if err := enc.Encode(evt); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
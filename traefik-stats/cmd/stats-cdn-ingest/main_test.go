@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestCloudflareCacheHitMapped(t *testing.T) {
+	line := []byte(`{"RayID":"7d1","EdgeStartTimestamp":1700000000000000000,"ClientRequestMethod":"GET","ClientRequestHost":"Example.com","ClientRequestURI":"/post?a=1","ClientIP":"203.0.113.7","ClientRequestUserAgent":"Mozilla/5.0","ClientRequestReferer":"https://news.ycombinator.com/","EdgeResponseContentType":"text/html; charset=utf-8","EdgeResponseStatus":200,"CacheCacheStatus":"hit"}`)
+	rec, err := parseCloudflare(line)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	evt, ok := toEvent(rec, false)
+	if !ok {
+		t.Fatal("expected cache hit to be ingested")
+	}
+	if evt.Host != "example.com" || evt.Path != "/post" || evt.Query != "a=1" {
+		t.Fatalf("unexpected mapping: %+v", evt)
+	}
+	if evt.Timestamp.Unix() != 1700000000 {
+		t.Fatalf("unexpected timestamp %v", evt.Timestamp)
+	}
+	if again, _ := toEvent(rec, false); again.EventID != evt.EventID {
+		t.Fatal("expected stable event id")
+	}
+
+	rec.CacheStatus = "miss"
+	if _, ok := toEvent(rec, false); ok {
+		t.Fatal("expected cache miss to be skipped")
+	}
+	if _, ok := toEvent(rec, true); !ok {
+		t.Fatal("expected cache miss to be ingested with -all")
+	}
+}
+
+func TestFastlyTimestampFormats(t *testing.T) {
+	rec, err := parseFastly([]byte(`{"request_id":"r1","timestamp":"2024-03-01T10:00:00Z","method":"GET","host":"example.com","url":"/feed.xml","client_ip":"203.0.113.7","content_type":"application/rss+xml","status":"200","cache_status":"HIT"}`))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if rec.Status != 200 || rec.Timestamp.Year() != 2024 {
+		t.Fatalf("unexpected record: %+v", rec)
+	}
+	if _, ok := toEvent(rec, false); !ok {
+		t.Fatal("expected feed hit to be ingested")
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/khaled/banan-stats/traefik-stats/statsapi"
+)
+
+// statsColumns are the columns of the sidecar's stats table.
+const statsColumns = "event_id, date, time, host, path, query, ip, user_agent, referrer, type, agent, os, ref_domain, mult, set_cookie, uniq, prefetch, ref_path"
+
+// fileBackend reads a DuckDB file through the duckdb CLI, which keeps this
+// module free of cgo. DuckDB allows a single writer, so point it at a copy,
+// a backup, or the file of a sidecar started with --read-only.
+type fileBackend struct {
+	bin  string
+	path string
+	// prelude attaches yearly partitions and defines the stats view over
+	// them; empty for a single-file store.
+	prelude string
+}
+
+func newFileBackend(bin, path string) (*fileBackend, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	b := &fileBackend{bin: bin, path: path}
+	years, err := partitionYears(path)
+	if err != nil || len(years) == 0 {
+		return b, err
+	}
+
+	legacy, err := b.hasStatsTable(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	var prelude strings.Builder
+	var selects []string
+	for _, year := range years {
+		fmt.Fprintf(&prelude, "ATTACH %s AS y%d (READ_ONLY);\n", quote(partitionPath(path, year)), year)
+		selects = append(selects, fmt.Sprintf("SELECT %s FROM y%d.stats", statsColumns, year))
+	}
+	if legacy {
+		selects = append(selects, fmt.Sprintf("SELECT %s FROM main.stats", statsColumns))
+	}
+	fmt.Fprintf(&prelude, "CREATE OR REPLACE TEMP VIEW stats AS %s;\n", strings.Join(selects, " UNION ALL "))
+	b.prelude = prelude.String()
+	return b, nil
+}
+
+func (b *fileBackend) hosts(ctx context.Context) ([]string, error) {
+	var rows []struct {
+		Host string `json:"host"`
+	}
+	err := b.query(ctx, "SELECT DISTINCT host FROM stats WHERE host IS NOT NULL AND host <> '' ORDER BY host", &rows)
+	hosts := make([]string, 0, len(rows))
+	for _, row := range rows {
+		hosts = append(hosts, row.Host)
+	}
+	return hosts, err
+}
+
+// top mirrors the dashboard's top-10 queries, including the trailing
+// "others" row.
+func (b *fileBackend) top(ctx context.Context, table string, f statsapi.Filters) ([]statsapi.TopRow, error) {
+	column, agentType, uniq := tableSpec(table)
+	where := whereClause(f) + " AND type = " + quote(agentType)
+	base := fmt.Sprintf("SELECT %s AS value FROM stats WHERE %s", column, where)
+	count := "CAST(COUNT(*) AS BIGINT)"
+	if uniq {
+		base = fmt.Sprintf("SELECT ANY_VALUE(%s) AS value, MAX(mult) AS mult FROM stats WHERE %s GROUP BY uniq", column, where)
+		count = "CAST(SUM(mult) AS BIGINT)"
+	}
+	sql := fmt.Sprintf(`WITH base_query AS (%[1]s),
+		top_values AS (
+			SELECT value, %[2]s AS count FROM base_query
+			WHERE value IS NOT NULL GROUP BY value
+		),
+		top_n AS (SELECT * FROM top_values ORDER BY count DESC LIMIT 10),
+		others AS (
+			SELECT NULL AS value, %[2]s AS count FROM base_query
+			WHERE value IS NOT NULL AND value NOT IN (SELECT value FROM top_n)
+		)
+		SELECT * FROM (SELECT * FROM top_n ORDER BY count DESC)
+		UNION ALL
+		SELECT * FROM others WHERE count > 0`, base, count)
+	var rows []statsapi.TopRow
+	err := b.query(ctx, sql, &rows)
+	return rows, err
+}
+
+func (b *fileBackend) uniques(ctx context.Context, by string, f statsapi.Filters) ([]statsapi.PeriodUniques, error) {
+	format := map[string]string{"day": "%Y-%m-%d", "week": "%Y-%m-%d", "month": "%Y-%m", "year": "%Y"}[by]
+	where := whereClause(f)
+	if f.Type == "" {
+		where += " AND type = 'browser'"
+	}
+	sql := fmt.Sprintf(`WITH subq AS (
+			SELECT CAST(date_trunc(%s, date) AS DATE) AS period, MAX(mult) AS mult
+			FROM stats WHERE %s GROUP BY period, uniq
+		)
+		SELECT strftime(period, %s) AS period, CAST(SUM(mult) AS BIGINT) AS uniques
+		FROM subq GROUP BY subq.period ORDER BY subq.period`, quote(by), where, quote(format))
+	var periods []statsapi.PeriodUniques
+	err := b.query(ctx, sql, &periods)
+	return periods, err
+}
+
+// export lets duckdb write the CSV itself, so large ranges stream straight
+// to w.
+func (b *fileBackend) export(ctx context.Context, f statsapi.Filters, columns []string, w io.Writer) error {
+	selects := make([]string, len(columns))
+	for i, col := range columns {
+		selects[i] = fmt.Sprintf("CAST(%s AS VARCHAR) AS %s", col, col)
+	}
+	sql := fmt.Sprintf("SELECT %s FROM stats WHERE %s ORDER BY date DESC, time DESC",
+		strings.Join(selects, ", "), whereClause(f))
+	return b.run(ctx, "-csv", sql, w)
+}
+
+func (b *fileBackend) hasStatsTable(ctx context.Context) (bool, error) {
+	var rows []struct {
+		N int64 `json:"n"`
+	}
+	err := b.query(ctx, `SELECT COUNT(*) AS n FROM duckdb_tables()
+		WHERE database_name = current_database() AND schema_name = 'main' AND table_name = 'stats'`, &rows)
+	return len(rows) == 1 && rows[0].N > 0, err
+}
+
+// query runs sql and decodes the JSON rows into out. duckdb prints nothing
+// at all for an empty result.
+func (b *fileBackend) query(ctx context.Context, sql string, out any) error {
+	var buf bytes.Buffer
+	if err := b.run(ctx, "-json", sql, &buf); err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(buf.Bytes())) == 0 {
+		return nil
+	}
+	return json.Unmarshal(buf.Bytes(), out)
+}
+
+func (b *fileBackend) run(ctx context.Context, mode, sql string, w io.Writer) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, b.bin, "-readonly", mode, b.path, b.prelude+sql)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %s", b.bin, msg)
+		}
+		return fmt.Errorf("%s: %w", b.bin, err)
+	}
+	return nil
+}
+
+// tableSpec mirrors the sidecar's dashboard TABLES.
+func tableSpec(table string) (column, agentType string, uniq bool) {
+	switch table {
+	case "paths":
+		return "path", "browser", false
+	case "queries":
+		return "query", "browser", false
+	case "referrers":
+		return "COALESCE(ref_domain, 'Direct / unknown')", "browser", false
+	case "search_terms":
+		return "search_terms", "browser", false
+	case "social":
+		return "social", "browser", false
+	case "browsers":
+		return "agent", "browser", true
+	case "readers":
+		return "agent", "feed", true
+	case "navigation":
+		return "ref_path || ' → ' || path", "browser", false
+	default:
+		return "agent", "bot", true
+	}
+}
+
+// whereClause mirrors the sidecar's build_where, including "*" wildcards
+// and "~" regular expressions for the host. Values are inlined as SQL
+// literals since the duckdb CLI has no bind parameters.
+func whereClause(f statsapi.Filters) string {
+	parts := []string{
+		"date >= " + quote(f.From),
+		"date <= " + quote(f.To),
+		"prefetch IS NOT TRUE",
+	}
+	for _, filter := range []struct{ column, value string }{
+		{"host", f.Host},
+		{"path", f.Path},
+		{"query", f.Query},
+		{"ref_domain", f.RefDomain},
+		{"agent", f.Agent},
+		{"type", f.Type},
+		{"os", f.OS},
+		{"scheme", f.Scheme},
+	} {
+		if pattern, ok := strings.CutPrefix(filter.value, "~"); ok && filter.column == "host" {
+			parts = append(parts, "regexp_matches(host, "+quote(pattern)+")")
+		} else if strings.Contains(filter.value, "*") {
+			parts = append(parts, filter.column+" LIKE "+quote(likePattern(filter.value))+` ESCAPE '\'`)
+		} else if filter.value != "" {
+			parts = append(parts, filter.column+" = "+quote(filter.value))
+		}
+	}
+	return strings.Join(parts, " AND ")
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func likePattern(value string) string {
+	parts := strings.Split(value, "*")
+	for i, part := range parts {
+		parts[i] = likeEscaper.Replace(part)
+	}
+	return strings.Join(parts, "%")
+}
+
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// partitionPath and partitionYears follow the sidecar's --partition-by-year
+// layout: stats.duckdb keeps its name and each year lives in
+// stats-2024.duckdb next to it.
+func partitionPath(path string, year int) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + strconv.Itoa(year) + ext
+}
+
+func partitionYears(path string) ([]int, error) {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(filepath.Base(path), ext)
+	re := regexp.MustCompile("^" + regexp.QuoteMeta(stem) + `-(\d{4})` + regexp.QuoteMeta(ext) + "$")
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	var years []int
+	for _, entry := range entries {
+		if m := re.FindStringSubmatch(entry.Name()); m != nil {
+			year, _ := strconv.Atoi(m[1])
+			years = append(years, year)
+		}
+	}
+	sort.Ints(years)
+	return years, nil
+}
@@ -0,0 +1,358 @@
+// Command stats-cli queries banan-stats from the shell, either through the
+// sidecar API or by reading the DuckDB file directly, for scripts and
+// cron-driven reports.
+//
+//	stats-cli top paths -from 2024-01-01 -to 2024-12-31 -host example.com
+//	stats-cli uniques -by month -json
+//	stats-cli export -col date,path,referrer > views.csv
+//	stats-cli hosts -db /data/stats.duckdb
+//	stats-cli tui -sidecar-url http://127.0.0.1:7070
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/khaled/banan-stats/traefik-stats/statsapi"
+)
+
+var tables = []string{"paths", "queries", "referrers", "search_terms", "social", "browsers", "readers", "scrapers", "trapped", "navigation"}
+
+// exportColumns matches the columns offered by the sidecar's /stats/events.
+var exportColumns = []string{
+	"date", "time", "host", "path", "query", "ip", "user_agent", "referrer", "type", "agent", "os",
+	"ref_domain", "ref_path", "mult", "set_cookie", "uniq", "event_id",
+}
+
+const defaultExportColumns = "date,time,host,path,user_agent,referrer,type,agent,os"
+
+// backend answers the CLI's queries from either the API or a DuckDB file.
+type backend interface {
+	hosts(ctx context.Context) ([]string, error)
+	top(ctx context.Context, table string, f statsapi.Filters) ([]statsapi.TopRow, error)
+	uniques(ctx context.Context, by string, f statsapi.Filters) ([]statsapi.PeriodUniques, error)
+	// export writes a header row followed by the matching events, newest first.
+	export(ctx context.Context, f statsapi.Filters, columns []string, w io.Writer) error
+}
+
+// options are the flags shared by every subcommand.
+type options struct {
+	sidecarURL string
+	token      string
+	db         string
+	duckdb     string
+	json       bool
+	timeout    time.Duration
+	filters    statsapi.Filters
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, args := os.Args[1], os.Args[2:]
+	var err error
+	switch cmd {
+	case "top":
+		err = runTop(args)
+	case "uniques":
+		err = runUniques(args)
+	case "export":
+		err = runExport(args)
+	case "hosts":
+		err = runHosts(args)
+	case "tui":
+		err = runTUI(args)
+	case "-h", "-help", "--help", "help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "stats-cli: unknown command %q\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "stats-cli %s: %v\n", cmd, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: stats-cli <command> [flags]
+
+commands:
+  top <%s>   top 10 rows of a dashboard table
+  uniques [-by day|week|month|year]   unique visitors per period
+  export [-col date,path,...]         raw events as CSV
+  hosts                               hosts with recorded events
+  tui                                 live terminal dashboard
+
+Run "stats-cli <command> -h" for the flags of a command.
+`, strings.Join(tables, "|"))
+}
+
+func newFlagSet(name string, opts *options) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&opts.sidecarURL, "sidecar-url", envOr("BANAN_STATS_URL", "http://localhost:7070"), "banan-stats sidecar base URL")
+	fs.StringVar(&opts.token, "token", os.Getenv("BANAN_STATS_TOKEN"), "sidecar admin token (needed by export over the API)")
+	fs.StringVar(&opts.db, "db", "", "read this DuckDB file directly instead of calling the sidecar")
+	fs.StringVar(&opts.duckdb, "duckdb", "duckdb", "duckdb CLI binary used with -db")
+	fs.BoolVar(&opts.json, "json", false, "print JSON instead of text")
+	fs.DurationVar(&opts.timeout, "timeout", 5*time.Minute, "give up after this long")
+	f := &opts.filters
+	fs.StringVar(&f.From, "from", "", "first day, YYYY-MM-DD (default: Jan 1 of this year)")
+	fs.StringVar(&f.To, "to", "", "last day, YYYY-MM-DD (default: Dec 31 of this year)")
+	fs.StringVar(&f.Host, "host", "", "only this host")
+	fs.StringVar(&f.Path, "path", "", "only this path")
+	fs.StringVar(&f.Query, "query", "", "only this query string")
+	fs.StringVar(&f.RefDomain, "ref-domain", "", "only this referrer domain")
+	fs.StringVar(&f.Agent, "agent", "", "only this agent")
+	fs.StringVar(&f.Type, "type", "", "only this type: browser, feed or bot")
+	fs.StringVar(&f.OS, "os", "", "only this operating system")
+	fs.StringVar(&f.Scheme, "scheme", "", "only this scheme: http or https")
+	return fs
+}
+
+// parseArgs accepts the positional argument before or after the flags, so
+// both "top paths -from ..." and "top -from ... paths" work.
+func parseArgs(fs *flag.FlagSet, args []string) (string, error) {
+	var positional string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		positional, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if positional == "" {
+		positional = fs.Arg(0)
+	} else if fs.NArg() > 0 {
+		return "", fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	return positional, nil
+}
+
+func (o *options) backend() (backend, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	if o.db != "" {
+		return newFileBackend(o.duckdb, o.db)
+	}
+	client := statsapi.New(o.sidecarURL)
+	client.Token = o.token
+	return apiBackend{client}, nil
+}
+
+// validate fills the default date range and rejects malformed dates, which
+// the file backend would otherwise pass into SQL.
+func (o *options) validate() error {
+	year := time.Now().Year()
+	if o.filters.From == "" {
+		o.filters.From = fmt.Sprintf("%d-01-01", year)
+	}
+	if o.filters.To == "" {
+		o.filters.To = fmt.Sprintf("%d-12-31", year)
+	}
+	for _, day := range []string{o.filters.From, o.filters.To} {
+		if _, err := time.Parse("2006-01-02", day); err != nil {
+			return fmt.Errorf("invalid date %q, want YYYY-MM-DD", day)
+		}
+	}
+	return nil
+}
+
+func (o *options) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), o.timeout)
+}
+
+func runTop(args []string) error {
+	var opts options
+	fs := newFlagSet("top", &opts)
+	table, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if !contains(tables, table) {
+		return fmt.Errorf("want one of %s, got %q", strings.Join(tables, ", "), table)
+	}
+	b, err := opts.backend()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := opts.context()
+	defer cancel()
+	rows, err := b.top(ctx, table, opts.filters)
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		return printJSON(rows)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	for _, row := range rows {
+		value := "(others)"
+		if row.Value != nil {
+			value = *row.Value
+		}
+		fmt.Fprintf(tw, "%d\t%s\n", row.Count, value)
+	}
+	return tw.Flush()
+}
+
+func runUniques(args []string) error {
+	var opts options
+	fs := newFlagSet("uniques", &opts)
+	by := fs.String("by", "day", "period: day, week, month or year")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if !contains([]string{"day", "week", "month", "year"}, *by) {
+		return fmt.Errorf("-by must be day, week, month or year, got %q", *by)
+	}
+	b, err := opts.backend()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := opts.context()
+	defer cancel()
+	periods, err := b.uniques(ctx, *by, opts.filters)
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		return printJSON(periods)
+	}
+	for _, p := range periods {
+		fmt.Printf("%s\t%d\n", p.Period, p.Uniques)
+	}
+	return nil
+}
+
+func runExport(args []string) error {
+	var opts options
+	fs := newFlagSet("export", &opts)
+	cols := fs.String("col", defaultExportColumns, "comma-separated columns: "+strings.Join(exportColumns, ","))
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	var columns []string
+	for _, col := range strings.Split(*cols, ",") {
+		col = strings.TrimSpace(col)
+		if !contains(exportColumns, col) {
+			return fmt.Errorf("unknown column %q", col)
+		}
+		columns = append(columns, col)
+	}
+	b, err := opts.backend()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := opts.context()
+	defer cancel()
+	return b.export(ctx, opts.filters, columns, os.Stdout)
+}
+
+func runHosts(args []string) error {
+	var opts options
+	fs := newFlagSet("hosts", &opts)
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	b, err := opts.backend()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := opts.context()
+	defer cancel()
+	hosts, err := b.hosts(ctx)
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		return printJSON(hosts)
+	}
+	for _, host := range hosts {
+		fmt.Println(host)
+	}
+	return nil
+}
+
+// apiBackend queries the sidecar over HTTP.
+type apiBackend struct {
+	client *statsapi.Client
+}
+
+func (a apiBackend) hosts(ctx context.Context) ([]string, error) {
+	return a.client.Hosts(ctx)
+}
+
+func (a apiBackend) top(ctx context.Context, table string, f statsapi.Filters) ([]statsapi.TopRow, error) {
+	return a.client.Top(ctx, table, f)
+}
+
+func (a apiBackend) uniques(ctx context.Context, by string, f statsapi.Filters) ([]statsapi.PeriodUniques, error) {
+	return a.client.Uniques(ctx, by, f)
+}
+
+// export pages through /stats/events, keeping only the first header row.
+func (a apiBackend) export(ctx context.Context, f statsapi.Filters, columns []string, w io.Writer) error {
+	if a.client.Token == "" {
+		return errors.New("export over the API needs -token (or use -db)")
+	}
+	out := csv.NewWriter(w)
+	for page := 0; ; page++ {
+		rows, err := a.client.Events(ctx, f, columns, page)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			break
+		}
+		header, data := rows[0], rows[1:]
+		if page == 0 {
+			if err := out.Write(header); err != nil {
+				return err
+			}
+		}
+		if err := out.WriteAll(data); err != nil {
+			return err
+		}
+		if len(data) < statsapi.EventsPageSize {
+			break
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/khaled/banan-stats/traefik-stats/statsapi"
+)
+
+func TestWhereClauseQuotesValues(t *testing.T) {
+	got := whereClause(statsapi.Filters{From: "2024-01-01", To: "2024-12-31", Path: "/it's", Query: "utm_*"})
+	want := `date >= '2024-01-01' AND date <= '2024-12-31' AND prefetch IS NOT TRUE AND path = '/it''s' AND query LIKE 'utm\_%' ESCAPE '\'`
+	if got != want {
+		t.Fatalf("whereClause = %q, want %q", got, want)
+	}
+}
+
+func TestWhereClauseHostPatterns(t *testing.T) {
+	got := whereClause(statsapi.Filters{From: "2024-01-01", To: "2024-12-31", Host: "*.example.com"})
+	if want := `host LIKE '%.example.com' ESCAPE '\'`; !strings.HasSuffix(got, want) {
+		t.Fatalf("whereClause = %q, want suffix %q", got, want)
+	}
+	got = whereClause(statsapi.Filters{From: "2024-01-01", To: "2024-12-31", Host: `~^(docs|blog)\.`})
+	if want := `regexp_matches(host, '^(docs|blog)\.')`; !strings.HasSuffix(got, want) {
+		t.Fatalf("whereClause = %q, want suffix %q", got, want)
+	}
+}
+
+func TestPartitionYears(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"stats.duckdb", "stats-2023.duckdb", "stats-2024.duckdb", "stats-2024.duckdb.wal", "other-2022.duckdb"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	years, err := partitionYears(filepath.Join(dir, "stats.duckdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(years, []int{2023, 2024}) {
+		t.Fatalf("years = %v", years)
+	}
+}
+
+func TestAPIExportPages(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		rows := 0
+		if r.URL.Query().Get("page") == "0" {
+			rows = statsapi.EventsPageSize
+		} else if r.URL.Query().Get("page") == "1" {
+			rows = 2
+		}
+		fmt.Fprintln(w, "date,path")
+		for i := 0; i < rows; i++ {
+			fmt.Fprintf(w, "2024-01-01,/p%d\n", i)
+		}
+	}))
+	defer srv.Close()
+
+	client := statsapi.New(srv.URL)
+	client.Token = "secret"
+	var out bytes.Buffer
+	err := apiBackend{client}.export(context.Background(), statsapi.Filters{}, []string{"date", "path"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1+statsapi.EventsPageSize+2 || lines[0] != "date,path" || strings.Count(out.String(), "date,path") != 1 {
+		t.Fatalf("got %d lines:\n%s", len(lines), out.String())
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	if got := sparkline([]int64{0, 1, 2, 4, 8}, 10); got != "▁▁▂▄█" {
+		t.Fatalf("sparkline = %q", got)
+	}
+	if got := sparkline([]int64{8, 0, 8}, 2); got != "▁█" {
+		t.Fatalf("sparkline keeps the latest values, got %q", got)
+	}
+}
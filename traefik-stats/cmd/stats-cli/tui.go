@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/khaled/banan-stats/traefik-stats/statsapi"
+	"golang.org/x/term"
+)
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// tuiRanges are the timeline windows cycled with "t", in days.
+var tuiRanges = []int{7, 30, 90, 365}
+
+// tuiTables are shown two per row under the timelines.
+var tuiTables = []struct{ name, title string }{
+	{"paths", "Paths"},
+	{"referrers", "Referrers"},
+	{"browsers", "Browsers"},
+	{"readers", "RSS Readers"},
+}
+
+// tuiTimelines are the per-day unique visitor sparklines, by type.
+var tuiTimelines = []struct{ agentType, title string }{
+	{"browser", "Visitors"},
+	{"feed", "Readers"},
+	{"bot", "Scrapers"},
+}
+
+// tuiData is one refresh worth of query results.
+type tuiData struct {
+	days    []string
+	series  [][]int64
+	tables  [][]statsapi.TopRow
+	fetched time.Time
+	err     error
+}
+
+type tui struct {
+	opts    options
+	backend backend
+	days    int
+	hosts   []string
+	// host indexes hosts; -1 means all hosts.
+	host int
+	data tuiData
+}
+
+func runTUI(args []string) error {
+	var opts options
+	fs := newFlagSet("tui", &opts)
+	refresh := fs.Duration("refresh", 30*time.Second, "reload interval")
+	days := fs.Int("days", 30, "initial timeline length in days")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if opts.filters.From != "" || opts.filters.To != "" {
+		return fmt.Errorf("tui shows the last -days days; -from and -to are not supported")
+	}
+	// Satisfy validate; the real range is recomputed on every refresh.
+	opts.filters.From, opts.filters.To = dayRange(time.Now(), *days)
+	b, err := opts.backend()
+	if err != nil {
+		return err
+	}
+
+	t := &tui{opts: opts, backend: b, days: *days, host: -1}
+	if opts.filters.Host == "" {
+		ctx, cancel := opts.context()
+		t.hosts, _ = b.hosts(ctx)
+		cancel()
+	}
+
+	fd := int(os.Stdout.Fd())
+	if !term.IsTerminal(fd) || !term.IsTerminal(int(os.Stdin.Fd())) {
+		// Not interactive: print a single frame, e.g. for watch(1) or a log.
+		t.load()
+		io.WriteString(os.Stdout, t.render(100, 40, "\n"))
+		return t.data.err
+	}
+
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	defer term.Restore(int(os.Stdin.Fd()), state)
+	io.WriteString(os.Stdout, "\x1b[?1049h\x1b[?25l")
+	defer io.WriteString(os.Stdout, "\x1b[?25h\x1b[?1049l")
+
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			for _, key := range buf[:n] {
+				keys <- key
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(*refresh)
+	defer ticker.Stop()
+	draw := func() {
+		width, height, err := term.GetSize(fd)
+		if err != nil {
+			width, height = 80, 24
+		}
+		io.WriteString(os.Stdout, "\x1b[H\x1b[2J"+t.render(width, height, "\r\n"))
+	}
+	draw()
+	t.load()
+	draw()
+	for {
+		select {
+		case key, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			switch key {
+			case 'q', 3: // Ctrl-C arrives as a byte in raw mode
+				return nil
+			case 'h':
+				if len(t.hosts) > 0 {
+					t.host++
+					if t.host >= len(t.hosts) {
+						t.host = -1
+					}
+				}
+			case 't':
+				t.days = nextRange(t.days)
+			case 'r':
+			default:
+				continue
+			}
+			t.load()
+			draw()
+		case <-ticker.C:
+			t.load()
+			draw()
+		}
+	}
+}
+
+// load runs every query for the current host and range. Errors are kept
+// and shown in the status line so a sidecar restart doesn't end the session.
+func (t *tui) load() {
+	ctx, cancel := t.opts.context()
+	defer cancel()
+
+	f := t.opts.filters
+	if t.host >= 0 {
+		f.Host = t.hosts[t.host]
+	}
+	now := time.Now()
+	f.From, f.To = dayRange(now, t.days)
+	data := tuiData{days: listDays(f.From, t.days), fetched: now}
+
+	for _, timeline := range tuiTimelines {
+		tf := f
+		tf.Type = timeline.agentType
+		periods, err := t.backend.uniques(ctx, "day", tf)
+		if err != nil {
+			t.data.err = err
+			return
+		}
+		data.series = append(data.series, fillDays(data.days, periods))
+	}
+	for _, table := range tuiTables {
+		rows, err := t.backend.top(ctx, table.name, f)
+		if err != nil {
+			t.data.err = err
+			return
+		}
+		data.tables = append(data.tables, rows)
+	}
+	t.data = data
+}
+
+func (t *tui) render(width, height int, nl string) string {
+	var lines []string
+	host := "all hosts"
+	if t.opts.filters.Host != "" {
+		host = t.opts.filters.Host
+	} else if t.host >= 0 {
+		host = t.hosts[t.host]
+	}
+	lines = append(lines, fmt.Sprintf("banan-stats · %s · last %d days", host, t.days))
+	switch {
+	case t.data.err != nil:
+		lines = append(lines, "error: "+t.data.err.Error())
+	case t.data.fetched.IsZero():
+		lines = append(lines, "loading…")
+	default:
+		lines = append(lines, "updated "+t.data.fetched.Format("15:04:05"))
+	}
+	lines = append(lines, "")
+
+	const label = 10
+	for i, series := range t.data.series {
+		var max int64
+		for _, v := range series {
+			if v > max {
+				max = v
+			}
+		}
+		summary := fmt.Sprintf("  max %d", max)
+		spark := sparkline(series, width-label-len(summary))
+		lines = append(lines, fmt.Sprintf("%-*s%s%s", label, tuiTimelines[i].title, spark, summary))
+	}
+	lines = append(lines, "")
+
+	colWidth := (width - 3) / 2
+	for i := 0; i+1 < len(t.data.tables); i += 2 {
+		left := tableLines(tuiTables[i].title, t.data.tables[i], colWidth)
+		right := tableLines(tuiTables[i+1].title, t.data.tables[i+1], colWidth)
+		for len(left) < len(right) {
+			left = append(left, "")
+		}
+		for j, l := range left {
+			r := ""
+			if j < len(right) {
+				r = right[j]
+			}
+			lines = append(lines, pad(l, colWidth)+"   "+r)
+		}
+		lines = append(lines, "")
+	}
+
+	footer := "q quit · r refresh · t range"
+	if len(t.hosts) > 0 {
+		footer += " · h host"
+	}
+	if len(lines) > height-1 {
+		lines = lines[:height-1]
+	}
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	lines = append(lines, footer)
+	return strings.Join(lines, nl)
+}
+
+func tableLines(title string, rows []statsapi.TopRow, width int) []string {
+	lines := []string{title}
+	for _, row := range rows {
+		value := "(others)"
+		if row.Value != nil {
+			value = *row.Value
+		}
+		if value == "" {
+			value = "(none)"
+		}
+		count := fmt.Sprintf("%d", row.Count)
+		lines = append(lines, pad(truncate(value, width-len(count)-1), width-len(count))+count)
+	}
+	return lines
+}
+
+// sparkline scales values to block characters, keeping the most recent
+// values when there are more than width.
+func sparkline(values []int64, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	if len(values) > width {
+		values = values[len(values)-width:]
+	}
+	var max int64
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	var b strings.Builder
+	for _, v := range values {
+		if max == 0 {
+			b.WriteRune(' ')
+			continue
+		}
+		idx := int(v * int64(len(sparkBlocks)-1) / max)
+		b.WriteRune(sparkBlocks[idx])
+	}
+	return b.String()
+}
+
+func dayRange(now time.Time, days int) (string, string) {
+	to := now.UTC()
+	from := to.AddDate(0, 0, -(days - 1))
+	return from.Format("2006-01-02"), to.Format("2006-01-02")
+}
+
+func listDays(from string, days int) []string {
+	start, _ := time.Parse("2006-01-02", from)
+	out := make([]string, days)
+	for i := range out {
+		out[i] = start.AddDate(0, 0, i).Format("2006-01-02")
+	}
+	return out
+}
+
+// fillDays lines periods up with days, since days without visitors are
+// left out of /api/uniques.
+func fillDays(days []string, periods []statsapi.PeriodUniques) []int64 {
+	byDay := make(map[string]int64, len(periods))
+	for _, p := range periods {
+		byDay[p.Period] = p.Uniques
+	}
+	out := make([]int64, len(days))
+	for i, day := range days {
+		out[i] = byDay[day]
+	}
+	return out
+}
+
+func nextRange(days int) int {
+	for _, r := range tuiRanges {
+		if r > days {
+			return r
+		}
+	}
+	return tuiRanges[0]
+}
+
+func truncate(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:width-1]) + "…"
+}
+
+func pad(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
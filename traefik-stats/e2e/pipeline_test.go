@@ -0,0 +1,304 @@
+// Package e2e runs the whole pipeline: the middleware in front of a site,
+// the sidecar storing what it sends, and the API and dashboard reading it
+// back. It needs a built sidecar:
+//
+//	cargo build --release --manifest-path banan-stats/Cargo.toml
+//	BANAN_STATS_SIDECAR=$PWD/banan-stats/target/release/banan-stats go test ./traefik-stats/e2e
+//
+// Without BANAN_STATS_SIDECAR the tests are skipped.
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/khaled/banan-stats/traefik-stats/statsapi"
+	"github.com/khaled/banan-stats/traefik-stats/traefikstats"
+)
+
+const (
+	siteHost  = "e2e.example"
+	chromeUA  = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/100.0.0.0 Safari/537.36"
+	curlUA    = "curl/8.4.0"
+	visitorID = "X-Visitor"
+)
+
+// visit is one synthetic request: who sends it, where to and from where.
+type visit struct {
+	visitor   string
+	userAgent string
+	path      string
+	referrer  string
+}
+
+// traffic is what every test drives through the middleware: three browser
+// visitors, one of them from Hacker News, and a script.
+var traffic = []visit{
+	{"v1", chromeUA, "/", ""},
+	{"v1", chromeUA, "/blog/post", "https://news.ycombinator.com/item?id=1"},
+	{"v2", chromeUA, "/", ""},
+	{"v2", chromeUA, "/blog/post", ""},
+	{"v3", chromeUA, "/", ""},
+	{"script", curlUA, "/", ""},
+	{"script", curlUA, "/about", ""},
+}
+
+func TestPipelineCountsTraffic(t *testing.T) {
+	p := startPipeline(t)
+	p.drive(t, traffic)
+
+	ctx := context.Background()
+	api := statsapi.New(p.sidecarURL)
+	host := map[string][]string{"host": {siteHost}}
+
+	byType, err := api.Query(ctx, statsapi.Query{Filters: host, GroupBy: []string{"type"}, Metric: "hits"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := counts(byType, "type"); got["browser"] != 5 || got["bot"] != 2 {
+		t.Fatalf("hits by type = %v", got)
+	}
+
+	uniques, err := api.Query(ctx, statsapi.Query{Filters: host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uniques) != 1 || uniques[0].Count != 3 {
+		t.Fatalf("uniques = %+v", uniques)
+	}
+
+	byReferrer, err := api.Aggregate(ctx, []string{"ref_domain"}, "hits", 0, statsapi.Filters{Host: siteHost, Type: "browser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := counts(byReferrer, "ref_domain"); got["news.ycombinator.com"] != 1 {
+		t.Fatalf("hits by referrer = %v", got)
+	}
+
+	page := p.dashboard(t, "host="+siteHost)
+	if strings.Contains(page, "notice error") {
+		t.Fatalf("dashboard shows an error banner")
+	}
+	paths := tableRows(t, page, "Paths")
+	if paths["/"] != "3" || paths["/blog/post"] != "2" || paths["/about"] != "" {
+		t.Fatalf("Paths table = %v", paths)
+	}
+}
+
+func TestPipelineAppliesDashboardFilters(t *testing.T) {
+	p := startPipeline(t)
+	p.drive(t, traffic)
+
+	// Excluding the front page leaves the post, read by two visitors.
+	page := p.dashboard(t, "host="+siteHost+"&path!=/")
+	paths := tableRows(t, page, "Paths")
+	if len(paths) != 1 || paths["/blog/post"] != "2" {
+		t.Fatalf("Paths table = %v", paths)
+	}
+	rows, err := statsapi.New(p.sidecarURL).Query(context.Background(), statsapi.Query{
+		Filters: map[string][]string{"host": {siteHost}, "path!": {"/"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Count != 2 {
+		t.Fatalf("uniques = %+v", rows)
+	}
+}
+
+// pipeline is a sidecar on a temporary database and a site behind the
+// middleware, sending to it.
+type pipeline struct {
+	sidecarURL string
+	site       *httptest.Server
+	middleware io.Closer
+}
+
+func startPipeline(t *testing.T) *pipeline {
+	t.Helper()
+	bin := os.Getenv("BANAN_STATS_SIDECAR")
+	if bin == "" {
+		t.Skip("BANAN_STATS_SIDECAR is not set to a built sidecar")
+	}
+	dir := t.TempDir()
+	addr := freeAddr(t)
+
+	var logs bytes.Buffer
+	cmd := exec.Command(bin,
+		"--db-path", filepath.Join(dir, "stats.duckdb"),
+		"--listen", addr,
+		"--inline-tables",
+	)
+	cmd.Stdout = &logs
+	cmd.Stderr = &logs
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		if t.Failed() {
+			t.Logf("sidecar output:\n%s", logs.String())
+		}
+	})
+	sidecarURL := "http://" + addr
+	waitFor(t, "sidecar to listen", func() bool {
+		resp, err := http.Get(sidecarURL + "/api/hosts")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+
+	cfg := traefikstats.CreateConfig()
+	cfg.SidecarURL = sidecarURL
+	cfg.FlushInterval = "50ms"
+	cfg.BufferPath = filepath.Join(dir, "buffer")
+	cfg.UniqStrategy = "header"
+	cfg.UniqHeader = visitorID
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<p>%s</p>", r.URL.Path)
+	})
+	handler, err := traefikstats.New(context.Background(), next, cfg, "e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleware, ok := handler.(io.Closer)
+	if !ok {
+		t.Fatal("middleware cannot be closed")
+	}
+	site := httptest.NewServer(handler)
+	t.Cleanup(site.Close)
+	t.Cleanup(func() { _ = middleware.Close() })
+	return &pipeline{sidecarURL: sidecarURL, site: site, middleware: middleware}
+}
+
+// drive sends visits through the middleware, closes it so it flushes, and
+// waits until the sidecar has stored all of them.
+func (p *pipeline) drive(t *testing.T, visits []visit) {
+	t.Helper()
+	for _, v := range visits {
+		req, err := http.NewRequest(http.MethodGet, p.site.URL+v.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = siteHost
+		req.Header.Set("User-Agent", v.userAgent)
+		req.Header.Set(visitorID, v.visitor)
+		if v.referrer != "" {
+			req.Header.Set("Referer", v.referrer)
+		}
+		resp, err := p.site.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %s", v.path, resp.Status)
+		}
+	}
+	if err := p.middleware.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	api := statsapi.New(p.sidecarURL)
+	waitFor(t, "events to be stored", func() bool {
+		rows, err := api.Query(context.Background(), statsapi.Query{
+			Filters: map[string][]string{"host": {siteHost}},
+			Metric:  "hits",
+		})
+		return err == nil && len(rows) == 1 && rows[0].Count == int64(len(visits))
+	})
+}
+
+// dashboard fetches today's dashboard through the middleware, which proxies
+// it to the sidecar.
+func (p *pipeline) dashboard(t *testing.T, filters string) string {
+	t.Helper()
+	today := time.Now().UTC().Format("2006-01-02")
+	req, err := http.NewRequest(http.MethodGet, p.site.URL+"/stats?from="+today+"&to="+today+"&"+filters, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = siteHost
+	resp, err := p.site.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("dashboard: %s\n%s", resp.Status, body)
+	}
+	return string(body)
+}
+
+var tableRow = regexp.MustCompile(`title='([^']*)'[^>]*>[^<]*</(?:a|span)>\s*<td>([^<]*)</td>`)
+
+// tableRows reads the value and count of each row of the dashboard table
+// titled title.
+func tableRows(t *testing.T, page, title string) map[string]string {
+	t.Helper()
+	start := strings.Index(page, "<h1>"+title+"</h1>")
+	if start < 0 {
+		t.Fatalf("dashboard has no %s table", title)
+	}
+	table := page[start:]
+	if end := strings.Index(table, "</table>"); end >= 0 {
+		table = table[:end]
+	}
+	rows := map[string]string{}
+	for _, m := range tableRow.FindAllStringSubmatch(table, -1) {
+		rows[m[1]] = m[2]
+	}
+	return rows
+}
+
+func counts(rows []statsapi.AggregateRow, column string) map[string]int64 {
+	out := map[string]int64{}
+	for _, row := range rows {
+		if value := row.Groups[column]; value != nil {
+			out[*value] = row.Count
+		}
+	}
+	return out
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(15 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -2,7 +2,10 @@ module github.com/khaled/banan-stats/traefik-stats
 
 go 1.25
 
-require modernc.org/sqlite v1.32.0
+require (
+	golang.org/x/term v0.22.0
+	modernc.org/sqlite v1.32.0
+)
 
 require (
 	github.com/dustin/go-humanize v1.0.1 // indirect
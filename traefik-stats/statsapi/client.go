@@ -0,0 +1,313 @@
+package statsapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to one sidecar. The zero HTTPClient uses http.DefaultClient.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// Token is sent as a bearer token; only admin endpoints need it.
+	Token string
+}
+
+// New returns a client for the sidecar at baseURL (e.g. http://127.0.0.1:8080).
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/")}
+}
+
+// APIError is returned for any non-2xx response. Code and Message are set
+// when the body is an /api error envelope; Code is one of invalid_request,
+// invalid_body, not_found, query_failed and overloaded. An overloaded
+// request can be retried after the response's Retry-After.
+type APIError struct {
+	StatusCode int
+	Body       string
+	Code       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("sidecar returned %d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("sidecar returned %d: %s", e.StatusCode, e.Body)
+}
+
+func newAPIError(statusCode int, body []byte) *APIError {
+	apiErr := &APIError{StatusCode: statusCode, Body: strings.TrimSpace(string(body))}
+	var envelope struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &envelope) == nil {
+		apiErr.Code = envelope.Error.Code
+		apiErr.Message = envelope.Error.Message
+	}
+	return apiErr
+}
+
+// Hosts calls GET /api/hosts.
+func (c *Client) Hosts(ctx context.Context) ([]string, error) {
+	var hosts []string
+	err := c.getJSON(ctx, "/api/hosts", nil, &hosts)
+	return hosts, err
+}
+
+// Search calls GET /api/search. q is a substring, or a /regex/.
+func (c *Client) Search(ctx context.Context, q string, f Filters) (*SearchResult, error) {
+	params := f.values()
+	params.Set("q", q)
+	var result SearchResult
+	if err := c.getJSON(ctx, "/api/search", params, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Growth calls GET /api/growth for the 12 months ending with f.To.
+func (c *Client) Growth(ctx context.Context, f Filters) ([]MonthGrowth, error) {
+	var months []MonthGrowth
+	err := c.getJSON(ctx, "/api/growth", f.values(), &months)
+	return months, err
+}
+
+// Top calls GET /api/top for one of the dashboard tables: paths, queries,
+// referrers, search_terms, social, browsers, readers, scrapers, trapped
+// or navigation.
+func (c *Client) Top(ctx context.Context, table string, f Filters) ([]TopRow, error) {
+	params := f.values()
+	params.Set("name", table)
+	var rows []TopRow
+	err := c.getJSON(ctx, "/api/top", params, &rows)
+	return rows, err
+}
+
+// Uniques calls GET /api/uniques; by is day, week, month or year.
+func (c *Client) Uniques(ctx context.Context, by string, f Filters) ([]PeriodUniques, error) {
+	params := f.values()
+	params.Set("by", by)
+	var periods []PeriodUniques
+	err := c.getJSON(ctx, "/api/uniques", params, &periods)
+	return periods, err
+}
+
+// Daily calls GET /api/daily. The summary is nil when no complete day in
+// the range had visitors.
+func (c *Client) Daily(ctx context.Context, f Filters) (*DailySummary, error) {
+	var summary *DailySummary
+	err := c.getJSON(ctx, "/api/daily", f.values(), &summary)
+	return summary, err
+}
+
+// Aggregate calls GET /api/aggregate, counting metric ("uniques" or "hits")
+// per combination of the groupBy columns. limit 0 keeps the server's default.
+func (c *Client) Aggregate(ctx context.Context, groupBy []string, metric string, limit int, f Filters) ([]AggregateRow, error) {
+	params := f.values()
+	params.Set("group_by", strings.Join(groupBy, ","))
+	if metric != "" {
+		params.Set("metric", metric)
+	}
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+	var rows []AggregateRow
+	err := c.getJSON(ctx, "/api/aggregate", params, &rows)
+	return rows, err
+}
+
+// Query posts q to /api/query.
+func (c *Client) Query(ctx context.Context, q Query) ([]AggregateRow, error) {
+	body, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/api/query", nil, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var rows []AggregateRow
+	err = c.do(req, &rows)
+	return rows, err
+}
+
+// Schema calls GET /api/schema.
+func (c *Client) Schema(ctx context.Context) (*Schema, error) {
+	var result Schema
+	if err := c.getJSON(ctx, "/api/schema", nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Classify calls GET /api/classify. Empty arguments are left out; path
+// defaults to "/".
+func (c *Client) Classify(ctx context.Context, userAgent, referrer, path, ip string) (*Classification, error) {
+	params := url.Values{}
+	for key, value := range map[string]string{"ua": userAgent, "referrer": referrer, "path": path, "ip": ip} {
+		if value != "" {
+			params.Set(key, value)
+		}
+	}
+	var result Classification
+	if err := c.getJSON(ctx, "/api/classify", params, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// EventsPageSize is the number of rows per page of Events.
+const EventsPageSize = 100
+
+// Events fetches one page of raw events, newest first, from the admin
+// /stats/events CSV export. It needs Token. The first returned row is the
+// header; a page with fewer than EventsPageSize data rows is the last.
+func (c *Client) Events(ctx context.Context, f Filters, columns []string, page int) ([][]string, error) {
+	params := f.values()
+	params.Set("format", "csv")
+	params.Set("page", strconv.Itoa(page))
+	for _, col := range columns {
+		params.Add("col", col)
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, "/stats/events", params, nil)
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	if err := c.do(req, &body); err != nil {
+		return nil, err
+	}
+	return csv.NewReader(&body).ReadAll()
+}
+
+// Ingest posts events as NDJSON to /ingest.
+func (c *Client) Ingest(ctx context.Context, events []Event) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/ingest", nil, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	return c.do(req, nil)
+}
+
+// IngestEdge posts events to /ingest/v2, signed with the shared secret.
+func (c *Client) IngestEdge(ctx context.Context, secret string, events []EdgeEvent) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := c.newRequest(ctx, http.MethodPost, "/ingest/v2", nil, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Banan-Timestamp", ts)
+	req.Header.Set("X-Banan-Signature", "sha256="+Sign(secret, ts, body))
+	return c.do(req, nil)
+}
+
+// Sign returns the hex HMAC-SHA256 of "ts.body" expected in X-Banan-Signature.
+func Sign(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (f Filters) values() url.Values {
+	v := url.Values{}
+	for key, value := range map[string]string{
+		"from":       f.From,
+		"to":         f.To,
+		"host":       f.Host,
+		"path":       f.Path,
+		"query":      f.Query,
+		"ref_domain": f.RefDomain,
+		"agent":      f.Agent,
+		"type":       f.Type,
+		"os":         f.OS,
+		"scheme":     f.Scheme,
+	} {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+	return v
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, params url.Values, out any) error {
+	req, err := c.newRequest(ctx, http.MethodGet, path, params, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	return c.do(req, out)
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, params url.Values, body io.Reader) (*http.Request, error) {
+	target := c.BaseURL + path
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return req, nil
+}
+
+func (c *Client) do(req *http.Request, out any) error {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return newAPIError(resp.StatusCode, msg)
+	}
+	switch out := out.(type) {
+	case nil:
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	case io.Writer:
+		_, err = io.Copy(out, resp.Body)
+		return err
+	default:
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+}
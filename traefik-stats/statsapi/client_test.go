@@ -0,0 +1,134 @@
+package statsapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSearchSendsFilters(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/search" {
+			t.Fatalf("path = %q", r.URL.Path)
+		}
+		q := r.URL.Query()
+		if q.Get("q") != "/rss" || q.Get("ref_domain") != "example.com" || q.Has("host") {
+			t.Fatalf("query = %q", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"days":[{"date":"2026-01-02","hits":3,"uniques":1}],"rows":[{"date":"2026-01-02","path":"/rss","query":"","referrer":"","userAgent":"x","type":"feed","hits":3}]}`))
+	}))
+	defer srv.Close()
+
+	result, err := New(srv.URL).Search(context.Background(), "/rss", Filters{RefDomain: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Days) != 1 || result.Days[0].Hits != 3 || result.Rows[0].UserAgent != "x" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "missing q", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	_, err := New(srv.URL).Search(context.Background(), "", Filters{})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Body != "missing q" {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":{"code":"query_failed","message":"Catalog Error: Table with name stats does not exist!"}}`))
+	}))
+	defer srv.Close()
+
+	_, err := New(srv.URL).Hosts(context.Background())
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != "query_failed" || !strings.HasPrefix(apiErr.Message, "Catalog Error") {
+		t.Fatalf("err = %v", err)
+	}
+	if err.Error() != "sidecar returned 500 query_failed: Catalog Error: Table with name stats does not exist!" {
+		t.Fatalf("Error() = %q", err.Error())
+	}
+}
+
+func TestAggregateDecodesGroups(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/aggregate" || r.URL.Query().Get("group_by") != "ref_domain,os" {
+			t.Fatalf("request = %s?%s", r.URL.Path, r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"os":"Linux","ref_domain":null,"count":7}]`))
+	}))
+	defer srv.Close()
+
+	rows, err := New(srv.URL).Aggregate(context.Background(), []string{"ref_domain", "os"}, "", 0, Filters{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Count != 7 || *rows[0].Groups["os"] != "Linux" || rows[0].Groups["ref_domain"] != nil {
+		t.Fatalf("unexpected rows: %+v", rows)
+	}
+}
+
+func TestQueryPostsBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/query" {
+			t.Fatalf("request = %s %s", r.Method, r.URL.Path)
+		}
+		var q map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := q["group_by"]; ok || q["metric"] != "hits" || q["filters"].(map[string]any)["path!"] == nil {
+			t.Fatalf("body = %v", q)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"count":12}]`))
+	}))
+	defer srv.Close()
+
+	rows, err := New(srv.URL).Query(context.Background(), Query{
+		Filters: map[string][]string{"path!": {"/feed.xml"}},
+		Metric:  "hits",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Count != 12 || len(rows[0].Groups) != 0 {
+		t.Fatalf("unexpected rows: %+v", rows)
+	}
+}
+
+func TestDailyDecodesNull(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("from") == "2026-01-01" {
+			w.Write([]byte(`{"days":3,"best":{"date":"2026-01-02","uniques":9},"worst":{"date":"2026-01-03","uniques":1},"p25":1,"median":4,"p75":9,"p90":9}`))
+			return
+		}
+		w.Write([]byte(`null`))
+	}))
+	defer srv.Close()
+
+	summary, err := New(srv.URL).Daily(context.Background(), Filters{From: "2026-01-01"})
+	if err != nil || summary == nil || summary.Best.Date != "2026-01-02" || summary.Median != 4 {
+		t.Fatalf("summary = %+v, err = %v", summary, err)
+	}
+	summary, err = New(srv.URL).Daily(context.Background(), Filters{From: "2030-01-01"})
+	if err != nil || summary != nil {
+		t.Fatalf("expected no summary, got %+v, err = %v", summary, err)
+	}
+}
@@ -0,0 +1,203 @@
+// Package statsapi is a typed client for the banan-stats sidecar API. The
+// types and operations follow banan-stats/assets/openapi.json (also served
+// at /api/openapi.json); keep both in sync when the API changes.
+package statsapi
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// SearchResult is returned by GET /api/search.
+type SearchResult struct {
+	Days []SearchDay `json:"days"`
+	Rows []SearchRow `json:"rows"`
+}
+
+// SearchDay holds the matches for one day.
+type SearchDay struct {
+	Date    string `json:"date"`
+	Hits    int64  `json:"hits"`
+	Uniques int64  `json:"uniques"`
+}
+
+// SearchRow is one matching (date, path, query, referrer, agent) group.
+type SearchRow struct {
+	Date      string `json:"date"`
+	Path      string `json:"path"`
+	Query     string `json:"query"`
+	Referrer  string `json:"referrer"`
+	UserAgent string `json:"userAgent"`
+	Type      string `json:"type"`
+	Hits      int64  `json:"hits"`
+}
+
+// TopRow is one row of GET /api/top. Value is nil for the bucket of
+// everything outside the top 10.
+type TopRow struct {
+	Value *string `json:"value"`
+	Count int64   `json:"count"`
+}
+
+// PeriodUniques is one period returned by GET /api/uniques.
+type PeriodUniques struct {
+	Period  string `json:"period"`
+	Uniques int64  `json:"uniques"`
+}
+
+// DayCount is a day and its unique visitors.
+type DayCount struct {
+	Date    string `json:"date"`
+	Uniques int64  `json:"uniques"`
+}
+
+// DailySummary is returned by GET /api/daily: how daily unique visitors
+// were spread over the complete days of the range.
+type DailySummary struct {
+	Days   int64    `json:"days"`
+	Best   DayCount `json:"best"`
+	Worst  DayCount `json:"worst"`
+	P25    int64    `json:"p25"`
+	Median int64    `json:"median"`
+	P75    int64    `json:"p75"`
+	P90    int64    `json:"p90"`
+}
+
+// AggregateRow is one group returned by GET /api/aggregate. Groups maps each
+// group_by column to its value, nil for rows without one.
+type AggregateRow struct {
+	Groups map[string]*string
+	Count  int64
+}
+
+func (r *AggregateRow) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	r.Groups = make(map[string]*string, len(fields))
+	for name, raw := range fields {
+		if name == "count" {
+			if err := json.Unmarshal(raw, &r.Count); err != nil {
+				return err
+			}
+			continue
+		}
+		var value *string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return err
+		}
+		r.Groups[name] = value
+	}
+	return nil
+}
+
+// Query is the body of POST /api/query. Filters maps a filter column, with
+// "!" appended to exclude, to the values it matches. Without GroupBy the
+// whole selection is counted in one row.
+type Query struct {
+	From    string              `json:"from,omitempty"`
+	To      string              `json:"to,omitempty"`
+	Filters map[string][]string `json:"filters,omitempty"`
+	GroupBy []string            `json:"group_by,omitempty"`
+	Metric  string              `json:"metric,omitempty"`
+	Limit   int                 `json:"limit,omitempty"`
+}
+
+// Schema is returned by GET /api/schema.
+type Schema struct {
+	Columns []SchemaColumn `json:"columns"`
+	Metrics []string       `json:"metrics"`
+}
+
+// SchemaColumn describes a column queries can filter or group by. Type is
+// "string", "date" or "boolean".
+type SchemaColumn struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Filter      bool   `json:"filter"`
+	GroupBy     bool   `json:"group_by"`
+	Description string `json:"description"`
+}
+
+// Classification is returned by GET /api/classify.
+type Classification struct {
+	Agent      string `json:"agent"`
+	Type       string `json:"type"`
+	TypeReason string `json:"typeReason"`
+	OS         string `json:"os"`
+	Mult       int64  `json:"mult"`
+	RefDomain  string `json:"refDomain"`
+	Uniq       string `json:"uniq"`
+	UniqSource string `json:"uniqSource"`
+	ASN        int64  `json:"asn"`
+	ASNName    string `json:"asnName"`
+	Datacenter bool   `json:"datacenter"`
+}
+
+// MonthGrowth is one month returned by GET /api/growth. Mom and Yoy are
+// percentages and nil when there is nothing to compare against.
+type MonthGrowth struct {
+	Month   string   `json:"month"`
+	Uniques int64    `json:"uniques"`
+	Mom     *float64 `json:"mom"`
+	Yoy     *float64 `json:"yoy"`
+}
+
+// Event is one NDJSON line accepted by POST /ingest.
+type Event struct {
+	EventID     string    `json:"eventId,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+	Host        string    `json:"host"`
+	Path        string    `json:"path"`
+	Query       string    `json:"query"`
+	IP          string    `json:"ip"`
+	UserAgent   string    `json:"userAgent"`
+	Referrer    string    `json:"referrer"`
+	ContentType string    `json:"contentType"`
+	SetCookie   string    `json:"setCookie,omitempty"`
+	Uniq        string    `json:"uniq,omitempty"`
+	SecondVisit bool      `json:"secondVisit,omitempty"`
+	Prefetch    bool      `json:"prefetch,omitempty"`
+	Fragment    bool      `json:"fragment,omitempty"`
+	// Agent, Type, OS and Mult are set by middleware running with dataMode
+	// minimal, which leaves IP and UserAgent empty.
+	Agent string `json:"agent,omitempty"`
+	Type  string `json:"type,omitempty"`
+	OS    string `json:"os,omitempty"`
+	Mult  int    `json:"mult,omitempty"`
+	// Consent is the consent level the middleware tracked the visitor at:
+	// full, cookieless or none.
+	Consent string `json:"consent,omitempty"`
+	// Scheme (http or https) and Port are the ones the request came in on.
+	Scheme string `json:"scheme,omitempty"`
+	Port   int    `json:"port,omitempty"`
+}
+
+// EdgeEvent is the payload accepted by the signed POST /ingest/v2.
+type EdgeEvent struct {
+	ID          string     `json:"id,omitempty"`
+	TS          *time.Time `json:"ts,omitempty"`
+	URL         string     `json:"url"`
+	IP          string     `json:"ip,omitempty"`
+	UA          string     `json:"ua,omitempty"`
+	Referrer    string     `json:"referrer,omitempty"`
+	ContentType string     `json:"contentType,omitempty"`
+	Uniq        string     `json:"uniq,omitempty"`
+}
+
+// Filters narrows the read endpoints the same way the dashboard filters do.
+// Empty fields are omitted; From and To are YYYY-MM-DD. A value ending in
+// "*" matches by prefix, e.g. Path "/blog/*".
+type Filters struct {
+	From      string
+	To        string
+	Host      string
+	Path      string
+	Query     string
+	RefDomain string
+	Agent     string
+	Type      string
+	OS        string
+	Scheme    string
+}
@@ -0,0 +1,195 @@
+package traefikstats
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The sidecar classifies user agents itself (banan-stats/src/analyzer.rs).
+// dataMode minimal needs the same classification at the edge, so this is a
+// port of it; the Go tests check it against the sidecar's fixtures.
+
+// builtinAgentTypes mirrors banan-stats/assets/agent_types.txt; a test fails
+// when they differ. The sidecar applies its --agent-types file on ingest.
+var builtinAgentTypes = map[string]string{
+	"Chrome":         "browser",
+	"Firefox":        "browser",
+	"Edg":            "browser",
+	"EdgA":           "browser",
+	"EdgiOS":         "browser",
+	"Safari":         "browser",
+	"OPR":            "browser",
+	"YaBrowser":      "browser",
+	"Vivaldi":        "browser",
+	"SamsungBrowser": "browser",
+	"UCBrowser":      "browser",
+	"Brave":          "browser",
+	"Arc":            "browser",
+	"DuckDuckGo":     "browser",
+	"Ddg":            "browser",
+	"CriOS":          "browser",
+	"FxiOS":          "browser",
+	"Focus":          "browser",
+	"Opera":          "browser",
+	"OPT":            "browser",
+	"OPiOS":          "browser",
+	"MiuiBrowser":    "browser",
+	"HuaweiBrowser":  "browser",
+	"HeyTapBrowser":  "browser",
+	"Silk":           "browser",
+	"Whale":          "browser",
+	"GSA":            "browser",
+	"Instagram":      "browser",
+	"FBAV":           "browser",
+}
+
+var (
+	reSpecial       = regexp.MustCompile(`(?i)(?:Leed|BeyondPod|360Spider|Lark|Nutch|Skype|leakix\.net|uni-app)`)
+	reUUIDPrefix    = regexp.MustCompile(`(?i)^[0-9A-F]{8}-[0-9A-F]{4}-[0-9A-F]{4}-[0-9A-F]{4}-[0-9A-F]{12}/\d+ ([^;(/]+)`)
+	reCompatible    = regexp.MustCompile(`(?i)compatible; ([^;(/+]*[^;(/+ ])`)
+	reBotBefore     = regexp.MustCompile(`(?i)^[\w\.\-_@ ]*[\w\.\-_@] (?:ro)?bot`)
+	reBotContains   = regexp.MustCompile(`(?i)\b[\w\-_]+bot\b`)
+	reTrident       = regexp.MustCompile(`(?i)Trident/[0-9.]+`)
+	reMozillaFirst  = regexp.MustCompile(`(?i)^Mozilla/.* ([A-Za-z0-9_]+)/[A-Z0-9.]+(?: (?:Chrome|Version|Mobile|Safari|Mobile Safari)/[A-Z0-9.]+)+$`)
+	reMozillaSafari = regexp.MustCompile(`(?i)^Mozilla/.* ([A-Za-z0-9_]+)/[0-9.]+(?: Mobile)? Safari/[0-9.]+$`)
+	reMozillaLast   = regexp.MustCompile(`(?i)^Mozilla/.* ([A-Za-z0-9_]+)/[a-z0-9.]+(?: \([^\)]+\)| Mobile| GTB[0-9.]+)*$`)
+	reFeedIDName    = regexp.MustCompile(`(?i)^([\w\.\-_@ ]*[\w\.\-_@]) feed-id:`)
+	reBeforeDash    = regexp.MustCompile(`(?i)^([\w\._@ ]*[\w\._@]) - `)
+	reBeforeVersion = regexp.MustCompile(`(?i)^([\w\.\-_@ ]*[\w\.\-_@])[- ]v?\d+\.\d+`)
+	reBeforeSlash   = regexp.MustCompile(`(?i)^([\w\.\-_@% ]*[\w\.\-_@%]) ?[/\(:\+]`)
+	reSingleWord    = regexp.MustCompile(`(?i)^[\w\.\-_@ ]*[\w\.\-_@]$`)
+
+	reRSS       = regexp.MustCompile(`(?i)rss`)
+	reBotUA     = regexp.MustCompile(`(?i)bot|crawl|fetch|node|ruby|.rb|python|curl|okhttp|spider|scan|nutch|mastodon|\+http`)
+	reOSAndroid = regexp.MustCompile(`(?i)Android`)
+	reOSWindows = regexp.MustCompile(`(?i)Windows`)
+	reOSIOS     = regexp.MustCompile(`(?i)iOS|iPhone|iPad|Mobile.*Safari`)
+	reOSMac     = regexp.MustCompile(`(?i)macOS|Mac OS|Macintosh|Darwin`)
+	reOSLinux   = regexp.MustCompile(`(?i)Linux|X11`)
+
+	reMultiplier = regexp.MustCompile(`(?i)(\d+) subscriber`)
+	reFeedID     = regexp.MustCompile(`(?i)feed-id[=:]([A-Za-z0-9_]+)`)
+)
+
+// agentName is the short client name the dashboard groups by, e.g.
+// "Firefox" or "Googlebot".
+func agentName(userAgent string) string {
+	if userAgent == "" {
+		return ""
+	}
+	ua := userAgent
+	if len(ua) >= 2 && strings.HasPrefix(ua, `"`) && strings.HasSuffix(ua, `"`) {
+		ua = ua[1 : len(ua)-1]
+	}
+	matchers := []func(string) string{
+		func(s string) string { return reSpecial.FindString(s) },
+		func(s string) string { return regexpGroup(reUUIDPrefix, s) },
+		func(s string) string { return regexpGroup(reCompatible, s) },
+		func(s string) string { return reBotBefore.FindString(s) },
+		func(s string) string { return reBotContains.FindString(s) },
+		func(s string) string {
+			if reTrident.MatchString(s) {
+				return "Trident"
+			}
+			return ""
+		},
+		func(s string) string {
+			switch name := regexpGroup(reMozillaFirst, s); name {
+			case "Chrome", "Version", "Mobile", "Safari", "Mobile Safari":
+				return ""
+			default:
+				return name
+			}
+		},
+		func(s string) string {
+			if name := regexpGroup(reMozillaSafari, s); !strings.EqualFold(name, "Version") {
+				return name
+			}
+			return ""
+		},
+		func(s string) string { return regexpGroup(reMozillaLast, s) },
+		func(s string) string { return regexpGroup(reFeedIDName, s) },
+		func(s string) string { return regexpGroup(reBeforeDash, s) },
+		func(s string) string { return regexpGroup(reBeforeVersion, s) },
+		func(s string) string {
+			val := regexpGroup(reBeforeSlash, s)
+			if strings.HasPrefix(strings.ToLower(val), "mozilla") {
+				return ""
+			}
+			return val
+		},
+		func(s string) string { return reSingleWord.FindString(s) },
+	}
+	for _, match := range matchers {
+		if val := strings.TrimSpace(match(ua)); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// agentType is "browser", "feed" or "bot".
+func agentType(path, agent, userAgent string) string {
+	if userAgent != "" && reRSS.MatchString(userAgent) {
+		return "feed"
+	}
+	if kind, ok := builtinAgentTypes[agent]; ok {
+		return kind
+	}
+	if reBotUA.MatchString(userAgent) {
+		return "bot"
+	}
+	if strings.HasPrefix(userAgent, "Mozilla/") {
+		return "browser"
+	}
+	return "bot"
+}
+
+func agentOS(userAgent string) string {
+	switch {
+	case reOSAndroid.MatchString(userAgent):
+		return "Android"
+	case reOSWindows.MatchString(userAgent):
+		return "Windows"
+	case reOSIOS.MatchString(userAgent):
+		return "iOS"
+	case reOSMac.MatchString(userAgent):
+		return "macOS"
+	case reOSLinux.MatchString(userAgent):
+		return "Linux"
+	}
+	return ""
+}
+
+// agentMultiplier is the subscriber count feed readers report for the
+// users behind one request, 1 otherwise.
+func agentMultiplier(userAgent string) int {
+	if n, err := strconv.Atoi(regexpGroup(reMultiplier, userAgent)); err == nil {
+		return n
+	}
+	return 1
+}
+
+// feedReaderUniq identifies the reader behind a feed request the way the
+// sidecar does, by agent and feed-id or by agent alone when it reports a
+// subscriber count. Empty when neither applies.
+func feedReaderUniq(userAgent, agent string) string {
+	if userAgent == "" || agent == "" {
+		return ""
+	}
+	if feedID := regexpGroup(reFeedID, userAgent); feedID != "" {
+		return hashUUID(agent + "/" + feedID)
+	}
+	if strings.Contains(strings.ToLower(userAgent), "subscriber") {
+		return hashUUID(agent)
+	}
+	return ""
+}
+
+func regexpGroup(re *regexp.Regexp, s string) string {
+	if m := re.FindStringSubmatch(s); len(m) > 1 {
+		return m[1]
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package traefikstats
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// sealedPrefix marks an encrypted buffer payload. Plain payloads are JSON
+// objects, so events buffered before a key was configured still read back.
+const sealedPrefix = "sealed1:"
+
+// errBufferKey marks a sealed payload the configured key cannot open: there
+// is no key, or it is not the one the payload was sealed with. Such events
+// stay buffered rather than being dropped as bad payloads.
+var errBufferKey = errors.New("buffer key cannot open payload")
+
+// payloadCipher encrypts buffered events with AES-256-GCM, so the buffer on
+// an edge node does not keep visitor IPs and user agents in plain text. A
+// nil cipher leaves payloads as they are.
+type payloadCipher struct {
+	aead cipher.AEAD
+}
+
+// loadBufferKey reads the buffer key from the file at keyFile or, failing
+// that, from the environment variable keyEnv. Neither set means no
+// encryption.
+func loadBufferKey(keyFile, keyEnv string) (*payloadCipher, error) {
+	var secret string
+	switch {
+	case strings.TrimSpace(keyFile) != "":
+		raw, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read bufferKeyFile: %w", err)
+		}
+		secret = strings.TrimSpace(string(raw))
+		if secret == "" {
+			return nil, fmt.Errorf("bufferKeyFile %s is empty", keyFile)
+		}
+	case strings.TrimSpace(keyEnv) != "":
+		secret = strings.TrimSpace(os.Getenv(keyEnv))
+		if secret == "" {
+			return nil, fmt.Errorf("bufferKeyEnv: %s is not set", keyEnv)
+		}
+	default:
+		return nil, nil
+	}
+	return newPayloadCipher(secret)
+}
+
+// newPayloadCipher derives the AES key from secret with SHA-256, so any
+// long random string works as a key.
+func newPayloadCipher(secret string) (*payloadCipher, error) {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &payloadCipher{aead: aead}, nil
+}
+
+// seal encrypts payload under a fresh nonce and returns it as one line of
+// text.
+func (c *payloadCipher) seal(payload []byte) ([]byte, error) {
+	if c == nil {
+		return payload, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("buffer nonce: %w", err)
+	}
+	sealed := c.aead.Seal(nonce, nonce, payload, nil)
+	out := make([]byte, len(sealedPrefix)+base64.StdEncoding.EncodedLen(len(sealed)))
+	copy(out, sealedPrefix)
+	base64.StdEncoding.Encode(out[len(sealedPrefix):], sealed)
+	return out, nil
+}
+
+// open reverses seal. Plain payloads pass through; sealed ones need the
+// key they were sealed with.
+func (c *payloadCipher) open(payload []byte) ([]byte, error) {
+	payload = bytes.TrimRight(payload, "\n")
+	if !bytes.HasPrefix(payload, []byte(sealedPrefix)) {
+		return payload, nil
+	}
+	if c == nil {
+		return nil, fmt.Errorf("%w: no buffer key is configured", errBufferKey)
+	}
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(payload)-len(sealedPrefix)))
+	n, err := base64.StdEncoding.Decode(sealed, payload[len(sealedPrefix):])
+	if err != nil {
+		return nil, fmt.Errorf("decode payload: %w", err)
+	}
+	sealed = sealed[:n]
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, errors.New("payload too short")
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plain, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBufferKey, err)
+	}
+	return plain, nil
+}
+
+// bufferKeyError reports that the buffer at path holds events the key
+// cannot open.
+func bufferKeyError(path string, err error) error {
+	return fmt.Errorf("buffer %s holds events sealed with another key; configure that key, or move the buffer aside to drop them: %w", path, err)
+}
@@ -0,0 +1,145 @@
+package traefikstats
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type ipResolver struct {
+	trusted    []*net.IPNet
+	ipv6Prefix int
+}
+
+func newIPResolver(trustedProxies []string, ipv6Prefix int) (*ipResolver, error) {
+	if ipv6Prefix < 0 || ipv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid ipv6PrefixLength %d", ipv6Prefix)
+	}
+	r := &ipResolver{ipv6Prefix: ipv6Prefix}
+	for _, entry := range trustedProxies {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			r.trusted = append(r.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		r.trusted = append(r.trusted, ipNet)
+	}
+	return r, nil
+}
+
+// clientIP returns the address of the visitor. Without trusted proxies the
+// leftmost X-Forwarded-For entry is used as before; with trusted proxies only
+// headers set by a trusted peer are honored and the rightmost untrusted hop
+// wins.
+func (r *ipResolver) clientIP(req *http.Request) string {
+	remote := stripPort(req.RemoteAddr)
+	if len(r.trusted) == 0 {
+		if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+			return stripPort(strings.TrimSpace(strings.Split(xff, ",")[0]))
+		}
+		return remote
+	}
+
+	if !r.isTrusted(remote) {
+		return remote
+	}
+
+	hops := forwardedHops(req.Header)
+	if len(hops) == 0 {
+		if realIP := stripPort(strings.TrimSpace(req.Header.Get("X-Real-IP"))); net.ParseIP(realIP) != nil {
+			return realIP
+		}
+		return remote
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !r.isTrusted(hops[i]) {
+			return hops[i]
+		}
+	}
+	return hops[0]
+}
+
+// visitorIP is the client IP as recorded and hashed: IPv6 addresses are
+// truncated to the configured prefix so rotating privacy addresses of one
+// host count as a single visitor.
+func (r *ipResolver) visitorIP(req *http.Request) string {
+	return maskIPv6(r.clientIP(req), r.ipv6Prefix)
+}
+
+func maskIPv6(ip string, prefix int) string {
+	if prefix == 0 || prefix == 128 {
+		return ip
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil {
+		return ip
+	}
+	return parsed.Mask(net.CIDRMask(prefix, 128)).String()
+}
+
+func (r *ipResolver) isTrusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range r.trusted {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHops lists the client chain from the Forwarded header, falling back
+// to X-Forwarded-For. Entries that are not IP addresses are dropped.
+func forwardedHops(h http.Header) []string {
+	var hops []string
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, elem := range strings.Split(strings.Join(values, ","), ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				ip := stripPort(strings.Trim(val, `"`))
+				if net.ParseIP(ip) != nil {
+					hops = append(hops, ip)
+				}
+			}
+		}
+		return hops
+	}
+	for _, value := range h.Values("X-Forwarded-For") {
+		for _, part := range strings.Split(value, ",") {
+			ip := stripPort(strings.TrimSpace(part))
+			if net.ParseIP(ip) != nil {
+				hops = append(hops, ip)
+			}
+		}
+	}
+	return hops
+}
+
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
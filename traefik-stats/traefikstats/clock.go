@@ -0,0 +1,34 @@
+package traefikstats
+
+import "time"
+
+// clock is where the middleware and its flusher read the time: cookie days,
+// debounce windows, flush ticks, backoff and the status endpoint. Tests swap
+// in a fake one to step through them without sleeping.
+type clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) ticker
+}
+
+// ticker is the part of time.Ticker the flusher uses.
+type ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// systemClock is the wall clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTicker(d time.Duration) ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (s systemTicker) Chan() <-chan time.Time { return s.t.C }
+
+func (s systemTicker) Stop() { s.t.Stop() }
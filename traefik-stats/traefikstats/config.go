@@ -20,7 +20,41 @@ type Config struct {
 	BatchSize      int    `json:"batchSize" yaml:"batchSize" toml:"batchSize"`
 	BufferPath     string `json:"bufferPath" yaml:"bufferPath" toml:"bufferPath"`
 	BufferMaxEvents int   `json:"bufferMaxEvents" yaml:"bufferMaxEvents" toml:"bufferMaxEvents"`
+	BufferKeyFile  string `json:"bufferKeyFile" yaml:"bufferKeyFile" toml:"bufferKeyFile"`
+	BufferKeyEnv   string `json:"bufferKeyEnv" yaml:"bufferKeyEnv" toml:"bufferKeyEnv"`
+	ShutdownTimeout string `json:"shutdownTimeout" yaml:"shutdownTimeout" toml:"shutdownTimeout"`
+	IngestMode     string `json:"ingestMode" yaml:"ingestMode" toml:"ingestMode"`
+	IngestSecret   string `json:"ingestSecret" yaml:"ingestSecret" toml:"ingestSecret"`
+	Source         string `json:"source" yaml:"source" toml:"source"`
 	HostFilterMode string `json:"hostFilterMode" yaml:"hostFilterMode" toml:"hostFilterMode"`
+	DebounceWindow string `json:"debounceWindow" yaml:"debounceWindow" toml:"debounceWindow"`
+	PrefetchMode   string `json:"prefetchMode" yaml:"prefetchMode" toml:"prefetchMode"`
+	FragmentMode   string `json:"fragmentMode" yaml:"fragmentMode" toml:"fragmentMode"`
+	DataMode       string `json:"dataMode" yaml:"dataMode" toml:"dataMode"`
+	ConsentCookie  string `json:"consentCookie" yaml:"consentCookie" toml:"consentCookie"`
+	ConsentHeader  string `json:"consentHeader" yaml:"consentHeader" toml:"consentHeader"`
+	ConsentDefault string `json:"consentDefault" yaml:"consentDefault" toml:"consentDefault"`
+
+	CountFeedRevalidations bool `json:"countFeedRevalidations" yaml:"countFeedRevalidations" toml:"countFeedRevalidations"`
+	CaptureStatus          bool `json:"captureStatus" yaml:"captureStatus" toml:"captureStatus"`
+	CaptureDuration        bool `json:"captureDuration" yaml:"captureDuration" toml:"captureDuration"`
+
+	UniqStrategy string `json:"uniqStrategy" yaml:"uniqStrategy" toml:"uniqStrategy"`
+	UniqHeader   string `json:"uniqHeader" yaml:"uniqHeader" toml:"uniqHeader"`
+	// UniqSalt is mixed into the daily visitor hash of the ip-ua-salted
+	// strategy, cookieless consent and dataMode minimal, and is required
+	// with any of them. Use the same value on every Traefik node so a
+	// visitor hashes alike on each, and across reloads.
+	UniqSalt string `json:"uniqSalt" yaml:"uniqSalt" toml:"uniqSalt"`
+
+	TrustedProxies   []string `json:"trustedProxies" yaml:"trustedProxies" toml:"trustedProxies"`
+	IPv6PrefixLength int      `json:"ipv6PrefixLength" yaml:"ipv6PrefixLength" toml:"ipv6PrefixLength"`
+
+	CaptureHeaders []string `json:"captureHeaders" yaml:"captureHeaders" toml:"captureHeaders"`
+	Enrichers      []string `json:"enrichers" yaml:"enrichers" toml:"enrichers"`
+
+	ExcludeHeaders []string `json:"excludeHeaders" yaml:"excludeHeaders" toml:"excludeHeaders"`
+	ExcludeCookies []string `json:"excludeCookies" yaml:"excludeCookies" toml:"excludeCookies"`
 }
 
 func CreateConfig() *Config {
@@ -40,8 +74,27 @@ func CreateConfig() *Config {
 		QueueSize:      1024,
 		FlushInterval:  (2 * time.Second).String(),
 		BatchSize:      100,
-		BufferPath:     "/tmp/banan-stats-buffer.sqlite",
+		BufferPath:     defaultBufferPath,
 		BufferMaxEvents: 5000,
+		ShutdownTimeout: (5 * time.Second).String(),
+		IngestMode:     ingestModeBatch,
 		HostFilterMode: "per-host",
+		DebounceWindow: "0s",
+		PrefetchMode:   prefetchModeSkip,
+		FragmentMode:   fragmentModeCount,
+		DataMode:       dataModeFull,
+		ConsentDefault: consentCookieless,
+
+		CountFeedRevalidations: false,
+		CaptureStatus:          false,
+		CaptureDuration:        false,
+
+		UniqStrategy: uniqStrategyCookie,
+		UniqHeader:   "",
+		UniqSalt:     "",
+
+		IPv6PrefixLength: 64,
+
+		ExcludeCookies: []string{excludeCookie},
 	}
 }
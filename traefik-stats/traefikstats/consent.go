@@ -0,0 +1,125 @@
+package traefikstats
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Consent levels, from most to least tracking. The level is recorded with
+// each event so reports can tell exact visitor counts from estimates.
+const (
+	// consentFull tracks as configured, cookie included.
+	consentFull = "full"
+	// consentCookieless neither reads nor sets the cookie; visitors are
+	// told apart by a daily salted hash of IP and User-Agent.
+	consentCookieless = "cookieless"
+	// consentNone keeps nothing that identifies the visitor.
+	consentNone = "none"
+)
+
+// TCF v2 purposes: storing information on the device, and measuring
+// content performance.
+const (
+	tcfPurposeStorage     = 1
+	tcfPurposeMeasurement = 8
+	// Bit offset of the PurposesConsent field in the core segment.
+	tcfPurposesOffset = 152
+)
+
+func normalizeConsentDefault(level string) (string, error) {
+	switch l := strings.ToLower(strings.TrimSpace(level)); l {
+	case "":
+		return consentCookieless, nil
+	case consentFull, consentCookieless, consentNone:
+		return l, nil
+	default:
+		return "", fmt.Errorf("unknown consentDefault %q", level)
+	}
+}
+
+// consentLevel reads the consent signal of a request: the consentHeader,
+// else the consentCookie. Empty when neither is configured; requests
+// without a readable signal get consentDefault.
+func (m *statsMiddleware) consentLevel(req *http.Request) string {
+	if m.cfg.ConsentHeader == "" && m.cfg.ConsentCookie == "" {
+		return ""
+	}
+	var value string
+	if m.cfg.ConsentHeader != "" {
+		value = req.Header.Get(m.cfg.ConsentHeader)
+	}
+	if value == "" && m.cfg.ConsentCookie != "" {
+		if cookie, err := req.Cookie(m.cfg.ConsentCookie); err == nil {
+			value = cookie.Value
+		}
+	}
+	if level := parseConsent(value); level != "" {
+		return level
+	}
+	return m.cfg.ConsentDefault
+}
+
+// parseConsent accepts a level name, as a custom consent banner would set
+// it, or an IAB TCF v2 TC string. Empty when it is neither.
+func parseConsent(value string) string {
+	value = strings.TrimSpace(value)
+	switch l := strings.ToLower(value); l {
+	case consentFull, consentCookieless, consentNone:
+		return l
+	}
+	return tcfConsentLevel(value)
+}
+
+// tcfConsentLevel grants full tracking with consent to both device storage
+// and measurement, cookieless tracking with measurement only, and none
+// otherwise.
+func tcfConsentLevel(tc string) string {
+	core, _, _ := strings.Cut(tc, ".")
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(core, "="))
+	if err != nil || len(raw)*8 < tcfPurposesOffset+24 {
+		return ""
+	}
+	bit := func(offset int) bool {
+		return raw[offset/8]&(0x80>>(offset%8)) != 0
+	}
+	// The first six bits are the version.
+	if raw[0]>>2 != 2 {
+		return ""
+	}
+	purpose := func(n int) bool { return bit(tcfPurposesOffset + n - 1) }
+	switch {
+	case purpose(tcfPurposeMeasurement) && purpose(tcfPurposeStorage):
+		return consentFull
+	case purpose(tcfPurposeMeasurement):
+		return consentCookieless
+	default:
+		return consentNone
+	}
+}
+
+// consentState is the visitor state for the cookieless and none levels,
+// which never touch the cookie.
+func (m *statsMiddleware) consentState(req *http.Request, level string, now time.Time) cookieState {
+	if level == consentNone {
+		return cookieState{consent: level}
+	}
+	day := now.UTC().Format("2006-01-02")
+	return cookieState{
+		uniq:    hashUUID(m.uniqSalt + day + m.ipResolver.visitorIP(req) + req.Header.Get("User-Agent")),
+		consent: level,
+	}
+}
+
+// anonymize strips an event of a visitor without consent down to what
+// minimize keeps, and gives every page view a uniq of its own. Feed readers
+// keep theirs, as it names the reader rather than a person.
+func (m *statsMiddleware) anonymize(evt *event) {
+	evt.Uniq = feedReaderUniq(evt.UserAgent, agentName(evt.UserAgent))
+	if evt.Uniq == "" {
+		evt.Uniq = hashUUID(evt.EventID)
+	}
+	m.minimize(evt)
+}
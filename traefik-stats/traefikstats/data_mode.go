@@ -0,0 +1,42 @@
+package traefikstats
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	dataModeFull    = "full"
+	dataModeMinimal = "minimal"
+)
+
+func normalizeDataMode(mode string) (string, error) {
+	switch m := strings.ToLower(strings.TrimSpace(mode)); m {
+	case "":
+		return dataModeFull, nil
+	case dataModeFull, dataModeMinimal:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown dataMode %q", mode)
+	}
+}
+
+// minimize replaces the visitor's address and User-Agent with what the
+// sidecar would have derived from them, so neither leaves the edge. Visitors
+// without a uniq yet get one from a daily salted hash instead of the
+// sidecar's unsalted one.
+func (m *statsMiddleware) minimize(evt *event) {
+	evt.Agent = agentName(evt.UserAgent)
+	evt.Type = agentType(evt.Path, evt.Agent, evt.UserAgent)
+	evt.OS = agentOS(evt.UserAgent)
+	evt.Mult = agentMultiplier(evt.UserAgent)
+	if evt.Uniq == "" {
+		evt.Uniq = feedReaderUniq(evt.UserAgent, evt.Agent)
+	}
+	if evt.Uniq == "" {
+		day := evt.Timestamp.UTC().Format("2006-01-02")
+		evt.Uniq = hashUUID(m.uniqSalt + day + evt.IP + evt.UserAgent)
+	}
+	evt.IP = ""
+	evt.UserAgent = ""
+}
@@ -0,0 +1,68 @@
+package traefikstats
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// debouncer drops repeat hits for the same visitor and page seen within a
+// window, so rapid reloads and prefetches count as a single visit.
+type debouncer struct {
+	window    time.Duration
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+func newDebouncer(window time.Duration) *debouncer {
+	if window <= 0 {
+		return nil
+	}
+	return &debouncer{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// allow reports whether a hit for key at now should be recorded. A nil
+// debouncer allows everything.
+func (d *debouncer) allow(key string, now time.Time) bool {
+	if d == nil {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.lastSweep) >= d.window {
+		for k, t := range d.seen {
+			if now.Sub(t) >= d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.lastSweep = now
+	}
+
+	if last, ok := d.seen[key]; ok && now.Sub(last) < d.window {
+		return false
+	}
+	d.seen[key] = now
+	return true
+}
+
+// allowVisit applies the debounce window to a page view. Second visits are
+// never debounced: they carry the cookie confirmation the sidecar needs to
+// attribute the first hit.
+func (m *statsMiddleware) allowVisit(req *http.Request, state cookieState) bool {
+	return state.secondVisit || m.debouncer.allow(m.debounceKey(req, state), m.clock.Now())
+}
+
+// debounceKey identifies a visitor+page. Visitors without a uniq yet (first
+// hit, no cookie) are keyed by IP and user agent instead.
+func (m *statsMiddleware) debounceKey(req *http.Request, state cookieState) string {
+	visitor := state.uniq
+	if visitor == "" {
+		visitor = m.ipResolver.visitorIP(req) + "|" + req.Header.Get("User-Agent")
+	}
+	return normalizeHost(req.Host) + "|" + req.URL.Path + "|" + visitor
+}
@@ -0,0 +1,135 @@
+package traefikstats
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// discoveryInterval is how long a discovered sidecar address is used before
+// it is looked up again.
+const discoveryInterval = 30 * time.Second
+
+// dockerDefaultPort is the sidecar port assumed by docker:// URLs without
+// one.
+const dockerDefaultPort = "7070"
+
+// sidecarResolver turns sidecarURL into the sidecar's base URL. Besides plain
+// http(s) URLs it accepts
+//
+//	srv://_banan-stats._tcp.example.internal   a DNS SRV record, over http
+//	srv+https://_banan-stats._tcp.example.internal
+//	docker://stats-sidecar:7070                a name from Docker's DNS
+//
+// Discovered addresses are re-resolved every discoveryInterval and after a
+// connection failure, so a redeployed sidecar with a new IP is picked up
+// without a Traefik config change.
+type sidecarResolver struct {
+	kind   string // "" for a plain URL, "srv" or "docker"
+	scheme string
+	name   string
+	port   string
+
+	mu         sync.Mutex
+	base       string
+	resolvedAt time.Time
+
+	lookupSRV  func(name string) ([]*net.SRV, error)
+	lookupHost func(host string) ([]string, error)
+}
+
+func newSidecarResolver(sidecarURL string) (*sidecarResolver, error) {
+	raw := strings.TrimRight(strings.TrimSpace(sidecarURL), "/")
+	if raw == "" {
+		return nil, fmt.Errorf("sidecarURL is empty")
+	}
+	r := &sidecarResolver{
+		lookupSRV:  lookupSRV,
+		lookupHost: net.LookupHost,
+	}
+	switch {
+	case strings.HasPrefix(raw, "srv://"):
+		r.kind, r.scheme, r.name = "srv", "http", strings.TrimPrefix(raw, "srv://")
+	case strings.HasPrefix(raw, "srv+https://"):
+		r.kind, r.scheme, r.name = "srv", "https", strings.TrimPrefix(raw, "srv+https://")
+	case strings.HasPrefix(raw, "docker://"):
+		r.kind, r.scheme = "docker", "http"
+		host := strings.TrimPrefix(raw, "docker://")
+		name, port, err := net.SplitHostPort(host)
+		if err != nil {
+			name, port = host, dockerDefaultPort
+		}
+		r.name, r.port = name, port
+	default:
+		r.base = raw
+		return r, nil
+	}
+	if r.name == "" {
+		return nil, fmt.Errorf("invalid sidecarURL %q", sidecarURL)
+	}
+	return r, nil
+}
+
+func lookupSRV(name string) ([]*net.SRV, error) {
+	_, addrs, err := net.LookupSRV("", "", name)
+	return addrs, err
+}
+
+// BaseURL returns the sidecar's base URL without a trailing slash. When a
+// lookup fails the previous address is kept until the next interval.
+func (r *sidecarResolver) BaseURL() (string, error) {
+	if r.kind == "" {
+		return r.base, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.base != "" && time.Since(r.resolvedAt) < discoveryInterval {
+		return r.base, nil
+	}
+	base, err := r.resolve()
+	if err != nil {
+		if r.base == "" {
+			return "", err
+		}
+		base = r.base
+	}
+	r.base, r.resolvedAt = base, time.Now()
+	return base, nil
+}
+
+// Invalidate makes the next BaseURL look the sidecar up again.
+func (r *sidecarResolver) Invalidate() {
+	if r.kind == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resolvedAt = time.Time{}
+}
+
+func (r *sidecarResolver) resolve() (string, error) {
+	if r.kind == "srv" {
+		// LookupSRV orders the records by priority and shuffles them by
+		// weight, so the first one is the pick.
+		addrs, err := r.lookupSRV(r.name)
+		if err != nil {
+			return "", fmt.Errorf("resolve %s: %w", r.name, err)
+		}
+		if len(addrs) == 0 {
+			return "", fmt.Errorf("no SRV records for %s", r.name)
+		}
+		target := strings.TrimSuffix(addrs[0].Target, ".")
+		return r.scheme + "://" + net.JoinHostPort(target, strconv.Itoa(int(addrs[0].Port))), nil
+	}
+	hosts, err := r.lookupHost(r.name)
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %w", r.name, err)
+	}
+	if len(hosts) == 0 {
+		return "", fmt.Errorf("no addresses for %s", r.name)
+	}
+	return r.scheme + "://" + net.JoinHostPort(hosts[0], r.port), nil
+}
@@ -1,8 +1,11 @@
+//go:build sqlite
+
 package traefikstats
 
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -10,13 +13,16 @@ import (
 	_ "modernc.org/sqlite"
 )
 
-type queuedEvent struct {
-	ID   int64
-	Event event
+const defaultBufferPath = "/tmp/banan-stats-buffer.sqlite"
+
+func openQueue(path string, maxEvents int, cipher *payloadCipher) (eventQueue, error) {
+	return newDiskQueue(path, maxEvents, cipher)
 }
 
 type diskQueue struct {
+	path      string
 	db        *sql.DB
+	cipher    *payloadCipher
 	notify    chan struct{}
 	maxEvents int
 	mu        sync.Mutex
@@ -24,7 +30,7 @@ type diskQueue struct {
 	count     int
 }
 
-func newDiskQueue(path string, maxEvents int) (*diskQueue, error) {
+func newDiskQueue(path string, maxEvents int, cipher *payloadCipher) (*diskQueue, error) {
 	if path == "" {
 		return nil, fmt.Errorf("buffer path is empty")
 	}
@@ -57,9 +63,15 @@ func newDiskQueue(path string, maxEvents int) (*diskQueue, error) {
 		_ = db.Close()
 		return nil, fmt.Errorf("count sqlite buffer: %w", err)
 	}
+	if err := checkBufferKey(db, path, cipher); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
 
 	q := &diskQueue{
+		path:      path,
 		db:        db,
+		cipher:    cipher,
 		notify:    make(chan struct{}, 1),
 		maxEvents: maxEvents,
 		count:     count,
@@ -68,6 +80,36 @@ func newDiskQueue(path string, maxEvents int) (*diskQueue, error) {
 	return q, nil
 }
 
+// checkBufferKey fails when the buffer holds events sealed with a key the
+// cipher does not have.
+func checkBufferKey(db *sql.DB, path string, cipher *payloadCipher) error {
+	rows, err := db.Query("SELECT payload FROM events WHERE payload LIKE ? ORDER BY id", sealedPrefix+"%")
+	if err != nil {
+		return fmt.Errorf("read sqlite buffer: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return fmt.Errorf("scan sqlite buffer: %w", err)
+		}
+		if _, err := cipher.open([]byte(payload)); errors.Is(err, errBufferKey) {
+			return bufferKeyError(path, err)
+		}
+	}
+	return rows.Err()
+}
+
+func (q *diskQueue) Notify() <-chan struct{} {
+	return q.notify
+}
+
+func (q *diskQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
 func (q *diskQueue) Close() error {
 	if q == nil || q.db == nil {
 		return nil
@@ -80,6 +122,10 @@ func (q *diskQueue) Enqueue(evt event) error {
 	if err != nil {
 		return fmt.Errorf("encode event: %w", err)
 	}
+	payload, err = q.cipher.seal(payload)
+	if err != nil {
+		return err
+	}
 
 	q.mu.Lock()
 	for q.maxEvents > 0 && q.count >= q.maxEvents {
@@ -121,7 +167,18 @@ func (q *diskQueue) FetchBatch(limit int) ([]queuedEvent, error) {
 			return nil, fmt.Errorf("scan batch: %w", err)
 		}
 		var evt event
-		if err := json.Unmarshal([]byte(payload), &evt); err != nil {
+		plain, err := q.cipher.open([]byte(payload))
+		if errors.Is(err, errBufferKey) {
+			// Stop before the row so it is neither deleted nor acked.
+			if len(out) == 0 {
+				return nil, bufferKeyError(q.path, err)
+			}
+			break
+		}
+		if err == nil {
+			err = json.Unmarshal(plain, &evt)
+		}
+		if err != nil {
 			log.Printf("stats buffer: invalid payload id=%d: %v", id, err)
 			if _, delErr := q.db.Exec("DELETE FROM events WHERE id = ?", id); delErr != nil {
 				log.Printf("stats buffer: failed to delete bad payload id=%d: %v", id, delErr)
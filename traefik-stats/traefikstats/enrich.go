@@ -0,0 +1,106 @@
+package traefikstats
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// An Enricher adds custom fields to an event before it is buffered. The
+// sidecar stores them as a JSON object in the event's extra column.
+type Enricher interface {
+	Enrich(req *http.Request, extra map[string]string)
+}
+
+// EnricherFunc adapts a function to the Enricher interface.
+type EnricherFunc func(req *http.Request, extra map[string]string)
+
+func (f EnricherFunc) Enrich(req *http.Request, extra map[string]string) {
+	f(req, extra)
+}
+
+var (
+	enrichersMu sync.RWMutex
+	enrichers   = map[string]Enricher{}
+)
+
+// RegisterEnricher makes an Enricher available under name, usually from an
+// init function in a build that links extra code into the plugin. Instances
+// only run the enrichers listed in their enrichers setting.
+func RegisterEnricher(name string, e Enricher) {
+	enrichersMu.Lock()
+	defer enrichersMu.Unlock()
+	enrichers[name] = e
+}
+
+// headerCapture copies one request header into an extra field.
+type headerCapture struct {
+	header string
+	field  string
+}
+
+// parseCaptureHeaders reads captureHeaders entries of the form "Header" or
+// "Header=field". Without a field name the lowercased header name is used.
+func parseCaptureHeaders(entries []string) ([]headerCapture, error) {
+	var captures []headerCapture
+	for _, entry := range entries {
+		header, field, _ := strings.Cut(entry, "=")
+		header = strings.TrimSpace(header)
+		field = strings.TrimSpace(field)
+		if header == "" {
+			return nil, fmt.Errorf("invalid captureHeaders entry %q", entry)
+		}
+		if field == "" {
+			field = strings.ToLower(header)
+		}
+		captures = append(captures, headerCapture{header: http.CanonicalHeaderKey(header), field: field})
+	}
+	return captures, nil
+}
+
+func lookupEnrichers(names []string) ([]Enricher, error) {
+	enrichersMu.RLock()
+	defer enrichersMu.RUnlock()
+	var list []Enricher
+	for _, name := range names {
+		e, ok := enrichers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown enricher %q (registered: %s)", name, strings.Join(registeredEnricherNames(), ", "))
+		}
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+func registeredEnricherNames() []string {
+	names := make([]string, 0, len(enrichers))
+	for name := range enrichers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// extraFields collects the captured headers and the enrichers' fields for
+// req. It returns nil when there is nothing to add, so the field is left out
+// of the event.
+func (m *statsMiddleware) extraFields(req *http.Request) map[string]string {
+	if len(m.captures) == 0 && len(m.enrichers) == 0 {
+		return nil
+	}
+	extra := map[string]string{}
+	for _, c := range m.captures {
+		if val := req.Header.Get(c.header); val != "" {
+			extra[c.field] = val
+		}
+	}
+	for _, e := range m.enrichers {
+		e.Enrich(req, extra)
+	}
+	if len(extra) == 0 {
+		return nil
+	}
+	return extra
+}
@@ -0,0 +1,101 @@
+package traefikstats
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+)
+
+// excludeCookie is set by the dashboard's "Exclude this browser" toggle and
+// by DashboardPath+"/exclude".
+const excludeCookie = "stats_exclude"
+
+// excludeCookieMaxAge is ten years, the longest lifetime browsers reliably
+// keep.
+const excludeCookieMaxAge = 315360000
+
+type headerMatch struct {
+	header string
+	// value, when set, must equal the header's value; otherwise any
+	// non-empty value matches.
+	value string
+}
+
+// exclusions recognizes the site owners' own traffic, e.g. requests that a
+// ForwardAuth middleware marked as authenticated, so it is not recorded.
+type exclusions struct {
+	headers []headerMatch
+	cookies []string
+}
+
+// parseExclusions reads excludeHeaders entries of the form "Header" or
+// "Header: value" and excludeCookies cookie names.
+func parseExclusions(headers, cookies []string) (exclusions, error) {
+	var ex exclusions
+	for _, entry := range headers {
+		header, value, _ := strings.Cut(entry, ":")
+		header = strings.TrimSpace(header)
+		if header == "" {
+			return exclusions{}, fmt.Errorf("invalid excludeHeaders entry %q", entry)
+		}
+		ex.headers = append(ex.headers, headerMatch{header: http.CanonicalHeaderKey(header), value: strings.TrimSpace(value)})
+	}
+	for _, name := range cookies {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return exclusions{}, fmt.Errorf("invalid excludeCookies entry %q", name)
+		}
+		ex.cookies = append(ex.cookies, name)
+	}
+	return ex, nil
+}
+
+func (ex exclusions) match(req *http.Request) bool {
+	for _, h := range ex.headers {
+		val := req.Header.Get(h.header)
+		if val != "" && (h.value == "" || val == h.value) {
+			return true
+		}
+	}
+	for _, name := range ex.cookies {
+		if c, err := req.Cookie(name); err == nil && c.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *statsMiddleware) isExcludeRequest(req *http.Request) bool {
+	return m.cfg.DashboardPath != "" && req.URL.Path == strings.TrimSuffix(m.cfg.DashboardPath, "/")+"/exclude"
+}
+
+// serveExclude sets the exclusion cookie on the browser that opens it, or
+// clears it with ?undo. It needs no dashboardToken: it only affects the
+// caller, and owners can send the link to everyone who works on the site.
+func (m *statsMiddleware) serveExclude(rw http.ResponseWriter, req *http.Request) {
+	_, undo := req.URL.Query()["undo"]
+	c := &http.Cookie{
+		Name:     excludeCookie,
+		Value:    "1",
+		Path:     "/",
+		Domain:   m.cfg.CookieDomain,
+		MaxAge:   excludeCookieMaxAge,
+		Secure:   m.cfg.CookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	host := html.EscapeString(req.Host)
+	if m.cfg.CookieDomain != "" {
+		host = html.EscapeString(m.cfg.CookieDomain)
+	}
+	msg := fmt.Sprintf("Visits from this browser to %s are no longer recorded. <a href=\"?undo\">Undo</a>", host)
+	if undo {
+		c.Value, c.MaxAge = "", -1
+		msg = fmt.Sprintf("Visits from this browser to %s are recorded again. <a href=\"?\">Exclude it</a>", host)
+	}
+	rw.Header().Add("Set-Cookie", c.String())
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	_, _ = fmt.Fprintf(rw, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>Stats</title></head><body><p>%s</p></body></html>\n", msg)
+}
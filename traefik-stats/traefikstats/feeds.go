@@ -0,0 +1,52 @@
+package traefikstats
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+func isFeedContentType(contentType string) bool {
+	ct := strings.ToLower(contentType)
+	return strings.HasPrefix(ct, "application/atom+xml") ||
+		strings.HasPrefix(ct, "application/rss+xml")
+}
+
+// looksLikeFeedPath is used for 304 responses, which usually carry no
+// Content-Type.
+func looksLikeFeedPath(p string) bool {
+	p = strings.ToLower(strings.TrimSuffix(p, "/"))
+	switch path.Ext(p) {
+	case ".xml", ".rss", ".atom":
+		return true
+	}
+	base := path.Base(p)
+	return base == "feed" || base == "rss" || base == "atom"
+}
+
+// feedRevalidation returns the content type to record when the request is a
+// HEAD or conditional GET of a feed, and reports whether it should be counted.
+func (m *statsMiddleware) feedRevalidation(req *http.Request, status int, contentType string) (string, bool) {
+	if !m.cfg.CountFeedRevalidations {
+		return "", false
+	}
+	switch {
+	case req.Method == http.MethodHead && status == http.StatusOK:
+	case status == http.StatusNotModified:
+	default:
+		return "", false
+	}
+	if isFeedContentType(contentType) {
+		return contentType, true
+	}
+	if contentType == "" && looksLikeFeedPath(req.URL.Path) {
+		return "application/rss+xml", true
+	}
+	return "", false
+}
+
+// feedRevalidationKey dedupes revalidations per visitor, feed and UTC day.
+func (m *statsMiddleware) feedRevalidationKey(req *http.Request, state cookieState, now time.Time) string {
+	return now.UTC().Format("2006-01-02") + "|" + m.debounceKey(req, state)
+}
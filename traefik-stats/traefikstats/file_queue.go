@@ -0,0 +1,303 @@
+//go:build !sqlite
+
+package traefikstats
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultBufferPath = "/tmp/banan-stats-buffer.ndjson"
+
+// legacyBufferPath is the default buffer of the sqlite queue, which earlier
+// releases built without tags. This queue cannot read it.
+const legacyBufferPath = "/tmp/banan-stats-buffer.sqlite"
+
+// compactThreshold is how many sent bytes may pile up at the head of the
+// buffer file before it is rewritten without them. A drained buffer is
+// truncated right away.
+const compactThreshold = 4 << 20
+
+func openQueue(path string, maxEvents int, cipher *payloadCipher) (eventQueue, error) {
+	if path == defaultBufferPath {
+		warnLegacyBuffer(legacyBufferPath)
+	}
+	return newFileQueue(path, maxEvents, cipher)
+}
+
+// fileQueue appends events as JSON lines to a file and keeps the offset of
+// the first unsent line in a sidecar ".offset" file. An event's ID is the
+// offset just past its line plus base, the bytes truncated or compacted
+// away before the file's start, so IDs keep increasing when the file is
+// rewritten.
+type fileQueue struct {
+	path      string
+	file      *os.File
+	cipher    *payloadCipher
+	offset    int64
+	size      int64
+	base      int64
+	notify    chan struct{}
+	maxEvents int
+	mu        sync.Mutex
+	cond      *sync.Cond
+	count     int
+}
+
+func newFileQueue(path string, maxEvents int, cipher *payloadCipher) (*fileQueue, error) {
+	if path == "" {
+		return nil, fmt.Errorf("buffer path is empty")
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open buffer: %w", err)
+	}
+	q := &fileQueue{
+		path:      path,
+		file:      file,
+		cipher:    cipher,
+		notify:    make(chan struct{}, 1),
+		maxEvents: maxEvents,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	if err := q.load(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// load restores the offset and count, dropping a partial last line left by
+// a crash mid-write. It fails when unsent events were sealed with a key the
+// cipher does not have.
+func (q *fileQueue) load() error {
+	data, err := io.ReadAll(q.file)
+	if err != nil {
+		return fmt.Errorf("read buffer: %w", err)
+	}
+	end := int64(bytes.LastIndexByte(data, '\n') + 1)
+	if end < int64(len(data)) {
+		if err := q.file.Truncate(end); err != nil {
+			return fmt.Errorf("truncate buffer: %w", err)
+		}
+	}
+	q.size = end
+
+	// "<offset> <base>"; buffers written before base existed hold only the
+	// offset.
+	if raw, err := os.ReadFile(q.offsetPath()); err == nil {
+		fields := strings.Fields(string(raw))
+		if len(fields) > 0 {
+			q.offset, _ = strconv.ParseInt(fields[0], 10, 64)
+		}
+		if len(fields) > 1 {
+			q.base, _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	if q.offset < 0 || q.offset > q.size {
+		q.offset = 0
+	}
+	if q.base < 0 {
+		q.base = 0
+	}
+	q.count = bytes.Count(data[q.offset:end], []byte{'\n'})
+	for _, line := range bytes.SplitAfter(data[q.offset:end], []byte{'\n'}) {
+		if _, err := q.cipher.open(line); errors.Is(err, errBufferKey) {
+			return bufferKeyError(q.path, err)
+		}
+	}
+	return nil
+}
+
+func (q *fileQueue) offsetPath() string {
+	return q.path + ".offset"
+}
+
+func (q *fileQueue) Notify() <-chan struct{} {
+	return q.notify
+}
+
+func (q *fileQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+func (q *fileQueue) Close() error {
+	if q == nil || q.file == nil {
+		return nil
+	}
+	return q.file.Close()
+}
+
+func (q *fileQueue) Enqueue(evt event) error {
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+	payload, err = q.cipher.seal(payload)
+	if err != nil {
+		return err
+	}
+	payload = append(payload, '\n')
+
+	q.mu.Lock()
+	for q.maxEvents > 0 && q.count >= q.maxEvents {
+		q.cond.Wait()
+	}
+	n, err := q.file.WriteAt(payload, q.size)
+	if err != nil {
+		// Leave the file as it was so a short write can't glue two lines.
+		_ = q.file.Truncate(q.size)
+		q.mu.Unlock()
+		return fmt.Errorf("append event: %w", err)
+	}
+	q.size += int64(n)
+	q.count++
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *fileQueue) FetchBatch(limit int) ([]queuedEvent, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	reader := bufio.NewReader(io.NewSectionReader(q.file, q.offset, q.size-q.offset))
+	pos := q.offset
+	skip := int64(0)
+	var out []queuedEvent
+	for len(out) < limit {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read batch: %w", err)
+		}
+		pos += int64(len(line))
+		var evt event
+		payload, err := q.cipher.open(line)
+		if errors.Is(err, errBufferKey) {
+			// Stop before the line so it is neither skipped nor acked.
+			if len(out) == 0 {
+				return nil, bufferKeyError(q.path, err)
+			}
+			break
+		}
+		if err == nil {
+			err = json.Unmarshal(payload, &evt)
+		}
+		if err != nil {
+			log.Printf("stats buffer: invalid payload at offset %d: %v", pos-int64(len(line)), err)
+			skip = pos
+			continue
+		}
+		out = append(out, queuedEvent{ID: q.base + pos, Event: evt})
+	}
+	// Deleting a later event drops bad lines before it; without one, drop
+	// them now so they don't block the queue.
+	if len(out) == 0 && skip > 0 {
+		if err := q.advance(skip); err != nil {
+			log.Printf("stats buffer: failed to skip bad payload: %v", err)
+		}
+	}
+	return out, nil
+}
+
+func (q *fileQueue) DeleteUpTo(lastID int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pos := lastID - q.base
+	if pos <= q.offset {
+		return nil
+	}
+	if pos > q.size {
+		pos = q.size
+	}
+	return q.advance(pos)
+}
+
+// advance marks everything before pos as sent. Callers hold q.mu.
+func (q *fileQueue) advance(pos int64) error {
+	sent := make([]byte, pos-q.offset)
+	if _, err := q.file.ReadAt(sent, q.offset); err != nil {
+		return fmt.Errorf("read sent events: %w", err)
+	}
+	q.count -= bytes.Count(sent, []byte{'\n'})
+	if q.count < 0 {
+		q.count = 0
+	}
+	q.offset = pos
+	q.cond.Broadcast()
+
+	switch {
+	case q.offset == q.size:
+		if err := q.file.Truncate(0); err != nil {
+			return fmt.Errorf("truncate buffer: %w", err)
+		}
+		q.base += q.size
+		q.offset, q.size = 0, 0
+	case q.offset >= compactThreshold:
+		if err := q.compact(); err != nil {
+			return err
+		}
+	}
+	return q.writeOffset()
+}
+
+// compact rewrites the buffer without the lines before the offset.
+func (q *fileQueue) compact() error {
+	tail := make([]byte, q.size-q.offset)
+	if _, err := q.file.ReadAt(tail, q.offset); err != nil {
+		return fmt.Errorf("read buffer tail: %w", err)
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, tail, 0o600); err != nil {
+		return fmt.Errorf("write compacted buffer: %w", err)
+	}
+	// The offset file must not point past the new, shorter buffer.
+	base := q.base + q.offset
+	if err := os.WriteFile(q.offsetPath(), []byte("0 "+strconv.FormatInt(base, 10)), 0o600); err != nil {
+		return fmt.Errorf("write buffer offset: %w", err)
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return fmt.Errorf("replace buffer: %w", err)
+	}
+	file, err := os.OpenFile(q.path, os.O_RDWR, 0o600)
+	if err != nil {
+		return fmt.Errorf("reopen buffer: %w", err)
+	}
+	_ = q.file.Close()
+	q.file = file
+	q.base = base
+	q.offset, q.size = 0, int64(len(tail))
+	return nil
+}
+
+func (q *fileQueue) writeOffset() error {
+	tmp := q.offsetPath() + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(q.offset, 10)+" "+strconv.FormatInt(q.base, 10)), 0o600); err != nil {
+		return fmt.Errorf("write buffer offset: %w", err)
+	}
+	if err := os.Rename(tmp, q.offsetPath()); err != nil {
+		return fmt.Errorf("write buffer offset: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+package traefikstats
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// sharedQueues holds the open buffers by path. Every middleware instance
+// with the same bufferPath (one per router, and the instances a Traefik
+// reload builds before the old ones are shut down) shares one queue and one
+// flusher instead of opening the file twice; the last instance to let go
+// stops the flusher and closes the buffer.
+var (
+	sharedQueuesMu sync.Mutex
+	sharedQueues   = map[string]*sharedQueue{}
+)
+
+type sharedQueue struct {
+	eventQueue
+	path    string
+	refs    int
+	flusher *flusher
+}
+
+// flushOptions configure the flusher. Only the instance that opens a buffer
+// sets them; later instances sharing it get a warning if theirs differ.
+type flushOptions struct {
+	name       string
+	sidecarURL string
+	interval   time.Duration
+	batchSize  int
+	// stream keeps one /ingest/stream connection open instead of posting
+	// each batch.
+	stream bool
+	// ingestSecret signs every event line for the sidecar to verify.
+	ingestSecret string
+	// clock is the middleware's, for ticks, backoff and the status times.
+	clock clock
+}
+
+// acquireQueue opens the buffer at path and starts its flusher, or returns
+// the one already open. maxEvents only applies when the buffer is opened.
+func acquireQueue(path string, maxEvents int, cipher *payloadCipher, opts flushOptions) (*sharedQueue, error) {
+	sharedQueuesMu.Lock()
+	defer sharedQueuesMu.Unlock()
+	if q, ok := sharedQueues[path]; ok {
+		if q.flusher.opts.sidecarURL != opts.sidecarURL || q.flusher.opts.interval != opts.interval ||
+			q.flusher.opts.batchSize != opts.batchSize || q.flusher.opts.stream != opts.stream ||
+			q.flusher.opts.ingestSecret != opts.ingestSecret {
+			log.Printf("[%s] buffer %s is shared with %s; using its sidecarURL, flushInterval, batchSize, ingestMode and ingestSecret",
+				opts.name, path, q.flusher.opts.name)
+		}
+		q.refs++
+		return q, nil
+	}
+	client, err := newStreamClient(opts.sidecarURL, opts.ingestSecret, opts.clock)
+	if err != nil {
+		return nil, err
+	}
+	queue, err := openQueue(path, maxEvents, cipher)
+	if err != nil {
+		return nil, err
+	}
+	q := &sharedQueue{eventQueue: queue, path: path, refs: 1}
+	q.flusher = &flusher{
+		opts:         opts,
+		queue:        queue,
+		streamClient: client,
+		clock:        opts.clock,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go q.flusher.run()
+	sharedQueues[path] = q
+	return q, nil
+}
+
+// release drops one reference. After the last it stops the flusher, sends
+// what is still buffered within shutdownWait and closes the buffer; events
+// that could not be sent stay on disk.
+func (q *sharedQueue) release(shutdownWait time.Duration) error {
+	sharedQueuesMu.Lock()
+	q.refs--
+	if q.refs > 0 {
+		sharedQueuesMu.Unlock()
+		return nil
+	}
+	delete(sharedQueues, q.path)
+	sharedQueuesMu.Unlock()
+
+	close(q.flusher.stop)
+	// Unacked stream events are still buffered and go out with the batches
+	// below.
+	q.flusher.abortSession()
+	<-q.flusher.done
+	if shutdownWait > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownWait)
+		_ = q.flusher.sendBuffered(ctx)
+		cancel()
+	}
+	return q.eventQueue.Close()
+}
+
+// flusher streams a buffer to the sidecar on every enqueue and flush
+// interval, backing off while the sidecar fails.
+type flusher struct {
+	opts         flushOptions
+	queue        eventQueue
+	streamClient *streamClient
+	clock        clock
+	stop         chan struct{}
+	done         chan struct{}
+	// backoff, nextAttempt and the status fields below are written by the
+	// flusher goroutine under statusMu, so the status endpoint can read them.
+	statusMu    sync.Mutex
+	backoff     time.Duration
+	nextAttempt time.Time
+	paused      bool
+	lastFlush   time.Time
+	lastErr     string
+	lastErrAt   time.Time
+	// session is only replaced by the flusher goroutine, under sessionMu so
+	// release can abort a write blocked on a stalled sidecar.
+	sessionMu sync.Mutex
+	session   *ingestSession
+}
+
+// maxInFlightBatches bounds how many batches a session may have written
+// without an ack before the flusher waits.
+const maxInFlightBatches = 10
+
+func (f *flusher) run() {
+	defer close(f.done)
+	ticker := f.clock.NewTicker(f.opts.interval)
+	defer ticker.Stop()
+	notify := f.queue.Notify()
+
+	for {
+		var acks <-chan sessionAck
+		if f.session != nil {
+			acks = f.session.acks
+		}
+		select {
+		case <-f.stop:
+			f.dropSession()
+			return
+		case <-ticker.Chan():
+			f.flush()
+			f.keepAlive()
+		case <-notify:
+			f.flush()
+		case ack, ok := <-acks:
+			f.handleAck(ack, ok)
+		}
+	}
+}
+
+func (f *flusher) flush() {
+	now := f.clock.Now()
+	if !f.nextAttempt.IsZero() && now.Before(f.nextAttempt) {
+		return
+	}
+	send := f.sendBuffered
+	if f.opts.stream {
+		send = f.streamBuffered
+	}
+	if err := send(context.Background()); err != nil {
+		f.noteError(err)
+		var busy *retryAfterError
+		if errors.As(err, &busy) {
+			f.pause(busy.wait)
+			return
+		}
+		f.scheduleBackoff()
+		return
+	}
+	f.statusMu.Lock()
+	f.backoff = 0
+	f.nextAttempt = time.Time{}
+	f.paused = false
+	f.statusMu.Unlock()
+}
+
+// streamBuffered writes the events not yet sent to the open session,
+// opening one first if needed. They are deleted from the buffer as acks
+// arrive.
+func (f *flusher) streamBuffered(ctx context.Context) error {
+	if f.session == nil {
+		session, err := f.streamClient.OpenSession()
+		if err != nil {
+			log.Printf("[%s] stats stream open failed: %v", f.opts.name, err)
+			return err
+		}
+		f.sessionMu.Lock()
+		f.session = session
+		f.sessionMu.Unlock()
+	}
+	for len(f.session.pending) < maxInFlightBatches*f.opts.batchSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch, err := f.queue.FetchBatch(len(f.session.pending) + f.opts.batchSize)
+		if err != nil {
+			log.Printf("[%s] stats buffer read failed: %v", f.opts.name, err)
+			return nil
+		}
+		var unsent []queuedEvent
+		for _, item := range batch {
+			if item.ID > f.session.sentUpTo {
+				unsent = append(unsent, item)
+			}
+		}
+		if len(unsent) == 0 {
+			return nil
+		}
+		if err := f.session.Send(unsent); err != nil {
+			log.Printf("[%s] stats stream failed: %v", f.opts.name, err)
+			f.dropSession()
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *flusher) handleAck(ack sessionAck, ok bool) {
+	if !ok {
+		log.Printf("[%s] stats stream closed: %v", f.opts.name, f.session.err)
+		f.noteError(f.session.err)
+		f.dropSession()
+		f.scheduleBackoff()
+		return
+	}
+	lastID, err := f.session.Acked(ack)
+	if err != nil {
+		log.Printf("[%s] stats stream out of sync: %v", f.opts.name, err)
+		f.noteError(err)
+		f.dropSession()
+		f.scheduleBackoff()
+		return
+	}
+	if err := f.queue.DeleteUpTo(lastID); err != nil {
+		log.Printf("[%s] stats buffer delete failed: %v", f.opts.name, err)
+	}
+	f.noteFlushed()
+	if ack.Drain > 0 {
+		f.dropSession()
+		f.pause(time.Duration(ack.Drain) * time.Second)
+		return
+	}
+	// Room in the window may let more buffered events through.
+	f.flush()
+}
+
+func (f *flusher) keepAlive() {
+	if f.session == nil || f.clock.Now().Sub(f.session.lastWrite) < f.opts.interval {
+		return
+	}
+	if err := f.session.KeepAlive(); err != nil {
+		log.Printf("[%s] stats stream failed: %v", f.opts.name, err)
+		f.dropSession()
+		f.scheduleBackoff()
+	}
+}
+
+func (f *flusher) dropSession() {
+	f.sessionMu.Lock()
+	defer f.sessionMu.Unlock()
+	if f.session != nil {
+		f.session.Close()
+		f.session = nil
+	}
+}
+
+// abortSession closes the open session without clearing it, for use from
+// outside the flusher goroutine.
+func (f *flusher) abortSession() {
+	f.sessionMu.Lock()
+	defer f.sessionMu.Unlock()
+	if f.session != nil {
+		f.session.Close()
+	}
+}
+
+// sendBuffered streams batches until the buffer is empty, a batch fails or
+// ctx is done.
+func (f *flusher) sendBuffered(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch, err := f.queue.FetchBatch(f.opts.batchSize)
+		if err != nil {
+			log.Printf("[%s] stats buffer read failed: %v", f.opts.name, err)
+			return nil
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		events := make([]event, 0, len(batch))
+		lastID := batch[len(batch)-1].ID
+		for _, item := range batch {
+			events = append(events, item.Event)
+		}
+
+		batchCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err = f.streamClient.StreamEvents(batchCtx, events)
+		cancel()
+		if err != nil {
+			log.Printf("[%s] stats stream failed: %v", f.opts.name, err)
+			return err
+		}
+		f.noteFlushed()
+		if err := f.queue.DeleteUpTo(lastID); err != nil {
+			log.Printf("[%s] stats buffer delete failed: %v", f.opts.name, err)
+			return err
+		}
+	}
+}
+
+// pause holds sends for as long as the sidecar asked, leaving the
+// exponential backoff where it was.
+func (f *flusher) pause(wait time.Duration) {
+	log.Printf("[%s] sidecar busy, pausing for %s", f.opts.name, wait)
+	f.statusMu.Lock()
+	defer f.statusMu.Unlock()
+	f.nextAttempt = f.clock.Now().Add(wait)
+	f.paused = true
+}
+
+func (f *flusher) scheduleBackoff() {
+	f.statusMu.Lock()
+	defer f.statusMu.Unlock()
+	if f.backoff <= 0 {
+		f.backoff = 500 * time.Millisecond
+	} else {
+		f.backoff *= 2
+		if f.backoff > 10*time.Second {
+			f.backoff = 10 * time.Second
+		}
+	}
+	f.nextAttempt = f.clock.Now().Add(f.backoff)
+	f.paused = false
+}
+
+// noteFlushed records that events reached the sidecar.
+func (f *flusher) noteFlushed() {
+	f.statusMu.Lock()
+	defer f.statusMu.Unlock()
+	f.lastFlush = f.clock.Now()
+}
+
+func (f *flusher) noteError(err error) {
+	if err == nil {
+		return
+	}
+	f.statusMu.Lock()
+	defer f.statusMu.Unlock()
+	f.lastErr = err.Error()
+	f.lastErrAt = f.clock.Now()
+}
@@ -0,0 +1,49 @@
+package traefikstats
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	fragmentModeCount = "count"
+	fragmentModeSkip  = "skip"
+	fragmentModeTag   = "tag"
+)
+
+func normalizeFragmentMode(mode string) (string, error) {
+	switch m := strings.ToLower(strings.TrimSpace(mode)); m {
+	case "":
+		return fragmentModeCount, nil
+	case fragmentModeCount, fragmentModeSkip, fragmentModeTag:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown fragmentMode %q", mode)
+	}
+}
+
+// isFragment reports whether the request was made by a script (fetch, XHR,
+// htmx, Turbo Frames) for a piece of a page rather than by the browser
+// navigating to one. Clients that send none of these headers, such as most
+// bots, count as navigations.
+func isFragment(req *http.Request) bool {
+	h := req.Header
+	switch {
+	case h.Get("HX-Boosted") != "":
+		// hx-boost swaps in whole pages behind links.
+		return false
+	case h.Get("HX-Request") != "", h.Get("Turbo-Frame") != "":
+		return true
+	case strings.EqualFold(h.Get("X-Requested-With"), "XMLHttpRequest"):
+		return true
+	}
+	switch dest := strings.ToLower(h.Get("Sec-Fetch-Dest")); dest {
+	case "", "document", "iframe", "frame":
+		return false
+	default:
+		// Turbo Drive and similar libraries fetch whole pages and ask for
+		// them with a browser's Accept header; fetch() sends */*.
+		return !strings.Contains(strings.ToLower(h.Get("Accept")), "application/xhtml+xml")
+	}
+}
@@ -12,7 +12,9 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,16 +23,35 @@ type statsMiddleware struct {
 	next          http.Handler
 	cfg           *Config
 	client        *http.Client
+	liveClient    *http.Client
+	sidecar       *sidecarResolver
 	streamClient  *streamClient
-	queue         *diskQueue
+	queue         *sharedQueue
 	stop          chan struct{}
-	flushInterval time.Duration
-	batchSize     int
-	backoff       time.Duration
-	nextAttempt   time.Time
+	closeOnce     sync.Once
+	closeErr      error
+	shutdownWait  time.Duration
+	uniqSalt      string
+	ipResolver    *ipResolver
+	debouncer     *debouncer
+	feedDebouncer *debouncer
+	captures      []headerCapture
+	enrichers     []Enricher
+	exclusions    exclusions
+	clock         clock
+	started       time.Time
 }
 
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
+	m, err := newMiddleware(ctx, next, config, name, systemClock{})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// newMiddleware is New reading the time from clk, which tests replace.
+func newMiddleware(ctx context.Context, next http.Handler, config *Config, name string, clk clock) (*statsMiddleware, error) {
 	if config == nil {
 		return nil, errors.New("config is required")
 	}
@@ -48,15 +69,96 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 		config.BatchSize = 100
 	}
 	if strings.TrimSpace(config.BufferPath) == "" {
-		config.BufferPath = "/tmp/banan-stats-buffer.sqlite"
+		config.BufferPath = defaultBufferPath
+	}
+	config.UniqStrategy, err = normalizeUniqStrategy(config)
+	if err != nil {
+		return nil, err
+	}
+	config.PrefetchMode, err = normalizePrefetchMode(config.PrefetchMode)
+	if err != nil {
+		return nil, err
+	}
+	config.FragmentMode, err = normalizeFragmentMode(config.FragmentMode)
+	if err != nil {
+		return nil, err
+	}
+	config.DataMode, err = normalizeDataMode(config.DataMode)
+	if err != nil {
+		return nil, err
+	}
+	config.ConsentDefault, err = normalizeConsentDefault(config.ConsentDefault)
+	if err != nil {
+		return nil, err
+	}
+	config.IngestMode, err = normalizeIngestMode(config.IngestMode)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(config.Source) == "" {
+		// Each Traefik node labels its events so the sidecar can tell
+		// whether one of them stopped reporting.
+		config.Source, _ = os.Hostname()
+	}
+	if config.UniqSalt == "" {
+		if use := saltedUniqUse(config); use != "" {
+			return nil, fmt.Errorf("uniqSalt is required for %s", use)
+		}
+	}
+
+	var debounceWindow time.Duration
+	if strings.TrimSpace(config.DebounceWindow) != "" {
+		debounceWindow, err = time.ParseDuration(config.DebounceWindow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid debounceWindow: %w", err)
+		}
+	}
+
+	var shutdownWait time.Duration
+	if strings.TrimSpace(config.ShutdownTimeout) != "" {
+		shutdownWait, err = time.ParseDuration(config.ShutdownTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shutdownTimeout: %w", err)
+		}
+	}
+
+	ipResolver, err := newIPResolver(config.TrustedProxies, config.IPv6PrefixLength)
+	if err != nil {
+		return nil, err
+	}
+
+	sidecar, err := newSidecarResolver(config.SidecarURL)
+	if err != nil {
+		return nil, err
 	}
 
-	streamClient, err := newStreamClient(config.SidecarURL)
+	captures, err := parseCaptureHeaders(config.CaptureHeaders)
+	if err != nil {
+		return nil, err
+	}
+	enrichers, err := lookupEnrichers(config.Enrichers)
+	if err != nil {
+		return nil, err
+	}
+	exclusions, err := parseExclusions(config.ExcludeHeaders, config.ExcludeCookies)
 	if err != nil {
-		return nil, fmt.Errorf("stream client init failed: %w", err)
+		return nil, err
 	}
 
-	queue, err := newDiskQueue(config.BufferPath, config.BufferMaxEvents)
+	bufferCipher, err := loadBufferKey(config.BufferKeyFile, config.BufferKeyEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	queue, err := acquireQueue(config.BufferPath, config.BufferMaxEvents, bufferCipher, flushOptions{
+		name:         name,
+		sidecarURL:   config.SidecarURL,
+		interval:     flushInterval,
+		batchSize:    config.BatchSize,
+		stream:       config.IngestMode == ingestModeStream,
+		ingestSecret: config.IngestSecret,
+		clock:        clk,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("buffer init failed: %w", err)
 	}
@@ -66,44 +168,108 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 		next:          next,
 		cfg:           config,
 		client:        &http.Client{Timeout: 5 * time.Second},
-		streamClient:  streamClient,
+		liveClient:    &http.Client{},
+		sidecar:       sidecar,
+		streamClient:  queue.flusher.streamClient,
 		queue:         queue,
 		stop:          make(chan struct{}),
-		flushInterval: flushInterval,
-		batchSize:     config.BatchSize,
-	}
-	go m.worker(ctx)
+		shutdownWait:  shutdownWait,
+		uniqSalt:      config.UniqSalt,
+		ipResolver:    ipResolver,
+		debouncer:     newDebouncer(debounceWindow),
+		feedDebouncer: newDebouncer(24 * time.Hour),
+		captures:      captures,
+		enrichers:     enrichers,
+		exclusions:    exclusions,
+		clock:         clk,
+		started:       clk.Now(),
+	}
+	go func() {
+		// Traefik cancels the context when a reload replaces this
+		// middleware; nothing else will call Close.
+		select {
+		case <-ctx.Done():
+			_ = m.Close()
+		case <-m.stop:
+		}
+	}()
 	return m, nil
 }
 
 func (m *statsMiddleware) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if m.isExcludeRequest(req) {
+		m.serveExclude(rw, req)
+		return
+	}
 	if m.isDashboardRequest(req) {
+		if !m.authorized(req) {
+			rw.WriteHeader(http.StatusUnauthorized)
+			_, _ = rw.Write([]byte("Unauthorized"))
+			return
+		}
+		if m.isStatusRequest(req) {
+			m.serveStatus(rw)
+			return
+		}
 		m.proxyDashboard(rw, req)
 		return
 	}
 
+	if m.exclusions.match(req) {
+		m.next.ServeHTTP(rw, req)
+		return
+	}
+
+	// Speculative loads are passed through untouched, without issuing or
+	// upgrading the visitor cookie.
+	prefetch := m.cfg.PrefetchMode != prefetchModeCount && isPrefetch(req)
+	if prefetch && m.cfg.PrefetchMode == prefetchModeSkip {
+		m.next.ServeHTTP(rw, req)
+		return
+	}
+	// Likewise for HTML fragments fetched by scripts (htmx, Turbo Frames).
+	fragment := m.cfg.FragmentMode != fragmentModeCount && isFragment(req)
+	if fragment && m.cfg.FragmentMode == fragmentModeSkip {
+		m.next.ServeHTTP(rw, req)
+		return
+	}
+
 	rec := newResponseRecorder(rw)
 
-	cookieState := m.readCookie(req)
+	start := m.clock.Now()
+	cookieState := m.visitorState(req, start)
 	m.maybeSetCookie(rec.Header(), cookieState)
 	m.next.ServeHTTP(rec, req)
+	rec.duration = m.clock.Now().Sub(start)
 
 	status := rec.statusCode()
 	contentType := rec.Header().Get("Content-Type")
 
-	if m.isLoggable(status, contentType) {
-		m.enqueueEvent(req, contentType, cookieState)
+	if feedType, ok := m.feedRevalidation(req, status, contentType); ok {
+		now := m.clock.Now()
+		if m.feedDebouncer.allow(m.feedRevalidationKey(req, cookieState, now), now) {
+			m.enqueueEvent(req, feedType, cookieState, prefetch, fragment, rec)
+		}
+	} else if m.isLoggable(status, contentType) && m.allowVisit(req, cookieState) {
+		m.enqueueEvent(req, contentType, cookieState, prefetch, fragment, rec)
+	} else if m.cfg.CaptureStatus && status >= http.StatusBadRequest {
+		// Errors of any content type feed the dashboard's Errors panel; the
+		// sidecar never counts them as visits.
+		m.enqueueEvent(req, contentType, cookieState, prefetch, fragment, rec)
 	}
 
 	rec.finalize()
 }
 
+// Close lets go of the shared buffer; the last instance using it sends what
+// is still buffered within shutdownTimeout first. It is safe to call more
+// than once.
 func (m *statsMiddleware) Close() error {
-	close(m.stop)
-	if m.queue != nil {
-		_ = m.queue.Close()
-	}
-	return nil
+	m.closeOnce.Do(func() {
+		close(m.stop)
+		m.closeErr = m.queue.release(m.shutdownWait)
+	})
+	return m.closeErr
 }
 
 func (m *statsMiddleware) isDashboardRequest(req *http.Request) bool {
@@ -113,20 +279,42 @@ func (m *statsMiddleware) isDashboardRequest(req *http.Request) bool {
 	if req.URL.Path == m.cfg.DashboardPath {
 		return true
 	}
-	return req.URL.Path == strings.TrimSuffix(m.cfg.DashboardPath, "/")+"/favicon.ico"
+	return strings.HasPrefix(req.URL.Path, strings.TrimSuffix(m.cfg.DashboardPath, "/")+"/")
 }
 
-func (m *statsMiddleware) proxyDashboard(rw http.ResponseWriter, req *http.Request) {
-	if m.cfg.DashboardToken != "" {
-		auth := req.Header.Get("Authorization")
-		if !strings.HasPrefix(auth, "Bearer ") || strings.TrimPrefix(auth, "Bearer ") != m.cfg.DashboardToken {
-			rw.WriteHeader(http.StatusUnauthorized)
-			_, _ = rw.Write([]byte("Unauthorized"))
-			return
-		}
+// proxiedRequestHeaders are copied to sidecar dashboard requests. Forwarding
+// Accept-Encoding passes the sidecar's compressed body through untouched: the
+// Go transport only decompresses when it added that header itself.
+var proxiedRequestHeaders = []string{
+	"Authorization",
+	"Content-Type",
+	"Accept-Encoding",
+	"If-None-Match",
+	"If-Modified-Since",
+}
+
+// proxiedCookies are the dashboard's own preference cookies. The rest of the
+// site's cookies, including the visitor id, stay behind.
+var proxiedCookies = []string{"stats_types", excludeCookie}
+
+// authorized checks the dashboardToken, when one is set, on requests under
+// DashboardPath.
+func (m *statsMiddleware) authorized(req *http.Request) bool {
+	if m.cfg.DashboardToken == "" {
+		return true
 	}
+	auth := req.Header.Get("Authorization")
+	return strings.HasPrefix(auth, "Bearer ") && strings.TrimPrefix(auth, "Bearer ") == m.cfg.DashboardToken
+}
 
-	target, err := url.Parse(m.cfg.SidecarURL)
+func (m *statsMiddleware) proxyDashboard(rw http.ResponseWriter, req *http.Request) {
+	base, err := m.sidecar.BaseURL()
+	if err != nil {
+		log.Printf("[%s] sidecar lookup failed: %v", m.name, err)
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	target, err := url.Parse(base)
 	if err != nil {
 		rw.WriteHeader(http.StatusBadGateway)
 		return
@@ -134,14 +322,37 @@ func (m *statsMiddleware) proxyDashboard(rw http.ResponseWriter, req *http.Reque
 	target.Path = req.URL.Path
 	target.RawQuery = req.URL.RawQuery
 
-	outReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, target.String(), nil)
+	var body io.Reader
+	if req.Method == http.MethodPost {
+		body = req.Body
+	}
+	outReq, err := http.NewRequestWithContext(req.Context(), req.Method, target.String(), body)
 	if err != nil {
 		rw.WriteHeader(http.StatusBadGateway)
 		return
 	}
+	for _, name := range proxiedRequestHeaders {
+		if val := req.Header.Get(name); val != "" {
+			outReq.Header.Set(name, val)
+		}
+	}
+	for _, name := range proxiedCookies {
+		if cookie, err := req.Cookie(name); err == nil {
+			outReq.AddCookie(cookie)
+		}
+	}
 
-	resp, err := m.client.Do(outReq)
+	// Live dashboard updates are an event stream that stays open as long as
+	// the page does, so it is bounded by the request context rather than the
+	// client timeout.
+	live := strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+	client := m.client
+	if live {
+		client = m.liveClient
+	}
+	resp, err := client.Do(outReq)
 	if err != nil {
+		m.sidecar.Invalidate()
 		rw.WriteHeader(http.StatusBadGateway)
 		return
 	}
@@ -153,115 +364,78 @@ func (m *statsMiddleware) proxyDashboard(rw http.ResponseWriter, req *http.Reque
 		}
 	}
 	rw.WriteHeader(resp.StatusCode)
+	if flusher, ok := rw.(http.Flusher); ok && live {
+		copyFlushing(rw, flusher, resp.Body)
+		return
+	}
 	_, _ = io.Copy(rw, resp.Body)
 }
 
+// copyFlushing copies an event stream, passing on the headers at once and
+// each event as it arrives.
+func copyFlushing(w io.Writer, flusher http.Flusher, r io.Reader) {
+	flusher.Flush()
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			flusher.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
 func (m *statsMiddleware) isLoggable(status int, contentType string) bool {
 	if status != http.StatusOK {
 		return false
 	}
-	ct := strings.ToLower(contentType)
-	return strings.HasPrefix(ct, "text/html") ||
-		strings.HasPrefix(ct, "application/atom+xml") ||
-		strings.HasPrefix(ct, "application/rss+xml")
+	return strings.HasPrefix(strings.ToLower(contentType), "text/html") ||
+		isFeedContentType(contentType)
 }
 
-func (m *statsMiddleware) enqueueEvent(req *http.Request, contentType string, cookieState cookieState) {
-	ip := req.Header.Get("X-Forwarded-For")
-	if ip == "" {
-		ip = req.RemoteAddr
-	}
-	if host, _, err := net.SplitHostPort(ip); err == nil {
-		ip = host
-	}
-
+func (m *statsMiddleware) enqueueEvent(req *http.Request, contentType string, cookieState cookieState, prefetch, fragment bool, rec *responseRecorder) {
+	scheme := requestScheme(req)
 	evt := event{
 		EventID:     newUUID(),
-		Timestamp:   time.Now().UTC(),
+		Timestamp:   m.clock.Now().UTC(),
 		Host:        normalizeHost(req.Host),
 		Path:        req.URL.Path,
 		Query:       req.URL.RawQuery,
-		IP:          ip,
+		IP:          m.ipResolver.visitorIP(req),
 		UserAgent:   req.Header.Get("User-Agent"),
 		Referrer:    req.Header.Get("Referer"),
 		ContentType: contentType,
 		SetCookie:   cookieState.setCookie,
 		Uniq:        cookieState.uniq,
 		SecondVisit: cookieState.secondVisit,
+		Prefetch:    prefetch,
+		Fragment:    fragment,
+		Extra:       m.extraFields(req),
+		Source:      m.cfg.Source,
+		Scheme:      scheme,
+		Port:        requestPort(req, scheme),
 	}
-
-	if err := m.queue.Enqueue(evt); err != nil {
-		log.Printf("[%s] stats buffer enqueue failed: %v", m.name, err)
+	if m.cfg.CaptureStatus {
+		evt.Status = rec.statusCode()
 	}
-}
-
-func (m *statsMiddleware) worker(ctx context.Context) {
-	ticker := time.NewTicker(m.flushInterval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-m.stop:
-			return
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			m.flush()
-		case <-m.queue.notify:
-			m.flush()
-		}
-	}
-}
-
-func (m *statsMiddleware) flush() {
-	now := time.Now()
-	if !m.nextAttempt.IsZero() && now.Before(m.nextAttempt) {
-		return
+	if m.cfg.CaptureDuration {
+		evt.DurationMs = float64(rec.duration.Microseconds()) / 1000
 	}
-	for {
-		batch, err := m.queue.FetchBatch(m.batchSize)
-		if err != nil {
-			log.Printf("[%s] stats buffer read failed: %v", m.name, err)
-			return
-		}
-		if len(batch) == 0 {
-			m.backoff = 0
-			m.nextAttempt = time.Time{}
-			return
-		}
-
-		events := make([]event, 0, len(batch))
-		lastID := batch[len(batch)-1].ID
-		for _, item := range batch {
-			events = append(events, item.Event)
-		}
-
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		err = m.streamClient.StreamEvents(ctx, events)
-		cancel()
-		if err != nil {
-			log.Printf("[%s] stats stream failed: %v", m.name, err)
-			m.scheduleBackoff()
-			return
-		}
-		if err := m.queue.DeleteUpTo(lastID); err != nil {
-			log.Printf("[%s] stats buffer delete failed: %v", m.name, err)
-			m.scheduleBackoff()
-			return
-		}
+	evt.Consent = cookieState.consent
+	if cookieState.consent == consentNone {
+		m.anonymize(&evt)
+	} else if m.cfg.DataMode == dataModeMinimal {
+		m.minimize(&evt)
 	}
-}
 
-func (m *statsMiddleware) scheduleBackoff() {
-	if m.backoff <= 0 {
-		m.backoff = 500 * time.Millisecond
-	} else {
-		m.backoff *= 2
-		if m.backoff > 10*time.Second {
-			m.backoff = 10 * time.Second
-		}
+	if err := m.queue.Enqueue(evt); err != nil {
+		log.Printf("[%s] stats buffer enqueue failed: %v", m.name, err)
 	}
-	m.nextAttempt = time.Now().Add(m.backoff)
 }
 
 type cookieState struct {
@@ -270,6 +444,9 @@ type cookieState struct {
 	secondVisit bool
 	needsSet    bool
 	value       string
+	// consent is the visitor's consent level, empty without a consent
+	// source configured.
+	consent string
 }
 
 func (m *statsMiddleware) readCookie(req *http.Request) cookieState {
@@ -358,6 +535,8 @@ type responseRecorder struct {
 	inner       http.ResponseWriter
 	status      int
 	wroteHeader bool
+	// duration is how long the next handler took to return.
+	duration time.Duration
 }
 
 func newResponseRecorder(inner http.ResponseWriter) *responseRecorder {
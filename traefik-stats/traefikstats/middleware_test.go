@@ -2,22 +2,33 @@ package traefikstats
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"go/build"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode"
 )
 
 func TestCookieSecondVisit(t *testing.T) {
 	cfg := CreateConfig()
 	cfg.SidecarURL = "http://example.com"
 	cfg.FlushInterval = "1h"
-	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer.sqlite")
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
 
 	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
@@ -45,13 +56,74 @@ func TestCookieSecondVisit(t *testing.T) {
 	}
 }
 
+func TestUniqStrategyIPUADailySkipsCookie(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+	cfg.UniqStrategy = "ip-ua-daily"
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	handler, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("User-Agent", "test-agent")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if setCookie := rr.Header().Get("Set-Cookie"); setCookie != "" {
+		t.Fatalf("expected no cookie, got %q", setCookie)
+	}
+	now := time.Now()
+	first := m.visitorState(req, now)
+	second := m.visitorState(req, now)
+	if first.uniq == "" || first.uniq != second.uniq {
+		t.Fatalf("expected stable uniq, got %q and %q", first.uniq, second.uniq)
+	}
+	if next := m.visitorState(req, now.Add(24*time.Hour)); next.uniq == first.uniq {
+		t.Fatalf("expected uniq to rotate daily")
+	}
+}
+
+func TestSaltedUniqNeedsSalt(t *testing.T) {
+	for _, set := range []func(*Config){
+		func(cfg *Config) { cfg.UniqStrategy = "ip-ua-salted" },
+		func(cfg *Config) { cfg.ConsentCookie = "euconsent-v2" },
+		func(cfg *Config) { cfg.DataMode = "minimal" },
+	} {
+		cfg := CreateConfig()
+		cfg.SidecarURL = "http://example.com"
+		cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+		set(cfg)
+		if m, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+			m.(*statsMiddleware).Close()
+			t.Fatalf("expected a missing uniqSalt to fail for %+v", cfg)
+		}
+		cfg.UniqSalt = "shared-salt"
+		m, err := New(context.Background(), http.NotFoundHandler(), cfg, "test")
+		if err != nil {
+			t.Fatalf("new middleware failed: %v", err)
+		}
+		m.(*statsMiddleware).Close()
+	}
+}
+
 func TestIngestEventPosted(t *testing.T) {
 	events := make(chan string, 1)
 
 	cfg := CreateConfig()
 	cfg.SidecarURL = "http://example.com"
 	cfg.FlushInterval = "5ms"
-	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer.sqlite")
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
 
 	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -99,6 +171,1527 @@ func TestIngestEventPosted(t *testing.T) {
 	}
 }
 
+func TestDashboardSubpathProxied(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://sidecar:7070"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatalf("dashboard request reached upstream")
+	})
+
+	handler, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+
+	var gotURL, gotAuth, gotCookie string
+	m.client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		gotURL = r.URL.String()
+		gotAuth = r.Header.Get("Authorization")
+		gotCookie = r.Header.Get("Cookie")
+		return newResponse(http.StatusOK), nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/stats/events?page=2", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	req.Header.Set("Cookie", "stats_id=abc; stats_types=browser.feed")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if gotURL != "http://sidecar:7070/stats/events?page=2" {
+		t.Fatalf("unexpected proxy target %q", gotURL)
+	}
+	if gotAuth != "Bearer admin" {
+		t.Fatalf("expected authorization to be forwarded, got %q", gotAuth)
+	}
+	if gotCookie != "stats_types=browser.feed" {
+		t.Fatalf("expected only the dashboard cookie to be forwarded, got %q", gotCookie)
+	}
+}
+
+func TestDashboardLiveUpdatesStreamed(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://sidecar:7070"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+
+	events, sidecar := io.Pipe()
+	m.client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		t.Fatalf("event stream went through the client with a timeout")
+		return nil, nil
+	})
+	m.liveClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		resp := newResponse(http.StatusOK)
+		resp.Header.Set("Content-Type", "text/event-stream")
+		resp.Body = events
+		return resp, nil
+	})
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	defer sidecar.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/stats/api/live", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("live request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The stream is still open, so the event only arrives if it was flushed.
+	go func() { _, _ = io.WriteString(sidecar, "event: update\n\n") }()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "event: update\n" {
+		t.Fatalf("expected the update event, got %q (%v)", line, err)
+	}
+}
+
+func TestClientIPTrustedProxies(t *testing.T) {
+	resolver, err := newIPResolver([]string{"10.0.0.0/8", "192.0.2.1"}, 0)
+	if err != nil {
+		t.Fatalf("new resolver failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"untrusted peer ignores headers", "203.0.113.7:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "203.0.113.7"},
+		{"rightmost untrusted hop", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 10.0.0.5"}, "1.2.3.4"},
+		{"forwarded header", "192.0.2.1:80", map[string]string{"Forwarded": `for=1.2.3.4;proto=https, for="[2001:db8::1]:4711"`}, "2001:db8::1"},
+		{"x-real-ip", "10.0.0.1:1234", map[string]string{"X-Real-IP": "1.2.3.4"}, "1.2.3.4"},
+		{"all hops trusted", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = tt.remote
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		if got := resolver.clientIP(req); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestMaskIPv6(t *testing.T) {
+	if got := maskIPv6("2001:db8:1:2:aaaa:bbbb:cccc:dddd", 64); got != "2001:db8:1:2::" {
+		t.Fatalf("expected /64 prefix, got %q", got)
+	}
+	if got := maskIPv6("203.0.113.7", 64); got != "203.0.113.7" {
+		t.Fatalf("expected IPv4 untouched, got %q", got)
+	}
+}
+
+func TestDebouncerWindow(t *testing.T) {
+	d := newDebouncer(30 * time.Second)
+	now := time.Now()
+	if !d.allow("example.com|/|u1", now) {
+		t.Fatal("expected first hit allowed")
+	}
+	if d.allow("example.com|/|u1", now.Add(5*time.Second)) {
+		t.Fatal("expected reload within window dropped")
+	}
+	if !d.allow("example.com|/about|u1", now.Add(5*time.Second)) {
+		t.Fatal("expected other path allowed")
+	}
+	if !d.allow("example.com|/|u1", now.Add(31*time.Second)) {
+		t.Fatal("expected hit after window allowed")
+	}
+	var disabled *debouncer
+	if !disabled.allow("example.com|/|u1", now) {
+		t.Fatal("expected nil debouncer to allow")
+	}
+}
+
+func TestPrefetchSkipped(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	handler, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Sec-Purpose", "prefetch;prerender")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if setCookie := rr.Header().Get("Set-Cookie"); setCookie != "" {
+		t.Fatalf("expected no cookie for prefetch, got %q", setCookie)
+	}
+	batch, err := m.queue.FetchBatch(10)
+	if err != nil {
+		t.Fatalf("fetch batch failed: %v", err)
+	}
+	if len(batch) != 0 {
+		t.Fatalf("expected prefetch to be skipped, got %d events", len(batch))
+	}
+}
+
+func TestFragmentModes(t *testing.T) {
+	for _, tc := range []struct {
+		mode   string
+		events int
+	}{
+		{fragmentModeCount, 2},
+		{fragmentModeSkip, 1},
+		{fragmentModeTag, 2},
+	} {
+		cfg := CreateConfig()
+		cfg.SidecarURL = "http://example.com"
+		cfg.FlushInterval = "1h"
+		cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+		cfg.FragmentMode = tc.mode
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte("ok"))
+		})
+		handler, err := New(context.Background(), next, cfg, "test")
+		if err != nil {
+			t.Fatalf("new middleware failed: %v", err)
+		}
+		m := handler.(*statsMiddleware)
+
+		page := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		page.Header.Set("Sec-Fetch-Dest", "document")
+		page.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+		handler.ServeHTTP(httptest.NewRecorder(), page)
+		fragment := httptest.NewRequest(http.MethodGet, "http://example.com/comments", nil)
+		fragment.Header.Set("HX-Request", "true")
+		fragment.Header.Set("Sec-Fetch-Dest", "empty")
+		handler.ServeHTTP(httptest.NewRecorder(), fragment)
+
+		batch, err := m.queue.FetchBatch(10)
+		if err != nil {
+			t.Fatalf("fetch batch failed: %v", err)
+		}
+		if len(batch) != tc.events {
+			t.Fatalf("%s: expected %d events, got %d", tc.mode, tc.events, len(batch))
+		}
+		if batch[0].Event.Fragment {
+			t.Fatalf("%s: page tagged as fragment", tc.mode)
+		}
+		if tc.events == 2 && batch[1].Event.Fragment != (tc.mode == fragmentModeTag) {
+			t.Fatalf("%s: fragment tag %v", tc.mode, batch[1].Event.Fragment)
+		}
+		m.Close()
+	}
+}
+
+func TestIsFragment(t *testing.T) {
+	for _, tc := range []struct {
+		headers map[string]string
+		want    bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{"Sec-Fetch-Dest": "document"}, false},
+		{map[string]string{"HX-Request": "true", "HX-Boosted": "true"}, false},
+		{map[string]string{"HX-Request": "true"}, true},
+		{map[string]string{"Turbo-Frame": "comments"}, true},
+		{map[string]string{"X-Requested-With": "XMLHttpRequest"}, true},
+		{map[string]string{"Sec-Fetch-Dest": "empty", "Accept": "*/*"}, true},
+		{map[string]string{"Sec-Fetch-Dest": "empty", "Accept": "text/vnd.turbo-stream.html, text/html, application/xhtml+xml"}, false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		if got := isFragment(req); got != tc.want {
+			t.Fatalf("isFragment(%v) = %v, want %v", tc.headers, got, tc.want)
+		}
+	}
+}
+
+func TestMinimalDataModeSendsDerivedFields(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+	cfg.DataMode = dataModeMinimal
+	cfg.UniqSalt = "test-salt"
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("ok"))
+	})
+	handler, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+
+	for _, ua := range []string{
+		"Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0",
+		"Feedly/1.0 (+http://www.feedly.com/fetcher.html; 42 subscribers)",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "203.0.113.9:1234"
+		req.Header.Set("User-Agent", ua)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	batch, err := m.queue.FetchBatch(10)
+	if err != nil || len(batch) != 2 {
+		t.Fatalf("expected 2 events, got %d (%v)", len(batch), err)
+	}
+	browser, reader := batch[0].Event, batch[1].Event
+	for _, evt := range []event{browser, reader} {
+		if evt.IP != "" || evt.UserAgent != "" {
+			t.Fatalf("expected no IP or User-Agent, got %q %q", evt.IP, evt.UserAgent)
+		}
+		if evt.Uniq == "" {
+			t.Fatalf("expected a uniq for %s", evt.Agent)
+		}
+	}
+	if browser.Agent != "Firefox" || browser.Type != "browser" || browser.OS != "Linux" || browser.Mult != 1 {
+		t.Fatalf("unexpected browser fields %+v", browser)
+	}
+	if reader.Agent != "Feedly" || reader.Type != "bot" || reader.Mult != 42 || reader.Uniq != hashUUID("Feedly") {
+		t.Fatalf("unexpected feed reader fields %+v", reader)
+	}
+}
+
+func TestConsentLevels(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+	cfg.ConsentHeader = "X-Consent"
+	cfg.UniqSalt = "test-salt"
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("ok"))
+	})
+	handler, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+
+	for _, tc := range []struct {
+		signal  string
+		consent string
+		cookie  bool
+	}{
+		{"full", consentFull, true},
+		{"cookieless", consentCookieless, false},
+		{"none", consentNone, false},
+		{"", consentCookieless, false},
+		{tcfString(1, 8), consentFull, true},
+		{tcfString(8), consentCookieless, false},
+		{tcfString(1), consentNone, false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/"+tc.consent, nil)
+		req.RemoteAddr = "203.0.113.9:1234"
+		req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0) Firefox/120.0")
+		req.Header.Set("X-Consent", tc.signal)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if got := rr.Header().Get("Set-Cookie") != ""; got != tc.cookie {
+			t.Fatalf("signal %q: expected cookie %v, got %v", tc.signal, tc.cookie, got)
+		}
+
+		batch, err := m.queue.FetchBatch(10)
+		if err != nil || len(batch) != 1 {
+			t.Fatalf("signal %q: expected 1 event, got %d (%v)", tc.signal, len(batch), err)
+		}
+		evt := batch[0].Event
+		if err := m.queue.DeleteUpTo(batch[0].ID); err != nil {
+			t.Fatalf("delete failed: %v", err)
+		}
+		if evt.Consent != tc.consent {
+			t.Fatalf("signal %q: expected consent %q, got %q", tc.signal, tc.consent, evt.Consent)
+		}
+		switch tc.consent {
+		case consentCookieless:
+			if evt.Uniq == "" || evt.IP == "" {
+				t.Fatalf("signal %q: expected a hashed uniq and the IP, got %+v", tc.signal, evt)
+			}
+		case consentNone:
+			if evt.IP != "" || evt.UserAgent != "" || evt.Uniq != hashUUID(evt.EventID) || evt.Agent != "Firefox" {
+				t.Fatalf("signal %q: expected an anonymous event, got %+v", tc.signal, evt)
+			}
+		}
+	}
+}
+
+// tcfString builds a TCF v2 core segment granting consent to the given
+// purposes.
+func tcfString(purposes ...int) string {
+	raw := make([]byte, 32)
+	raw[0] = 2 << 2
+	for _, p := range purposes {
+		offset := tcfPurposesOffset + p - 1
+		raw[offset/8] |= 0x80 >> (offset % 8)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// The edge classification must agree with the sidecar's, which is tested
+// against the same fixtures.
+func TestAgentClassificationMatchesSidecarFixtures(t *testing.T) {
+	files, _ := filepath.Glob("../../banan-stats/fixtures/user_agent*.tsv")
+	if len(files) == 0 {
+		t.Skip("sidecar fixtures not found")
+	}
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("read fixtures failed: %v", err)
+		}
+		for n, line := range strings.Split(string(raw), "\n") {
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if strings.HasSuffix(file, "regressions.tsv") {
+				// Prefixed with the issue that reported it.
+				_, line, _ = strings.Cut(line, "\t")
+			}
+			fields := strings.SplitN(line, "\t", 4)
+			if len(fields) != 4 {
+				t.Fatalf("malformed fixture %s:%d", file, n+1)
+			}
+			agent := agentName(fields[3])
+			if agent != fields[1] || agentType("/", agent, fields[3]) != fields[0] || agentOS(fields[3]) != fields[2] {
+				t.Errorf("%s:%d: %q classified as %q %q %q, want %q %q %q", file, n+1, fields[3],
+					agentType("/", agent, fields[3]), agent, agentOS(fields[3]), fields[0], fields[1], fields[2])
+			}
+		}
+	}
+}
+
+// builtinAgentTypes is a copy of the sidecar's list and must not drift from it.
+func TestBuiltinAgentTypesMatchSidecar(t *testing.T) {
+	raw, err := os.ReadFile("../../banan-stats/assets/agent_types.txt")
+	if os.IsNotExist(err) {
+		t.Skip("sidecar agent types not found")
+	}
+	if err != nil {
+		t.Fatalf("read agent types failed: %v", err)
+	}
+	want := map[string]string{}
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.LastIndexFunc(line, unicode.IsSpace)
+		if idx < 0 {
+			t.Fatalf("malformed agent type line %q", line)
+		}
+		want[strings.TrimSpace(line[:idx])] = line[idx+1:]
+	}
+	for agent, kind := range want {
+		if builtinAgentTypes[agent] != kind {
+			t.Errorf("agent %q: builtinAgentTypes has %q, agent_types.txt %q", agent, builtinAgentTypes[agent], kind)
+		}
+	}
+	for agent := range builtinAgentTypes {
+		if _, ok := want[agent]; !ok {
+			t.Errorf("agent %q is in builtinAgentTypes but not in agent_types.txt", agent)
+		}
+	}
+}
+
+func TestFeedRevalidationCountedOncePerDay(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+	cfg.CountFeedRevalidations = true
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	})
+
+	handler, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+	clock := newFakeClock()
+	m.clock = clock
+
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), feedRequest())
+		clock.Advance(time.Hour)
+	}
+
+	batch, err := m.queue.FetchBatch(10)
+	if err != nil {
+		t.Fatalf("fetch batch failed: %v", err)
+	}
+	if len(batch) != 1 {
+		t.Fatalf("expected one feed hit, got %d", len(batch))
+	}
+	if batch[0].Event.ContentType != "application/rss+xml" {
+		t.Fatalf("expected feed content type, got %q", batch[0].Event.ContentType)
+	}
+
+	clock.Advance(24 * time.Hour)
+	handler.ServeHTTP(httptest.NewRecorder(), feedRequest())
+	if batch, _ := m.queue.FetchBatch(10); len(batch) != 2 || !batch[1].Event.Timestamp.Equal(clock.Now()) {
+		t.Fatalf("expected a second feed hit the next day, got %d", len(batch))
+	}
+}
+
+func feedRequest() *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/feed.xml", nil)
+	req.Header.Set("User-Agent", "Feedbin feed-id:1 - 12 subscribers")
+	return req
+}
+
+func TestCaptureHeadersAndEnrichers(t *testing.T) {
+	RegisterEnricher("test-bucket", EnricherFunc(func(req *http.Request, extra map[string]string) {
+		if c, err := req.Cookie("ab"); err == nil {
+			extra["bucket"] = c.Value
+		}
+	}))
+
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+	cfg.CaptureHeaders = []string{"CF-IPCountry=country", "X-Variant"}
+	cfg.Enrichers = []string{"test-bucket"}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	handler, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Cf-Ipcountry", "NL")
+	req.AddCookie(&http.Cookie{Name: "ab", Value: "b"})
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	batch, err := m.queue.FetchBatch(10)
+	if err != nil {
+		t.Fatalf("fetch batch failed: %v", err)
+	}
+	if len(batch) != 1 {
+		t.Fatalf("expected one event, got %d", len(batch))
+	}
+	extra := batch[0].Event.Extra
+	if len(extra) != 2 || extra["country"] != "NL" || extra["bucket"] != "b" {
+		t.Fatalf("unexpected extra fields %v", extra)
+	}
+
+	cfg.Enrichers = []string{"missing"}
+	if _, err := New(context.Background(), next, cfg, "test"); err == nil {
+		t.Fatal("expected unknown enricher to be rejected")
+	}
+}
+
+func TestCaptureStatusRecordsErrors(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+	cfg.CaptureStatus = true
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	handler, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+
+	for _, path := range []string{"/", "/missing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+	}
+
+	batch, err := m.queue.FetchBatch(10)
+	if err != nil {
+		t.Fatalf("fetch batch failed: %v", err)
+	}
+	if len(batch) != 2 {
+		t.Fatalf("expected two events, got %d", len(batch))
+	}
+	if batch[0].Event.Status != http.StatusOK || batch[1].Event.Status != http.StatusNotFound {
+		t.Fatalf("unexpected statuses %d and %d", batch[0].Event.Status, batch[1].Event.Status)
+	}
+}
+
+func TestCaptureDuration(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+	cfg.CaptureDuration = true
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	handler, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+	batch, err := m.queue.FetchBatch(10)
+	if err != nil {
+		t.Fatalf("fetch batch failed: %v", err)
+	}
+	if len(batch) != 1 || batch[0].Event.DurationMs < 5 {
+		t.Fatalf("expected a duration of at least 5ms, got %+v", batch)
+	}
+}
+
+func TestInstancesShareBufferAndCloseFlushes(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handler, err := New(ctx, next, cfg, "old")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	old := handler.(*statsMiddleware)
+
+	handler, err = New(context.Background(), next, cfg, "new")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	if m.queue != old.queue || m.streamClient != old.streamClient {
+		t.Fatalf("expected instances with the same buffer path to share the queue and flusher")
+	}
+	var mu sync.Mutex
+	var sent []string
+	m.streamClient.client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var evt event
+			if err := json.Unmarshal(scanner.Bytes(), &evt); err == nil {
+				mu.Lock()
+				sent = append(sent, evt.Path)
+				mu.Unlock()
+			}
+		}
+		return newResponse(http.StatusAccepted), nil
+	})
+
+	// Like after a reload: the old instance serves until Traefik cancels
+	// its context, and closing it leaves the buffer to the new one.
+	old.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/old", nil))
+	cancel()
+	_ = old.Close()
+	if _, ok := sharedQueues[cfg.BufferPath]; !ok {
+		t.Fatalf("expected the buffer to stay open while an instance uses it")
+	}
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/new", nil))
+
+	if err := m.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(sent, ",") != "/old,/new" {
+		t.Fatalf("expected both events flushed on close, got %v", sent)
+	}
+	if _, ok := sharedQueues[cfg.BufferPath]; ok {
+		t.Fatalf("expected the buffer to be closed after the last instance")
+	}
+}
+
+func TestEventsCarrySource(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+	cfg.Source = "edge-1"
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("ok"))
+	})
+	handler, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	batch, err := m.queue.FetchBatch(10)
+	if err != nil || len(batch) != 1 {
+		t.Fatalf("expected 1 event, got %d (%v)", len(batch), err)
+	}
+	if batch[0].Event.Source != "edge-1" {
+		t.Fatalf("expected source edge-1, got %q", batch[0].Event.Source)
+	}
+}
+
+func TestEventsCarrySchemeAndPort(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("ok"))
+	})
+	handler, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+
+	forwarded := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	forwarded.Header.Set("X-Forwarded-Proto", "HTTPS, http")
+	forwarded.Header.Set("X-Forwarded-Port", "8443")
+	handler.ServeHTTP(httptest.NewRecorder(), forwarded)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com:8080/", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+
+	batch, err := m.queue.FetchBatch(10)
+	if err != nil || len(batch) != 3 {
+		t.Fatalf("expected 3 events, got %d (%v)", len(batch), err)
+	}
+	for i, want := range []struct {
+		scheme string
+		port   int
+	}{{"https", 8443}, {"http", 8080}, {"https", 443}} {
+		if got := batch[i].Event; got.Scheme != want.scheme || got.Port != want.port {
+			t.Fatalf("event %d: expected %s:%d, got %s:%d", i, want.scheme, want.port, got.Scheme, got.Port)
+		}
+	}
+}
+
+func TestExcludedRequestsAreNotRecorded(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+	cfg.ExcludeHeaders = []string{"X-Admin: 1"}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("ok"))
+	})
+	handler, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+
+	admin := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	admin.Header.Set("X-Admin", "1")
+	handler.ServeHTTP(httptest.NewRecorder(), admin)
+	owner := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	owner.AddCookie(&http.Cookie{Name: excludeCookie, Value: "1"})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, owner)
+	if rec.Header().Get("Set-Cookie") != "" {
+		t.Fatalf("expected no visitor cookie for excluded requests")
+	}
+	other := httptest.NewRequest(http.MethodGet, "http://example.com/other", nil)
+	other.Header.Set("X-Admin", "0")
+	handler.ServeHTTP(httptest.NewRecorder(), other)
+
+	batch, err := m.queue.FetchBatch(10)
+	if err != nil || len(batch) != 1 {
+		t.Fatalf("expected 1 event, got %d (%v)", len(batch), err)
+	}
+	if batch[0].Event.Path != "/other" {
+		t.Fatalf("expected only /other to be recorded, got %q", batch[0].Event.Path)
+	}
+}
+
+func TestExcludeEndpointSetsCookie(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+	cfg.DashboardToken = "token"
+	cfg.CookieDomain = "example.com"
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	defer handler.(*statsMiddleware).Close()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/stats/exclude", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 without a token, got %d", rec.Code)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != excludeCookie || cookies[0].Value != "1" || cookies[0].Domain != "example.com" {
+		t.Fatalf("unexpected cookies %+v", cookies)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/stats/exclude?undo", nil))
+	cookies = rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Fatalf("expected the cookie to be cleared, got %+v", cookies)
+	}
+}
+
+func TestStatusEndpointReportsQueue(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+	cfg.DashboardToken = "token"
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+	if err := m.queue.Enqueue(event{Path: "/"}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/stats/status", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the token, got %d", rr.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/stats/status", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	var st pipelineStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &st); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	if rr.Code != http.StatusOK || !st.OK || st.QueueDepth != 1 {
+		t.Fatalf("expected a healthy status with one queued event, got %d %+v", rr.Code, st)
+	}
+
+	if st := m.pipelineStatus(time.Now().Add(24 * time.Hour)); st.OK || st.State != "stalled" {
+		t.Fatalf("expected a stalled pipeline, got %+v", st)
+	}
+}
+
+func TestStatusStallCountsFromStart(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+
+	clock := newFakeClock()
+	m, err := newMiddleware(context.Background(), http.NotFoundHandler(), cfg, "test", clock)
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	defer m.Close()
+	if m.queue.flusher.clock != clock || m.streamClient.clock != clock {
+		t.Fatal("expected the flusher and stream client to use the middleware's clock")
+	}
+	if err := m.queue.Enqueue(event{Path: "/"}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+
+	clock.Advance(9 * time.Hour)
+	if st := m.pipelineStatus(clock.Now()); !st.OK {
+		t.Fatalf("expected no stall within ten flush intervals of starting, got %+v", st)
+	}
+	clock.Advance(2 * time.Hour)
+	if st := m.pipelineStatus(clock.Now()); st.OK || st.State != "stalled" {
+		t.Fatalf("expected a stalled pipeline, got %+v", st)
+	}
+}
+
+func TestIngestSecretSignsLines(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+	cfg.IngestSecret = "s3cret"
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+	var body []byte
+	m.streamClient.client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		body, _ = io.ReadAll(r.Body)
+		return newResponse(http.StatusAccepted), nil
+	})
+
+	if err := m.streamClient.StreamEvents(context.Background(), []event{{EventID: "e1", Path: "/<a>"}}); err != nil {
+		t.Fatalf("stream failed: %v", err)
+	}
+	line := bytes.TrimSuffix(body, []byte("\n"))
+	idx := bytes.LastIndex(line, []byte(`,"sig":"`))
+	if idx < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		t.Fatalf("expected a signed line, got %s", line)
+	}
+	unsigned := append(append([]byte{}, line[:idx]...), '}')
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(unsigned)
+	if got, want := string(line[idx+len(`,"sig":"`):len(line)-2]), hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Fatalf("signature %s, want %s", got, want)
+	}
+	var evt event
+	if err := json.Unmarshal(line, &evt); err != nil || evt.Path != "/<a>" {
+		t.Fatalf("signed line does not decode: %v %+v", err, evt)
+	}
+}
+
+func TestStreamIngestAcksEvents(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	sidecar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ingest/stream" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rc := http.NewResponseController(w)
+		_ = rc.EnableFullDuplex()
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		_ = rc.Flush()
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var evt event
+			if len(scanner.Bytes()) == 0 || json.Unmarshal(scanner.Bytes(), &evt) != nil {
+				continue
+			}
+			mu.Lock()
+			received = append(received, evt.Path)
+			mu.Unlock()
+			_ = json.NewEncoder(w).Encode(sessionAck{Ack: evt.EventID, Count: 1})
+			_ = rc.Flush()
+		}
+	}))
+	defer sidecar.Close()
+
+	cfg := CreateConfig()
+	cfg.SidecarURL = sidecar.URL
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+	cfg.IngestMode = "stream"
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	handler, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		batch, err := m.queue.FetchBatch(10)
+		if err != nil {
+			t.Fatalf("fetch batch failed: %v", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected acked events to leave the buffer, %d left", len(batch))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(received, ",") != "/a,/b,/c" {
+		t.Fatalf("expected events over one stream in order, got %v", received)
+	}
+}
+
+func TestStreamIngestSendsEventsAfterDrain(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	sidecar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		_ = rc.EnableFullDuplex()
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		_ = rc.Flush()
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var evt event
+			if len(scanner.Bytes()) == 0 || json.Unmarshal(scanner.Bytes(), &evt) != nil {
+				continue
+			}
+			mu.Lock()
+			received = append(received, evt.Path)
+			mu.Unlock()
+			_ = json.NewEncoder(w).Encode(sessionAck{Ack: evt.EventID, Count: 1})
+			_ = rc.Flush()
+		}
+	}))
+	defer sidecar.Close()
+
+	cfg := CreateConfig()
+	cfg.SidecarURL = sidecar.URL
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+	cfg.IngestMode = "stream"
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("ok"))
+	})
+	handler, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+
+	waitForDrain := func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for m.queue.Len() > 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected acked events to leave the buffer, %d left", m.queue.Len())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for _, paths := range [][]string{{"/a", "/b", "/c"}, {"/d", "/e"}} {
+		for _, path := range paths {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+		}
+		waitForDrain()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(received, ",") != "/a,/b,/c,/d,/e" {
+		t.Fatalf("expected every event once, got %v", received)
+	}
+}
+
+func TestFlusherHonorsRetryAfter(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.FlushInterval = "1h"
+	cfg.BufferPath = filepath.Join(t.TempDir(), "buffer")
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatalf("new middleware failed: %v", err)
+	}
+	m := handler.(*statsMiddleware)
+	defer m.Close()
+	m.streamClient.client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		resp := newResponse(http.StatusTooManyRequests)
+		resp.Header.Set("Retry-After", "7")
+		return resp, nil
+	})
+
+	clock := newFakeClock()
+	f := &flusher{opts: flushOptions{name: "test", batchSize: 10}, queue: m.queue, streamClient: m.streamClient, clock: clock}
+	if err := m.queue.Enqueue(event{Path: "/"}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	f.flush()
+	if f.backoff != 0 {
+		t.Fatalf("expected Retry-After to replace the backoff, got %s", f.backoff)
+	}
+	if wait := f.nextAttempt.Sub(clock.Now()); wait != 7*time.Second {
+		t.Fatalf("expected a pause of 7s, got %s", wait)
+	}
+}
+
+func TestFlusherBacksOff(t *testing.T) {
+	queue, err := openQueue(filepath.Join(t.TempDir(), "buffer"), 0, nil)
+	if err != nil {
+		t.Fatalf("open queue failed: %v", err)
+	}
+	defer queue.Close()
+	clock := newFakeClock()
+	client, err := newStreamClient("http://example.com", "", clock)
+	if err != nil {
+		t.Fatalf("new stream client failed: %v", err)
+	}
+	attempts, up := 0, false
+	client.client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		attempts++
+		if !up {
+			return newResponse(http.StatusInternalServerError), nil
+		}
+		return newResponse(http.StatusAccepted), nil
+	})
+	f := &flusher{opts: flushOptions{name: "test", batchSize: 10}, queue: queue, streamClient: client, clock: clock}
+	if err := queue.Enqueue(event{Path: "/"}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+
+	for i, want := range []time.Duration{
+		500 * time.Millisecond, time.Second, 2 * time.Second, 4 * time.Second,
+		8 * time.Second, 10 * time.Second, 10 * time.Second,
+	} {
+		f.flush()
+		if attempts != i+1 || f.backoff != want {
+			t.Fatalf("attempt %d: expected a backoff of %s, got %s after %d attempts", i+1, want, f.backoff, attempts)
+		}
+		// Flushes before the backoff has passed do not reach the sidecar.
+		clock.Advance(want - time.Millisecond)
+		f.flush()
+		if attempts != i+1 {
+			t.Fatalf("attempt %d: expected no retry within the backoff", i+1)
+		}
+		clock.Advance(time.Millisecond)
+	}
+
+	up = true
+	f.flush()
+	if f.backoff != 0 || !f.nextAttempt.IsZero() || queue.Len() != 0 {
+		t.Fatalf("expected the buffer sent and the backoff reset, got %s with %d left", f.backoff, queue.Len())
+	}
+	if !f.lastFlush.Equal(clock.Now()) || !f.lastErrAt.Equal(clock.Now().Add(-10*time.Second)) {
+		t.Fatalf("unexpected status times: flushed %s, failed %s", f.lastFlush, f.lastErrAt)
+	}
+}
+
+func TestFlusherRetriesOnTick(t *testing.T) {
+	queue, err := openQueue(filepath.Join(t.TempDir(), "buffer"), 0, nil)
+	if err != nil {
+		t.Fatalf("open queue failed: %v", err)
+	}
+	defer queue.Close()
+	clock := newFakeClock()
+	client, err := newStreamClient("http://example.com", "", clock)
+	if err != nil {
+		t.Fatalf("new stream client failed: %v", err)
+	}
+	attempts := make(chan int, 10)
+	var calls int
+	client.client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		calls++
+		defer func() { attempts <- calls }()
+		if calls == 1 {
+			return newResponse(http.StatusInternalServerError), nil
+		}
+		return newResponse(http.StatusAccepted), nil
+	})
+	f := &flusher{
+		opts:         flushOptions{name: "test", interval: time.Minute, batchSize: 10},
+		queue:        queue,
+		streamClient: client,
+		clock:        clock,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go f.run()
+	clock.waitForTicker(t)
+
+	// The enqueue triggers a flush, which fails; the next tick retries.
+	if err := queue.Enqueue(event{Path: "/"}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	waitForAttempt(t, attempts, 1)
+	clock.Advance(time.Minute)
+	waitForAttempt(t, attempts, 2)
+	close(f.stop)
+	<-f.done
+	if queue.Len() != 0 || f.backoff != 0 {
+		t.Fatalf("expected the retry to send the buffer, got %d left with backoff %s", queue.Len(), f.backoff)
+	}
+}
+
+func waitForAttempt(t *testing.T, attempts <-chan int, want int) {
+	t.Helper()
+	select {
+	case got := <-attempts:
+		if got != want {
+			t.Fatalf("expected attempt %d, got %d", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("flusher made no attempt %d", want)
+	}
+}
+
+func TestQueueSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer")
+	queue, err := openQueue(path, 0, nil)
+	if err != nil {
+		t.Fatalf("open queue failed: %v", err)
+	}
+	for _, p := range []string{"/a", "/b", "/c"} {
+		if err := queue.Enqueue(event{Path: p}); err != nil {
+			t.Fatalf("enqueue failed: %v", err)
+		}
+	}
+	batch, err := queue.FetchBatch(2)
+	if err != nil || len(batch) != 2 {
+		t.Fatalf("expected 2 events, got %d (%v)", len(batch), err)
+	}
+	if err := queue.DeleteUpTo(batch[1].ID); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	_ = queue.Close()
+
+	queue, err = openQueue(path, 0, nil)
+	if err != nil {
+		t.Fatalf("reopen queue failed: %v", err)
+	}
+	defer queue.Close()
+	batch, err = queue.FetchBatch(10)
+	if err != nil {
+		t.Fatalf("fetch batch failed: %v", err)
+	}
+	if len(batch) != 1 || batch[0].Event.Path != "/c" {
+		t.Fatalf("expected only /c to remain, got %+v", batch)
+	}
+}
+
+// Stream sessions skip events up to the last ID they sent, so a drained
+// buffer must not hand out lower IDs again, also after a restart.
+func TestQueueIDsIncreaseAfterDrain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer")
+	var last int64
+	for round, paths := range [][]string{{"/a", "/b", "/c"}, {"/d", "/e"}, {"/f"}} {
+		queue, err := openQueue(path, 0, nil)
+		if err != nil {
+			t.Fatalf("open queue failed: %v", err)
+		}
+		for _, p := range paths {
+			if err := queue.Enqueue(event{Path: p}); err != nil {
+				t.Fatalf("enqueue failed: %v", err)
+			}
+		}
+		batch, err := queue.FetchBatch(10)
+		if err != nil || len(batch) != len(paths) {
+			t.Fatalf("round %d: expected %d events, got %d (%v)", round, len(paths), len(batch), err)
+		}
+		for _, item := range batch {
+			if item.ID <= last {
+				t.Fatalf("round %d: ID %d of %s not above %d", round, item.ID, item.Event.Path, last)
+			}
+			last = item.ID
+		}
+		if err := queue.DeleteUpTo(last); err != nil {
+			t.Fatalf("delete failed: %v", err)
+		}
+		if queue.Len() != 0 {
+			t.Fatalf("round %d: expected a drained queue, %d left", round, queue.Len())
+		}
+		_ = queue.Close()
+	}
+}
+
+func TestBufferKeyEncryptsPayloads(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte("correct horse battery staple\n"), 0o600); err != nil {
+		t.Fatalf("write key failed: %v", err)
+	}
+	cipher, err := loadBufferKey(keyFile, "")
+	if err != nil || cipher == nil {
+		t.Fatalf("load key failed: %v", err)
+	}
+
+	path := filepath.Join(dir, "buffer")
+	plain, err := openQueue(path, 0, nil)
+	if err != nil {
+		t.Fatalf("open queue failed: %v", err)
+	}
+	if err := plain.Enqueue(event{Path: "/before", IP: "203.0.113.9"}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	_ = plain.Close()
+
+	queue, err := openQueue(path, 0, cipher)
+	if err != nil {
+		t.Fatalf("open queue failed: %v", err)
+	}
+	defer queue.Close()
+	if err := queue.Enqueue(event{Path: "/after", IP: "198.51.100.7", UserAgent: "Mozilla/5.0"}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read buffer failed: %v", err)
+	}
+	if bytes.Contains(raw, []byte("198.51.100.7")) || bytes.Contains(raw, []byte("Mozilla")) {
+		t.Fatalf("expected the new event to be encrypted, got %q", raw)
+	}
+	batch, err := queue.FetchBatch(10)
+	if err != nil {
+		t.Fatalf("fetch batch failed: %v", err)
+	}
+	if len(batch) != 2 || batch[0].Event.Path != "/before" || batch[1].Event.IP != "198.51.100.7" {
+		t.Fatalf("expected the plain and the sealed event back, got %+v", batch)
+	}
+
+	other, _ := newPayloadCipher("another key")
+	sealed, _ := cipher.seal([]byte(`{"path":"/x"}`))
+	if _, err := other.open(sealed); err == nil {
+		t.Fatal("expected a different key to fail")
+	}
+	if _, err := (*payloadCipher)(nil).open(sealed); err == nil {
+		t.Fatal("expected a sealed payload to need a key")
+	}
+	if _, err := loadBufferKey("", "BANAN_STATS_TEST_UNSET_KEY"); err == nil {
+		t.Fatal("expected an unset key variable to fail")
+	}
+}
+
+func TestQueueWarnsAboutLegacyBuffer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "banan-stats-buffer.sqlite")
+	if warnLegacyBuffer(path) {
+		t.Fatal("expected no warning without a legacy buffer")
+	}
+	if err := os.WriteFile(path, []byte("SQLite format 3\x00"), 0o600); err != nil {
+		t.Fatalf("write legacy buffer failed: %v", err)
+	}
+	if !warnLegacyBuffer(path) {
+		t.Fatal("expected a warning about the legacy buffer")
+	}
+}
+
+func TestWrongBufferKeyKeepsEvents(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "buffer")
+	cipher, _ := newPayloadCipher("old key")
+	queue, err := openQueue(path, 0, cipher)
+	if err != nil {
+		t.Fatalf("open queue failed: %v", err)
+	}
+	if err := queue.Enqueue(event{Path: "/sealed"}); err != nil {
+		t.Fatalf("enqueue failed: %v", err)
+	}
+	_ = queue.Close()
+
+	other, _ := newPayloadCipher("new key")
+	for _, c := range []*payloadCipher{other, nil} {
+		if _, err := openQueue(path, 0, c); !errors.Is(err, errBufferKey) {
+			t.Fatalf("expected the buffer to need its key, got %v", err)
+		}
+	}
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte("new key\n"), 0o600); err != nil {
+		t.Fatalf("write key failed: %v", err)
+	}
+	cfg := CreateConfig()
+	cfg.SidecarURL = "http://example.com"
+	cfg.BufferPath = path
+	cfg.BufferKeyFile = keyFile
+	if m, err := newMiddleware(context.Background(), http.NotFoundHandler(), cfg, "test", newFakeClock()); err == nil {
+		m.Close()
+		t.Fatal("expected the middleware to refuse a buffer sealed with another key")
+	}
+
+	queue, err = openQueue(path, 0, cipher)
+	if err != nil {
+		t.Fatalf("open queue with the old key failed: %v", err)
+	}
+	defer queue.Close()
+	batch, err := queue.FetchBatch(10)
+	if err != nil || len(batch) != 1 || batch[0].Event.Path != "/sealed" {
+		t.Fatalf("expected the sealed event to still be buffered, got %+v (%v)", batch, err)
+	}
+}
+
+func TestSidecarResolverRediscovers(t *testing.T) {
+	r, err := newSidecarResolver("srv://_banan-stats._tcp.internal")
+	if err != nil {
+		t.Fatalf("new resolver failed: %v", err)
+	}
+	target := "stats-a.internal."
+	lookups := 0
+	r.lookupSRV = func(name string) ([]*net.SRV, error) {
+		lookups++
+		return []*net.SRV{{Target: target, Port: 7070}}, nil
+	}
+	for i := 0; i < 2; i++ {
+		base, err := r.BaseURL()
+		if err != nil || base != "http://stats-a.internal:7070" {
+			t.Fatalf("unexpected base %q (%v)", base, err)
+		}
+	}
+	if lookups != 1 {
+		t.Fatalf("expected the address to be cached, got %d lookups", lookups)
+	}
+
+	target = "stats-b.internal."
+	r.Invalidate()
+	if base, _ := r.BaseURL(); base != "http://stats-b.internal:7070" {
+		t.Fatalf("expected the new address after invalidate, got %q", base)
+	}
+
+	r.lookupSRV = func(string) ([]*net.SRV, error) { return nil, errors.New("no such host") }
+	r.Invalidate()
+	if base, err := r.BaseURL(); err != nil || base != "http://stats-b.internal:7070" {
+		t.Fatalf("expected the last address to be kept, got %q (%v)", base, err)
+	}
+
+	d, err := newSidecarResolver("docker://stats-sidecar")
+	if err != nil {
+		t.Fatalf("new resolver failed: %v", err)
+	}
+	d.lookupHost = func(string) ([]string, error) { return []string{"10.0.3.7"}, nil }
+	if base, _ := d.BaseURL(); base != "http://10.0.3.7:7070" {
+		t.Fatalf("unexpected docker base %q", base)
+	}
+}
+
+// Traefik loads plugins from source with Yaegi, which can only interpret
+// the standard library and vendored pure-Go packages.
+func TestPluginImportsOnlyStandardLibrary(t *testing.T) {
+	pkg, err := build.ImportDir(".", 0)
+	if err != nil {
+		t.Fatalf("import dir failed: %v", err)
+	}
+	for _, path := range pkg.Imports {
+		if strings.Contains(strings.Split(path, "/")[0], ".") {
+			t.Errorf("plugin imports non-standard package %q", path)
+		}
+	}
+}
+
+// fakeClock is a clock that only moves on Advance, firing the tickers whose
+// next tick it passes.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	created chan struct{}
+}
+
+type fakeTicker struct {
+	clock  *fakeClock
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+	// stopped is guarded by clock.mu.
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:     time.Date(2024, 5, 7, 12, 0, 0, 0, time.UTC),
+		created: make(chan struct{}, 16),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{clock: c, c: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	c.created <- struct{}{}
+	return t
+}
+
+// Advance moves the clock forward. Like time.Ticker, a ticker whose channel
+// is full drops the ticks it misses.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		for !t.stopped && !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+// waitForTicker returns once a goroutine has created a ticker, so Advance
+// cannot run before it exists.
+func (c *fakeClock) waitForTicker(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.created:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ticker was created")
+	}
+}
+
+func (t *fakeTicker) Chan() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stopped = true
+}
+
 type roundTripFunc func(*http.Request) (*http.Response, error)
 
 func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
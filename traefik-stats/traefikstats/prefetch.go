@@ -0,0 +1,38 @@
+package traefikstats
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	prefetchModeSkip  = "skip"
+	prefetchModeTag   = "tag"
+	prefetchModeCount = "count"
+)
+
+func normalizePrefetchMode(mode string) (string, error) {
+	switch m := strings.ToLower(strings.TrimSpace(mode)); m {
+	case "":
+		return prefetchModeSkip, nil
+	case prefetchModeSkip, prefetchModeTag, prefetchModeCount:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown prefetchMode %q", mode)
+	}
+}
+
+// isPrefetch reports whether the request is a speculative load (link
+// prefetch, Chrome prerender) rather than a page the visitor opened.
+func isPrefetch(req *http.Request) bool {
+	for _, name := range []string{"Sec-Purpose", "Purpose", "X-Purpose", "X-Moz"} {
+		for _, val := range req.Header.Values(name) {
+			v := strings.ToLower(val)
+			if strings.Contains(v, "prefetch") || strings.Contains(v, "prerender") || strings.Contains(v, "preview") {
+				return true
+			}
+		}
+	}
+	return false
+}
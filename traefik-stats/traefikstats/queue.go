@@ -0,0 +1,42 @@
+package traefikstats
+
+import (
+	"log"
+	"os"
+)
+
+// eventQueue buffers events on disk until the worker has streamed them to
+// the sidecar. The default build uses fileQueue, which only needs the
+// standard library so the plugin can run under Traefik's Yaegi interpreter;
+// building with -tags sqlite swaps in the SQLite-backed diskQueue.
+type eventQueue interface {
+	Enqueue(evt event) error
+	// FetchBatch returns up to limit of the oldest events without removing
+	// them. IDs only ever increase, also after the buffer drained, so a
+	// stream can tell the events it sent from newer ones.
+	FetchBatch(limit int) ([]queuedEvent, error)
+	// DeleteUpTo drops every event with an ID up to and including lastID.
+	DeleteUpTo(lastID int64) error
+	// Notify receives a value after an Enqueue.
+	Notify() <-chan struct{}
+	// Len is the number of events waiting to be sent.
+	Len() int
+	Close() error
+}
+
+type queuedEvent struct {
+	ID    int64
+	Event event
+}
+
+// warnLegacyBuffer logs when the sqlite buffer of an earlier release is left
+// at path, since the file queue never sends the events in it. It reports
+// whether it did.
+func warnLegacyBuffer(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 {
+		return false
+	}
+	log.Printf("stats buffer: %s from an earlier release is not read any more; to send the events in it, run a build with -tags sqlite and bufferPath %s until it drains, then delete it", path, path)
+	return true
+}
@@ -0,0 +1,47 @@
+package traefikstats
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// requestScheme is http or https: the first X-Forwarded-Proto, which
+// Traefik's entrypoint sets before any middleware runs, or whether the
+// request itself came over TLS.
+func requestScheme(req *http.Request) string {
+	proto, _, _ := strings.Cut(req.Header.Get("X-Forwarded-Proto"), ",")
+	switch strings.ToLower(strings.TrimSpace(proto)) {
+	case "https", "wss":
+		return "https"
+	case "http", "ws":
+		return "http"
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requestPort is X-Forwarded-Port, the port of the Host header, or the
+// default port of scheme, in that order.
+func requestPort(req *http.Request, scheme string) int {
+	if port, ok := parsePort(req.Header.Get("X-Forwarded-Port")); ok {
+		return port
+	}
+	if _, p, err := net.SplitHostPort(req.Host); err == nil {
+		if port, ok := parsePort(p); ok {
+			return port
+		}
+	}
+	if scheme == "https" {
+		return 443
+	}
+	return 80
+}
+
+func parsePort(value string) (int, bool) {
+	port, err := strconv.Atoi(strings.TrimSpace(value))
+	return port, err == nil && port > 0 && port <= 65535
+}
@@ -0,0 +1,90 @@
+package traefikstats
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// minStallAge is the shortest time without a successful flush, with events
+// waiting, before the status endpoint reports the pipeline as stalled.
+const minStallAge = time.Minute
+
+// pipelineStatus is the JSON served at DashboardPath+"/status".
+type pipelineStatus struct {
+	OK     bool   `json:"ok"`
+	State  string `json:"state"`
+	Source string `json:"source,omitempty"`
+	// QueueDepth counts the buffered events not yet acknowledged by the
+	// sidecar; QueueLimit is bufferMaxEvents.
+	QueueDepth  int    `json:"queueDepth"`
+	QueueLimit  int    `json:"queueLimit"`
+	IngestMode  string `json:"ingestMode"`
+	LastFlush   string `json:"lastFlush,omitempty"`
+	LastError   string `json:"lastError,omitempty"`
+	LastErrorAt string `json:"lastErrorAt,omitempty"`
+	Backoff     string `json:"backoff,omitempty"`
+	NextAttempt string `json:"nextAttempt,omitempty"`
+}
+
+func (m *statsMiddleware) isStatusRequest(req *http.Request) bool {
+	return m.cfg.DashboardPath != "" && req.URL.Path == strings.TrimSuffix(m.cfg.DashboardPath, "/")+"/status"
+}
+
+func (m *statsMiddleware) pipelineStatus(now time.Time) pipelineStatus {
+	f := m.queue.flusher
+	f.statusMu.Lock()
+	backoff, nextAttempt, paused := f.backoff, f.nextAttempt, f.paused
+	lastFlush, lastErr, lastErrAt := f.lastFlush, f.lastErr, f.lastErrAt
+	f.statusMu.Unlock()
+
+	st := pipelineStatus{
+		OK:         true,
+		State:      "ok",
+		Source:     m.cfg.Source,
+		QueueDepth: m.queue.Len(),
+		QueueLimit: m.cfg.BufferMaxEvents,
+		IngestMode: m.cfg.IngestMode,
+		LastError:  lastErr,
+	}
+	if !lastFlush.IsZero() {
+		st.LastFlush = lastFlush.UTC().Format(time.RFC3339)
+	}
+	if !lastErrAt.IsZero() {
+		st.LastErrorAt = lastErrAt.UTC().Format(time.RFC3339)
+	}
+	if now.Before(nextAttempt) {
+		st.NextAttempt = nextAttempt.UTC().Format(time.RFC3339)
+		if paused {
+			st.State = "paused"
+		} else {
+			st.State = "backoff"
+			st.Backoff = backoff.String()
+		}
+	}
+
+	// Events waiting longer than a few flush intervals mean the sidecar is
+	// not taking them, whatever the backoff says.
+	stallAge := 10 * f.opts.interval
+	if stallAge < minStallAge {
+		stallAge = minStallAge
+	}
+	if st.QueueDepth > 0 && now.Sub(lastFlush) > stallAge && now.Sub(m.started) > stallAge {
+		st.OK = false
+		st.State = "stalled"
+	}
+	return st
+}
+
+// serveStatus answers health probes from the edge: 200 while events are
+// flowing, 503 once they have piled up without a successful flush.
+func (m *statsMiddleware) serveStatus(rw http.ResponseWriter) {
+	st := m.pipelineStatus(m.clock.Now())
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	if !st.OK {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(rw).Encode(st)
+}
@@ -2,33 +2,120 @@ package traefikstats
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
+const (
+	ingestModeBatch  = "batch"
+	ingestModeStream = "stream"
+)
+
+func normalizeIngestMode(mode string) (string, error) {
+	switch m := strings.ToLower(strings.TrimSpace(mode)); m {
+	case "":
+		return ingestModeBatch, nil
+	case ingestModeBatch, ingestModeStream:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown ingestMode %q", mode)
+	}
+}
+
+// retryAfterError is returned when the sidecar is under pressure and asks
+// for a pause, which replaces the flusher's own backoff.
+type retryAfterError struct {
+	wait time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("sidecar busy, retry in %s", e.wait)
+}
+
+// busyError turns a 429, 503 or 507 (sidecar disk full) into a
+// retryAfterError using Retry-After (seconds or an HTTP date, one second when
+// missing).
+func busyError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusInsufficientStorage:
+	default:
+		return nil
+	}
+	wait := time.Second
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		wait = time.Duration(secs) * time.Second
+	} else if at, err := http.ParseTime(value); err == nil && time.Until(at) > 0 {
+		wait = time.Until(at)
+	}
+	return &retryAfterError{wait: wait}
+}
+
 type streamClient struct {
-	endpoint string
-	client   *http.Client
+	sidecar *sidecarResolver
+	client  *http.Client
+	// secret signs every line when set; see encodeEvent.
+	secret []byte
+	clock  clock
+}
+
+func newStreamClient(sidecarURL, ingestSecret string, clk clock) (*streamClient, error) {
+	sidecar, err := newSidecarResolver(sidecarURL)
+	if err != nil {
+		return nil, err
+	}
+	c := &streamClient{
+		sidecar: sidecar,
+		client:  &http.Client{},
+		clock:   clk,
+	}
+	if ingestSecret != "" {
+		c.secret = []byte(ingestSecret)
+	}
+	return c, nil
 }
 
-func newStreamClient(sidecarURL string) (*streamClient, error) {
-	if strings.TrimSpace(sidecarURL) == "" {
-		return nil, fmt.Errorf("sidecarURL is empty")
+// encodeEvent returns evt as one NDJSON line. With a secret the line ends in
+// `,"sig":"<hex>"}`, the HMAC-SHA256 of the line without that member, which
+// a sidecar started with the same --ingest-secret verifies.
+func encodeEvent(evt event, secret []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(evt); err != nil {
+		return nil, err
+	}
+	if len(secret) == 0 {
+		return buf.Bytes(), nil
 	}
-	endpoint := strings.TrimRight(sidecarURL, "/") + "/ingest"
-	return &streamClient{
-		endpoint: endpoint,
-		client:   &http.Client{},
-	}, nil
+	line := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(line)
+	signed := make([]byte, 0, len(line)+sha256.Size*2+12)
+	signed = append(signed, line[:len(line)-1]...)
+	signed = append(signed, `,"sig":"`...)
+	signed = append(signed, hex.EncodeToString(mac.Sum(nil))...)
+	signed = append(signed, "\"}\n"...)
+	return signed, nil
 }
 
 func (c *streamClient) StreamEvents(ctx context.Context, events []event) error {
+	base, err := c.sidecar.BaseURL()
+	if err != nil {
+		return err
+	}
 	reader, writer := io.Pipe()
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, reader)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/ingest", reader)
 	if err != nil {
 		return err
 	}
@@ -37,10 +124,12 @@ func (c *streamClient) StreamEvents(ctx context.Context, events []event) error {
 	writeErrCh := make(chan error, 1)
 	go func() {
 		buf := bufio.NewWriter(writer)
-		enc := json.NewEncoder(buf)
-		enc.SetEscapeHTML(false)
 		for _, evt := range events {
-			if err := enc.Encode(evt); err != nil {
+			line, err := encodeEvent(evt, c.secret)
+			if err == nil {
+				_, err = buf.Write(line)
+			}
+			if err != nil {
 				_ = writer.CloseWithError(err)
 				writeErrCh <- err
 				return
@@ -57,15 +146,163 @@ func (c *streamClient) StreamEvents(ctx context.Context, events []event) error {
 
 	resp, err := c.client.Do(req)
 	if err != nil {
+		c.sidecar.Invalidate()
 		return err
 	}
 	defer resp.Body.Close()
 	_, _ = io.Copy(io.Discard, resp.Body)
-	if err := <-writeErrCh; err != nil {
+	// A server may answer without reading the whole body; closing the read
+	// side keeps the writer from blocking forever.
+	_ = reader.Close()
+	writeErr := <-writeErrCh
+	if err := busyError(resp); err != nil {
 		return err
 	}
 	if resp.StatusCode != http.StatusAccepted {
 		return fmt.Errorf("unexpected status %d", resp.StatusCode)
 	}
+	return writeErr
+}
+
+// ingestSession is one long-lived POST to /ingest/stream. Events are written
+// to the request body as they are buffered and the sidecar answers with an
+// ack line per chunk it has stored, so no connection is set up per batch.
+type ingestSession struct {
+	writer *io.PipeWriter
+	secret []byte
+	cancel context.CancelFunc
+	done   <-chan struct{}
+	// acks is closed when the response ends; err then tells why.
+	acks chan sessionAck
+	err  error
+
+	// pending are the events written but not acked yet, oldest first, and
+	// sentUpTo the queue ID of the newest of them.
+	pending   []queuedEvent
+	sentUpTo  int64
+	clock     clock
+	lastWrite time.Time
+}
+
+type sessionAck struct {
+	Ack   string `json:"ack"`
+	Count int    `json:"count"`
+	// Drain, in seconds, asks the client to pause; the sidecar ends the
+	// stream after this ack.
+	Drain int `json:"drain,omitempty"`
+}
+
+func (c *streamClient) OpenSession() (*ingestSession, error) {
+	base, err := c.sidecar.BaseURL()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, writer := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/ingest/stream", reader)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	// A compressed response would hold acks back in the encoder.
+	req.Header.Set("Accept-Encoding", "identity")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		cancel()
+		c.sidecar.Invalidate()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		if err := busyError(resp); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	s := &ingestSession{
+		writer:    writer,
+		secret:    c.secret,
+		cancel:    cancel,
+		done:      ctx.Done(),
+		acks:      make(chan sessionAck, 64),
+		clock:     c.clock,
+		lastWrite: c.clock.Now(),
+	}
+	go s.readAcks(resp.Body)
+	return s, nil
+}
+
+func (s *ingestSession) readAcks(body io.ReadCloser) {
+	defer close(s.acks)
+	defer body.Close()
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		var ack sessionAck
+		if err := json.Unmarshal(scanner.Bytes(), &ack); err != nil {
+			s.err = fmt.Errorf("bad ack: %w", err)
+			return
+		}
+		select {
+		case s.acks <- ack:
+		case <-s.done:
+			return
+		}
+	}
+	s.err = scanner.Err()
+	if s.err == nil {
+		s.err = io.EOF
+	}
+}
+
+// Send writes events to the stream; they stay pending until acked.
+func (s *ingestSession) Send(items []queuedEvent) error {
+	for _, item := range items {
+		line, err := encodeEvent(item.Event, s.secret)
+		if err != nil {
+			return err
+		}
+		if _, err := s.writer.Write(line); err != nil {
+			return err
+		}
+		s.pending = append(s.pending, item)
+		s.sentUpTo = item.ID
+	}
+	s.lastWrite = s.clock.Now()
+	return nil
+}
+
+// KeepAlive writes a blank line, which the sidecar skips, so idle
+// connections are not dropped and a broken one is noticed.
+func (s *ingestSession) KeepAlive() error {
+	if _, err := s.writer.Write([]byte("\n")); err != nil {
+		return err
+	}
+	s.lastWrite = s.clock.Now()
 	return nil
 }
+
+// Acked removes the events covered by ack from pending and returns the queue
+// ID of the last of them.
+func (s *ingestSession) Acked(ack sessionAck) (int64, error) {
+	if ack.Count <= 0 || ack.Count > len(s.pending) {
+		return 0, fmt.Errorf("ack for %d events with %d pending", ack.Count, len(s.pending))
+	}
+	last := s.pending[ack.Count-1]
+	if ack.Ack != "" && ack.Ack != last.Event.EventID {
+		return 0, fmt.Errorf("ack for %s, expected %s", ack.Ack, last.Event.EventID)
+	}
+	s.pending = s.pending[ack.Count:]
+	return last.ID, nil
+}
+
+// Close aborts the request; it may be called from any goroutine. Pending events are still in the buffer and are
+// sent again by the next session or batch; the sidecar drops duplicates by
+// event ID.
+func (s *ingestSession) Close() {
+	_ = s.writer.CloseWithError(io.ErrClosedPipe)
+	s.cancel()
+}
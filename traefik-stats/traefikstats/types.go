@@ -15,4 +15,25 @@ type event struct {
 	SetCookie   string    `json:"setCookie"`
 	Uniq        string    `json:"uniq"`
 	SecondVisit bool      `json:"secondVisit"`
+	Prefetch    bool      `json:"prefetch,omitempty"`
+	Fragment    bool      `json:"fragment,omitempty"`
+	Status      int       `json:"status,omitempty"`
+	DurationMs  float64   `json:"durationMs,omitempty"`
+	// Agent, Type, OS and Mult are derived at the edge with dataMode
+	// minimal, which sends neither IP nor UserAgent.
+	Agent string `json:"agent,omitempty"`
+	Type  string `json:"type,omitempty"`
+	OS    string `json:"os,omitempty"`
+	Mult  int    `json:"mult,omitempty"`
+	// Consent is the visitor's consent level when a consent source is
+	// configured: full, cookieless or none.
+	Consent string `json:"consent,omitempty"`
+	// Scheme and Port are the ones the request came in on, as Traefik's
+	// entrypoint reports them in X-Forwarded-Proto and X-Forwarded-Port.
+	Scheme string `json:"scheme,omitempty"`
+	Port   int    `json:"port,omitempty"`
+	// Extra holds the captured headers and enricher fields.
+	Extra map[string]string `json:"extra,omitempty"`
+	// Source names the node or instance that saw the request.
+	Source string `json:"source,omitempty"`
 }
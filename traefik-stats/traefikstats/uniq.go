@@ -0,0 +1,84 @@
+package traefikstats
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	uniqStrategyCookie     = "cookie"
+	uniqStrategyIPUADaily  = "ip-ua-daily"
+	uniqStrategyIPUASalted = "ip-ua-salted"
+	uniqStrategyHeader     = "header"
+)
+
+func normalizeUniqStrategy(cfg *Config) (string, error) {
+	strategy := strings.ToLower(strings.TrimSpace(cfg.UniqStrategy))
+	switch strategy {
+	case "":
+		return uniqStrategyCookie, nil
+	case uniqStrategyCookie, uniqStrategyIPUADaily, uniqStrategyIPUASalted:
+		return strategy, nil
+	case uniqStrategyHeader:
+		if strings.TrimSpace(cfg.UniqHeader) == "" {
+			return "", fmt.Errorf("uniqHeader is required for uniqStrategy %q", strategy)
+		}
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown uniqStrategy %q", cfg.UniqStrategy)
+	}
+}
+
+// saltedUniqUse names the setting that hashes visitors with uniqSalt, empty
+// when none does. The salt must then be configured: a random one would
+// differ between Traefik nodes and across reloads, counting the same visitor
+// once per instance.
+func saltedUniqUse(cfg *Config) string {
+	switch {
+	case cfg.UniqStrategy == uniqStrategyIPUASalted:
+		return "uniqStrategy " + uniqStrategyIPUASalted
+	case cfg.ConsentHeader != "" || cfg.ConsentCookie != "":
+		return "cookieless consent (consentHeader, consentCookie)"
+	case cfg.DataMode == dataModeMinimal:
+		return "dataMode " + dataModeMinimal
+	}
+	return ""
+}
+
+// visitorState resolves the uniq for a request according to the consent
+// signal and the configured strategy. Only the cookie strategy (and the
+// header strategy when the header is absent) issues tracking cookies, and
+// only with full consent.
+func (m *statsMiddleware) visitorState(req *http.Request, now time.Time) cookieState {
+	level := m.consentLevel(req)
+	if level == consentCookieless || level == consentNone {
+		return m.consentState(req, level, now)
+	}
+	state := m.strategyState(req, now)
+	state.consent = level
+	return state
+}
+
+func (m *statsMiddleware) strategyState(req *http.Request, now time.Time) cookieState {
+	switch m.cfg.UniqStrategy {
+	case uniqStrategyIPUADaily:
+		day := now.UTC().Format("2006-01-02")
+		return cookieState{uniq: hashUUID(day + m.ipResolver.visitorIP(req) + req.Header.Get("User-Agent"))}
+	case uniqStrategyIPUASalted:
+		day := now.UTC().Format("2006-01-02")
+		return cookieState{uniq: hashUUID(m.uniqSalt + day + m.ipResolver.visitorIP(req) + req.Header.Get("User-Agent"))}
+	case uniqStrategyHeader:
+		if val := strings.TrimSpace(req.Header.Get(m.cfg.UniqHeader)); val != "" {
+			return cookieState{uniq: hashUUID(val)}
+		}
+	}
+	return m.readCookie(req)
+}
+
+func hashUUID(input string) string {
+	sum := sha256.Sum256([]byte(input))
+	return uuidFromBytes(sum[:16])
+}